@@ -0,0 +1,111 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Collection of the access log, recording every access to a file.
+var ACCESS_LOGS_COLLECTION = "access_logs"
+
+// Whether accesses to files are recorded in the access log, configured through ACCESS_LOG.
+var ACCESS_LOG = false
+
+// How long access log entries are kept, configured through ACCESS_LOG_RETENTION.
+var ACCESS_LOG_RETENTION = 90 * 24 * time.Hour
+
+// Whether removing a file's record removes its access log entries too, configured through CASCADE_ACCESS_LOGS.
+// Entries otherwise outlive the file until their retention has passed.
+var CASCADE_ACCESS_LOGS = false
+
+// Ways a file is accessed, as recorded in the access log.
+const (
+  AccessEventGet      = "get"
+  AccessEventDownload = "download"
+  AccessEventCDN      = "cdn"
+)
+
+type AccessLogEntry struct {
+  ID        bson.ObjectId `bson:"_id"`
+  FileID    bson.ObjectId
+  Event     string
+  ClientIP  string
+  CreatedAt time.Time
+  ExpiresAt time.Time
+}
+
+// Loading the access log configuration, called once the environment has been loaded.
+func LoadAccessLogSettings(config *Config) {
+  if accessLog := config.Getenv("ACCESS_LOG", &ACCESS_LOG); len(accessLog) > 0 {
+    enabled, err := strconv.ParseBool(accessLog)
+    if err != nil {
+      log.Fatalf("Invalid ACCESS_LOG %q.", accessLog)
+    }
+    ACCESS_LOG = enabled
+  }
+
+  if retention := config.Getenv("ACCESS_LOG_RETENTION", &ACCESS_LOG_RETENTION); len(retention) > 0 {
+    duration, err := time.ParseDuration(retention)
+    if err != nil || duration <= 0 {
+      log.Fatalf("Invalid ACCESS_LOG_RETENTION %q.", retention)
+    }
+    ACCESS_LOG_RETENTION = duration
+  }
+
+  if cascade := config.Getenv("CASCADE_ACCESS_LOGS", &CASCADE_ACCESS_LOGS); len(cascade) > 0 {
+    enabled, err := strconv.ParseBool(cascade)
+    if err != nil {
+      log.Fatalf("Invalid CASCADE_ACCESS_LOGS %q.", cascade)
+    }
+    CASCADE_ACCESS_LOGS = enabled
+  }
+}
+
+// Access Log Utility Functions.
+
+// Records the access, without failing it when the entry can't be written, and tells the file's watchers of it.
+func RecordAccess(collection *mgo.Collection, file *File, req *http.Request, event string) {
+  PublishAccessEvent(file, event)
+
+  if ACCESS_LOG == false {
+    return
+  }
+
+  now := CLOCK.Now()
+  entry := &AccessLogEntry{bson.NewObjectId(), file.ID, event, ClientIP(req), now, now.Add(ACCESS_LOG_RETENTION)}
+  err := collection.Database.C(ACCESS_LOGS_COLLECTION).Insert(entry)
+  if err != nil {
+    log.Printf("Unable to record the %s of file %s in the access log: %v", event, file.ID.Hex(), err)
+  }
+}
+
+// Removes the access log entries of the file when CASCADE_ACCESS_LOGS is set.
+func RemoveAccessLogs(collection *mgo.Collection, file *File) error {
+  if CASCADE_ACCESS_LOGS == false {
+    return nil
+  }
+
+  _, err := collection.Database.C(ACCESS_LOGS_COLLECTION).RemoveAll(bson.M{"fileid": file.ID})
+  return err
+}
+
+func EnsureAccessLogIndexes(session *mgo.Session) {
+  accessLogs := session.DB(DATABASE).C(ACCESS_LOGS_COLLECTION)
+
+  // Mongo removes entries once they expire. Each entry carries its own expiry, so changing the retention
+  // doesn't need the index to be rebuilt.
+  err := accessLogs.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+  if err != nil {
+    log.Printf("Unable to create the access log expiry index: %v", err)
+  }
+
+  err = accessLogs.EnsureIndex(mgo.Index{Key: []string{"fileid"}})
+  if err != nil {
+    log.Printf("Unable to create the access log file index: %v", err)
+  }
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+  "crypto/subtle"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Token guarding the admin endpoints, configured through ADMIN_TOKEN. The admin endpoints are disabled when unset.
+var ADMIN_TOKEN string
+
+// Password granting access to every file, configured through MASTER_PASSWORD. Only meant for trusted internal deployments, disabled when unset.
+var MASTER_PASSWORD string
+
+// Loading the admin configuration, called once the environment has been loaded.
+func LoadAdminSettings(config *Config) {
+  ADMIN_TOKEN = config.GetenvSecret("ADMIN_TOKEN", &ADMIN_TOKEN)
+
+  MASTER_PASSWORD = config.GetenvSecret("MASTER_PASSWORD", &MASTER_PASSWORD)
+  if len(MASTER_PASSWORD) > 0 {
+    log.Println("MASTER_PASSWORD is set, every file can be accessed with it.")
+  }
+}
+
+// Most files listed per page of /admin/files.
+const ADMIN_LIST_MAX = 1000
+
+// A file as listed to admins, including what clients aren't shown.
+type AdminFile struct {
+  ID        bson.ObjectId `json:"id"`
+  Owner     string        `json:"owner,omitempty"`
+  URL       string        `json:"file_url"`
+  Filename  string        `json:"filename"`
+  Size      int64         `json:"size"`
+  Accessed  bool          `json:"accessed"`
+  ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+  DeletedAt *time.Time    `json:"deleted_at,omitempty"`
+  Link      *SignedLink   `json:"link,omitempty"`
+}
+
+// A short-lived presigned URL to download a file's object from directly.
+type SignedLink struct {
+  URL       string    `json:"url"`
+  ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AdminFileList struct {
+  Files []AdminFile `json:"files"`
+  Next  string      `json:"next,omitempty"`
+}
+
+// Handlers
+// Lists files oldest first, optionally only those of one tenant. Pages continue after the id given as "after".
+// With "links" each file with a stored object comes with a presigned link to it, valid for PRESIGN_TTL.
+func ListFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  query := bson.M{}
+  if tenant := req.URL.Query().Get("tenant"); len(tenant) > 0 {
+    query["owner"] = tenant
+  }
+
+  if after := req.URL.Query().Get("after"); len(after) > 0 {
+    if bson.IsObjectIdHex(after) == false {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid after. (Expected a file id)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+    query["_id"] = bson.M{"$gt": bson.ObjectIdHex(after)}
+  }
+
+  limit := 100
+  if submittedLimit := req.URL.Query().Get("limit"); len(submittedLimit) > 0 {
+    var err error
+    limit, err = strconv.Atoi(submittedLimit)
+    if err != nil || limit <= 0 || limit > ADMIN_LIST_MAX {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid limit. (Expected 1 to %d)", ADMIN_LIST_MAX))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  links, response := ParseLinksParameter(req)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  files := []File{}
+  err := collection.Find(query).Sort("_id").Limit(limit).All(&files)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  list := &AdminFileList{Files: GetAdminFiles(files, links)}
+  if len(files) == limit {
+    list.Next = files[len(files)-1].ID.Hex()
+  }
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = list
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Lists the files expiring within the given window ("within", 24 hours by default), soonest first. Pages are
+// walked with "limit" and "skip", and "links" adds presigned links as for /admin/files.
+func ListExpiringFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  within := 24 * time.Hour
+  if submittedWithin := req.URL.Query().Get("within"); len(submittedWithin) > 0 {
+    var err error
+    within, err = time.ParseDuration(submittedWithin)
+    if err != nil || within <= 0 {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid within. (Expected a duration such as 24h)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  limit := 100
+  if submittedLimit := req.URL.Query().Get("limit"); len(submittedLimit) > 0 {
+    var err error
+    limit, err = strconv.Atoi(submittedLimit)
+    if err != nil || limit <= 0 || limit > ADMIN_LIST_MAX {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid limit. (Expected 1 to %d)", ADMIN_LIST_MAX))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  skip := 0
+  if submittedSkip := req.URL.Query().Get("skip"); len(submittedSkip) > 0 {
+    var err error
+    skip, err = strconv.Atoi(submittedSkip)
+    if err != nil || skip < 0 {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid skip. (Expected a positive integer)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  links, response := ParseLinksParameter(req)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  // Files already consumed or deleted are gone whenever they were meant to expire.
+  now := CLOCK.Now()
+  query := bson.M{
+    "expiresat": bson.M{"$gt": now, "$lte": now.Add(within)},
+    "accessed":  false,
+    "deletedat": bson.M{"$exists": false},
+  }
+
+  files := []File{}
+  err := collection.Find(query).Sort("expiresat", "_id").Skip(skip).Limit(limit).All(&files)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  list := &AdminFileList{Files: GetAdminFiles(files, links)}
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = list
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Most files deleted per request to /admin/owners/{owner} or /admin/files, in batches of OWNER_DELETE_BATCH.
+const OWNER_DELETE_MAX = 1000
+const OWNER_DELETE_BATCH = 100
+
+type FilteredDeletion struct {
+  Deleted   int            `json:"deleted"`
+  Remaining int            `json:"remaining"`
+  Held      int            `json:"held"`
+  Matched   map[string]int `json:"matched"`
+}
+
+// Deletes the files matching every filter given, objects and records alike: "consumed" and "expired" as true
+// or false, "older_than" as a duration and "owner" as the id of an API key. Reports how many files each filter
+// matched on its own, and like deleting an owner's files, repeating the request carries on.
+func DeleteFilteredFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  filters := map[string]bson.M{}
+  now := CLOCK.Now()
+
+  for _, name := range []string{"consumed", "expired"} {
+    submittedValue := req.URL.Query().Get(name)
+    if len(submittedValue) == 0 {
+      continue
+    }
+
+    value, err := strconv.ParseBool(submittedValue)
+    if err != nil {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid %s. (Expected true or false)", name))
+      WriteResponse(response, w, req)
+      return nil
+    }
+
+    switch {
+    case name == "consumed":
+      filters[name] = bson.M{"accessed": value}
+    case value:
+      filters[name] = bson.M{"expiresat": bson.M{"$lte": now}}
+    default:
+      filters[name] = bson.M{"expiresat": bson.M{"$not": bson.M{"$lte": now}}}
+    }
+  }
+
+  if olderThan := req.URL.Query().Get("older_than"); len(olderThan) > 0 {
+    age, err := time.ParseDuration(olderThan)
+    if err != nil || age <= 0 {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid older_than. (Expected a duration such as 720h)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+    filters["older_than"] = bson.M{"_id": bson.M{"$lt": bson.NewObjectIdWithTime(now.Add(-age))}}
+  }
+
+  if owner := req.URL.Query().Get("owner"); len(owner) > 0 {
+    filters["owner"] = bson.M{"owner": owner}
+  }
+
+  // Deleting every file takes asking for it file by file, or owner by owner.
+  if len(filters) == 0 {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "At least one filter is required. (consumed, expired, older_than or owner)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  deletion := &FilteredDeletion{Matched: map[string]int{}}
+  conditions := []bson.M{}
+  for name, filter := range filters {
+    matched, err := collection.Find(filter).Count()
+    if err != nil {
+      return HandleError(err)
+    }
+    deletion.Matched[name] = matched
+    conditions = append(conditions, filter)
+  }
+  // Files under a hold are left alone, and counted apart.
+  held, err := collection.Find(bson.M{"$and": append(conditions, bson.M{"immutableuntil": bson.M{"$gt": CLOCK.Now()}})}).Count()
+  if err != nil {
+    return HandleError(err)
+  }
+  deletion.Held = held
+  query := bson.M{"$and": append(conditions, NotImmutableQuery())}
+
+  for deletion.Deleted < OWNER_DELETE_MAX {
+    files := []File{}
+    err := collection.Find(query).Limit(OWNER_DELETE_BATCH).All(&files)
+    if err != nil {
+      return HandleError(err)
+    }
+
+    if len(files) == 0 {
+      break
+    }
+
+    // Failed object deletions are left to the sweeper, the record goes either way.
+    for i := range files {
+      file := &files[i]
+      if HasStoredObjects(file) {
+        TryDeleteFileFromS3(file.Region, file.URL)
+        TryDeleteFileFormats(file)
+      }
+
+      err = RemoveFileRecord(collection, file)
+      if err != nil && err != mgo.ErrNotFound {
+        return HandleError(err)
+      }
+      deletion.Deleted++
+    }
+  }
+
+  remaining, err := collection.Find(query).Count()
+  if err != nil {
+    return HandleError(err)
+  }
+  deletion.Remaining = remaining
+
+  log.Printf("Deleted %d files matching %s, %d remaining.", deletion.Deleted, req.URL.RawQuery, deletion.Remaining)
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = deletion
+  WriteResponse(response, w, req)
+  return nil
+}
+
+type OwnerDeletion struct {
+  Deleted   int `json:"deleted"`
+  Remaining int `json:"remaining"`
+  Held      int `json:"held"`
+}
+
+// Deletes the files of an API key, objects and records alike, for offboarding a tenant. Owners with more
+// files than a request deletes report what remains, and repeating the request carries on.
+func DeleteOwnerFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  owner := mux.Vars(req)["owner"]
+  deletion := &OwnerDeletion{}
+
+  // Files under a hold outlive their tenant until it has passed, and are counted apart.
+  held, err := collection.Find(bson.M{"owner": owner, "immutableuntil": bson.M{"$gt": CLOCK.Now()}}).Count()
+  if err != nil {
+    return HandleError(err)
+  }
+  deletion.Held = held
+  query := bson.M{"owner": owner, "$and": []bson.M{NotImmutableQuery()}}
+
+  for deletion.Deleted < OWNER_DELETE_MAX {
+    files := []File{}
+    err := collection.Find(query).Limit(OWNER_DELETE_BATCH).All(&files)
+    if err != nil {
+      return HandleError(err)
+    }
+
+    if len(files) == 0 {
+      break
+    }
+
+    for i := range files {
+      file := &files[i]
+
+      // Failed object deletions are left to the sweeper, the record goes either way. No tombstone is
+      // kept, nothing of an erased tenant should remain.
+      if HasStoredObjects(file) {
+        TryDeleteFileFromS3(file.Region, file.URL)
+        TryDeleteFileFormats(file)
+      }
+
+      err = RemoveAccessLogs(collection, file)
+      if err != nil {
+        return HandleError(err)
+      }
+
+      err = collection.RemoveId(file.ID)
+      if err != nil && err != mgo.ErrNotFound {
+        return HandleError(err)
+      }
+      deletion.Deleted++
+    }
+  }
+
+  remaining, err := collection.Find(query).Count()
+  if err != nil {
+    return HandleError(err)
+  }
+  deletion.Remaining = remaining
+
+  log.Printf("Deleted %d files of owner %s, %d remaining.", deletion.Deleted, owner, deletion.Remaining)
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = deletion
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Middleware
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if len(ADMIN_TOKEN) == 0 {
+      response := GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), false, 0, "The admin endpoints are disabled.")
+      WriteResponse(response, w, req)
+      return
+    }
+
+    if IsAdminRequest(req) == false {
+      response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This endpoint requires the admin token.")
+      WriteResponse(response, w, req)
+      return
+    }
+
+    next(w, req)
+  }
+}
+
+// Admin Utility Functions.
+
+// Presigned links are only asked for with "links=true", and only S3 can sign them.
+func ParseLinksParameter(req *http.Request) (bool, *Response) {
+  submittedLinks := req.URL.Query().Get("links")
+  if len(submittedLinks) == 0 {
+    return false, nil
+  }
+
+  links, err := strconv.ParseBool(submittedLinks)
+  if err != nil {
+    return false, GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid links. (Expected true or false)")
+  }
+  if links && IsS3Storage(STORAGE) == false {
+    return false, GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Links need the s3 storage backend.")
+  }
+  return links, nil
+}
+
+// The files as listed to admins, with a presigned link to each stored object when asked for. Encrypted objects
+// are left without one, their content can only be read with the file's password.
+func GetAdminFiles(files []File, links bool) []AdminFile {
+  adminFiles := []AdminFile{}
+  expiresAt := time.Now().Add(PRESIGN_TTL)
+
+  for i := range files {
+    file := &files[i]
+    adminFile := AdminFile{file.ID, file.Owner, file.URL, file.Filename, file.Size, file.Accessed, file.ExpiresAt, file.DeletedAt, nil}
+
+    if links && HasStoredObjects(file) && file.Encrypted == false {
+      storage := GetStorage(file.Region)
+      signedUrl, err := storage.SignedGetURL(storage.Path(file.URL), expiresAt)
+      ErrorHandler(err)
+      adminFile.Link = &SignedLink{signedUrl, expiresAt}
+    }
+
+    adminFiles = append(adminFiles, adminFile)
+  }
+
+  return adminFiles
+}
+
+// Whether the request carries the admin token as "Authorization: Bearer <token>".
+func IsAdminRequest(req *http.Request) bool {
+  if len(ADMIN_TOKEN) == 0 {
+    return false
+  }
+
+  submittedToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+  return subtle.ConstantTimeCompare([]byte(submittedToken), []byte(ADMIN_TOKEN)) == 1
+}
+
+// Whether the request's password is the master password.
+func IsMasterPasswordRequest(req *http.Request) bool {
+  if len(MASTER_PASSWORD) == 0 {
+    return false
+  }
+
+  submittedPassword := req.FormValue("password")
+  return subtle.ConstantTimeCompare([]byte(submittedPassword), []byte(MASTER_PASSWORD)) == 1
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "crypto/subtle"
+  "fmt"
+  "log"
+  "net/http"
+  "regexp"
+  "strconv"
+  "strings"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// API keys by their id, configured through API_KEYS as "id:key,id:key". Uploads made with a key are
+// owned by its id and stored under their own prefix.
+var API_KEYS = map[string]string{}
+
+// Prefix the objects of each API key are stored under, followed by the key's id, configured through TENANT_PREFIX.
+var TENANT_PREFIX = "tenants/"
+
+var apiKeyIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Loading the API key configuration, called once the environment has been loaded.
+func LoadAPIKeySettings(config *Config) {
+  if apiKeys := config.Getenv("API_KEYS", GetAPIKeyIds); len(apiKeys) > 0 {
+    for _, entry := range strings.Split(apiKeys, ",") {
+      keyId, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+      if ok == false || apiKeyIdPattern.MatchString(keyId) == false || len(key) == 0 {
+        log.Fatalf("Invalid API_KEYS entry %q, expected id:key with a lowercase id.", entry)
+      }
+      API_KEYS[keyId] = key
+    }
+  }
+
+  if tenantPrefix, ok := config.LookupEnv("TENANT_PREFIX", &TENANT_PREFIX); ok {
+    TENANT_PREFIX = tenantPrefix
+  }
+}
+
+// Most files listed per page of /files/mine.
+const OWNED_LIST_MAX = 100
+
+type OwnedFileList struct {
+  Files []File `json:"files"`
+}
+
+// Handlers
+// Lists the files uploaded with the request's API key that haven't been consumed, newest first unless sorted
+// by "created_at". Pages are walked with "limit" and "skip".
+func ListOwnedFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  owner, ok := AuthenticateAPIKey(req)
+  if ok == false || len(owner) == 0 {
+    response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This endpoint requires an API key.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  sort := "-_id"
+  switch req.URL.Query().Get("sort") {
+  case "", "-created_at":
+  case "created_at":
+    sort = "_id"
+  default:
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid sort. (Expected created_at or -created_at)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  limit := 20
+  if submittedLimit := req.URL.Query().Get("limit"); len(submittedLimit) > 0 {
+    var err error
+    limit, err = strconv.Atoi(submittedLimit)
+    if err != nil || limit <= 0 || limit > OWNED_LIST_MAX {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid limit. (Expected 1 to %d)", OWNED_LIST_MAX))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  skip := 0
+  if submittedSkip := req.URL.Query().Get("skip"); len(submittedSkip) > 0 {
+    var err error
+    skip, err = strconv.Atoi(submittedSkip)
+    if err != nil || skip < 0 {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid skip. (Expected a positive integer)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  // Ids are sorted by creation time, so the owner and id index serves the query.
+  files := []File{}
+  err := collection.Find(bson.M{"owner": owner, "accessed": false, "deletedat": bson.M{"$exists": false}}).Sort(sort).Skip(skip).Limit(limit).All(&files)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &OwnedFileList{files}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// API Key Utility Functions.
+
+// Returns the id of the API key in the request's X-API-Key header, or an empty id for anonymous requests.
+// The bool is false when a key was sent but doesn't match any.
+func AuthenticateAPIKey(req *http.Request) (string, bool) {
+  submittedKey := req.Header.Get("X-API-Key")
+  if len(submittedKey) == 0 {
+    return "", true
+  }
+
+  // Comparing against every key, so the time taken doesn't tell which one came closest.
+  matchingKeyId := ""
+  for keyId, key := range API_KEYS {
+    if subtle.ConstantTimeCompare([]byte(submittedKey), []byte(key)) == 1 {
+      matchingKeyId = keyId
+    }
+  }
+
+  return matchingKeyId, len(matchingKeyId) > 0
+}
+
+// The prefix of an owner's objects, empty for anonymous uploads.
+func GetTenantPrefix(owner string) string {
+  if len(owner) == 0 {
+    return ""
+  }
+  return TENANT_PREFIX + owner + "/"
+}
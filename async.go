@@ -0,0 +1,178 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// States of a file's upload. Files uploaded synchronously have no state, and are complete.
+const (
+  UploadStatePending   = "pending"
+  UploadStateUploading = "uploading"
+  UploadStateComplete  = "complete"
+  UploadStateFailed    = "failed"
+)
+
+// How often the progress of a background upload is written to Mongo.
+var UPLOAD_PROGRESS_INTERVAL = time.Second
+
+type UploadStatus struct {
+  State            string `json:"state"`
+  BytesTransferred int64  `json:"bytes_transferred"`
+  Size             int64  `json:"size,omitempty"`
+  Error            string `json:"error,omitempty"`
+}
+
+// Handlers
+func GetUploadStatus(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // The status of a file hiding its existence tells it exists, so it takes the file's password.
+  if HIDE_EXISTENCE {
+    if response = CheckFilePassword(collection, file, req); response != nil {
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  status := &UploadStatus{State: file.UploadState, BytesTransferred: file.BytesTransferred, Error: file.UploadError}
+  if len(file.UploadState) == 0 || file.UploadState == UploadStateComplete {
+    status = &UploadStatus{State: UploadStateComplete, BytesTransferred: file.Size, Size: file.Size}
+  }
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = status
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Upload Utility Functions.
+
+// Returns nil once the file's content is available and not quarantined, otherwise the response explaining why it isn't.
+func CheckUploadState(file *File) *Response {
+  switch file.UploadState {
+  case UploadStatePending, UploadStateUploading:
+    return GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file is still being uploaded.")
+  case UploadStateFailed:
+    return GoneResponse(GoneReasonUploadFailed)
+  }
+
+  return CheckScanState(file)
+}
+
+// Fetches the source url into the already inserted file, tracking the upload's state and progress on its record.
+func FetchRemoteFileInBackground(file *File, sourceUrl string) {
+  session := InitializeMongoSession()
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  fail := func(uploadError string) {
+    log.Printf("Background upload of file %s failed: %s", file.ID.Hex(), uploadError)
+    err := collection.UpdateId(file.ID, bson.M{"$set": bson.M{"uploadstate": UploadStateFailed, "uploaderror": uploadError}})
+    if err != nil && err != mgo.ErrNotFound {
+      log.Printf("Unable to mark file %s as failed: %v", file.ID.Hex(), err)
+    }
+  }
+
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      // Only the safe message is recorded, the file's status is public.
+      if appError, ok := recovered.(*AppError); ok {
+        log.Printf("Background upload of file %s failed: %v", file.ID.Hex(), appError)
+        fail(appError.Message)
+        return
+      }
+      // Anything else is a bug, whose details are only logged.
+      log.Printf("Background upload of file %s panicked: %v", file.ID.Hex(), recovered)
+      fail(AsAppError(fmt.Errorf("%v", recovered)).Message)
+    }
+  }()
+
+  err := collection.UpdateId(file.ID, bson.M{"$set": bson.M{"uploadstate": UploadStateUploading}})
+  ErrorHandler(err)
+
+  lastReportedAt := time.Now()
+  upload, err := FetchRemoteFile(sourceUrl, func(bytesTransferred int64) {
+    if time.Since(lastReportedAt) < UPLOAD_PROGRESS_INTERVAL {
+      return
+    }
+
+    lastReportedAt = time.Now()
+    err := collection.UpdateId(file.ID, bson.M{"$set": bson.M{"bytestransferred": bytesTransferred}})
+    if err != nil {
+      log.Printf("Unable to record the progress of file %s: %v", file.ID.Hex(), err)
+    }
+  })
+  if err != nil {
+    fail(err.Error())
+    return
+  }
+
+  if IsBlockedFilename(upload.Filename) {
+    fail("files with this extension aren't allowed")
+    return
+  }
+
+  contentType, mismatched := DetectUploadContentType(upload)
+  if mismatched && STRICT_CONTENT_TYPE {
+    fail(fmt.Sprintf("the content doesn't match its content type %q", upload.ContentType))
+    return
+  }
+  upload.ContentType = contentType
+
+  StoreUpload(file, upload)
+
+  uploaded := bson.M{
+    "uploadstate":      UploadStateComplete,
+    "bytestransferred": file.Size,
+    "url":              file.URL,
+    "filename":         file.Filename,
+    "contenttype":      file.ContentType,
+    "size":             file.Size,
+    "compressed":       file.Compressed,
+    "checksum":         file.Checksum,
+  }
+  if AV_SCAN {
+    file.ScanState = ScanStateQuarantined
+    uploaded["scanstate"] = file.ScanState
+  }
+  err = collection.UpdateId(file.ID, bson.M{"$set": uploaded})
+
+  // The file was deleted while it was being fetched.
+  if err == mgo.ErrNotFound {
+    DeleteFileFromS3(file.Region, file.URL)
+    return
+  }
+  if err != nil {
+    RollBackUpload(file, err)
+  }
+  ErrorHandler(err)
+
+  if file.ScanState == ScanStateQuarantined {
+    ScanFile(collection, file)
+    return
+  }
+
+  RunPostUploadHooks(file)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "sync"
+  "time"
+
+  "github.com/mitchellh/goamz/s3"
+)
+
+// States of a circuit breaker.
+const (
+  BreakerClosed   = "closed"
+  BreakerOpen     = "open"
+  BreakerHalfOpen = "half_open"
+)
+
+// Failures within BREAKER_OPEN_DURATION of each other that open a breaker, configured through
+// BREAKER_FAILURE_THRESHOLD. The breakers are disabled when 0.
+var BREAKER_FAILURE_THRESHOLD = 5
+
+// How long an open breaker fails fast before letting a request through to probe the dependency, configured
+// through BREAKER_OPEN_DURATION.
+var BREAKER_OPEN_DURATION = 30 * time.Second
+
+var S3_BREAKER = &CircuitBreaker{Name: "s3", state: BreakerClosed}
+var MONGO_BREAKER = &CircuitBreaker{Name: "mongo", state: BreakerClosed}
+
+// Stops calls to a dependency that keeps failing, until a probe finds it has recovered.
+type CircuitBreaker struct {
+  mutex         sync.Mutex
+  Name          string
+  state         string
+  failures      int
+  lastFailureAt time.Time
+  openedAt      time.Time
+  probeAt       time.Time
+}
+
+type BreakerStatus struct {
+  Name     string `json:"name"`
+  State    string `json:"state"`
+  Failures int    `json:"failures"`
+}
+
+type BreakerHealth struct {
+  Breakers []BreakerStatus `json:"breakers"`
+}
+
+// The error calls fail fast with while a breaker is open, until the next probe is let through.
+type CircuitOpenError struct {
+  Name       string
+  RetryAfter time.Duration
+}
+
+func (circuitOpenError *CircuitOpenError) Error() string {
+  return fmt.Sprintf("the %s circuit breaker is open", circuitOpenError.Name)
+}
+
+// Loading the circuit breaker configuration, called once the environment has been loaded.
+func LoadBreakerSettings(config *Config) {
+  if failureThreshold := config.Getenv("BREAKER_FAILURE_THRESHOLD", &BREAKER_FAILURE_THRESHOLD); len(failureThreshold) > 0 {
+    threshold, err := strconv.Atoi(failureThreshold)
+    if err != nil || threshold < 0 {
+      log.Fatalf("Invalid BREAKER_FAILURE_THRESHOLD %q.", failureThreshold)
+    }
+    BREAKER_FAILURE_THRESHOLD = threshold
+  }
+
+  if openDuration := config.Getenv("BREAKER_OPEN_DURATION", &BREAKER_OPEN_DURATION); len(openDuration) > 0 {
+    duration, err := time.ParseDuration(openDuration)
+    if err != nil || duration <= 0 {
+      log.Fatalf("Invalid BREAKER_OPEN_DURATION %q.", openDuration)
+    }
+    BREAKER_OPEN_DURATION = duration
+  }
+}
+
+// Handlers
+// Reports the state of each breaker, with a 503 while any of them isn't closed.
+func HealthHandler(w http.ResponseWriter, req *http.Request) *AppError {
+  health := &BreakerHealth{[]BreakerStatus{S3_BREAKER.Status(), MONGO_BREAKER.Status()}}
+
+  for _, breaker := range health.Breakers {
+    if breaker.State != BreakerClosed {
+      response := GenerateResponse(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), false, 0, fmt.Sprintf("The %s circuit breaker is %s.", breaker.Name, breaker.State))
+      response.Content = health
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = health
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Breaker Utility Functions.
+
+// Returns an error when the call has to fail fast. Once an open breaker has waited BREAKER_OPEN_DURATION,
+// a single call is let through as the probe, reported by the bool.
+func (breaker *CircuitBreaker) Allow() (probe bool, err error) {
+  if BREAKER_FAILURE_THRESHOLD == 0 {
+    return false, nil
+  }
+
+  breaker.mutex.Lock()
+  defer breaker.mutex.Unlock()
+
+  switch breaker.state {
+  case BreakerOpen:
+    if time.Since(breaker.openedAt) < BREAKER_OPEN_DURATION {
+      return false, &CircuitOpenError{breaker.Name, BREAKER_OPEN_DURATION - time.Since(breaker.openedAt)}
+    }
+    breaker.state = BreakerHalfOpen
+  case BreakerHalfOpen:
+    // Letting another probe through when the previous one never reported back.
+    if time.Since(breaker.probeAt) < BREAKER_OPEN_DURATION {
+      return false, &CircuitOpenError{breaker.Name, BREAKER_OPEN_DURATION - time.Since(breaker.probeAt)}
+    }
+  default:
+    return false, nil
+  }
+
+  breaker.probeAt = time.Now()
+  return true, nil
+}
+
+// Records the outcome of a call, nil for a success. Only failures of the dependency itself should be
+// recorded as such, not errors such as a missing object.
+func (breaker *CircuitBreaker) Record(err error) {
+  if BREAKER_FAILURE_THRESHOLD == 0 {
+    return
+  }
+
+  breaker.mutex.Lock()
+  defer breaker.mutex.Unlock()
+
+  if err == nil {
+    if breaker.state != BreakerClosed {
+      log.Printf("The %s circuit breaker closed, the dependency recovered.", breaker.Name)
+    }
+    breaker.state = BreakerClosed
+    breaker.failures = 0
+    return
+  }
+
+  if time.Since(breaker.lastFailureAt) > BREAKER_OPEN_DURATION {
+    breaker.failures = 0
+  }
+  breaker.failures++
+  breaker.lastFailureAt = time.Now()
+
+  if breaker.state == BreakerHalfOpen || (breaker.state == BreakerClosed && breaker.failures >= BREAKER_FAILURE_THRESHOLD) {
+    log.Printf("The %s circuit breaker opened after %d failures: %v", breaker.Name, breaker.failures, err)
+    breaker.state = BreakerOpen
+    breaker.openedAt = time.Now()
+  }
+}
+
+func (breaker *CircuitBreaker) Status() BreakerStatus {
+  breaker.mutex.Lock()
+  defer breaker.mutex.Unlock()
+
+  state := breaker.state
+  if state == BreakerOpen && time.Since(breaker.openedAt) >= BREAKER_OPEN_DURATION {
+    state = BreakerHalfOpen
+  }
+  return BreakerStatus{breaker.Name, state, breaker.failures}
+}
+
+// Whether the storage error means S3 itself failed: it couldn't be reached or answered with a 5xx. Errors
+// about the request, like a missing object, and a busy pool of connections don't count.
+func IsStorageOutageError(err error) bool {
+  if err == nil || errors.Is(err, ErrS3Busy) {
+    return false
+  }
+
+  var s3Error *s3.Error
+  if errors.As(err, &s3Error) {
+    return s3Error.StatusCode >= http.StatusInternalServerError
+  }
+  if status := GetSDKErrorStatus(err); status > 0 {
+    return status >= http.StatusInternalServerError
+  }
+
+  var urlError *url.Error
+  var netError net.Error
+  return errors.As(err, &urlError) || errors.As(err, &netError)
+}
+
+// Whether the error means Mongo couldn't be reached or dropped the connection. Errors reaching S3 are HTTP
+// errors, so they aren't mistaken for these.
+func IsDatabaseOutageError(err error) bool {
+  var urlError *url.Error
+  if err == nil || errors.As(err, &urlError) {
+    return false
+  }
+
+  var netError net.Error
+  return err == io.EOF || errors.As(err, &netError) || err.Error() == "no reachable servers" || err.Error() == "Closed explicitly"
+}
+
+// Storage failing fast while the S3 breaker is open.
+type BreakerStorage struct {
+  Storage
+}
+
+// Calls the storage through the S3 breaker, recording how it went.
+func (storage *BreakerStorage) call(call func() error) error {
+  if _, err := S3_BREAKER.Allow(); err != nil {
+    return err
+  }
+
+  err := call()
+  if IsStorageOutageError(err) {
+    S3_BREAKER.Record(err)
+  } else {
+    S3_BREAKER.Record(nil)
+  }
+  return err
+}
+
+func (storage *BreakerStorage) Put(path string, content []byte, headers map[string][]string) error {
+  return storage.call(func() error {
+    return storage.Storage.Put(path, content, headers)
+  })
+}
+
+func (storage *BreakerStorage) PutReader(path string, reader io.Reader, headers map[string][]string) (size int64, err error) {
+  err = storage.call(func() error {
+    size, err = storage.Storage.PutReader(path, reader, headers)
+    return err
+  })
+  return
+}
+
+func (storage *BreakerStorage) Get(path string) (object *StoredObject, err error) {
+  err = storage.call(func() error {
+    object, err = storage.Storage.Get(path)
+    return err
+  })
+  return
+}
+
+func (storage *BreakerStorage) Del(path string) error {
+  return storage.call(func() error {
+    return storage.Storage.Del(path)
+  })
+}
+
+func (storage *BreakerStorage) Copy(sourcePath string, path string) error {
+  return storage.call(func() error {
+    return storage.Storage.Copy(sourcePath, path)
+  })
+}
+
+func (storage *BreakerStorage) List(prefix string, marker string, max int) (paths []string, err error) {
+  err = storage.call(func() error {
+    paths, err = storage.Storage.List(prefix, marker, max)
+    return err
+  })
+  return
+}
+
+func (storage *BreakerStorage) Stat(path string) (info *ObjectInfo, err error) {
+  err = storage.call(func() error {
+    info, err = storage.Storage.Stat(path)
+    return err
+  })
+  return
+}
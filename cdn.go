@@ -0,0 +1,197 @@
+package main
+
+import (
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha1"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/pem"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+
+  "github.com/gorilla/mux"
+)
+
+// Root URL of the CloudFront distribution in front of the bucket, configured through CLOUDFRONT_URL. CDN
+// URLs are disabled when unset.
+var CLOUDFRONT_URL string
+
+// Id of the CloudFront key pair signing URLs, configured through CLOUDFRONT_KEY_PAIR_ID.
+var CLOUDFRONT_KEY_PAIR_ID string
+
+// How long a signed CloudFront URL remains valid, configured through CLOUDFRONT_URL_TTL.
+var CLOUDFRONT_URL_TTL = 5 * time.Minute
+
+// Path of the PEM file holding the private key of the key pair, configured through CLOUDFRONT_PRIVATE_KEY_FILE.
+var CLOUDFRONT_PRIVATE_KEY_FILE string
+
+// Private key of the key pair, read from the PEM file at CLOUDFRONT_PRIVATE_KEY_FILE.
+var cloudFrontPrivateKey *rsa.PrivateKey
+
+type CDNURL struct {
+  URL       string    `json:"url"`
+  ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Loading the CloudFront configuration, called once the environment has been loaded.
+func LoadCloudFrontSettings(config *Config) {
+  CLOUDFRONT_URL = strings.TrimSuffix(config.Getenv("CLOUDFRONT_URL", &CLOUDFRONT_URL), "/")
+  if len(CLOUDFRONT_URL) == 0 {
+    return
+  }
+
+  CLOUDFRONT_KEY_PAIR_ID = config.Getenv("CLOUDFRONT_KEY_PAIR_ID", &CLOUDFRONT_KEY_PAIR_ID)
+  if len(CLOUDFRONT_KEY_PAIR_ID) == 0 {
+    log.Fatal("CLOUDFRONT_KEY_PAIR_ID is required along with CLOUDFRONT_URL.")
+  }
+
+  CLOUDFRONT_PRIVATE_KEY_FILE = config.Getenv("CLOUDFRONT_PRIVATE_KEY_FILE", &CLOUDFRONT_PRIVATE_KEY_FILE)
+  key, err := ReadRSAPrivateKey(CLOUDFRONT_PRIVATE_KEY_FILE)
+  if err != nil {
+    log.Fatalf("Invalid CLOUDFRONT_PRIVATE_KEY_FILE %q: %v.", CLOUDFRONT_PRIVATE_KEY_FILE, err)
+  }
+  cloudFrontPrivateKey = key
+
+  if urlTTL := config.Getenv("CLOUDFRONT_URL_TTL", &CLOUDFRONT_URL_TTL); len(urlTTL) > 0 {
+    ttl, err := time.ParseDuration(urlTTL)
+    if err != nil || ttl <= 0 {
+      log.Fatalf("Invalid CLOUDFRONT_URL_TTL %q.", urlTTL)
+    }
+    CLOUDFRONT_URL_TTL = ttl
+  }
+}
+
+// Handlers
+func CreateCDNURL(w http.ResponseWriter, req *http.Request) *AppError {
+  if cloudFrontPrivateKey == nil {
+    response := GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), false, 0, "CDN URLs are disabled.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckFilePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckEncryptedAccess(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Handing out a CDN URL is an access like any other.
+  if ClaimFile(collection, file) == false {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GoneReasonConsumed)
+    WriteResponse(response, w, req)
+    return nil
+  }
+  RecordAccess(collection, file, req, AccessEventCDN)
+
+  path := GetStorage(file.Region).Path(file.URL)
+  expiresAt := time.Now().Add(CLOUDFRONT_URL_TTL)
+  signedUrl, err := SignCloudFrontURL(CLOUDFRONT_URL+(&url.URL{Path: "/" + path}).EscapedPath(), expiresAt)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  // The object has to outlive the URL, so a consumed file is only deleted once the URL has expired.
+  if file.Accessed == true {
+    QueueDeletion(file.Region, path, GetObjectDeletionTime(file, expiresAt))
+    QueueFormatDeletions(file, expiresAt)
+  }
+
+  response = GenerateResponse(http.StatusCreated, http.StatusText(http.StatusCreated), true, 0, "No Error")
+  response.Content = &CDNURL{signedUrl, expiresAt}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// CDN Utility Functions.
+
+// Signs the URL with a CloudFront canned policy, valid until expiresAt.
+func SignCloudFrontURL(resourceUrl string, expiresAt time.Time) (string, error) {
+  policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resourceUrl, expiresAt.Unix())
+
+  hash := sha1.Sum([]byte(policy))
+  signature, err := rsa.SignPKCS1v15(rand.Reader, cloudFrontPrivateKey, crypto.SHA1, hash[:])
+  if err != nil {
+    return "", err
+  }
+
+  // CloudFront expects base64 with the characters that aren't URL safe swapped out.
+  encodedSignature := strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(signature))
+
+  return fmt.Sprintf("%s?Expires=%d&Signature=%s&Key-Pair-Id=%s", resourceUrl, expiresAt.Unix(), encodedSignature, url.QueryEscape(CLOUDFRONT_KEY_PAIR_ID)), nil
+}
+
+// Reads a PEM encoded RSA private key, in either PKCS #1 or PKCS #8 form.
+func ReadRSAPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+  content, err := ioutil.ReadFile(keyFile)
+  if err != nil {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(content)
+  if block == nil {
+    return nil, fmt.Errorf("no PEM data found")
+  }
+
+  if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+    return key, nil
+  }
+
+  parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    return nil, err
+  }
+
+  key, ok := parsedKey.(*rsa.PrivateKey)
+  if ok == false {
+    return nil, fmt.Errorf("not an RSA key")
+  }
+
+  return key, nil
+}
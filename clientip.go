@@ -0,0 +1,89 @@
+package main
+
+import (
+  "log"
+  "net"
+  "net/http"
+  "strings"
+)
+
+// Proxies whose X-Forwarded-For and X-Real-IP headers are trusted, configured through TRUSTED_PROXIES.
+var TRUSTED_PROXIES []*net.IPNet
+
+// Loading the trusted proxy configuration, called once the environment has been loaded.
+func LoadTrustedProxies(config *Config) {
+  trustedProxies := config.Getenv("TRUSTED_PROXIES", &TRUSTED_PROXIES)
+  if len(trustedProxies) == 0 {
+    return
+  }
+
+  for _, cidr := range strings.Split(trustedProxies, ",") {
+    cidr = strings.TrimSpace(cidr)
+
+    // Accepting bare addresses as single host networks.
+    if strings.Contains(cidr, "/") == false {
+      if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+        cidr += "/32"
+      } else {
+        cidr += "/128"
+      }
+    }
+
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil {
+      log.Fatalf("Invalid TRUSTED_PROXIES entry %q.", cidr)
+    }
+    TRUSTED_PROXIES = append(TRUSTED_PROXIES, network)
+  }
+}
+
+// Client IP Utility Functions.
+
+// Returns the address of the client making the request. Forwarding headers are only honored when the
+// immediate peer is a trusted proxy, in which case X-Forwarded-For is walked from the right, skipping
+// trusted proxies, so a client can't spoof its address by prepending entries.
+func ClientIP(req *http.Request) string {
+  remoteIP := req.RemoteAddr
+  if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+    remoteIP = host
+  }
+
+  if IsTrustedProxy(net.ParseIP(remoteIP)) == false {
+    return remoteIP
+  }
+
+  if forwardedFor := req.Header.Get("X-Forwarded-For"); len(forwardedFor) > 0 {
+    addresses := strings.Split(forwardedFor, ",")
+
+    for i := len(addresses) - 1; i >= 0; i-- {
+      ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+      if ip == nil {
+        break
+      }
+
+      if IsTrustedProxy(ip) == false || i == 0 {
+        return ip.String()
+      }
+    }
+  }
+
+  if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+    return ip.String()
+  }
+
+  return remoteIP
+}
+
+func IsTrustedProxy(ip net.IP) bool {
+  if ip == nil {
+    return false
+  }
+
+  for _, network := range TRUSTED_PROXIES {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+
+  return false
+}
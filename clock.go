@@ -0,0 +1,70 @@
+package main
+
+import (
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/satori/go.uuid"
+)
+
+// The clock dating S3 keys, expirations, accesses and the sweeper's passes, swapped for a FixedClock to pin
+// the time.
+var CLOCK Clock = SystemClock{}
+
+// Generator of the uuids in S3 keys, swapped for a SequenceIDGenerator to pin them.
+var ID_GENERATOR IDGenerator = UUIDGenerator{}
+
+type Clock interface {
+  Now() time.Time
+}
+
+type IDGenerator interface {
+  NewID() string
+}
+
+// The real clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+  return time.Now()
+}
+
+// A clock that always tells the same time, until it is moved.
+type FixedClock struct {
+  mutex sync.Mutex
+  Time  time.Time
+}
+
+func (clock *FixedClock) Now() time.Time {
+  clock.mutex.Lock()
+  defer clock.mutex.Unlock()
+  return clock.Time
+}
+
+func (clock *FixedClock) Advance(duration time.Duration) {
+  clock.mutex.Lock()
+  defer clock.mutex.Unlock()
+  clock.Time = clock.Time.Add(duration)
+}
+
+// Random version 4 uuids.
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) NewID() string {
+  return uuid.NewV4().String()
+}
+
+// Predictable ids, the prefix followed by a counter starting at 1.
+type SequenceIDGenerator struct {
+  mutex  sync.Mutex
+  Prefix string
+  count  int
+}
+
+func (generator *SequenceIDGenerator) NewID() string {
+  generator.mutex.Lock()
+  defer generator.mutex.Unlock()
+  generator.count++
+  return fmt.Sprintf("%s%d", generator.Prefix, generator.count)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "log"
+  "mime"
+  "strconv"
+  "strings"
+)
+
+// Whether compressible uploads are gzipped before being stored, configured through COMPRESS_UPLOADS.
+var COMPRESS_UPLOADS = false
+
+// Media types worth compressing besides text/*. Images, archives and other formats are
+// already compressed and are stored as they are.
+var COMPRESSIBLE_CONTENT_TYPES = []string{
+  "application/json",
+  "application/xml",
+  "application/javascript",
+  "application/x-ndjson",
+  "application/x-yaml",
+  "image/svg+xml",
+}
+
+// Loading the compression configuration, called once the environment has been loaded.
+func LoadCompressionSettings(config *Config) {
+  if compressUploads := config.Getenv("COMPRESS_UPLOADS", &COMPRESS_UPLOADS); len(compressUploads) > 0 {
+    enabled, err := strconv.ParseBool(compressUploads)
+    if err != nil {
+      log.Fatalf("Invalid COMPRESS_UPLOADS %q.", compressUploads)
+    }
+    COMPRESS_UPLOADS = enabled
+  }
+}
+
+// Compression Utility Functions.
+func IsCompressibleContentType(contentType string) bool {
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return false
+  }
+
+  if strings.HasPrefix(mediaType, "text/") {
+    return true
+  }
+
+  for _, compressibleContentType := range COMPRESSIBLE_CONTENT_TYPES {
+    if mediaType == compressibleContentType {
+      return true
+    }
+  }
+
+  return false
+}
+
+// Returns the gzipped content, and whether it came out smaller than the original.
+func GzipContent(content []byte) ([]byte, bool) {
+  buffer := &bytes.Buffer{}
+  writer := gzip.NewWriter(buffer)
+
+  _, err := writer.Write(content)
+  ErrorHandler(err)
+  err = writer.Close()
+  ErrorHandler(err)
+
+  if buffer.Len() >= len(content) {
+    return nil, false
+  }
+
+  return buffer.Bytes(), true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "os"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// The configuration, loaded and validated from the environment at startup. Every setting is read through it,
+// only this file reading the environment, and parsed by its Load function into the package variable the rest
+// of the code reads. Each setting keeps a reference to that variable rather than a copy of its value, so the
+// startup log and the feature flags of GET /version always give the values in effect.
+type Config struct {
+  Settings []ConfigSetting
+}
+
+type ConfigSetting struct {
+  Name   string
+  Value  interface{} // The variable the setting is loaded into, or a function returning its value in effect.
+  Secret bool
+}
+
+// The configuration loaded at startup.
+var CONFIG *Config
+
+// Loading every setting, in the order they depend on each other. Invalid settings stop the server.
+func LoadConfig() *Config {
+  config := &Config{}
+  LoadGeneralSettings(config)
+  LoadDownloadTokenSettings(config)
+  LoadResponseSigningSettings(config)
+  LoadRemoteFetchSettings(config)
+  LoadCompressionSettings(config)
+  LoadErrorPageTemplates(config)
+  LoadUISettings(config)
+  LoadTrustedProxies(config)
+  LoadStorageBackend(config)
+  LoadStreamingSettings(config)
+  LoadFilenameSettings(config)
+  LoadRetentionSettings(config)
+  LoadMiddlewareSettings(config)
+  LoadTLSSettings(config)
+  LoadObjectTags(config)
+  LoadAdminSettings(config)
+  LoadAPIKeySettings(config)
+  LoadRegionSettings(config)
+  LoadPresignSettings(config)
+  LoadCloudFrontSettings(config)
+  LoadMaintenanceSettings(config)
+  LoadContentTypeSettings(config)
+  LoadRateLimitSettings(config)
+  LoadTombstoneSettings(config)
+  LoadExistenceSettings(config)
+  LoadSoftDeleteSettings(config)
+  LoadAccessLogSettings(config)
+  LoadDownloadSettings(config)
+  LoadScanSettings(config)
+  LoadBreakerSettings(config)
+  LoadMongoSettings(config)
+  LoadHookSettings(config)
+  LoadThrottleSettings(config)
+  LoadSweeperSettings(config)
+  LoadVersionSettings(config)
+
+  return config
+}
+
+// Reading a setting from the environment, recording the variable it's loaded into.
+func (config *Config) LookupEnv(name string, setting interface{}) (string, bool) {
+  config.Record(name, setting, false)
+  return os.LookupEnv(name)
+}
+
+func (config *Config) Getenv(name string, setting interface{}) string {
+  value, _ := config.LookupEnv(name, setting)
+  return value
+}
+
+// Reading a setting that's only ever logged as whether it's set.
+func (config *Config) GetenvSecret(name string, setting interface{}) string {
+  config.Record(name, setting, true)
+  return os.Getenv(name)
+}
+
+// Records the setting once, however many times it's read.
+func (config *Config) Record(name string, setting interface{}, secret bool) {
+  for _, recorded := range config.Settings {
+    if recorded.Name == name {
+      return
+    }
+  }
+  config.Settings = append(config.Settings, ConfigSetting{name, setting, secret})
+}
+
+// Config Utility Functions.
+
+// Sets the variables of an env file, NAME=value lines and # comments, leaving alone the ones already set in
+// the environment so a deployment can override the file.
+func LoadEnvironmentFile(path string) error {
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return err
+  }
+
+  for number, line := range strings.Split(string(content), "\n") {
+    line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "export "))
+    if len(line) == 0 || strings.HasPrefix(line, "#") {
+      continue
+    }
+
+    name, value, found := strings.Cut(line, "=")
+    name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+    if found == false || len(name) == 0 {
+      return fmt.Errorf("line %d isn't a NAME=value pair", number+1)
+    }
+
+    // Values may be quoted, double quotes taking Go escapes.
+    if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+      value = unquoted
+    } else if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+      value = value[1 : len(value)-1]
+    }
+
+    if _, set := os.LookupEnv(name); set == false {
+      os.Setenv(name, value)
+    }
+  }
+
+  return nil
+}
+
+// Logs every setting, secrets only as whether they're set.
+func (config *Config) Log() {
+  lines := []string{}
+  for _, setting := range config.Settings {
+    lines = append(lines, fmt.Sprintf("  %s=%s", setting.Name, setting.Format()))
+  }
+  log.Printf("Effective configuration:\n%s", strings.Join(lines, "\n"))
+}
+
+// The value of the setting in effect.
+func (setting ConfigSetting) Current() interface{} {
+  value := reflect.ValueOf(setting.Value)
+  switch value.Kind() {
+  case reflect.Pointer:
+    return value.Elem().Interface()
+  case reflect.Func:
+    return value.Call(nil)[0].Interface()
+  }
+  return setting.Value
+}
+
+func (setting ConfigSetting) Format() string {
+  current := setting.Current()
+  if setting.Secret {
+    value := reflect.ValueOf(current)
+    if value.IsZero() || ((value.Kind() == reflect.String || value.Kind() == reflect.Slice) && value.Len() == 0) {
+      return "(unset)"
+    }
+    return "(redacted)"
+  }
+  return fmt.Sprintf("%v", current)
+}
+
+// The ids of the API keys, without their keys.
+func GetAPIKeyIds() []string {
+  ids := []string{}
+  for id := range API_KEYS {
+    ids = append(ids, id)
+  }
+  sort.Strings(ids)
+  return ids
+}
+
+func GetRegionNames() []string {
+  names := []string{}
+  for name := range S3_REGIONS {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
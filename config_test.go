@@ -0,0 +1,50 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestConfigFormatsSettingsInEffect(t *testing.T) {
+  config := &Config{}
+  SetTestSetting(t, &AV_SCAN, false)
+  SetTestSetting(t, &TOKEN_SECRET, []byte{})
+  SetTestSetting(t, &MONGO_URL, "mongodb://user:secret@db")
+  config.Getenv("AV_SCAN", &AV_SCAN)
+  config.Getenv("AV_SCAN", &AV_SCAN)
+  config.GetenvSecret("TOKEN_SECRET", &TOKEN_SECRET)
+  config.GetenvSecret("MONGO_URL", &MONGO_URL)
+  config.Getenv("TLS_MIN_VERSION", GetTLSMinVersionName)
+
+  if len(config.Settings) != 4 {
+    t.Fatalf("Recorded %d settings, expected every setting once.", len(config.Settings))
+  }
+
+  // Settings are formatted as they are now, not as they were when read.
+  AV_SCAN = true
+  expected := []string{"true", "(unset)", "(redacted)", GetTLSMinVersionName()}
+  for i, setting := range config.Settings {
+    if formatted := setting.Format(); formatted != expected[i] {
+      t.Fatalf("Formatted %s as %q, expected %q.", setting.Name, formatted, expected[i])
+    }
+  }
+}
+
+func TestVersionFeaturesAreInEffect(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &AV_SCAN, true)
+  SetTestSetting(t, &HIDE_EXISTENCE, false)
+
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/version", nil)))
+  version := &VersionInfo{}
+  if err := json.Unmarshal(response.Content, version); err != nil {
+    t.Fatal(err)
+  }
+  if version.Features["AV_SCAN"] != true || version.Features["HIDE_EXISTENCE"] != false {
+    t.Fatalf("Got the features %v.", version.Features)
+  }
+  if _, ok := version.Features["MONGO_URL"]; ok {
+    t.Fatalf("The features give the secret MONGO_URL.")
+  }
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+  "bufio"
+  "log"
+  "mime"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// Whether uploads whose content doesn't match their claimed content type are rejected, configured through
+// STRICT_CONTENT_TYPE. Otherwise the detected type is stored in place of the claimed one.
+var STRICT_CONTENT_TYPE = false
+
+// Content types http.DetectContentType recognizes from the content itself. A claim of any other type can't
+// be checked when the content isn't recognized.
+var SNIFFABLE_CONTENT_TYPES = []string{
+  "application/ogg",
+  "application/pdf",
+  "application/postscript",
+  "application/vnd.ms-fontobject",
+  "application/wasm",
+  "application/x-gzip",
+  "application/x-rar-compressed",
+  "application/zip",
+  "audio/aiff",
+  "audio/basic",
+  "audio/midi",
+  "audio/mpeg",
+  "audio/wave",
+  "font/collection",
+  "font/otf",
+  "font/ttf",
+  "font/woff",
+  "font/woff2",
+  "image/bmp",
+  "image/gif",
+  "image/jpeg",
+  "image/png",
+  "image/webp",
+  "image/x-icon",
+  "video/avi",
+  "video/mp4",
+  "video/webm",
+}
+
+// Formats stored in a zip container, which are detected as application/zip.
+var ZIP_CONTAINER_CONTENT_TYPES = []string{
+  "application/epub+zip",
+  "application/java-archive",
+  "application/vnd.android.package-archive",
+  "application/vnd.oasis.opendocument.",
+  "application/vnd.openxmlformats-officedocument.",
+}
+
+// Loading the content type checking configuration, called once the environment has been loaded.
+func LoadContentTypeSettings(config *Config) {
+  if strictContentType := config.Getenv("STRICT_CONTENT_TYPE", &STRICT_CONTENT_TYPE); len(strictContentType) > 0 {
+    enabled, err := strconv.ParseBool(strictContentType)
+    if err != nil {
+      log.Fatalf("Invalid STRICT_CONTENT_TYPE %q.", strictContentType)
+    }
+    STRICT_CONTENT_TYPE = enabled
+  }
+}
+
+// Content Type Utility Functions.
+
+// Detects the content type of the upload from its first bytes, returning the type to store and whether it
+// contradicts the claimed one. The reader of streamed uploads is buffered to peek at them.
+func DetectUploadContentType(upload *Upload) (string, bool) {
+  var head []byte
+  if upload.Reader != nil {
+    bufferedReader := bufio.NewReaderSize(upload.Reader, 512)
+    head, _ = bufferedReader.Peek(512)
+    upload.Reader = bufferedReader
+  } else {
+    head = upload.Content
+  }
+
+  return ResolveContentType(upload.ContentType, http.DetectContentType(head))
+}
+
+func ResolveContentType(claimedContentType string, detectedContentType string) (string, bool) {
+  claimedMediaType, _, err := mime.ParseMediaType(claimedContentType)
+  if err != nil || claimedMediaType == "application/octet-stream" {
+    return detectedContentType, false
+  }
+
+  detectedMediaType, _, _ := mime.ParseMediaType(detectedContentType)
+
+  switch {
+  case claimedMediaType == detectedMediaType:
+    return claimedContentType, false
+  // Text is only told apart as plain text, HTML or XML, the claim is the more specific.
+  case strings.HasPrefix(detectedMediaType, "text/") && IsCompressibleContentType(claimedContentType):
+    return claimedContentType, false
+  case detectedMediaType == "application/zip" && IsZipContainerContentType(claimedMediaType):
+    return claimedContentType, false
+  case detectedMediaType == "application/octet-stream" && IsSniffableContentType(claimedMediaType) == false:
+    return claimedContentType, false
+  }
+
+  return detectedContentType, true
+}
+
+func IsSniffableContentType(mediaType string) bool {
+  for _, sniffableContentType := range SNIFFABLE_CONTENT_TYPES {
+    if mediaType == sniffableContentType {
+      return true
+    }
+  }
+
+  return false
+}
+
+func IsZipContainerContentType(mediaType string) bool {
+  for _, zipContainerContentType := range ZIP_CONTAINER_CONTENT_TYPES {
+    if mediaType == zipContainerContentType || (strings.HasSuffix(zipContainerContentType, ".") && strings.HasPrefix(mediaType, zipContainerContentType)) {
+      return true
+    }
+  }
+
+  return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+  "compress/gzip"
+  "io"
+  "log"
+  "mime"
+  "net/http"
+  "strconv"
+  "strings"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Content types safe to display inline in a browser.
+var INLINE_CONTENT_TYPES = []string{
+  "application/pdf",
+  "audio/mpeg",
+  "audio/ogg",
+  "image/gif",
+  "image/jpeg",
+  "image/png",
+  "image/webp",
+  "text/plain",
+  "video/mp4",
+  "video/webm",
+}
+
+// Whether compressible content is gzipped on the fly for clients accepting it, configured through GZIP_DOWNLOADS.
+var GZIP_DOWNLOADS = true
+
+// What happens to a file whose object is gone from storage, e.g. removed by a lifecycle rule, when it's downloaded,
+// configured through MISSING_OBJECT_ACTION: "consume" marks its record consumed, "keep" leaves it as it is, such
+// as while objects may still be replicating. Either way the download is answered with 410.
+var MISSING_OBJECT_ACTION = "consume"
+
+// Loading the download configuration, called once the environment has been loaded.
+func LoadDownloadSettings(config *Config) {
+  if gzipDownloads := config.Getenv("GZIP_DOWNLOADS", &GZIP_DOWNLOADS); len(gzipDownloads) > 0 {
+    enabled, err := strconv.ParseBool(gzipDownloads)
+    if err != nil {
+      log.Fatalf("Invalid GZIP_DOWNLOADS %q.", gzipDownloads)
+    }
+    GZIP_DOWNLOADS = enabled
+  }
+
+  if missingObjectAction := config.Getenv("MISSING_OBJECT_ACTION", &MISSING_OBJECT_ACTION); len(missingObjectAction) > 0 {
+    if missingObjectAction != "consume" && missingObjectAction != "keep" {
+      log.Fatalf("Invalid MISSING_OBJECT_ACTION %q, expected consume or keep.", missingObjectAction)
+    }
+    MISSING_OBJECT_ACTION = missingObjectAction
+  }
+}
+
+// Handlers
+func DownloadFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  disposition := req.URL.Query().Get("disposition")
+  if len(disposition) == 0 {
+    disposition = "attachment"
+  }
+
+  if disposition != "attachment" && disposition != "inline" {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid disposition. (Expected inline or attachment)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckFilePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Serving another representation of the file when one is asked for, which consumes the file all the same.
+  objectUrl := file.URL
+  compressed := file.Compressed
+  size := file.Size
+  if formatName := req.URL.Query().Get("format"); len(formatName) > 0 && formatName != FormatOriginal {
+    format := FindStoredFormat(file, formatName)
+    if format == nil {
+      response = GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), false, 0, "Unknown format.")
+      WriteResponse(response, w, req)
+      return nil
+    }
+
+    objectUrl, compressed, size = format.URL, false, format.Size
+  }
+
+  storage := GetStorage(file.Region)
+  object, err := storage.Get(storage.Path(objectUrl))
+  if IsNoSuchKeyError(err) {
+    WriteResponse(MissingObjectResponse(collection, file, objectUrl), w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+  defer object.Body.Close()
+
+  // Claiming the file atomically, so concurrent requests can't both download it.
+  if ClaimFile(collection, file) == false {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GoneReasonConsumed)
+    WriteResponse(response, w, req)
+    return nil
+  }
+  RecordAccess(collection, file, req, AccessEventDownload)
+
+  contentType := object.ContentType
+  w.Header().Set("Content-Type", contentType)
+
+  // Types that could run script in our origin, like HTML or SVG, are always served as attachments.
+  if IsInlineContentType(contentType) == false {
+    disposition = "attachment"
+  }
+
+  if len(file.Filename) > 0 {
+    w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Filename}))
+  } else {
+    w.Header().Set("Content-Disposition", disposition)
+  }
+
+  // Preferring the length S3 reports for the object being streamed, falling back to the stored size.
+  contentLength := object.ContentLength
+  if contentLength < 0 && size > 0 {
+    contentLength = size
+  }
+
+  // Decrypting encrypted files with the key their password derived.
+  body := io.Reader(object.Body)
+  if file.Encrypted {
+    contentLength = file.Size
+    body = NewDecryptingReader(object.Body, file.encryptionKey)
+  }
+
+  // Decompressing objects compressed at rest, unless the HTTP client already did so transparently.
+  if compressed {
+    contentLength = size
+
+    if object.Decompressed == false {
+      gzipReader, err := gzip.NewReader(object.Body)
+      if err != nil {
+        return HandleError(err)
+      }
+      defer gzipReader.Close()
+      body = gzipReader
+    }
+  }
+
+  // Compressing text-like content on the fly for clients accepting it, without changing what's stored.
+  writer := io.Writer(w)
+  var gzipWriter *gzip.Writer
+  if GZIP_DOWNLOADS && compressed == false && IsCompressibleContentType(contentType) {
+    w.Header().Add("Vary", "Accept-Encoding")
+
+    if AcceptsGzip(req) {
+      w.Header().Set("Content-Encoding", "gzip")
+      contentLength = -1
+      gzipWriter = gzip.NewWriter(w)
+      writer = gzipWriter
+    }
+  }
+
+  if contentLength >= 0 {
+    w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+  } else {
+    w.Header().Set("Transfer-Encoding", "chunked")
+  }
+
+  _, err = io.Copy(writer, ThrottleDownload(body))
+  if err == nil && gzipWriter != nil {
+    err = gzipWriter.Close()
+  }
+  if err != nil {
+    log.Printf("Download of file %s was interrupted: %v", file.ID.Hex(), err)
+  }
+
+  if file.Accessed == true {
+    DiscardConsumedFile(collection, file)
+  }
+  return nil
+}
+
+// Download Utility Functions.
+
+// The response to a file whose record outlived its object, consuming the file as MISSING_OBJECT_ACTION says. A
+// missing format only makes that format unavailable, the file itself is left alone.
+func MissingObjectResponse(collection *mgo.Collection, file *File, objectUrl string) *Response {
+  log.Printf("The object of file %s is missing from storage: %s", file.ID.Hex(), objectUrl)
+
+  if objectUrl == file.URL && MISSING_OBJECT_ACTION == "consume" {
+    consumedAt := CLOCK.Now()
+    err := collection.Update(bson.M{"_id": file.ID, "accessed": false}, bson.M{"$set": bson.M{"accessed": true, "consumedat": consumedAt, "gonereason": GoneReasonDeleted}})
+    if err != nil && err != mgo.ErrNotFound {
+      ErrorHandler(err)
+    }
+    file.Accessed = true
+    file.ConsumedAt = &consumedAt
+    file.GoneReason = GoneReasonDeleted
+
+    // The file's other objects, such as its formats, are no use without it, though a hold still keeps them.
+    DeleteFileFormats(file)
+  }
+
+  return SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "The content of this file is no longer available."), GoneReasonDeleted)
+}
+
+// Whether the request's Accept-Encoding accepts gzip, explicitly or through a wildcard, with a non-zero q-value.
+func AcceptsGzip(req *http.Request) bool {
+  for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+    name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+    name = strings.ToLower(strings.TrimSpace(name))
+    if name != "gzip" && name != "*" {
+      continue
+    }
+
+    q := 1.0
+    if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+      if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+        q = parsed
+      }
+    }
+
+    return q > 0
+  }
+
+  return false
+}
+
+func IsInlineContentType(contentType string) bool {
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return false
+  }
+
+  for _, inlineContentType := range INLINE_CONTENT_TYPES {
+    if mediaType == inlineContentType {
+      return true
+    }
+  }
+
+  return false
+}
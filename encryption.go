@@ -0,0 +1,228 @@
+package main
+
+import (
+  "bufio"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/binary"
+  "errors"
+  "io"
+  "net/http"
+  "strconv"
+
+  "golang.org/x/crypto/argon2"
+)
+
+// Files uploaded with "encrypt" are encrypted with a key derived from their password, which is never stored.
+// Only the salt and a verifier are: the Argon2id output is split in two, the first half is the AES-256 key
+// and the SHA-256 of the second half is the verifier, so the verifier tells a password is right without
+// revealing anything of the key. A lost password makes the file unrecoverable.
+//
+// The content is sealed with AES-256-GCM in chunks of ENCRYPTION_CHUNK_SIZE, so it can be streamed both ways.
+// Keys are unique to each file, so the nonce of a chunk is its index, with its last byte marking the final
+// chunk: reordered, dropped or truncated chunks all fail to open.
+//
+// The parameters below are part of the stored format, changing them makes existing files unreadable.
+const (
+  ENCRYPTION_SALT_SIZE   = 16
+  ENCRYPTION_KDF_TIME    = 3
+  ENCRYPTION_KDF_MEMORY  = 64 * 1024
+  ENCRYPTION_KDF_THREADS = 4
+  ENCRYPTION_CHUNK_SIZE  = 64 << 10
+)
+
+// Key derivations in flight at once, each taking ENCRYPTION_KDF_MEMORY KiB.
+const ENCRYPTION_MAX_DERIVATIONS = 4
+
+var encryptionDerivationSlots = make(chan struct{}, ENCRYPTION_MAX_DERIVATIONS)
+
+var ErrEncryptedChunk = errors.New("the encrypted content has been tampered with or truncated")
+
+// Encryption Utility Functions.
+
+// Encrypting takes a password to derive the key from, and can't be combined with what needs the content or
+// the password to be readable by the server.
+func ValidateEncryptionFields(req *http.Request) []*FieldError {
+  if encrypt, _ := strconv.ParseBool(req.PostForm.Get("encrypt")); encrypt == false {
+    return nil
+  }
+
+  fieldErrors := []*FieldError{}
+  if len(req.PostForm.Get("password")) == 0 {
+    fieldErrors = append(fieldErrors, &FieldError{"encrypt", FieldErrorRequires, "Requires a password to derive the key from."})
+  }
+  if len(req.PostForm.Get("password_hash")) > 0 {
+    fieldErrors = append(fieldErrors, &FieldError{"encrypt", FieldErrorConflict, "Can't be given along with a password_hash."})
+  }
+  if AV_SCAN {
+    fieldErrors = append(fieldErrors, &FieldError{"encrypt", FieldErrorNotAllowed, "Encrypted files can't be scanned, and scanning is required."})
+  }
+
+  return fieldErrors
+}
+
+// Returns nil unless the file is encrypted, otherwise the response explaining it can only be downloaded through
+// /download with its password.
+func CheckEncryptedAccess(file *File) *Response {
+  if file.Encrypted == false {
+    return nil
+  }
+
+  return GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file is encrypted, it can only be downloaded through /files/{id}/download with its password.")
+}
+
+// Sets the file up to be encrypted with a key derived from the password, a salt and verifier being all that's stored.
+func EnableFileEncryption(file *File, password string) {
+  salt := make([]byte, ENCRYPTION_SALT_SIZE)
+  _, err := rand.Read(salt)
+  ErrorHandler(err)
+
+  key, verifier := DeriveEncryptionKey(password, salt)
+  file.Encrypted = true
+  file.PasswordProtected = true
+  file.EncryptionSalt = salt
+  file.EncryptionVerifier = verifier
+  file.encryptionKey = key
+}
+
+// Checks the password against the file's verifier, keeping the key it derives to decrypt the file with.
+func UnlockEncryptedFile(file *File, password string) bool {
+  if len(password) == 0 {
+    return false
+  }
+
+  key, verifier := DeriveEncryptionKey(password, file.EncryptionSalt)
+  if subtle.ConstantTimeCompare(verifier, file.EncryptionVerifier) != 1 {
+    return false
+  }
+
+  file.encryptionKey = key
+  return true
+}
+
+func DeriveEncryptionKey(password string, salt []byte) (key []byte, verifier []byte) {
+  encryptionDerivationSlots <- struct{}{}
+  defer func() { <-encryptionDerivationSlots }()
+
+  derived := argon2.IDKey([]byte(password), salt, ENCRYPTION_KDF_TIME, ENCRYPTION_KDF_MEMORY, ENCRYPTION_KDF_THREADS, 64)
+  verifierHash := sha256.Sum256(derived[32:])
+  return derived[:32], verifierHash[:]
+}
+
+func NewFileCipher(key []byte) cipher.AEAD {
+  block, err := aes.NewCipher(key)
+  ErrorHandler(err)
+
+  aead, err := cipher.NewGCM(block)
+  ErrorHandler(err)
+  return aead
+}
+
+func GetChunkNonce(index uint64, final bool) []byte {
+  nonce := make([]byte, 12)
+  binary.BigEndian.PutUint64(nonce, index)
+  if final {
+    nonce[11] = 1
+  }
+  return nonce
+}
+
+// Encrypts the content read through it, counting the bytes of the original content.
+type EncryptingReader struct {
+  source        *bufio.Reader
+  aead          cipher.AEAD
+  index         uint64
+  pending       []byte
+  done          bool
+  PlaintextSize int64
+}
+
+func NewEncryptingReader(source io.Reader, key []byte) *EncryptingReader {
+  return &EncryptingReader{source: bufio.NewReaderSize(source, ENCRYPTION_CHUNK_SIZE), aead: NewFileCipher(key)}
+}
+
+func (reader *EncryptingReader) Read(p []byte) (int, error) {
+  for len(reader.pending) == 0 {
+    if reader.done {
+      return 0, io.EOF
+    }
+
+    chunk := make([]byte, ENCRYPTION_CHUNK_SIZE)
+    n, err := io.ReadFull(reader.source, chunk)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      return 0, err
+    }
+
+    // The chunk is the final one when nothing follows it, an empty content being a single empty final chunk.
+    final := err != nil
+    if final == false {
+      if _, peekErr := reader.source.Peek(1); peekErr == io.EOF {
+        final = true
+      } else if peekErr != nil {
+        return 0, peekErr
+      }
+    }
+
+    reader.pending = reader.aead.Seal(nil, GetChunkNonce(reader.index, final), chunk[:n], nil)
+    reader.PlaintextSize += int64(n)
+    reader.index++
+    reader.done = final
+  }
+
+  n := copy(p, reader.pending)
+  reader.pending = reader.pending[n:]
+  return n, nil
+}
+
+// Decrypts the content read through it, failing with ErrEncryptedChunk on any chunk that doesn't open.
+type DecryptingReader struct {
+  source  *bufio.Reader
+  aead    cipher.AEAD
+  index   uint64
+  pending []byte
+  done    bool
+}
+
+func NewDecryptingReader(source io.Reader, key []byte) *DecryptingReader {
+  aead := NewFileCipher(key)
+  return &DecryptingReader{source: bufio.NewReaderSize(source, ENCRYPTION_CHUNK_SIZE+aead.Overhead()), aead: aead}
+}
+
+func (reader *DecryptingReader) Read(p []byte) (int, error) {
+  for len(reader.pending) == 0 {
+    if reader.done {
+      return 0, io.EOF
+    }
+
+    sealed := make([]byte, ENCRYPTION_CHUNK_SIZE+reader.aead.Overhead())
+    n, err := io.ReadFull(reader.source, sealed)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      return 0, err
+    }
+
+    final := err != nil
+    if final == false {
+      if _, peekErr := reader.source.Peek(1); peekErr == io.EOF {
+        final = true
+      } else if peekErr != nil {
+        return 0, peekErr
+      }
+    }
+
+    chunk, openErr := reader.aead.Open(nil, GetChunkNonce(reader.index, final), sealed[:n], nil)
+    if openErr != nil {
+      return 0, ErrEncryptedChunk
+    }
+
+    reader.pending = chunk
+    reader.index++
+    reader.done = final
+  }
+
+  n := copy(p, reader.pending)
+  reader.pending = reader.pending[n:]
+  return n, nil
+}
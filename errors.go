@@ -0,0 +1,166 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/mitchellh/goamz/s3"
+  "gopkg.in/mgo.v2"
+)
+
+// Error codes reported in the error_code of responses for unexpected failures.
+const (
+  ErrorCodeInternal    = 1000
+  ErrorCodeStorage     = 1001
+  ErrorCodeStorageBusy = 1002
+  ErrorCodeDatabase    = 1003
+  ErrorCodeUnavailable = 1004
+)
+
+// An error carrying what the client is told about it. The wrapped error is only ever logged, its
+// details aren't safe to expose.
+type AppError struct {
+  StatusCode int
+  ErrorCode  int
+  Message    string
+  Err        error
+  RetryAfter time.Duration
+}
+
+func (appError *AppError) Error() string {
+  if appError.Err == nil {
+    return appError.Message
+  }
+  return fmt.Sprintf("%s: %v", appError.Message, appError.Err)
+}
+
+func (appError *AppError) Unwrap() error {
+  return appError.Err
+}
+
+func NewAppError(statusCode int, errorCode int, message string, err error) *AppError {
+  return &AppError{statusCode, errorCode, message, err, 0}
+}
+
+// A handler returning the unexpected error it ran into, nil once it has written its response.
+type AppHandler func(w http.ResponseWriter, req *http.Request) *AppError
+
+// Handlers
+// Answering requests whose route exists with another method in JSON, like any other error.
+func MethodNotAllowed(w http.ResponseWriter, req *http.Request) {
+  response := GenerateResponse(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), false, 0, fmt.Sprintf("%s is not allowed on %s.", req.Method, req.URL.Path))
+  WriteResponse(response, w, req)
+}
+
+// Middleware
+// Rendering the AppError a handler returns.
+func HandleAppErrors(handler AppHandler) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if appError := handler(w, req); appError != nil {
+      WriteAppError(appError, w, req)
+    }
+  }
+}
+
+// Rendering the errors helpers bail out with through ErrorHandler, and any other panic, rather than dropping
+// the connection.
+func RecoverErrors(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    defer func() {
+      recovered := recover()
+      if recovered == nil {
+        return
+      }
+
+      // Aborting is how a handler deliberately drops the connection.
+      if recovered == http.ErrAbortHandler {
+        panic(recovered)
+      }
+
+      err, ok := recovered.(error)
+      if ok == false {
+        err = fmt.Errorf("%v", recovered)
+      }
+      WriteAppError(AsAppError(err), w, req)
+    }()
+
+    next.ServeHTTP(w, req)
+  })
+}
+
+// Error Utility Functions.
+
+// Wrapping any error into an AppError, telling the client no more than what kind of failure it was.
+func AsAppError(err error) *AppError {
+  var appError *AppError
+  if errors.As(err, &appError) {
+    return appError
+  }
+
+  var circuitOpenError *CircuitOpenError
+  if errors.As(err, &circuitOpenError) {
+    appError = NewAppError(http.StatusServiceUnavailable, ErrorCodeUnavailable, "The service is temporarily unavailable, please try again.", err)
+    appError.RetryAfter = circuitOpenError.RetryAfter
+    return appError
+  }
+
+  // Streamed uploads only find out they're too large while being stored.
+  if IsBodyTooLargeError(err) {
+    return NewAppError(http.StatusRequestEntityTooLarge, 0, fmt.Sprintf("The upload is too large. (At most %d bytes)", MAX_UPLOAD_BYTES), err)
+  }
+
+  if IsBodyReadStalledError(err) {
+    return NewAppError(http.StatusRequestTimeout, 0, fmt.Sprintf("The upload stopped arriving. (Nothing was received for %v)", BODY_READ_IDLE_TIMEOUT), err)
+  }
+
+  if headerError := AsMultipartHeaderError(err); headerError != nil {
+    return NewAppError(http.StatusBadRequest, 0, fmt.Sprintf("Invalid Form. (%v)", headerError), err)
+  }
+
+  // A streamed file part cut short surfaces while it's being stored.
+  if errors.Is(err, ErrMalformedMultipart) {
+    return NewAppError(http.StatusBadRequest, 0, "Invalid Form. (malformed multipart body)", err)
+  }
+
+  // The object was deleted already, what the client sent has to be sent again.
+  if errors.Is(err, ErrChecksumMismatch) {
+    return NewAppError(http.StatusUnprocessableEntity, 0, "The stored content doesn't match its checksum, please upload it again.", err)
+  }
+
+  if errors.Is(err, ErrS3Busy) {
+    return NewAppError(http.StatusServiceUnavailable, ErrorCodeStorageBusy, "The storage is busy, please try again.", err)
+  }
+
+  if IsStorageError(err) {
+    return NewAppError(http.StatusInternalServerError, ErrorCodeStorage, "The storage failed to handle the request.", err)
+  }
+
+  if IsDatabaseError(err) {
+    return NewAppError(http.StatusInternalServerError, ErrorCodeDatabase, "The database failed to handle the request.", err)
+  }
+
+  return NewAppError(http.StatusInternalServerError, ErrorCodeInternal, "Something went wrong.", err)
+}
+
+// Logging the underlying error and writing only the safe message.
+func WriteAppError(appError *AppError, w http.ResponseWriter, req *http.Request) {
+  log.Printf("%s %s failed: %v", req.Method, req.URL.Path, appError)
+
+  response := GenerateResponse(appError.StatusCode, http.StatusText(appError.StatusCode), false, appError.ErrorCode, appError.Message)
+  response.RetryAfter = appError.RetryAfter
+  WriteResponse(response, w, req)
+}
+
+func IsStorageError(err error) bool {
+  var s3Error *s3.Error
+  return errors.As(err, &s3Error) || GetSDKErrorStatus(err) > 0
+}
+
+func IsDatabaseError(err error) bool {
+  var queryError *mgo.QueryError
+  var lastError *mgo.LastError
+  return errors.As(err, &queryError) || errors.As(err, &lastError) || err == mgo.ErrNotFound
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func TestHandleAppErrorsWritesOnlyTheSafeMessage(t *testing.T) {
+  handler := HandleAppErrors(func(w http.ResponseWriter, req *http.Request) *AppError {
+    return HandleError(errors.New("dial tcp 10.0.0.7:27017: secret details"))
+  })
+
+  recorder := httptest.NewRecorder()
+  handler(recorder, httptest.NewRequest("GET", "/v1/files/x", nil))
+  response := DecodeTestResponse(t, recorder)
+  if response.StatusCode != http.StatusInternalServerError || response.ErrorText != "Something went wrong." {
+    t.Fatalf("Got %d %q.", response.StatusCode, response.ErrorText)
+  }
+  if strings.Contains(recorder.Body.String(), "secret details") {
+    t.Fatalf("The response exposes the error: %s", recorder.Body.String())
+  }
+}
+
+func TestHandleAppErrorsKeepsHandlerResponses(t *testing.T) {
+  handler := HandleAppErrors(func(w http.ResponseWriter, req *http.Request) *AppError {
+    WriteResponse(GenerateResponse(http.StatusTeapot, http.StatusText(http.StatusTeapot), false, 0, "Short and stout."), w, req)
+    return nil
+  })
+
+  recorder := httptest.NewRecorder()
+  handler(recorder, httptest.NewRequest("GET", "/v1/files/x", nil))
+  if response := DecodeTestResponse(t, recorder); response.StatusCode != http.StatusTeapot {
+    t.Fatalf("Got %d %q.", response.StatusCode, response.ErrorText)
+  }
+}
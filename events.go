@@ -0,0 +1,235 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Events of a file streamed to its watchers through /files/{id}/events. Watchers only hear of what happens on
+// the instance they're connected to, and of nothing that happened before they connected.
+const (
+  FileEventAccessed = "accessed"
+  FileEventExpiring = "expiring"
+  FileEventDeleted  = "deleted"
+)
+
+// Events a slow watcher may lag behind by before the next ones are dropped, rather than holding up publishers.
+const FILE_EVENT_BUFFER = 16
+
+// How often a comment is sent on an idle stream, keeping proxies from closing it and noticing gone clients.
+const FILE_EVENT_KEEPALIVE = 30 * time.Second
+
+type FileEvent struct {
+  Type               string     `json:"type"`
+  FileID             string     `json:"file_id"`
+  At                 time.Time  `json:"at"`
+  Access             string     `json:"access,omitempty"`
+  DownloadsRemaining *int       `json:"downloads_remaining,omitempty"`
+  ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+}
+
+// The watchers of each file, by the hex of its id.
+type FileEventHub struct {
+  mutex    sync.Mutex
+  watchers map[string]map[chan *FileEvent]bool
+}
+
+var FILE_EVENTS = &FileEventHub{watchers: map[string]map[chan *FileEvent]bool{}}
+
+// Handlers
+// Streams the events of the file as Server-Sent Events until it's deleted or the client goes away. The file's
+// password is required as for GET /files/{id}, without accessing the file.
+func StreamFileEvents(w http.ResponseWriter, req *http.Request) *AppError {
+  file, response := AuthorizeFileEvents(req)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  flusher, ok := w.(http.Flusher)
+  if ok == false {
+    return HandleError(fmt.Errorf("streaming the events of file %s: the response can't be flushed", file.ID.Hex()))
+  }
+
+  events, unsubscribe := FILE_EVENTS.Subscribe(file.ID.Hex())
+  defer unsubscribe()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-store")
+  w.Header().Set("X-Accel-Buffering", "no")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  keepalive := time.NewTicker(FILE_EVENT_KEEPALIVE)
+  defer keepalive.Stop()
+
+  for {
+    select {
+    case <-req.Context().Done():
+      return nil
+    case <-keepalive.C:
+      if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+        return nil
+      }
+    case event := <-events:
+      data, err := json.Marshal(event)
+      if err != nil {
+        return HandleError(err)
+      }
+      if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+        return nil
+      }
+      if event.Type == FileEventDeleted {
+        flusher.Flush()
+        return nil
+      }
+    }
+    flusher.Flush()
+  }
+}
+
+// Event Utility Functions.
+
+// Finds the file and checks the request's password, the Mongo session being released before streaming starts.
+func AuthorizeFileEvents(req *http.Request) (*File, *Response) {
+  session := InitializeMongoSession()
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  file, response := FindVisibleFile(collection, mux.Vars(req)["id"], req, GetPasswordRequiredResponse)
+  if response != nil {
+    return nil, response
+  }
+
+  if response = CheckWatchPassword(file, req); response != nil {
+    return nil, response
+  }
+
+  // Nothing can happen to a consumed or expired file but its deletion.
+  if file.Accessed == true {
+    return nil, SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has already been accessed."), GetGoneReason(file))
+  }
+  if IsFileExpired(file) {
+    return nil, SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+  }
+
+  return file, nil
+}
+
+// Checks the password of a request watching the file as CheckFilePassword does, without anything watching can
+// use up: download tokens, which only stand in for the password once, are refused, and incorrect passwords
+// don't count toward max_password_attempts, so watchers can't get the file deleted.
+func CheckWatchPassword(file *File, req *http.Request) *Response {
+  if response := CheckDuplicateAccessFields(req); response != nil {
+    return response
+  }
+
+  if len(req.FormValue("token")) > 0 {
+    return GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Download tokens can't be used to watch a file, send its password instead.")
+  }
+
+  if file.PasswordProtected == false {
+    if STRICT_PASSWORD && len(req.FormValue("password")) > 0 {
+      return GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "This file is not password protected.")
+    }
+    return nil
+  }
+
+  if file.Encrypted == false && IsMasterPasswordRequest(req) {
+    log.Printf("Master password used to watch file %s from %s.", file.ID.Hex(), ClientIP(req))
+    return nil
+  }
+
+  passwordIsCorrect := false
+  if file.Encrypted {
+    passwordIsCorrect = UnlockEncryptedFile(file, req.FormValue("password"))
+  } else {
+    passwordIsCorrect = IsPasswordCorrect(file.Password, []byte(req.FormValue("password")))
+  }
+  if passwordIsCorrect == false {
+    return GetPasswordRequiredResponse(req)
+  }
+
+  return nil
+}
+
+// Returns the channel the file's events are sent on, and the function to call once they're no longer read.
+func (hub *FileEventHub) Subscribe(fileId string) (chan *FileEvent, func()) {
+  events := make(chan *FileEvent, FILE_EVENT_BUFFER)
+
+  hub.mutex.Lock()
+  defer hub.mutex.Unlock()
+  if hub.watchers[fileId] == nil {
+    hub.watchers[fileId] = map[chan *FileEvent]bool{}
+  }
+  hub.watchers[fileId][events] = true
+
+  return events, func() {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+    delete(hub.watchers[fileId], events)
+    if len(hub.watchers[fileId]) == 0 {
+      delete(hub.watchers, fileId)
+    }
+  }
+}
+
+// Sends the event to every watcher of its file, dropping it for those whose buffer is full.
+func (hub *FileEventHub) Publish(event *FileEvent) {
+  hub.mutex.Lock()
+  defer hub.mutex.Unlock()
+
+  for events := range hub.watchers[event.FileID] {
+    select {
+    case events <- event:
+    default:
+      log.Printf("Dropped the %s event of file %s for a watcher falling behind.", event.Type, event.FileID)
+    }
+  }
+}
+
+// The ids of the files currently watched.
+func (hub *FileEventHub) GetWatchedFileIds() []bson.ObjectId {
+  hub.mutex.Lock()
+  defer hub.mutex.Unlock()
+
+  ids := []bson.ObjectId{}
+  for fileId := range hub.watchers {
+    ids = append(ids, bson.ObjectIdHex(fileId))
+  }
+  return ids
+}
+
+func PublishFileEvent(eventType string, file *File) {
+  FILE_EVENTS.Publish(&FileEvent{Type: eventType, FileID: file.ID.Hex(), At: CLOCK.Now()})
+}
+
+func PublishAccessEvent(file *File, access string) {
+  FILE_EVENTS.Publish(&FileEvent{Type: FileEventAccessed, FileID: file.ID.Hex(), At: CLOCK.Now(), Access: access, DownloadsRemaining: file.GetDownloadsRemaining()})
+}
+
+// Warns the watchers of the files expiring before the sweeper's next run. Only watched files are looked up.
+func PublishExpiringFiles(session *mgo.Session) {
+  ids := FILE_EVENTS.GetWatchedFileIds()
+  if len(ids) == 0 {
+    return
+  }
+
+  now := CLOCK.Now()
+  files := []File{}
+  query := bson.M{"_id": bson.M{"$in": ids}, "accessed": false, "expiresat": bson.M{"$gt": now, "$lte": now.Add(SWEEP_INTERVAL)}}
+  err := session.DB(DATABASE).C(COLLECTION).Find(query).Select(bson.M{"expiresat": 1}).All(&files)
+  ErrorHandler(err)
+
+  for i := range files {
+    FILE_EVENTS.Publish(&FileEvent{Type: FileEventExpiring, FileID: files[i].ID.Hex(), At: now, ExpiresAt: files[i].ExpiresAt})
+  }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Opens the file's event stream for a moment, returning the recorder of what it answered.
+func WatchTestFile(t *testing.T, file *TestFile, query string) *httptest.ResponseRecorder {
+  t.Helper()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+  req := httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex()+"/events?"+query, nil).WithContext(ctx)
+  return ServeTestRequest(req)
+}
+
+func TestWatchingDoesNotUseUpAccess(t *testing.T) {
+  ResetTestState(t)
+  file := UploadTestFile(t, [][2]string{{"password", "secret"}, {"max_password_attempts", "1"}}, "notes.txt", []byte("Hello, world."))
+
+  // Incorrect passwords are refused without counting toward the file's attempts.
+  for i := 0; i < 2; i++ {
+    response := DecodeTestResponse(t, WatchTestFile(t, file, "password=guess"))
+    if response.StatusCode != http.StatusUnauthorized || response.ErrorText != "Incorrect password. Please try again." {
+      t.Fatalf("Watching with an incorrect password returned %d %q.", response.StatusCode, response.ErrorText)
+    }
+  }
+
+  recorder := WatchTestFile(t, file, "password=secret")
+  if recorder.Code != http.StatusOK || strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/event-stream") == false {
+    t.Fatalf("Watching with the password returned %d: %s", recorder.Code, recorder.Body.String())
+  }
+
+  // Download tokens are refused, and still redeemable afterwards.
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("POST", "/v1/files/"+file.ID.Hex()+"/token?password=secret", nil)))
+  token := &DownloadToken{}
+  if err := json.Unmarshal(response.Content, token); err != nil {
+    t.Fatal(err)
+  }
+  response = DecodeTestResponse(t, WatchTestFile(t, file, "token="+token.Token))
+  if response.StatusCode != http.StatusBadRequest || response.ErrorText != "Download tokens can't be used to watch a file, send its password instead." {
+    t.Fatalf("Watching with a token returned %d %q.", response.StatusCode, response.ErrorText)
+  }
+
+  response = DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex()+"?token="+token.Token, nil)))
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("Redeeming the token after watching returned %d %q.", response.StatusCode, response.ErrorText)
+  }
+}
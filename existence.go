@@ -0,0 +1,135 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Whether missing files are answered for as password protected ones, configured through HIDE_EXISTENCE. Every
+// endpoint looking a file up then responds the same, and takes as long, whether the id exists or not, and
+// consumed and expired files are answered for as missing ones.
+var HIDE_EXISTENCE = false
+
+// Compared against the password submitted for a missing file, so it's rejected after a check as costly as a real one.
+var missingFilePasswordHash []byte
+
+// Least time GET /files/{id} takes to respond, configured through PASSWORD_TIMING_FLOOR, so how long its lookup
+// and password check took doesn't tell missing files, wrong passwords and right ones apart. Off when zero.
+var PASSWORD_TIMING_FLOOR time.Duration
+
+// Loading the existence hiding configuration, called once the environment has been loaded.
+func LoadExistenceSettings(config *Config) {
+  if hideExistence := config.Getenv("HIDE_EXISTENCE", &HIDE_EXISTENCE); len(hideExistence) > 0 {
+    enabled, err := strconv.ParseBool(hideExistence)
+    if err != nil {
+      log.Fatalf("Invalid HIDE_EXISTENCE %q.", hideExistence)
+    }
+    HIDE_EXISTENCE = enabled
+  }
+
+  if HIDE_EXISTENCE {
+    missingFilePasswordHash = CreatePasswordHash(bson.NewObjectId().Hex())
+  }
+
+  if timingFloor := config.Getenv("PASSWORD_TIMING_FLOOR", &PASSWORD_TIMING_FLOOR); len(timingFloor) > 0 {
+    floor, err := time.ParseDuration(timingFloor)
+    if err != nil || floor < 0 {
+      log.Fatalf("Invalid PASSWORD_TIMING_FLOOR %q.", timingFloor)
+    }
+    PASSWORD_TIMING_FLOOR = floor
+  }
+}
+
+// Middleware
+// Holds the response back until PASSWORD_TIMING_FLOOR has passed since the request came in, whichever way the
+// handler answers it, panicking included.
+func ApplyTimingFloor(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if PASSWORD_TIMING_FLOOR == 0 {
+      next(w, req)
+      return
+    }
+
+    // Also waiting when the handler panics, as RecoverErrors then answers through the outer writer.
+    writer := &timingFloorWriter{ResponseWriter: w, notBefore: time.Now().Add(PASSWORD_TIMING_FLOOR)}
+    defer writer.wait()
+    next(writer, req)
+  }
+}
+
+// Waits for the floor before the status or body of the response is first written.
+type timingFloorWriter struct {
+  http.ResponseWriter
+  notBefore time.Time
+  waited    bool
+}
+
+func (w *timingFloorWriter) WriteHeader(statusCode int) {
+  w.wait()
+  w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *timingFloorWriter) Write(content []byte) (int, error) {
+  w.wait()
+  return w.ResponseWriter.Write(content)
+}
+
+// Streamed responses, such as file events, flush through here once the floor has passed.
+func (w *timingFloorWriter) Flush() {
+  w.wait()
+  if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+// Lets http.ResponseController reach the underlying writer.
+func (w *timingFloorWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+func (w *timingFloorWriter) wait() {
+  if w.waited {
+    return
+  }
+  w.waited = true
+  time.Sleep(time.Until(w.notBefore))
+}
+
+// Existence Utility Functions.
+
+// Finds the file the request is for as FindFile does, every endpoint looking a file up by id going through here.
+// When HIDE_EXISTENCE is on, files that are missing, or were consumed, expired or deleted, are answered for
+// with the response reject gives a protected file's wrong credentials, once the credentials submitted were
+// checked all the same.
+func FindVisibleFile(collection *mgo.Collection, submittedFileId string, req *http.Request, reject func(req *http.Request) *Response) (*File, *Response) {
+  file, response := FindFile(collection, submittedFileId)
+  if HIDE_EXISTENCE == false {
+    return file, response
+  }
+
+  if response == nil && file.Accessed == false && IsFileExpired(file) == false {
+    return file, nil
+  }
+  if response != nil && response.StatusCode != http.StatusNotFound && response.StatusCode != http.StatusGone {
+    return nil, response
+  }
+
+  if duplicateResponse := CheckDuplicateAccessFields(req); duplicateResponse != nil {
+    return nil, duplicateResponse
+  }
+
+  if submittedToken := req.FormValue("token"); len(submittedToken) > 0 {
+    ParseDownloadToken(submittedToken, bson.NewObjectId())
+  } else if submittedPassword := req.FormValue("delete_password"); len(submittedPassword) > 0 {
+    IsPasswordCorrect(missingFilePasswordHash, []byte(submittedPassword))
+  } else {
+    IsPasswordCorrect(missingFilePasswordHash, []byte(req.FormValue("password")))
+  }
+
+  return nil, reject(req)
+}
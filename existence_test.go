@@ -0,0 +1,123 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+func TestHideExistence(t *testing.T) {
+  cases := []struct {
+    name      string
+    method    string
+    path      string
+    status    int
+    errorText string
+  }{
+    {"Get", "GET", "/v1/files/%s?password=guess", http.StatusUnauthorized, "Incorrect password. Please try again."},
+    {"GetWithoutPassword", "GET", "/v1/files/%s", http.StatusUnauthorized, "This file requires a password in order to be accessed. Please enter the correct password in order to access this file."},
+    {"Download", "GET", "/v1/files/%s/download?password=guess", http.StatusUnauthorized, "Incorrect password. Please try again."},
+    {"Token", "POST", "/v1/files/%s/token?password=guess", http.StatusUnauthorized, "Incorrect password. Please try again."},
+    {"Status", "GET", "/v1/files/%s/status", http.StatusUnauthorized, "This file requires a password in order to be accessed. Please enter the correct password in order to access this file."},
+    {"Delete", "DELETE", "/v1/files/%s?delete_password=guess", http.StatusUnauthorized, "Incorrect delete password. Please try again."},
+    {"Rotate", "POST", "/v1/files/%s/rotate?delete_password=guess", http.StatusUnauthorized, "Incorrect delete password. Please try again."},
+  }
+
+  // Every kind of file the endpoints must not tell apart from a protected one.
+  files := []struct {
+    name    string
+    fields  [][2]string
+    prepare func(t *testing.T, file *TestFile)
+  }{
+    {"Unknown", nil, func(t *testing.T, file *TestFile) {
+      file.ID = bson.NewObjectId()
+    }},
+    {"Protected", [][2]string{{"password", "secret"}, {"delete_password", "delete-secret"}}, nil},
+    {"Consumed", nil, func(t *testing.T, file *TestFile) {
+      SetTestSetting(t, &HIDE_EXISTENCE, false)
+      recorder := ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex(), nil))
+      if response := DecodeTestResponse(t, recorder); response.StatusCode != http.StatusOK {
+        t.Fatalf("Accessing the file returned %d: %s", response.StatusCode, recorder.Body.String())
+      }
+      HIDE_EXISTENCE = true
+    }},
+    {"Expired", nil, func(t *testing.T, file *TestFile) {
+      session := InitializeMongoSession()
+      defer session.Close()
+      err := session.DB(DATABASE).C(COLLECTION).UpdateId(file.ID, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+      if err != nil {
+        t.Fatal(err)
+      }
+    }},
+  }
+
+  for _, c := range cases {
+    for _, f := range files {
+      t.Run(c.name+"/"+f.name, func(t *testing.T) {
+        ResetTestState(t)
+        SetTestSetting(t, &HIDE_EXISTENCE, true)
+        SetTestSetting(t, &CONSUMED_RECORD_RETENTION, 0)
+        SetTestSetting(t, &missingFilePasswordHash, CreatePasswordHash(bson.NewObjectId().Hex()))
+
+        file := UploadTestFile(t, f.fields, "notes.txt", []byte("Hello, world."))
+        if f.prepare != nil {
+          f.prepare(t, file)
+        }
+
+        req := httptest.NewRequest(c.method, fmt.Sprintf(c.path, file.ID.Hex()), nil)
+        response := DecodeTestResponse(t, ServeTestRequest(req))
+        if response.StatusCode != c.status || response.ErrorText != c.errorText {
+          t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+        }
+      })
+    }
+  }
+}
+
+func TestHideExistenceInStatuses(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &HIDE_EXISTENCE, true)
+
+  protected := UploadTestFile(t, [][2]string{{"password", "secret"}}, "notes.txt", []byte("Hello, world."))
+  available := UploadTestFile(t, nil, "notes.txt", []byte("Hello, world."))
+  unknown := bson.NewObjectId()
+
+  body := fmt.Sprintf(`["%s", "%s", "%s"]`, protected.ID.Hex(), available.ID.Hex(), unknown.Hex())
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("POST", "/v1/files/status", strings.NewReader(body))))
+  statuses := map[string]string{}
+  if err := json.Unmarshal(response.Content, &statuses); err != nil {
+    t.Fatal(err)
+  }
+
+  expected := map[string]string{protected.ID.Hex(): StatusPasswordProtected, available.ID.Hex(): StatusAvailable, unknown.Hex(): StatusPasswordProtected}
+  for id, status := range expected {
+    if statuses[id] != status {
+      t.Fatalf("Got the statuses %v, expected %v.", statuses, expected)
+    }
+  }
+}
+
+func TestTimingFloorCoversPanics(t *testing.T) {
+  SetTestSetting(t, &PASSWORD_TIMING_FLOOR, 50*time.Millisecond)
+
+  handler := RecoverErrors(ApplyTimingFloor(func(w http.ResponseWriter, req *http.Request) {
+    panic(errors.New("lookup failed"))
+  }))
+
+  start := time.Now()
+  recorder := httptest.NewRecorder()
+  handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/files/x", nil))
+  if elapsed := time.Since(start); elapsed < PASSWORD_TIMING_FLOOR {
+    t.Fatalf("Answered the panic after %s, before the floor of %s.", elapsed, PASSWORD_TIMING_FLOOR)
+  }
+  if response := DecodeTestResponse(t, recorder); response.StatusCode != http.StatusInternalServerError {
+    t.Fatalf("Got %d %q.", response.StatusCode, response.ErrorText)
+  }
+}
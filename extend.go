@@ -0,0 +1,108 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Handlers
+// Pushes the expiry of the file back to "expires_in" from now, within the maximum retention as uploads are. An
+// expiry can only be put off, a file is never made to expire sooner than it was uploaded to.
+func ExtendFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetDeletePasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the delete password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckDeletePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true || IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if fieldErrors := ValidateExtendFields(req); len(fieldErrors) > 0 {
+    WriteResponse(InvalidFormResponse(fieldErrors), w, req)
+    return nil
+  }
+
+  expiresIn, expiresInNote, err := ResolveExpiresIn(req.FormValue("expires_in"))
+  if err != nil {
+    response = GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  expiresAt := CLOCK.Now().Add(expiresIn)
+  if file.ExpiresAt == nil || expiresAt.After(*file.ExpiresAt) == false {
+    WriteResponse(InvalidFormResponse([]*FieldError{GetExtendTooShortError(file)}), w, req)
+    return nil
+  }
+
+  // Extending only a file still there as it was read, so an access consuming it in the meantime wins.
+  err = collection.Update(bson.M{"_id": file.ID, "accessed": false, "expiresat": file.ExpiresAt}, bson.M{"$set": bson.M{"expiresat": expiresAt}})
+  if err == mgo.ErrNotFound {
+    response = GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file was accessed or extended in the meantime.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+  file.ExpiresAt = &expiresAt
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Note = expiresInNote
+  response.Content = file
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Extend Utility Functions.
+
+// Returns the problems of the "expires_in" to extend the file by, which is required.
+func ValidateExtendFields(req *http.Request) []*FieldError {
+  if name := FindDuplicateField(req, []string{"expires_in"}); len(name) > 0 {
+    return []*FieldError{{name, FieldErrorDuplicate, "Must only be given once."}}
+  }
+
+  submittedExpiresIn := req.FormValue("expires_in")
+  if len(submittedExpiresIn) == 0 {
+    return []*FieldError{{"expires_in", FieldErrorRequires, "Is required."}}
+  }
+  if _, err := ParseDurationValue(submittedExpiresIn); err != nil {
+    return []*FieldError{{"expires_in", FieldErrorInvalid, "Must be a positive number of seconds or a duration such as 24h."}}
+  }
+
+  return ValidateRetentionFields(req)
+}
+
+// The problem of an "expires_in" that wouldn't put the file's expiry off.
+func GetExtendTooShortError(file *File) *FieldError {
+  if file.ExpiresAt == nil {
+    return &FieldError{"expires_in", FieldErrorOutOfRange, "This file doesn't expire."}
+  }
+  return &FieldError{"expires_in", FieldErrorOutOfRange, fmt.Sprintf("Must end after the file's current expiry, %s.", file.ExpiresAt.UTC().Format(time.RFC3339))}
+}
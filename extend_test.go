@@ -0,0 +1,83 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Posts the form to the file's endpoint, such as "extend", with the management token when one is given.
+func PostTestFileForm(t *testing.T, file *TestFile, endpoint string, token string, form url.Values) *TestResponse {
+  t.Helper()
+
+  req := httptest.NewRequest("POST", "/v1/files/"+file.ID.Hex()+"/"+endpoint, strings.NewReader(form.Encode()))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  if len(token) > 0 {
+    req.Header.Set(MANAGEMENT_TOKEN_HEADER, token)
+  }
+  return DecodeTestResponse(t, ServeTestRequest(req))
+}
+
+func TestExtendFile(t *testing.T) {
+  ResetTestState(t)
+  clock := &FixedClock{Time: time.Now()}
+  SetTestSetting[Clock](t, &CLOCK, clock)
+  SetTestSetting(t, &ONE_TIME_ACCESS, false)
+
+  file := UploadTestFile(t, [][2]string{{"expires_in", "1h"}}, "notes.txt", []byte("Hello, world."))
+
+  cases := []struct {
+    name      string
+    token     string
+    expiresIn string
+    status    int
+    errorText string
+  }{
+    {"WrongToken", "wrong", "3h", http.StatusUnauthorized, "Incorrect management token."},
+    {"MissingExpiresIn", file.ManagementToken, "", http.StatusBadRequest, "Invalid Form. (expires_in: Is required.)"},
+    {"Shorter", file.ManagementToken, "30m", http.StatusBadRequest, "Invalid Form. (expires_in: Must end after the file's current expiry, " + clock.Now().Add(time.Hour).UTC().Format(time.RFC3339) + ".)"},
+    {"Extended", file.ManagementToken, "3h", http.StatusOK, "No Error."},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      response := PostTestFileForm(t, file, "extend", c.token, url.Values{"expires_in": {c.expiresIn}})
+      if response.StatusCode != c.status || response.ErrorText != c.errorText {
+        t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+      }
+    })
+  }
+
+  // The file outlives the hour it was uploaded for.
+  clock.Advance(2 * time.Hour)
+  if response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex(), nil))); response.StatusCode != http.StatusOK {
+    t.Fatalf("Got %d %q, expected the extended file to be found.", response.StatusCode, response.ErrorText)
+  }
+}
+
+func TestManagementTokenDoesNotTransfer(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &API_KEYS, map[string]string{"test-key": "test-api-key", "colleague": "colleague-api-key"})
+
+  req := NewTestUploadRequest(t, nil, "notes.txt", []byte("Hello, world."))
+  req.Header.Set("X-API-Key", "test-api-key")
+  recorder := ServeTestRequest(req)
+  file := &TestFile{}
+  if err := json.Unmarshal(DecodeTestResponse(t, recorder).Content, file); err != nil {
+    t.Fatal(err)
+  }
+
+  form := url.Values{"owner": {"colleague"}}
+  req = httptest.NewRequest("POST", "/v1/files/"+file.ID.Hex()+"/transfer", strings.NewReader(form.Encode()))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("X-API-Key", "test-api-key")
+  req.Header.Set(MANAGEMENT_TOKEN_HEADER, file.ManagementToken)
+  response := DecodeTestResponse(t, ServeTestRequest(req))
+  if response.StatusCode != http.StatusBadRequest || response.ErrorText != "The management token can't be used to transfer a file, send its delete password instead." {
+    t.Fatalf("Got %d %q, expected the management token to be refused.", response.StatusCode, response.ErrorText)
+  }
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "mime"
+  "net"
+  "net/http"
+  "net/netip"
+  "net/url"
+  "path"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// Largest resource fetched from a source url, configured through SOURCE_URL_MAX_BYTES.
+var SOURCE_URL_MAX_BYTES int64 = 16 << 20
+
+// How long fetching a source url may take, configured through SOURCE_URL_TIMEOUT.
+var SOURCE_URL_TIMEOUT = 30 * time.Second
+
+// Content types (or prefixes, e.g. "image/") fetched from a source url, configured through
+// SOURCE_URL_ALLOWED_TYPES. Any content type is accepted when empty.
+var SOURCE_URL_ALLOWED_TYPES []string
+
+// How many times a fetch failing midway is resumed, configured through SOURCE_URL_RESUME_ATTEMPTS.
+var SOURCE_URL_RESUME_ATTEMPTS = 3
+
+// Addresses source urls can't reach: every range of the IANA IPv4 and IPv6 special-purpose address registries
+// that isn't globally reachable, and those translating to one, such as NAT64 and 6to4, which could lead to a
+// private IPv4 address. IPv4-mapped IPv6 addresses are checked as the IPv4 address they map.
+var NON_PUBLIC_PREFIXES = []netip.Prefix{
+  netip.MustParsePrefix("0.0.0.0/8"),          // "This network"
+  netip.MustParsePrefix("10.0.0.0/8"),         // Private-Use
+  netip.MustParsePrefix("100.64.0.0/10"),      // Shared Address Space, CGNAT and some cloud metadata services
+  netip.MustParsePrefix("127.0.0.0/8"),        // Loopback
+  netip.MustParsePrefix("169.254.0.0/16"),     // Link Local, cloud metadata services
+  netip.MustParsePrefix("172.16.0.0/12"),      // Private-Use
+  netip.MustParsePrefix("192.0.0.0/24"),       // IETF Protocol Assignments
+  netip.MustParsePrefix("192.0.2.0/24"),       // Documentation (TEST-NET-1)
+  netip.MustParsePrefix("192.31.196.0/24"),    // AS112-v4
+  netip.MustParsePrefix("192.52.193.0/24"),    // AMT
+  netip.MustParsePrefix("192.88.99.0/24"),     // Deprecated 6to4 Relay Anycast
+  netip.MustParsePrefix("192.168.0.0/16"),     // Private-Use
+  netip.MustParsePrefix("192.175.48.0/24"),    // Direct Delegation AS112 Service
+  netip.MustParsePrefix("198.18.0.0/15"),      // Benchmarking
+  netip.MustParsePrefix("198.51.100.0/24"),    // Documentation (TEST-NET-2)
+  netip.MustParsePrefix("203.0.113.0/24"),     // Documentation (TEST-NET-3)
+  netip.MustParsePrefix("224.0.0.0/4"),        // Multicast
+  netip.MustParsePrefix("240.0.0.0/4"),        // Reserved, and Limited Broadcast
+  netip.MustParsePrefix("::/128"),             // Unspecified Address
+  netip.MustParsePrefix("::1/128"),            // Loopback Address
+  netip.MustParsePrefix("::/96"),              // Deprecated IPv4-Compatible Addresses
+  netip.MustParsePrefix("64:ff9b::/96"),       // IPv4-IPv6 Translation
+  netip.MustParsePrefix("64:ff9b:1::/48"),     // Local-Use IPv4/IPv6 Translation
+  netip.MustParsePrefix("100::/64"),           // Discard-Only Address Block
+  netip.MustParsePrefix("2001::/23"),          // IETF Protocol Assignments, Teredo included
+  netip.MustParsePrefix("2001:db8::/32"),      // Documentation
+  netip.MustParsePrefix("2002::/16"),          // 6to4
+  netip.MustParsePrefix("3fff::/20"),          // Documentation
+  netip.MustParsePrefix("5f00::/16"),          // Segment Routing (SRv6) SIDs
+  netip.MustParsePrefix("fc00::/7"),           // Unique-Local
+  netip.MustParsePrefix("fe80::/10"),          // Link-Local Unicast
+  netip.MustParsePrefix("fec0::/10"),          // Deprecated Site-Local
+  netip.MustParsePrefix("ff00::/8"),           // Multicast
+}
+
+var ErrForbiddenAddress = errors.New("source url resolves to a private address")
+
+var ErrSourceTooLarge = errors.New("resource is too large")
+
+// Client used to fetch source urls. Addresses are checked after resolution, when dialing, so
+// neither DNS tricks nor redirects can reach an internal address.
+var remoteFetchClient = &http.Client{
+  Transport: &http.Transport{
+    Proxy: nil,
+    DialContext: (&net.Dialer{
+      Timeout: 10 * time.Second,
+      Control: func(network, address string, conn syscall.RawConn) error {
+        host, _, err := net.SplitHostPort(address)
+        if err != nil {
+          return err
+        }
+
+        if IsPublicIP(net.ParseIP(host)) == false {
+          return ErrForbiddenAddress
+        }
+
+        return nil
+      },
+    }).DialContext,
+  },
+  CheckRedirect: func(req *http.Request, via []*http.Request) error {
+    if len(via) >= 5 {
+      return errors.New("too many redirects")
+    }
+    return IsFetchableURL(req.URL)
+  },
+}
+
+// Loading the source url fetch configuration, called once the environment has been loaded.
+func LoadRemoteFetchSettings(config *Config) {
+  if maxBytes := config.Getenv("SOURCE_URL_MAX_BYTES", &SOURCE_URL_MAX_BYTES); len(maxBytes) > 0 {
+    limit, err := strconv.ParseInt(maxBytes, 10, 64)
+    if err != nil || limit <= 0 {
+      log.Fatalf("Invalid SOURCE_URL_MAX_BYTES %q.", maxBytes)
+    }
+    SOURCE_URL_MAX_BYTES = limit
+  }
+
+  if timeout := config.Getenv("SOURCE_URL_TIMEOUT", &SOURCE_URL_TIMEOUT); len(timeout) > 0 {
+    duration, err := time.ParseDuration(timeout)
+    if err != nil || duration <= 0 {
+      log.Fatalf("Invalid SOURCE_URL_TIMEOUT %q.", timeout)
+    }
+    SOURCE_URL_TIMEOUT = duration
+  }
+
+  if resumeAttempts := config.Getenv("SOURCE_URL_RESUME_ATTEMPTS", &SOURCE_URL_RESUME_ATTEMPTS); len(resumeAttempts) > 0 {
+    attempts, err := strconv.Atoi(resumeAttempts)
+    if err != nil || attempts < 0 {
+      log.Fatalf("Invalid SOURCE_URL_RESUME_ATTEMPTS %q.", resumeAttempts)
+    }
+    SOURCE_URL_RESUME_ATTEMPTS = attempts
+  }
+
+  if allowedTypes := config.Getenv("SOURCE_URL_ALLOWED_TYPES", &SOURCE_URL_ALLOWED_TYPES); len(allowedTypes) > 0 {
+    for _, allowedType := range strings.Split(allowedTypes, ",") {
+      SOURCE_URL_ALLOWED_TYPES = append(SOURCE_URL_ALLOWED_TYPES, strings.ToLower(strings.TrimSpace(allowedType)))
+    }
+  }
+}
+
+// Remote Fetch Utility Functions.
+
+// Fetches the resource at the source url, reporting the bytes read so far to progress when it isn't nil.
+// A read failing midway is resumed with a Range request, as long as the source identifies the resource's
+// version so the remainder is known to belong to the same one.
+func FetchRemoteFile(sourceUrl string, progress func(int64)) (*Upload, error) {
+  parsedUrl, err := url.Parse(sourceUrl)
+  if err != nil {
+    return nil, errors.New("invalid url")
+  }
+
+  err = IsFetchableURL(parsedUrl)
+  if err != nil {
+    return nil, err
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), SOURCE_URL_TIMEOUT)
+  defer cancel()
+
+  res, err := RequestRemoteFile(ctx, parsedUrl.String(), nil)
+  if err != nil {
+    return nil, err
+  }
+
+  if res.StatusCode != http.StatusOK {
+    res.Body.Close()
+    return nil, fmt.Errorf("source responded with %d", res.StatusCode)
+  }
+
+  if res.ContentLength > SOURCE_URL_MAX_BYTES {
+    res.Body.Close()
+    return nil, fmt.Errorf("resource is larger than %d bytes", SOURCE_URL_MAX_BYTES)
+  }
+
+  contentType := res.Header.Get("Content-Type")
+  if IsAllowedSourceContentType(contentType) == false {
+    res.Body.Close()
+    return nil, fmt.Errorf("content type %q is not allowed", contentType)
+  }
+
+  // Using the last path segment of the final url as the filename.
+  finalUrl := res.Request.URL
+  filename := path.Base(finalUrl.Path)
+  if filename == "/" || filename == "." {
+    filename = "download"
+  }
+
+  validator := GetResumeValidator(res.Header)
+  content := []byte{}
+
+  for attempt := 0; ; attempt++ {
+    content, err = ReadRemoteFileBody(res.Body, content, progress)
+    res.Body.Close()
+
+    if err == nil {
+      break
+    }
+
+    if errors.Is(err, ErrSourceTooLarge) {
+      return nil, fmt.Errorf("resource is larger than %d bytes", SOURCE_URL_MAX_BYTES)
+    }
+
+    if attempt >= SOURCE_URL_RESUME_ATTEMPTS || len(validator) == 0 || ctx.Err() != nil {
+      return nil, errors.New("reading the resource failed")
+    }
+
+    log.Printf("Fetching %s failed after %d bytes, resuming: %v", finalUrl.Host, len(content), err)
+
+    headers := map[string]string{
+      "Range":    fmt.Sprintf("bytes=%d-", len(content)),
+      "If-Range": validator,
+    }
+    res, err = RequestRemoteFile(ctx, finalUrl.String(), headers)
+    if err != nil {
+      return nil, err
+    }
+
+    switch {
+    case res.StatusCode == http.StatusPartialContent && GetContentRangeStart(res.Header) == int64(len(content)):
+    case res.StatusCode == http.StatusOK:
+      // The source ignored the range, or the resource changed, and sent it all over again.
+      content = content[:0]
+    default:
+      res.Body.Close()
+      return nil, fmt.Errorf("source responded with %d while resuming", res.StatusCode)
+    }
+  }
+
+  return &Upload{Filename: filename, ContentType: contentType, Content: content}, nil
+}
+
+func RequestRemoteFile(ctx context.Context, sourceUrl string, headers map[string]string) (*http.Response, error) {
+  req, err := http.NewRequestWithContext(ctx, "GET", sourceUrl, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  for name, value := range headers {
+    req.Header.Set(name, value)
+  }
+
+  res, err := remoteFetchClient.Do(req)
+  if err != nil {
+    if errors.Is(err, ErrForbiddenAddress) {
+      return nil, ErrForbiddenAddress
+    }
+    return nil, errors.New("request failed")
+  }
+
+  return res, nil
+}
+
+// Appends the body to the content read so far, enforcing the limit over the whole resource and not
+// only the part being read, since resources don't always declare their length.
+func ReadRemoteFileBody(body io.Reader, content []byte, progress func(int64)) ([]byte, error) {
+  buffer := make([]byte, 32<<10)
+
+  for {
+    n, err := body.Read(buffer)
+    content = append(content, buffer[:n]...)
+
+    if int64(len(content)) > SOURCE_URL_MAX_BYTES {
+      return content, ErrSourceTooLarge
+    }
+
+    if n > 0 && progress != nil {
+      progress(int64(len(content)))
+    }
+
+    if err == io.EOF {
+      return content, nil
+    }
+    if err != nil {
+      return content, err
+    }
+  }
+}
+
+// The strong ETag, or failing that the Last-Modified date, identifying the version of a resource for If-Range.
+func GetResumeValidator(header http.Header) string {
+  if etag := header.Get("ETag"); len(etag) > 0 && strings.HasPrefix(etag, "W/") == false {
+    return etag
+  }
+
+  return header.Get("Last-Modified")
+}
+
+// The first byte of a "Content-Range: bytes <start>-<end>/<size>" header, or -1 when it's missing or malformed.
+func GetContentRangeStart(header http.Header) int64 {
+  contentRange := strings.TrimPrefix(header.Get("Content-Range"), "bytes ")
+  dash := strings.Index(contentRange, "-")
+  if dash < 0 {
+    return -1
+  }
+
+  start, err := strconv.ParseInt(contentRange[:dash], 10, 64)
+  if err != nil {
+    return -1
+  }
+
+  return start
+}
+
+func IsFetchableURL(sourceUrl *url.URL) error {
+  if sourceUrl.Scheme != "http" && sourceUrl.Scheme != "https" {
+    return errors.New("only http and https urls are supported")
+  }
+
+  if len(sourceUrl.Hostname()) == 0 {
+    return errors.New("missing host")
+  }
+
+  // Rejecting literal addresses up front, resolved hostnames are checked when dialing.
+  if ip := net.ParseIP(sourceUrl.Hostname()); ip != nil && IsPublicIP(ip) == false {
+    return ErrForbiddenAddress
+  }
+
+  return nil
+}
+
+func IsPublicIP(ip net.IP) bool {
+  addr, ok := netip.AddrFromSlice(ip)
+  if ok == false {
+    return false
+  }
+  addr = addr.Unmap()
+
+  for _, prefix := range NON_PUBLIC_PREFIXES {
+    if prefix.Contains(addr) {
+      return false
+    }
+  }
+  return true
+}
+
+func IsAllowedSourceContentType(contentType string) bool {
+  if len(SOURCE_URL_ALLOWED_TYPES) == 0 {
+    return true
+  }
+
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return false
+  }
+
+  for _, allowedType := range SOURCE_URL_ALLOWED_TYPES {
+    if mediaType == allowedType || (strings.HasSuffix(allowedType, "/") && strings.HasPrefix(mediaType, allowedType)) {
+      return true
+    }
+  }
+
+  return false
+}
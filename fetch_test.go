@@ -0,0 +1,62 @@
+package main
+
+import (
+  "net"
+  "testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+  cases := []struct {
+    ip     string
+    public bool
+  }{
+    {"93.184.216.34", true},
+    {"8.8.8.8", true},
+    {"100.63.255.255", true},
+    {"100.128.0.0", true},
+    {"198.20.0.1", true},
+    {"2606:2800:220:1:248:1893:25c8:1946", true},
+    {"2001:4860:4860::8888", true},
+    {"0.0.0.0", false},
+    {"0.1.2.3", false},
+    {"10.0.0.1", false},
+    {"100.64.0.1", false},
+    {"100.100.100.200", false},
+    {"127.0.0.1", false},
+    {"169.254.169.254", false},
+    {"172.16.0.1", false},
+    {"192.0.0.170", false},
+    {"192.0.2.1", false},
+    {"192.168.1.1", false},
+    {"198.18.0.1", false},
+    {"198.19.255.255", false},
+    {"224.0.0.1", false},
+    {"255.255.255.255", false},
+    {"::", false},
+    {"::1", false},
+    {"::ffff:127.0.0.1", false},
+    {"::ffff:169.254.169.254", false},
+    {"::127.0.0.1", false},
+    {"64:ff9b::a9fe:a9fe", false},
+    {"64:ff9b::10.0.0.1", false},
+    {"2002:a9fe:a9fe::1", false},
+    {"2001::1", false},
+    {"2001:db8::1", false},
+    {"fc00::1", false},
+    {"fd12:3456::1", false},
+    {"fe80::1", false},
+    {"ff02::1", false},
+  }
+
+  for _, c := range cases {
+    t.Run(c.ip, func(t *testing.T) {
+      if public := IsPublicIP(net.ParseIP(c.ip)); public != c.public {
+        t.Fatalf("IsPublicIP(%s) = %v, expected %v.", c.ip, public, c.public)
+      }
+    })
+  }
+
+  if IsPublicIP(nil) {
+    t.Fatalf("IsPublicIP(nil) = true, expected false.")
+  }
+}
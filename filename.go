@@ -0,0 +1,161 @@
+package main
+
+import (
+  "log"
+  "mime"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "golang.org/x/text/unicode/norm"
+)
+
+// Longest filename stored, in bytes once UTF-8 encoded, configured through FILENAME_MAX_BYTES.
+var FILENAME_MAX_BYTES = 255
+
+// Longest filename used in an S3 key, which also carries the date and uuid.
+var KEY_FILENAME_MAX_BYTES = 100
+
+// Extensions uploads are refused for, configured through BLOCKED_EXTENSIONS as "exe,bat,tar.gz". Stored
+// lowercase, without their leading dot.
+var BLOCKED_EXTENSIONS = []string{}
+
+// Name of the files uploaded without one, or with one that's empty once sanitized, given an extension guessed
+// from their content type.
+const DEFAULT_FILENAME = "upload"
+
+// Extensions of the content types mime knows several for, its first in alphabetical order not being the usual one.
+var DEFAULT_FILENAME_EXTENSIONS = map[string]string{
+  "application/octet-stream": "",
+  "audio/mpeg":               ".mp3",
+  "image/jpeg":               ".jpg",
+  "image/svg+xml":            ".svg",
+  "image/tiff":               ".tiff",
+  "text/html":                ".html",
+  "text/plain":               ".txt",
+  "video/mpeg":               ".mpeg",
+}
+
+// Loading the filename configuration, called once the environment has been loaded.
+func LoadFilenameSettings(config *Config) {
+  if maxBytes := config.Getenv("FILENAME_MAX_BYTES", &FILENAME_MAX_BYTES); len(maxBytes) > 0 {
+    limit, err := strconv.Atoi(maxBytes)
+    if err != nil || limit <= 0 {
+      log.Fatalf("Invalid FILENAME_MAX_BYTES %q.", maxBytes)
+    }
+    FILENAME_MAX_BYTES = limit
+  }
+
+  if blockedExtensions := config.Getenv("BLOCKED_EXTENSIONS", &BLOCKED_EXTENSIONS); len(blockedExtensions) > 0 {
+    for _, extension := range strings.Split(blockedExtensions, ",") {
+      extension = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), "."))
+      if len(extension) == 0 || strings.ContainsAny(extension, `/\ `) {
+        log.Fatalf("Invalid BLOCKED_EXTENSIONS entry %q.", extension)
+      }
+      BLOCKED_EXTENSIONS = append(BLOCKED_EXTENSIONS, extension)
+    }
+  }
+}
+
+// Filename Utility Functions.
+
+// Returns the filename to store and display: without any directories, NFC normalized, stripped
+// of control and bidi override characters (which can disguise an extension) and truncated to FILENAME_MAX_BYTES with its extension kept.
+func SanitizeFilename(filename string) string {
+  if utf8.ValidString(filename) == false {
+    filename = strings.ToValidUTF8(filename, "")
+  }
+
+  // Some clients send the full path of the file, with either separator.
+  filename = filename[strings.LastIndexAny(filename, `/\`)+1:]
+
+  filename = strings.Map(func(r rune) rune {
+    if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+      return -1
+    }
+    return r
+  }, norm.NFC.String(filename))
+
+  return TruncateFilename(strings.TrimSpace(filename), FILENAME_MAX_BYTES)
+}
+
+// Sanitizes the filename of an upload, naming it after DEFAULT_FILENAME when nothing is left of it, so neither
+// its key nor its downloads end up without a name.
+func SanitizeUploadFilename(filename string, contentType string) string {
+  filename = SanitizeFilename(filename)
+  if len(filename) > 0 {
+    return filename
+  }
+
+  mediaType, _, _ := mime.ParseMediaType(contentType)
+  extension, ok := DEFAULT_FILENAME_EXTENSIONS[mediaType]
+  if ok == false {
+    if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+      extension = extensions[0]
+    }
+  }
+
+  // The guess mustn't give the file an extension it couldn't have been uploaded with.
+  if IsBlockedFilename(DEFAULT_FILENAME + extension) {
+    extension = ""
+  }
+  return DEFAULT_FILENAME + extension
+}
+
+// Whether the filename ends with a blocked extension, ignoring case, so "evil.jpg.exe" is blocked by "exe" and
+// "backup.tar.gz" by "tar.gz". The filename is sanitized first, as it would be stored, and trailing dots and
+// spaces, which Windows drops, are ignored.
+func IsBlockedFilename(filename string) bool {
+  filename = strings.ToLower(strings.TrimRight(SanitizeFilename(filename), ". "))
+
+  for _, extension := range BLOCKED_EXTENSIONS {
+    if strings.HasSuffix(filename, "."+extension) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// Returns an ASCII only version of the filename, safe to use in an S3 key.
+func GetKeyFilename(filename string) string {
+  var builder strings.Builder
+
+  for _, r := range norm.NFKD.String(filename) {
+    switch {
+    case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_'):
+      builder.WriteRune(r)
+    case unicode.Is(unicode.Mn, r):
+      // Dropping the accents NFKD split from their letters.
+    default:
+      builder.WriteRune('_')
+    }
+  }
+
+  keyFilename := strings.Trim(builder.String(), "._")
+  if len(keyFilename) == 0 {
+    return "file"
+  }
+
+  return TruncateFilename(keyFilename, KEY_FILENAME_MAX_BYTES)
+}
+
+// Truncates the filename to at most maxBytes without splitting a character, keeping the extension when it's short.
+func TruncateFilename(filename string, maxBytes int) string {
+  if len(filename) <= maxBytes {
+    return filename
+  }
+
+  extension := ""
+  if i := strings.LastIndex(filename, "."); i > 0 && len(filename)-i <= 16 && len(filename)-i < maxBytes {
+    filename, extension = filename[:i], filename[i:]
+  }
+
+  limit := maxBytes - len(extension)
+  for limit > 0 && utf8.RuneStart(filename[limit]) == false {
+    limit--
+  }
+
+  return filename[:limit] + extension
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+  cases := []struct {
+    name     string
+    filename string
+    expected string
+  }{
+    {"Plain", "notes.txt", "notes.txt"},
+    {"Emoji", "😀 party 🎉.png", "😀 party 🎉.png"},
+    {"RightToLeft", "שלום עולם.txt", "שלום עולם.txt"},
+    {"Decomposed", "Cre\u0300me bru\u0302le\u0301e.txt", "Crème brûlée.txt"},
+    {"BidiOverride", "invoice\u202Etxt.exe", "invoicetxt.exe"},
+    {"ControlCharacters", "a\x00b\r\n.txt", "ab.txt"},
+    {"InvalidUTF8", "a\xffb.txt", "ab.txt"},
+    {"WindowsPath", `C:\Users\me\notes.txt`, "notes.txt"},
+    {"UnixPath", "../../etc/passwd", "passwd"},
+    {"Whitespace", "  notes.txt  ", "notes.txt"},
+    {"Long", strings.Repeat("a", 300) + ".txt", strings.Repeat("a", 251) + ".txt"},
+    {"LongEmoji", strings.Repeat("😀", 100) + ".txt", strings.Repeat("😀", 62) + ".txt"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      if sanitized := SanitizeFilename(c.filename); sanitized != c.expected {
+        t.Fatalf("SanitizeFilename(%q) = %q, expected %q.", c.filename, sanitized, c.expected)
+      }
+    })
+  }
+}
+
+func TestTruncateFilename(t *testing.T) {
+  cases := []struct {
+    name     string
+    filename string
+    maxBytes int
+    expected string
+  }{
+    {"Short", "notes.txt", 255, "notes.txt"},
+    {"Exact", "notes.txt", 9, "notes.txt"},
+    {"KeepsExtension", "abcdef.txt", 8, "abcd.txt"},
+    {"DoesNotSplitCharacters", "ééééé", 5, "éé"},
+    {"DoesNotSplitEmoji", "😀😀.txt", 10, "😀.txt"},
+    {"LongExtension", "name." + strings.Repeat("x", 20), 10, "name.xxxxx"},
+    {"ExtensionTooLong", "ab.longext", 6, "ab.lon"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      truncated := TruncateFilename(c.filename, c.maxBytes)
+      if truncated != c.expected {
+        t.Fatalf("TruncateFilename(%q, %d) = %q, expected %q.", c.filename, c.maxBytes, truncated, c.expected)
+      }
+      if len(truncated) > c.maxBytes {
+        t.Fatalf("TruncateFilename(%q, %d) is %d bytes long.", c.filename, c.maxBytes, len(truncated))
+      }
+    })
+  }
+}
+
+func TestGetKeyFilename(t *testing.T) {
+  cases := []struct {
+    name     string
+    filename string
+    expected string
+  }{
+    {"Plain", "notes.txt", "notes.txt"},
+    {"Accents", "Crème brûlée.txt", "Creme_brulee.txt"},
+    {"Emoji", "party 🎉.png", "party__.png"},
+    {"NothingLeft", "😀", "file"},
+    {"Long", strings.Repeat("a", 150) + ".txt", strings.Repeat("a", 96) + ".txt"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      if keyFilename := GetKeyFilename(c.filename); keyFilename != c.expected {
+        t.Fatalf("GetKeyFilename(%q) = %q, expected %q.", c.filename, keyFilename, c.expected)
+      }
+    })
+  }
+}
+
+func TestSanitizeUploadFilename(t *testing.T) {
+  cases := []struct {
+    name        string
+    filename    string
+    contentType string
+    blocked     []string
+    expected    string
+  }{
+    {"Kept", "notes.txt", "image/png", nil, "notes.txt"},
+    {"Empty", "", "image/png", nil, "upload.png"},
+    {"Spaces", "   ", "image/png", nil, "upload.png"},
+    {"EmptyBinary", "", "application/octet-stream", nil, "upload"},
+    {"SpacesBinary", "   ", "application/octet-stream", nil, "upload"},
+    {"ContentTypeParameters", "", "text/plain; charset=utf-8", nil, "upload.txt"},
+    {"UnknownContentType", "", "application/x-unknown", nil, "upload"},
+    {"NothingLeft", "\u202E\x00", "image/jpeg", nil, "upload.jpg"},
+    // A guessed extension that is blocked is dropped rather than giving the file an extension it couldn't be uploaded with.
+    {"BlockedGuess", "", "image/png", []string{"png"}, "upload"},
+    {"BlockedGuessSpaces", "   ", "text/html", []string{"html"}, "upload"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      SetTestSetting(t, &BLOCKED_EXTENSIONS, c.blocked)
+      if sanitized := SanitizeUploadFilename(c.filename, c.contentType); sanitized != c.expected {
+        t.Fatalf("SanitizeUploadFilename(%q, %q) = %q, expected %q.", c.filename, c.contentType, sanitized, c.expected)
+      }
+    })
+  }
+}
+
+func TestUploadSanitizesFilename(t *testing.T) {
+  ResetTestState(t)
+
+  file := UploadTestFile(t, nil, "Cre\u0300me bru\u0302le\u0301e 😀.txt", []byte("Hello, world."))
+  if file.Filename != "Crème brûlée 😀.txt" {
+    t.Fatalf("Stored the filename %q.", file.Filename)
+  }
+  if strings.HasSuffix(file.URL, "-Creme_brulee__.txt") == false {
+    t.Fatalf("Stored the object at %q.", file.URL)
+  }
+}
+
+func TestIsBlockedFilename(t *testing.T) {
+  SetTestSetting(t, &BLOCKED_EXTENSIONS, []string{"exe", "tar.gz"})
+
+  cases := []struct {
+    name     string
+    filename string
+    expected bool
+  }{
+    {"Blocked", "setup.exe", true},
+    {"DoubleExtension", "evil.jpg.exe", true},
+    {"UpperCase", "EVIL.JPG.EXE", true},
+    {"TrailingDots", "evil.jpg.exe. . ", true},
+    {"Path", `C:\Downloads\evil.jpg.exe`, true},
+    {"BidiOverride", "evil\u202Egpj.exe", true},
+    {"MultipartExtension", "backup.tar.gz", true},
+    {"ExtensionInTheMiddle", "evil.exe.jpg", false},
+    {"OnlyASuffix", "notexe", false},
+    {"OtherExtension", "backup.gz", false},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      if blocked := IsBlockedFilename(c.filename); blocked != c.expected {
+        t.Fatalf("IsBlockedFilename(%q) = %v, expected %v.", c.filename, blocked, c.expected)
+      }
+    })
+  }
+}
+
+func TestUploadRejectsBlockedExtension(t *testing.T) {
+  SetTestSetting(t, &BLOCKED_EXTENSIONS, []string{"exe"})
+
+  for _, filename := range []string{"evil.jpg.exe", "evil.jpg.EXE", "evil.jpg.exe."} {
+    t.Run(filename, func(t *testing.T) {
+      ResetTestState(t)
+
+      response := DecodeTestResponse(t, ServeTestRequest(NewTestUploadRequest(t, nil, filename, []byte("MZ"))))
+      if response.StatusCode != http.StatusUnsupportedMediaType || response.ErrorText != "Files with this extension aren't allowed." {
+        t.Fatalf("Got %d %q, expected a 415.", response.StatusCode, response.ErrorText)
+      }
+      if keys, _ := STORAGE.List("", "", 10); len(keys) > 0 {
+        t.Fatalf("Stored %v for a blocked upload.", keys)
+      }
+    })
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "net/http"
+  "net/url"
+
+  "github.com/gorilla/mux"
+)
+
+// Name of the representation uploaded by the client.
+const FormatOriginal = "original"
+
+// Name of a thumbnail representation, for images and video.
+const FormatThumbnail = "thumbnail"
+
+// Another representation of a file, stored alongside the original.
+type StoredFormat struct {
+  Name        string
+  ContentType string
+  Size        int64
+  URL         string
+}
+
+type FileFormat struct {
+  Name        string `json:"name"`
+  ContentType string `json:"content_type"`
+  Size        int64  `json:"size"`
+  URL         string `json:"url"`
+}
+
+type FileFormats struct {
+  Formats []FileFormat `json:"formats"`
+  Views   int          `json:"views"`
+}
+
+// Handlers
+func GetFileFormats(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckFilePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  RecordView(collection, file)
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &FileFormats{ListFileFormats(file), file.Views}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Format Utility Functions.
+
+// Lists the original followed by every stored representation. The URLs point at the download endpoint rather
+// than S3, so listing the formats doesn't hand out a way around consuming the file.
+func ListFileFormats(file *File) []FileFormat {
+  downloadUrl := "/v1/files/" + file.ID.Hex() + "/download"
+
+  formats := []FileFormat{{FormatOriginal, file.ContentType, file.Size, downloadUrl}}
+  for _, format := range file.Formats {
+    formatUrl := downloadUrl + "?" + url.Values{"format": {format.Name}}.Encode()
+    formats = append(formats, FileFormat{format.Name, format.ContentType, format.Size, formatUrl})
+  }
+
+  return formats
+}
+
+func FindStoredFormat(file *File, name string) *StoredFormat {
+  for i := range file.Formats {
+    if file.Formats[i].Name == name {
+      return &file.Formats[i]
+    }
+  }
+
+  return nil
+}
+
+// The representations go with the original, a failure is left to the sweeper.
+func TryDeleteFileFormats(file *File) {
+  for _, format := range file.Formats {
+    TryDeleteFileFromS3(file.Region, format.URL)
+  }
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "image"
+  _ "image/gif"
+  _ "image/jpeg"
+  "image/png"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Processing run in the background once a file has been uploaded, and is available. The file is a copy,
+// changes the hook wants kept have to be written to Mongo.
+type PostUploadHook struct {
+  Name string
+  Run  func(ctx context.Context, file *File) error
+}
+
+// The hooks run after every upload, registered through RegisterPostUploadHook.
+var POST_UPLOAD_HOOKS = []PostUploadHook{}
+
+// Longest a post-upload hook may run, configured through POST_UPLOAD_HOOK_TIMEOUT.
+var POST_UPLOAD_HOOK_TIMEOUT = time.Minute
+
+// Whether thumbnails are made of uploaded images, configured through THUMBNAILS.
+var THUMBNAILS = false
+
+// Longest side of thumbnails, in pixels, configured through THUMBNAIL_MAX_SIDE.
+var THUMBNAIL_MAX_SIDE = 256
+
+// Images larger than this, in bytes or pixels, aren't thumbnailed.
+const THUMBNAIL_MAX_SOURCE_BYTES = 20 << 20
+const THUMBNAIL_MAX_SOURCE_PIXELS = 50000000
+
+// URL notified of every upload, configured through UPLOAD_WEBHOOK_URL. No webhook is sent when unset.
+var UPLOAD_WEBHOOK_URL string
+
+// Loading the post-upload hook configuration and registering the hooks it enables, called once the
+// environment has been loaded.
+func LoadHookSettings(config *Config) {
+  if hookTimeout := config.Getenv("POST_UPLOAD_HOOK_TIMEOUT", &POST_UPLOAD_HOOK_TIMEOUT); len(hookTimeout) > 0 {
+    timeout, err := time.ParseDuration(hookTimeout)
+    if err != nil || timeout <= 0 {
+      log.Fatalf("Invalid POST_UPLOAD_HOOK_TIMEOUT %q.", hookTimeout)
+    }
+    POST_UPLOAD_HOOK_TIMEOUT = timeout
+  }
+
+  if thumbnails := config.Getenv("THUMBNAILS", &THUMBNAILS); len(thumbnails) > 0 {
+    enabled, err := strconv.ParseBool(thumbnails)
+    if err != nil {
+      log.Fatalf("Invalid THUMBNAILS %q.", thumbnails)
+    }
+    THUMBNAILS = enabled
+  }
+
+  if thumbnailMaxSide := config.Getenv("THUMBNAIL_MAX_SIDE", &THUMBNAIL_MAX_SIDE); len(thumbnailMaxSide) > 0 {
+    maxSide, err := strconv.Atoi(thumbnailMaxSide)
+    if err != nil || maxSide <= 0 {
+      log.Fatalf("Invalid THUMBNAIL_MAX_SIDE %q.", thumbnailMaxSide)
+    }
+    THUMBNAIL_MAX_SIDE = maxSide
+  }
+
+  if webhookUrl := config.Getenv("UPLOAD_WEBHOOK_URL", &UPLOAD_WEBHOOK_URL); len(webhookUrl) > 0 {
+    if parsedUrl, err := url.Parse(webhookUrl); err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+      log.Fatalf("Invalid UPLOAD_WEBHOOK_URL %q.", webhookUrl)
+    }
+    UPLOAD_WEBHOOK_URL = webhookUrl
+  }
+
+  if THUMBNAILS {
+    RegisterPostUploadHook("thumbnail", CreateThumbnail)
+  }
+  if len(UPLOAD_WEBHOOK_URL) > 0 {
+    RegisterPostUploadHook("webhook", SendUploadWebhook)
+  }
+}
+
+// Hook Utility Functions.
+
+func RegisterPostUploadHook(name string, run func(ctx context.Context, file *File) error) {
+  POST_UPLOAD_HOOKS = append(POST_UPLOAD_HOOKS, PostUploadHook{name, run})
+}
+
+// Runs every hook on its own, without waiting for them, logging how each one went.
+func RunPostUploadHooks(file *File) {
+  for _, hook := range POST_UPLOAD_HOOKS {
+    fileCopy := *file
+    go RunPostUploadHook(hook, &fileCopy)
+  }
+}
+
+func RunPostUploadHook(hook PostUploadHook, file *File) {
+  ctx, cancel := context.WithTimeout(context.Background(), POST_UPLOAD_HOOK_TIMEOUT)
+  defer cancel()
+
+  start := time.Now()
+  err := func() (err error) {
+    defer func() {
+      if recovered := recover(); recovered != nil {
+        err = fmt.Errorf("%v", recovered)
+      }
+    }()
+    return hook.Run(ctx, file)
+  }()
+
+  if err != nil {
+    log.Printf("Post-upload hook %s failed for file %s: %v", hook.Name, file.ID.Hex(), err)
+    return
+  }
+  log.Printf("Post-upload hook %s succeeded for file %s in %v.", hook.Name, file.ID.Hex(), time.Since(start))
+}
+
+// Stores a PNG thumbnail of uploaded images as their thumbnail format.
+func CreateThumbnail(ctx context.Context, file *File) error {
+  if file.ContentType != "image/png" && file.ContentType != "image/jpeg" && file.ContentType != "image/gif" {
+    return nil
+  }
+  if file.Size > THUMBNAIL_MAX_SOURCE_BYTES || file.Encrypted {
+    return nil
+  }
+
+  storage := GetStorage(file.Region)
+  object, err := storage.Get(storage.Path(file.URL))
+  if err != nil {
+    return err
+  }
+  content, err := ioutil.ReadAll(io.LimitReader(object.Body, THUMBNAIL_MAX_SOURCE_BYTES+1))
+  object.Body.Close()
+  if err != nil {
+    return err
+  }
+
+  // Checking the dimensions before decoding, a small file can claim a huge image.
+  config, _, err := image.DecodeConfig(bytes.NewReader(content))
+  if err != nil {
+    return err
+  }
+  if config.Width*config.Height > THUMBNAIL_MAX_SOURCE_PIXELS {
+    return nil
+  }
+
+  source, _, err := image.Decode(bytes.NewReader(content))
+  if err != nil {
+    return err
+  }
+
+  var thumbnail bytes.Buffer
+  if err = png.Encode(&thumbnail, ScaleImage(source, THUMBNAIL_MAX_SIDE)); err != nil {
+    return err
+  }
+
+  if err = ctx.Err(); err != nil {
+    return err
+  }
+
+  path := storage.Path(file.URL) + ".thumbnail.png"
+  headers := map[string][]string{
+    "Content-Type":        {"image/png"},
+    "x-amz-storage-class": {STORAGE_CLASS},
+    "x-amz-tagging":       {EncodeObjectTags(CreateObjectTags(file))},
+  }
+  if err = storage.Put(path, thumbnail.Bytes(), headers); err != nil {
+    return err
+  }
+
+  session, err := CopyMongoSession()
+  if err != nil {
+    storage.Del(path)
+    return err
+  }
+  defer session.Close()
+
+  // The file was consumed or deleted in the meantime, along with the formats it had then.
+  format := StoredFormat{FormatThumbnail, "image/png", int64(thumbnail.Len()), storage.URL(path)}
+  err = session.DB(DATABASE).C(COLLECTION).Update(bson.M{"_id": file.ID, "accessed": false}, bson.M{"$push": bson.M{"formats": format}})
+  if err == mgo.ErrNotFound {
+    return storage.Del(path)
+  }
+  return err
+}
+
+// Scales the image down so its longest side is at most maxSide, sampling the nearest pixel.
+func ScaleImage(source image.Image, maxSide int) image.Image {
+  bounds := source.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  if width <= maxSide && height <= maxSide {
+    return source
+  }
+
+  targetWidth, targetHeight := maxSide, height*maxSide/width
+  if height > width {
+    targetWidth, targetHeight = width*maxSide/height, maxSide
+  }
+  if targetWidth < 1 {
+    targetWidth = 1
+  }
+  if targetHeight < 1 {
+    targetHeight = 1
+  }
+
+  scaled := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+  for y := 0; y < targetHeight; y++ {
+    for x := 0; x < targetWidth; x++ {
+      scaled.Set(x, y, source.At(bounds.Min.X+x*width/targetWidth, bounds.Min.Y+y*height/targetHeight))
+    }
+  }
+
+  return scaled
+}
+
+// Posts the file, as clients see it, to UPLOAD_WEBHOOK_URL. The management token is only for the uploader.
+func SendUploadWebhook(ctx context.Context, file *File) error {
+  sentFile := *file
+  sentFile.NewManagementToken = ""
+  body, err := json.Marshal(&sentFile)
+  if err != nil {
+    return err
+  }
+
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, UPLOAD_WEBHOOK_URL, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    return fmt.Errorf("the webhook responded with %s", res.Status)
+  }
+  return nil
+}
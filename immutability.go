@@ -0,0 +1,80 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Files uploaded with "immutable_until" are under a hold until then: nobody, admins included, can delete or
+// rotate them, and consuming them leaves their objects in place until the hold has passed. They can still be
+// downloaded, and expire or are consumed as usual.
+
+// Immutability Utility Functions.
+
+func IsFileImmutable(file *File) bool {
+  return file.ImmutableUntil != nil && CLOCK.Now().Before(*file.ImmutableUntil)
+}
+
+// Returns nil unless the file is under a hold, otherwise the response refusing to change it.
+func CheckImmutable(file *File) *Response {
+  if IsFileImmutable(file) == false {
+    return nil
+  }
+
+  return GenerateResponse(http.StatusForbidden, http.StatusText(http.StatusForbidden), false, 0, fmt.Sprintf("This file is under a hold until %s and can't be deleted or changed.", file.ImmutableUntil.UTC().Format(time.RFC3339)))
+}
+
+// Deletes the objects of the file, or schedules their deletion for when its hold has passed.
+func DeleteFileObjects(file *File) {
+  if IsFileImmutable(file) == false {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    TryDeleteFileFormats(file)
+    return
+  }
+
+  QueueDeletion(file.Region, GetStorage(file.Region).Path(file.URL), *file.ImmutableUntil)
+  QueueFormatDeletions(file, *file.ImmutableUntil)
+}
+
+// Deletes the formats of the file, or schedules their deletion for when its hold has passed.
+func DeleteFileFormats(file *File) {
+  if IsFileImmutable(file) == false {
+    TryDeleteFileFormats(file)
+    return
+  }
+
+  QueueFormatDeletions(file, *file.ImmutableUntil)
+}
+
+// Schedules the deletion of the file's formats for the time, or for the end of its hold when that's later.
+func QueueFormatDeletions(file *File, at time.Time) {
+  storage := GetStorage(file.Region)
+  for _, format := range file.Formats {
+    QueueDeletion(file.Region, storage.Path(format.URL), GetObjectDeletionTime(file, at))
+  }
+}
+
+// The later of the time and the end of the file's hold, for deletions scheduled ahead.
+func GetObjectDeletionTime(file *File, at time.Time) time.Time {
+  if file.ImmutableUntil != nil && file.ImmutableUntil.After(at) {
+    return *file.ImmutableUntil
+  }
+  return at
+}
+
+// Matches the files that aren't under a hold, for queries deleting files in bulk.
+func NotImmutableQuery() bson.M {
+  return bson.M{"immutableuntil": bson.M{"$not": bson.M{"$gt": CLOCK.Now()}}}
+}
+
+// Parses an RFC 3339 time in the future, no further than MAX_FORM_DURATION away.
+func ParseTimestampValue(value string) (time.Time, error) {
+  timestamp, err := time.Parse(time.RFC3339, value)
+  if err != nil || timestamp.After(CLOCK.Now()) == false || timestamp.Sub(CLOCK.Now()) > MAX_FORM_DURATION {
+    return time.Time{}, fmt.Errorf("invalid time %q", value)
+  }
+  return timestamp, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestDeleteFileFormatsKeepsHeldFormats(t *testing.T) {
+  ResetTestState(t)
+  clock := &FixedClock{Time: time.Now().Truncate(time.Second)}
+  SetTestSetting[Clock](t, &CLOCK, clock)
+
+  storage := GetStorage("")
+  storage.Put("held/thumbnail.jpg", []byte("thumbnail"), nil)
+  storage.Put("released/thumbnail.jpg", []byte("thumbnail"), nil)
+
+  immutableUntil := clock.Now().Add(time.Hour)
+  held := &File{ImmutableUntil: &immutableUntil, Formats: []StoredFormat{{Name: "thumbnail", URL: storage.URL("held/thumbnail.jpg")}}}
+  released := &File{Formats: []StoredFormat{{Name: "thumbnail", URL: storage.URL("released/thumbnail.jpg")}}}
+  DeleteFileFormats(held)
+  DeleteFileFormats(released)
+
+  if _, err := storage.Stat("held/thumbnail.jpg"); err != nil {
+    t.Fatalf("The format of the held file was deleted. (%v)", err)
+  }
+  if _, err := storage.Stat("released/thumbnail.jpg"); err == nil {
+    t.Fatalf("The format of the file without a hold wasn't deleted.")
+  }
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  deletions := []FailedDeletion{}
+  session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION).Find(nil).All(&deletions)
+  if len(deletions) != 1 || deletions[0].Path != "held/thumbnail.jpg" || deletions[0].NotBefore.Equal(immutableUntil) == false {
+    t.Fatalf("Queued %+v, expected the held format's deletion at the end of its hold.", deletions)
+  }
+
+  // A deletion due before the hold ends waits for it, a later one keeps its time.
+  expiresAt := immutableUntil.Add(time.Hour)
+  if at := GetObjectDeletionTime(held, clock.Now()); at.Equal(immutableUntil) == false {
+    t.Fatalf("Got %v, expected the end of the hold.", at)
+  }
+  if at := GetObjectDeletionTime(held, expiresAt); at.Equal(expiresAt) == false {
+    t.Fatalf("Got %v, expected %v.", at, expiresAt)
+  }
+}
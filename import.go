@@ -0,0 +1,110 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "path"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Most objects looked at per import request.
+const IMPORT_BATCH_MAX = 1000
+
+type ImportSummary struct {
+  Imported int      `json:"imported"`
+  Skipped  int      `json:"skipped"`
+  Failed   []string `json:"failed"`
+  Next     string   `json:"next,omitempty"`
+}
+
+// Handlers
+// Creates a file for every object under the prefix that isn't tracked yet, so an existing bucket can be
+// managed without uploading it again. Imports continue after the path given as "after". Imported objects were
+// already shared, so their files can be downloaded any number of times unless "max_downloads" limits them.
+func ImportFiles(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  prefix := req.FormValue("prefix")
+  if len(prefix) == 0 {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid Form. (prefix: Required.)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  limit := IMPORT_BATCH_MAX
+  if submittedLimit := req.FormValue("limit"); len(submittedLimit) > 0 {
+    var err error
+    limit, err = ParsePositiveInteger(submittedLimit)
+    if err != nil || limit > IMPORT_BATCH_MAX {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid limit. (Expected 1 to %d)", IMPORT_BATCH_MAX))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  maxDownloads := 0
+  if submittedMaxDownloads := req.FormValue("max_downloads"); len(submittedMaxDownloads) > 0 {
+    var err error
+    if maxDownloads, err = ParsePositiveInteger(submittedMaxDownloads); err != nil {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (max_downloads: Must be a positive integer, at most %d.)", MAX_FORM_INTEGER))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  paths, err := STORAGE.List(prefix, req.FormValue("after"), limit)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  summary := &ImportSummary{Failed: []string{}}
+  for _, objectPath := range paths {
+    fileUrl := STORAGE.URL(objectPath)
+
+    count, err := collection.Find(bson.M{"url": fileUrl}).Count()
+    if err != nil {
+      return HandleError(err)
+    }
+    if count > 0 {
+      summary.Skipped++
+      continue
+    }
+
+    object, err := STORAGE.Stat(objectPath)
+    if err != nil {
+      log.Printf("Unable to import %s: %v", objectPath, err)
+      summary.Failed = append(summary.Failed, objectPath)
+      continue
+    }
+
+    contentType := object.ContentType
+    if len(contentType) == 0 {
+      contentType = "application/octet-stream"
+    }
+
+    file := &File{ID: bson.NewObjectId(), URL: fileUrl, Filename: SanitizeFilename(path.Base(objectPath)), ContentType: contentType, Size: object.ContentLength}
+    file.MaxDownloads = maxDownloads
+    file.UnlimitedDownloads = maxDownloads == 0
+    err = collection.Insert(file)
+    if err != nil {
+      return HandleError(err)
+    }
+    summary.Imported++
+  }
+
+  if len(paths) == limit {
+    summary.Next = paths[len(paths)-1]
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = summary
+  WriteResponse(response, w, req)
+  return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Imports the objects under legacy/, returning the ids of the files created.
+func ImportTestFiles(t *testing.T, fields url.Values) []bson.ObjectId {
+  t.Helper()
+
+  req := httptest.NewRequest("POST", "/v1/admin/import", strings.NewReader(fields.Encode()))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+  recorder := ServeTestRequest(req)
+  response := DecodeTestResponse(t, recorder)
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("Import returned %d: %s", response.StatusCode, recorder.Body.String())
+  }
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  files := []File{}
+  if err := session.DB(DATABASE).C(COLLECTION).Find(nil).All(&files); err != nil {
+    t.Fatal(err)
+  }
+
+  ids := []bson.ObjectId{}
+  for _, file := range files {
+    ids = append(ids, file.ID)
+  }
+  return ids
+}
+
+func TestImportedFilesAreNotConsumed(t *testing.T) {
+  cases := []struct {
+    name      string
+    fields    url.Values
+    downloads int
+  }{
+    {"Unlimited", url.Values{"prefix": {"legacy/"}}, 0},
+    {"MaxDownloads", url.Values{"prefix": {"legacy/"}, "max_downloads": {"2"}}, 2},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+      SetTestSetting(t, &ADMIN_TOKEN, "test-admin-token")
+      if err := STORAGE.Put("legacy/notes.txt", []byte("Hello, world."), map[string][]string{"Content-Type": {"text/plain"}}); err != nil {
+        t.Fatal(err)
+      }
+
+      ids := ImportTestFiles(t, c.fields)
+      if len(ids) != 1 {
+        t.Fatalf("Imported %d files, expected 1.", len(ids))
+      }
+
+      // Unlimited files are still there after more accesses than any one-time or limited file allows.
+      accesses := c.downloads
+      if accesses == 0 {
+        accesses = 3
+      }
+      for i := 0; i < accesses; i++ {
+        response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+ids[0].Hex(), nil)))
+        if response.StatusCode != http.StatusOK {
+          t.Fatalf("Access %d returned %d %q.", i+1, response.StatusCode, response.ErrorText)
+        }
+      }
+
+      response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+ids[0].Hex(), nil)))
+      if c.downloads == 0 && response.StatusCode != http.StatusOK {
+        t.Fatalf("Got %d %q, expected the file to stay accessible.", response.StatusCode, response.ErrorText)
+      }
+      if c.downloads > 0 && response.StatusCode != http.StatusGone {
+        t.Fatalf("Got %d %q, expected the file to be consumed after %d downloads.", response.StatusCode, response.ErrorText, c.downloads)
+      }
+    })
+  }
+}
+
+func TestImportRejectsInvalidMaxDownloads(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &ADMIN_TOKEN, "test-admin-token")
+
+  req := httptest.NewRequest("POST", "/v1/admin/import", strings.NewReader("prefix=legacy/&max_downloads=-1"))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+  response := DecodeTestResponse(t, ServeTestRequest(req))
+  if response.StatusCode != http.StatusBadRequest || response.ErrorText != "Invalid Form. (max_downloads: Must be a positive integer, at most 1000000.)" {
+    t.Fatalf("Got %d %q, expected a 400.", response.StatusCode, response.ErrorText)
+  }
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
   "encoding/json"
   "fmt"
+  "io"
   "io/ioutil"
   "log"
+  "mime/multipart"
   "net/http"
   "os"
+  "strconv"
   "strings"
+  "sync"
   "time"
 
-  "github.com/tmilewski/goenv"
-  "github.com/satori/go.uuid"
   "github.com/gorilla/mux"
-  "github.com/mitchellh/goamz/aws"
   "github.com/mitchellh/goamz/s3"
   "golang.org/x/crypto/bcrypt"
   "gopkg.in/mgo.v2"
@@ -24,165 +28,704 @@ import (
 var DATABASE = "ghost-protocol"
 var COLLECTION = "files"
 
+// Whether responses are indented, configured through JSON_PRETTY. Production deployments will want it off.
+var JSON_PRETTY = true
+
+// Whether accessing a file consumes it, configured through ONE_TIME_ACCESS. When off, files without a
+// max_downloads live until they expire, or are deleted.
+var ONE_TIME_ACCESS = true
+
+// Whether a password sent for a file that isn't password protected is rejected rather than ignored,
+// configured through STRICT_PASSWORD, so clients notice when they asked for the wrong file.
+var STRICT_PASSWORD = false
+
+// Largest upload body accepted, in bytes, configured through MAX_UPLOAD_BYTES. Unlimited when 0.
+var MAX_UPLOAD_BYTES int64 = 0
+
+// Go layout of the date prefixing S3 keys, configured through KEY_DATE_FORMAT. Keys have no date prefix when empty.
+var KEY_DATE_FORMAT = "2006-01-02"
+
+// Storage class applied to uploaded objects, configured through S3_STORAGE_CLASS.
+var STORAGE_CLASS = "STANDARD"
+
+// Storage classes accepted for S3_STORAGE_CLASS. The archive classes (GLACIER,
+// DEEP_ARCHIVE) are left out since their objects can't be read back without a restore.
+var STORAGE_CLASSES = []string{"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR"}
+
+// Connections shared across requests, established on first use or by the warm-up.
+var mongoSession *mgo.Session
+var mongoSessionLock sync.Mutex
+var s3Bucket *s3.Bucket
+var s3BucketLock sync.Mutex
+
 type File struct {
-  ID                bson.ObjectId `bson:"_id,omitempty"`
-  Password          []byte        `json:"-"`
-  PasswordProtected bool          `json:"-"`
-  Accessed          bool          `json:"-"`
-  URL               string        `json:"file_url"`
+  ID                  bson.ObjectId     `bson:"_id,omitempty"`
+  Password            []byte            `json:"-"`
+  DeletePassword      []byte            `json:"-"`
+  PasswordProtected   bool              `json:"-"`
+  Accessed            bool              `json:"-"`
+  URL                 string            `json:"file_url"`
+  Slug                string            `json:"slug,omitempty" bson:",omitempty"`
+  Filename            string            `json:"filename"`
+  ContentType         string            `json:"content_type"`
+  Size                int64             `json:"size"`
+  Checksum            string            `json:"checksum,omitempty" bson:",omitempty"`
+  ExpiresAt           *time.Time        `json:"expires_at,omitempty" bson:",omitempty"`
+  ImmutableUntil      *time.Time        `json:"immutable_until,omitempty" bson:",omitempty"`
+  Compressed          bool              `json:"-"`
+  ConsumedAt          *time.Time        `json:"-" bson:",omitempty"`
+  UploadState         string            `json:"upload_state,omitempty" bson:",omitempty"`
+  BytesTransferred    int64             `json:"-" bson:",omitempty"`
+  UploadError         string            `json:"-" bson:",omitempty"`
+  MaxDownloads        int               `json:"-"`
+  UnlimitedDownloads  bool              `json:"-" bson:",omitempty"`
+  DownloadCount       int               `json:"-"`
+  MaxPasswordAttempts int               `json:"-"`
+  PasswordAttempts    int               `json:"-"`
+  Owner               string            `json:"-" bson:",omitempty"`
+  ExpireAfterAccess   time.Duration     `json:"-" bson:",omitempty"`
+  FirstAccessedAt     *time.Time        `json:"-" bson:",omitempty"`
+  ScanState           string            `json:"scan_state,omitempty" bson:",omitempty"`
+  ScannedAt           *time.Time        `json:"-" bson:",omitempty"`
+  Region              string            `json:"region,omitempty" bson:",omitempty"`
+  Metadata            map[string]string `json:"metadata,omitempty" bson:",omitempty"`
+  DeletedAt           *time.Time        `json:"-" bson:",omitempty"`
+  Views               int               `json:"views"`
+  Encrypted           bool              `json:"encrypted,omitempty" bson:",omitempty"`
+  EncryptionSalt      []byte            `json:"-" bson:",omitempty"`
+  EncryptionVerifier  []byte            `json:"-" bson:",omitempty"`
+  Formats             []StoredFormat    `json:"-" bson:",omitempty"`
+  ManagementTokenHash []byte            `json:"-" bson:",omitempty"`
+  GoneReason          string            `json:"-" bson:",omitempty"`
+
+  // Only set on the file as it's created, returned once and never stored.
+  NewManagementToken  string            `json:"management_token,omitempty" bson:"-"`
+
+  // Derived from the password once it's been checked, never stored.
+  encryptionKey       []byte
+}
+
+// Files without an explicit maximum, including those uploaded before it existed, are one-time files. Unless
+// ONE_TIME_ACCESS is off, they expire after access instead or were imported without a maximum, in which case
+// they can be downloaded any number of times, returned as 0.
+func (file *File) GetMaxDownloads() int {
+  if file.MaxDownloads <= 0 {
+    if ONE_TIME_ACCESS == false || file.ExpireAfterAccess > 0 || file.UnlimitedDownloads {
+      return 0
+    }
+    return 1
+  }
+  return file.MaxDownloads
 }
 
+// Returns nil for files that can be downloaded any number of times.
+func (file *File) GetDownloadsRemaining() *int {
+  remaining := 0
+  if file.GetMaxDownloads() == 0 {
+    return nil
+  }
+  if file.Accessed == false && file.DownloadCount < file.GetMaxDownloads() {
+    remaining = file.GetMaxDownloads() - file.DownloadCount
+  }
+  return &remaining
+}
+
+// Adding the computed downloads_remaining to the stored fields, and leaving out the URL of files that aren't
+// released yet.
+func (file File) MarshalJSON() ([]byte, error) {
+  type storedFile File
+  if IsFileReleased(&file) == false {
+    file.URL = ""
+  }
+  return json.Marshal(struct {
+    storedFile
+    DownloadsRemaining *int `json:"downloads_remaining,omitempty"`
+  }{storedFile(file), file.GetDownloadsRemaining()})
+}
+
+// The content of an upload, whether it was submitted in the form or fetched from a source url.
+type Upload struct {
+  Filename        string
+  ContentType     string
+  ContentEncoding string
+  Content         []byte
+  Reader          io.Reader // Set instead of the content for streamed uploads.
+  Tags            map[string]string
+  Prefix          string
+  Region          string
+  Metadata        map[string]string
+}
+
+// How long clients are told to wait before retrying a 429 or 503 that doesn't know any better, configured
+// through RETRY_AFTER.
+var RETRY_AFTER = 30 * time.Second
+
+// Written in place of a response that couldn't be marshaled.
+var MARSHAL_FAILURE_RESPONSE = []byte(`{"success":false,"status_code":500,"status_text":"Internal Server Error","error_code":1000,"error_text":"Something went wrong.","content":null}`)
+
 type Response struct {
   Success    bool        `json:"success"`
   StatusCode int         `json:"status_code"`
   StatusText string      `json:"status_text"`
   ErrorCode  int         `json:"error_code"`
   ErrorText  string      `json:"error_text"`
+  Note       string      `json:"note,omitempty"`
+  Notice     string      `json:"notice,omitempty"`
+  Reason     string      `json:"reason,omitempty"`
   Content    interface{} `json:"content"`
+
+  // How long clients should wait before retrying a 429 or 503, RETRY_AFTER when unset.
+  RetryAfter time.Duration `json:"-"`
 }
 
-// Loading the required environment variables for S3.
-func init() {
-  err := goenv.Load()
-  if err != nil {
-    log.Fatal("The enviroment variable file (.env) is missing.")
-    os.Exit(1)
+// Loading the settings of main.go, called once the environment has been loaded.
+func LoadGeneralSettings(config *Config) {
+  if storageClass := config.Getenv("S3_STORAGE_CLASS", &STORAGE_CLASS); len(storageClass) > 0 {
+    if IsValidStorageClass(storageClass) == false {
+      log.Fatalf("Invalid S3_STORAGE_CLASS %q, expected one of: %s.", storageClass, strings.Join(STORAGE_CLASSES, ", "))
+    }
+    STORAGE_CLASS = storageClass
+  }
+
+  if keyDateFormat, ok := config.LookupEnv("KEY_DATE_FORMAT", &KEY_DATE_FORMAT); ok {
+    KEY_DATE_FORMAT = keyDateFormat
+  }
+
+  if jsonPretty := config.Getenv("JSON_PRETTY", &JSON_PRETTY); len(jsonPretty) > 0 {
+    pretty, err := strconv.ParseBool(jsonPretty)
+    if err != nil {
+      log.Fatalf("Invalid JSON_PRETTY %q.", jsonPretty)
+    }
+    JSON_PRETTY = pretty
+  }
+
+  if oneTimeAccess := config.Getenv("ONE_TIME_ACCESS", &ONE_TIME_ACCESS); len(oneTimeAccess) > 0 {
+    enabled, err := strconv.ParseBool(oneTimeAccess)
+    if err != nil {
+      log.Fatalf("Invalid ONE_TIME_ACCESS %q.", oneTimeAccess)
+    }
+    ONE_TIME_ACCESS = enabled
+  }
+
+  if strictPassword := config.Getenv("STRICT_PASSWORD", &STRICT_PASSWORD); len(strictPassword) > 0 {
+    enabled, err := strconv.ParseBool(strictPassword)
+    if err != nil {
+      log.Fatalf("Invalid STRICT_PASSWORD %q.", strictPassword)
+    }
+    STRICT_PASSWORD = enabled
+  }
+
+  if retryAfter := config.Getenv("RETRY_AFTER", &RETRY_AFTER); len(retryAfter) > 0 {
+    duration, err := time.ParseDuration(retryAfter)
+    if err != nil || duration <= 0 {
+      log.Fatalf("Invalid RETRY_AFTER %q.", retryAfter)
+    }
+    RETRY_AFTER = duration
+  }
+
+  if maxUploadBytes := config.Getenv("MAX_UPLOAD_BYTES", &MAX_UPLOAD_BYTES); len(maxUploadBytes) > 0 {
+    limit, err := strconv.ParseInt(maxUploadBytes, 10, 64)
+    if err != nil || limit < 0 {
+      log.Fatalf("Invalid MAX_UPLOAD_BYTES %q.", maxUploadBytes)
+    }
+    MAX_UPLOAD_BYTES = limit
   }
 }
 
 func main() {
+  // Loading the environment before anything reads it, tests load their own configuration.
+  err := LoadEnvironmentFile(".env")
+  if os.IsNotExist(err) {
+    log.Fatal("The enviroment variable file (.env) is missing.")
+  }
+  if err != nil {
+    log.Fatalf("Invalid .env file. (%v)", err)
+  }
+
+  CONFIG = LoadConfig()
+  CONFIG.Log()
+
+  router := NewRouter()
+
+  // Establishing connections before serving, so the first request doesn't pay for them.
+  if _, err := WarmUp(); err != nil {
+    log.Printf("Warm-up failed, connections will be established on first use: %v", err)
+  }
+
+  go RunSweeper()
+
+  log.Fatal(ListenAndServe(":3000", router))
+}
+
+func NewRouter() *mux.Router {
   router := mux.NewRouter().StrictSlash(true)
-  router.HandleFunc("/v1/files/{id}", GetFile).Methods("GET")
-  router.HandleFunc("/v1/files", UploadFile).Methods("PUT")
-  log.Fatal(http.ListenAndServe(":3000", router))
+  router.Use(RedirectToHTTPS)
+  router.Use(SecurityHeaders)
+  router.Use(SendVersionHeader)
+  router.Use(RecoverErrors)
+  router.Use(WatchBodyReads)
+  router.Use(LimitMultipartHeaders)
+  router.MethodNotAllowedHandler = http.HandlerFunc(MethodNotAllowed)
+  // /v2 shares the handlers of /v1, only writing responses in its own shape.
+  for _, version := range []string{"/v1", "/v2"} {
+    router.HandleFunc(version+"/files/mine", HandleAppErrors(ListOwnedFiles)).Methods("GET")
+    router.HandleFunc(version+"/files/{id}", LimitDownloadRate(ApplyTimingFloor(HandleAppErrors(GetFile)))).Methods("GET")
+    router.HandleFunc(version+"/files/{id}", RequireWritable(HandleAppErrors(DeleteFile))).Methods("DELETE")
+    router.HandleFunc(version+"/files", RequireWritable(LimitConcurrentUploads(HandleAppErrors(UploadFile)))).Methods("PUT", "POST")
+    router.HandleFunc(version+"/files/status", CacheMetadata(HandleAppErrors(GetFileStatuses))).Methods("POST")
+    router.HandleFunc(version+"/files/presign", RequireWritable(HandleAppErrors(PresignUpload))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/finalize", RequireWritable(HandleAppErrors(FinalizeUpload))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/download", LimitDownloadRate(HandleAppErrors(DownloadFile))).Methods("GET")
+    router.HandleFunc(version+"/files/{id}/token", HandleAppErrors(CreateDownloadToken)).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/cdn", LimitDownloadRate(HandleAppErrors(CreateCDNURL))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/rotate", RequireWritable(HandleAppErrors(RotateFile))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/extend", RequireWritable(HandleAppErrors(ExtendFile))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/transfer", RequireWritable(HandleAppErrors(TransferFile))).Methods("POST")
+    router.HandleFunc(version+"/files/{id}/status", CacheMetadata(HandleAppErrors(GetUploadStatus))).Methods("GET")
+    router.HandleFunc(version+"/files/{id}/formats", CacheMetadata(HandleAppErrors(GetFileFormats))).Methods("GET")
+    router.HandleFunc(version+"/files/{id}/events", LimitDownloadRate(ApplyTimingFloor(HandleAppErrors(StreamFileEvents)))).Methods("GET")
+    router.HandleFunc(version+"/version", HandleAppErrors(GetVersion)).Methods("GET")
+    router.HandleFunc(version+"/admin/selftest", RequireAdmin(HandleAppErrors(SelfTest))).Methods("GET")
+    router.HandleFunc(version+"/admin/files", RequireAdmin(HandleAppErrors(ListFiles))).Methods("GET")
+    router.HandleFunc(version+"/admin/files", RequireAdmin(RequireWritable(HandleAppErrors(DeleteFilteredFiles)))).Methods("DELETE")
+    router.HandleFunc(version+"/admin/expiring", RequireAdmin(HandleAppErrors(ListExpiringFiles))).Methods("GET")
+    router.HandleFunc(version+"/admin/read-only", RequireAdmin(HandleAppErrors(SetReadOnlyHandler))).Methods("PUT")
+    router.HandleFunc(version+"/admin/notice", RequireAdmin(HandleAppErrors(SetServiceNoticeHandler))).Methods("PUT")
+    router.HandleFunc(version+"/admin/owners/{owner}", RequireAdmin(RequireWritable(HandleAppErrors(DeleteOwnerFiles)))).Methods("DELETE")
+    router.HandleFunc(version+"/admin/import", RequireAdmin(RequireWritable(HandleAppErrors(ImportFiles)))).Methods("POST")
+    router.HandleFunc(version+"/admin/dead-letters", RequireAdmin(HandleAppErrors(ListDeadLetters))).Methods("GET")
+    router.HandleFunc(version+"/admin/files/{id}/restore", RequireAdmin(RequireWritable(HandleAppErrors(RestoreFile)))).Methods("POST")
+  }
+  router.HandleFunc("/internal/warmup", HandleAppErrors(WarmUpHandler)).Methods("POST")
+  router.HandleFunc("/internal/health", HandleAppErrors(HealthHandler)).Methods("GET")
+
+  if SERVE_UI {
+    router.HandleFunc("/", HandleAppErrors(ServeUploadPage)).Methods("GET")
+  }
+
+  return router
 }
 
 // Handlers
-func UploadFile(w http.ResponseWriter, req *http.Request) {
-  session := InitializeMongoSession()
+func UploadFile(w http.ResponseWriter, req *http.Request) *AppError {
+  // Refusing bodies announced as too large before reading any of them, and cutting off those that turn out to be.
+  if MAX_UPLOAD_BYTES > 0 {
+    if req.ContentLength > MAX_UPLOAD_BYTES {
+      response := GenerateResponse(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge), false, 0, fmt.Sprintf("The upload is too large. (At most %d bytes)", MAX_UPLOAD_BYTES))
+      WriteResponse(response, w, req)
+      return nil
+    }
+    req.Body = http.MaxBytesReader(w, req.Body, MAX_UPLOAD_BYTES)
+  }
+
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
   defer session.Close()
   collection := session.DB(DATABASE).C(COLLECTION)
 
-  // Confirming whether or not the request includes a file.
-  _, _, err := req.FormFile("file")
+  upload := &Upload{}
+  var err error
+
+  if _, ok := AuthenticateAPIKey(req); ok == false {
+    response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "Invalid API key.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if _, err = ResolveRegion(req); err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid X-Region. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Streaming the file part straight to S3 when enabled, after reading the fields sent before it.
+  var multipartReader *multipart.Reader
+  var filePart *multipart.Part
+  if STREAM_UPLOADS && IsMultipartRequest(req) {
+    multipartReader, filePart, err = ReadStreamingForm(req)
+  } else {
+    err = ParseUploadForm(req, 16<<20)
+  }
+
+  // Bodies going over MAX_UPLOAD_BYTES are too large rather than invalid, and stalled ones timed out.
+  if IsBodyTooLargeError(err) || IsBodyReadStalledError(err) {
+    return HandleError(err)
+  }
   if err != nil {
-    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid Form. (Missing file)")
-    WriteResponse(response, w)
-    return
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Rejecting unknown fields and values of the wrong type, reporting every field that failed and why.
+  fieldErrors := ValidateForm(req, UPLOAD_FORM)
+  fieldErrors = append(fieldErrors, ValidatePasswordFields(req)...)
+  fieldErrors = append(fieldErrors, ValidateEncryptionFields(req)...)
+  fieldErrors = append(fieldErrors, ValidateRetentionFields(req)...)
+  if len(fieldErrors) > 0 {
+    WriteResponse(InvalidFormResponse(fieldErrors), w, req)
+    return nil
+  }
+
+  expiresIn, expiresInNote, err := ResolveExpiresIn(req.PostForm.Get("expires_in"))
+  if err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking up front so a taken slug doesn't cost an upload, the unique index settles any race on insert.
+  if slug := req.PostForm.Get("slug"); len(slug) > 0 {
+    count, err := collection.Find(bson.M{"slug": slug}).Count()
+    if err != nil {
+      return HandleError(err)
+    }
+
+    if count > 0 {
+      WriteResponse(SlugTakenResponse(req), w, req)
+      return nil
+    }
+  }
+
+  // Fetching the file from the submitted source url, or confirming whether or not the request includes a file.
+  if sourceUrl := req.PostForm.Get("source_url"); len(sourceUrl) > 0 {
+    // Fetching in the background when asked to, the client follows along through /files/{id}/status.
+    if async, _ := strconv.ParseBool(req.PostForm.Get("async")); async {
+      file := NewFile(req, expiresIn)
+      file.UploadState = UploadStatePending
+
+      err = collection.Insert(file)
+      if mgo.IsDup(err) {
+        WriteResponse(SlugTakenResponse(req), w, req)
+        return nil
+      }
+      if err != nil {
+        return HandleError(err)
+      }
+
+      go FetchRemoteFileInBackground(file, sourceUrl)
+
+      response := GenerateResponse(http.StatusAccepted, http.StatusText(http.StatusAccepted), true, 0, "No Error")
+      response.Note = expiresInNote
+      response.Content = file
+      WriteResponse(response, w, req)
+      return nil
+    }
+
+    upload, err = FetchRemoteFile(sourceUrl, nil)
+    if err != nil {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Unable to fetch source_url. (%v)", err))
+      WriteResponse(response, w, req)
+      return nil
+    }
+  } else if filePart != nil {
+    upload = ReadUploadFromPart(filePart)
+  } else {
+    upload, err = ReadUploadFromForm(req)
+    if err != nil {
+      response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid Form. (Missing file)")
+      WriteResponse(response, w, req)
+      return nil
+    }
+  }
+
+  if IsBlockedFilename(upload.Filename) {
+    response := GenerateResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType), false, 0, "Files with this extension aren't allowed.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Storing the content type detected from the content rather than trusting the claimed one.
+  contentType, mismatched := DetectUploadContentType(upload)
+  if mismatched && STRICT_CONTENT_TYPE {
+    response := GenerateResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType), false, 0, fmt.Sprintf("The content doesn't match its content type. (Claimed %s, detected %s)", upload.ContentType, contentType))
+    WriteResponse(response, w, req)
+    return nil
   }
+  upload.ContentType = contentType
 
-  file := CreateFile(req)
+  file := CreateFile(req, upload, expiresIn)
+
+  // Scanned files are quarantined until the scan, made once the record exists, finds them clean.
+  if AV_SCAN {
+    file.ScanState = ScanStateQuarantined
+  }
+
+  // The file has to be the last part, fields after it would have been missed.
+  if filePart != nil && HasRemainingParts(multipartReader) {
+    DeleteFileFromS3(file.Region, file.URL)
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid Form. (The file must be the last field)")
+    WriteResponse(response, w, req)
+    return nil
+  }
 
   err = collection.Insert(file)
-  ErrorHandler(err)
+  if mgo.IsDup(err) {
+    DeleteFileFromS3(file.Region, file.URL)
+    WriteResponse(SlugTakenResponse(req), w, req)
+    return nil
+  }
+  if err != nil {
+    RollBackUpload(file, err)
+    return HandleError(err)
+  }
+
+  if file.ScanState == ScanStateQuarantined {
+    go ScanFileInBackground(file)
+
+    response := GenerateResponse(http.StatusAccepted, http.StatusText(http.StatusAccepted), true, 0, "No Error")
+    response.Note = expiresInNote
+    response.Content = file
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  RunPostUploadHooks(file)
 
   response := GenerateResponse(http.StatusCreated, http.StatusText(http.StatusCreated), true, 0, "No Error")
+  response.Note = expiresInNote
   response.Content = file
-  WriteResponse(response, w)
+  WriteResponse(response, w, req)
+  return nil
 }
 
-func GetFile(w http.ResponseWriter, req *http.Request) {
-  session := InitializeMongoSession()
+func GetFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
   defer session.Close()
   collection := session.DB(DATABASE).C(COLLECTION)
 
   vars := mux.Vars(req)
   submittedFileId := string(vars["id"])
-  response := &Response{}
 
-  // Confirm whether or not the submitted id is valid.
-  if bson.IsObjectIdHex(submittedFileId) == false {
-    response = GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid ID format.")
-    WriteResponse(response, w)
-    return
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
   }
 
-  file := &File{}
-  fileId := bson.ObjectIdHex(submittedFileId)
-  err := collection.FindId(fileId).One(file)
-
-  // Confirm whether a file with the given id exists.
-  if err != nil {
-    response = GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), true, 0, "No Error.")
-    WriteResponse(response, w)
-    return
+  // Checking the password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckFilePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
   }
 
-  passwordIsCorrect := false
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
 
-  if file.PasswordProtected == true {
-    submittedPassword := []byte(req.FormValue("password"))
-    passwordIsCorrect = IsPasswordCorrect(file.Password, submittedPassword)
+  // The URL of an encrypted file only leads to its encrypted content.
+  if response = CheckEncryptedAccess(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
   }
 
-  // Check whether or not the correct password was given.
-  if (file.PasswordProtected && passwordIsCorrect) || (file.PasswordProtected == false) {
-    // Check whether or not the file has already been accessed.
-    if file.Accessed == true {
-      response = GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error")
-    } else {
-      response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
-      response.Content = file
-      file.Accessed = true
-      DeleteFileFromS3(file.URL)
-      err = collection.UpdateId(fileId, file)
-      ErrorHandler(err)
-    }
+  // Check whether or not the file has already been accessed.
+  if file.Accessed == true {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+  } else if IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+  } else if ClaimFile(collection, file) == false {
+    // Another request accessed the file in the meantime.
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GoneReasonConsumed)
   } else {
-    response = GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "")
+    RecordAccess(collection, file, req, AccessEventGet)
+    response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+    response.Content = file
 
-    // Check whether there was no password provided or the password was incorrect. 
-    if len(req.FormValue("password")) == 0 {
-      response.ErrorText = "This file requires a password in order to be accessed. Please enter the correct password in order to access this file."
-    } else {
-      response.ErrorText = "Incorrect password. Please try again."
+    if file.Accessed == true {
+      DiscardConsumedFile(collection, file)
     }
   }
 
-  WriteResponse(response, w)
-  return
+  WriteResponse(response, w, req)
+  return nil
 }
 
-// S3 Utility Functions.
-func UploadFileToS3(req *http.Request) (fileAbsoluteUrl string) {
-  bucket := GetS3Bucket()
-  req.ParseMultipartForm(16 << 20)
+func DeleteFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
 
-  file, header, err := req.FormFile("file")
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
 
-  content, err := ioutil.ReadAll(file)
-  ErrorHandler(err)
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetDeletePasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckDeletePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckImmutable(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files consumed before soft deletes were enabled have no objects left to keep.
+  if SOFT_DELETE_WINDOW > 0 && (file.Accessed == false || file.DeletedAt != nil) {
+    SoftDeleteFile(collection, file)
+    response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files that have already been accessed were removed from S3 at the time, and pending ones aren't in S3 yet.
+  if file.Accessed == false && len(file.URL) > 0 {
+    DeleteFileFromS3(file.Region, file.URL)
+    TryDeleteFileFormats(file)
+  }
 
-  // Creating the S3 upload path based on: today's date, uuid + filename.
-  now := time.Now().Format("2006-01-02")
-  uuid := uuid.NewV4()
-  path := fmt.Sprintf("%v/%s-%v", now, uuid, header.Filename)
+  err := RemoveFileRecord(collection, file)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  WriteResponse(response, w, req)
+  return nil
+}
 
-  err = bucket.Put(path, content, req.Header.Get("Content-Type"), s3.PublicRead)
+// S3 Utility Functions.
+// Uploading the content, or streaming it from the reader of a streamed upload, returning the stored size.
+func UploadFileToS3(upload *Upload) (fileAbsoluteUrl string, size int64) {
+  storage := GetStorage(upload.Region)
+  path := upload.Prefix + CreateS3Path(upload.Filename)
+
+  headers := map[string][]string{
+    "Content-Type":        {upload.ContentType},
+    "x-amz-acl":           {GetObjectACL(path)},
+    "x-amz-storage-class": {STORAGE_CLASS},
+  }
+  if len(upload.ContentEncoding) > 0 {
+    headers["Content-Encoding"] = []string{upload.ContentEncoding}
+  }
+  if len(upload.Tags) > 0 {
+    headers["x-amz-tagging"] = []string{EncodeObjectTags(upload.Tags)}
+  }
+  for key, value := range upload.Metadata {
+    headers["x-amz-meta-"+key] = []string{value}
+  }
+  var err error
+  if upload.Reader != nil {
+    size, err = storage.PutReader(path, upload.Reader, headers)
+  } else {
+    size, err = int64(len(upload.Content)), storage.Put(path, upload.Content, headers)
+  }
   ErrorHandler(err)
 
-  fileAbsoluteUrl = bucket.URL(path)
+  fileAbsoluteUrl = storage.URL(path)
 
   return
 }
 
-func DeleteFileFromS3(fileAbsoluteUrl string) {
-  bucket := GetS3Bucket()
-  // Stripping the file URL, in order to just get the path relative to the S3 bucket. 
-  fileRelativeUrl := strings.Replace(fileAbsoluteUrl, os.Getenv("AWS_BUCKET_ROOT_PATH"), "", -1)
-  err := bucket.Del(fileRelativeUrl)
+// Creating the S3 upload path based on: today's date (in UTC), uuid + filename.
+func CreateS3Path(filename string) string {
+  uuid := ID_GENERATOR.NewID()
+  if len(KEY_DATE_FORMAT) == 0 {
+    return fmt.Sprintf("%s-%v", uuid, GetKeyFilename(filename))
+  }
+
+  now := CLOCK.Now().UTC().Format(KEY_DATE_FORMAT)
+  return fmt.Sprintf("%v/%s-%v", now, uuid, GetKeyFilename(filename))
+}
+
+func DeleteFileFromS3(region string, fileAbsoluteUrl string) {
+  storage := GetStorage(region)
+  err := storage.Del(storage.Path(fileAbsoluteUrl))
   ErrorHandler(err)
 }
 
+// Deletes the file from S3 without failing the request, queueing the deletion for the sweeper when it fails.
+func TryDeleteFileFromS3(region string, fileAbsoluteUrl string) {
+  storage := GetStorage(region)
+  path := storage.Path(fileAbsoluteUrl)
+
+  err := storage.Del(path)
+  if err != nil {
+    log.Printf("Deleting %s failed, queueing it for the sweeper: %v", path, err)
+    QueueFailedDeletion(region, path, err)
+  }
+}
+
+// Deletes the object of a file whose record couldn't be stored, which nothing would point to otherwise. The
+// failure that called for it is what the client is told about, a failed rollback is only logged.
+func RollBackUpload(file *File, recordErr error) {
+  defer func() {
+    if err := recover(); err != nil {
+      log.Printf("ALERT: Unable to roll back the upload of %s, its object is orphaned: %v", file.URL, err)
+    }
+  }()
+
+  log.Printf("Storing the record of file %s failed, deleting its object: %v", file.ID.Hex(), recordErr)
+  TryDeleteFileFromS3(file.Region, file.URL)
+}
+
+// Stripping the file URL, in order to just get the path relative to the S3 bucket. 
+func GetS3RelativeUrl(fileAbsoluteUrl string) string {
+  return strings.Replace(fileAbsoluteUrl, AWS_BUCKET_ROOT_PATH, "", -1)
+}
+
 func GetS3Bucket() (bucket *s3.Bucket) {
-  auth, err := aws.EnvAuth()
+  bucket, err := LoadS3Bucket()
   ErrorHandler(err)
-
-  client := s3.New(auth, aws.USEast)
-  bucket = client.Bucket(os.Getenv("AWS_STORAGE_BUCKET_NAME"))
   return
 }
 
+// Creating the bucket handle once and reusing it, it's safe for concurrent use. The handle is replaced when the
+// credentials are, temporary ones being renewed before they expire.
+func LoadS3Bucket() (*s3.Bucket, error) {
+  s3BucketLock.Lock()
+  defer s3BucketLock.Unlock()
+
+  auth, err := GetAWSAuth()
+  if err != nil {
+    return nil, err
+  }
+
+  if s3Bucket != nil && s3Bucket.Auth != auth {
+    s3Bucket = s3.New(auth, s3Bucket.Region).Bucket(AWS_STORAGE_BUCKET_NAME)
+  }
+
+  if s3Bucket == nil {
+    region, err := DetectBucketRegion(AWS_STORAGE_BUCKET_NAME)
+    if err != nil {
+      return nil, err
+    }
+
+    client := s3.New(auth, region)
+    s3Bucket = client.Bucket(AWS_STORAGE_BUCKET_NAME)
+    log.Printf("Using bucket %s in %s.", AWS_STORAGE_BUCKET_NAME, region.Name)
+  }
+
+  return s3Bucket, nil
+}
+
+func IsValidStorageClass(storageClass string) bool {
+  for _, validStorageClass := range STORAGE_CLASSES {
+    if storageClass == validStorageClass {
+      return true
+    }
+  }
+
+  return false
+}
+
 // Password Utility Functions.
 func CreatePasswordHash(rawPassword string) (bcryptHashedPassword []byte) {
   password := []byte(rawPassword)
@@ -201,35 +744,474 @@ func IsPasswordCorrect(filePassword []byte, submittedPassword[]byte) bool {
   return true
 }
 
+// Atomically marks the file as accessed, returning false when another request already did.
+func ClaimFile(collection *mgo.Collection, file *File) bool {
+  maxDownloads := file.GetMaxDownloads()
+
+  // Counting the download only while downloads remain, so concurrent requests can't exceed the limit.
+  query := bson.M{"_id": file.ID, "accessed": false, "deletedat": bson.M{"$exists": false}}
+  if maxDownloads > 0 {
+    query["downloadcount"] = bson.M{"$not": bson.M{"$gte": maxDownloads}}
+  }
+  change := mgo.Change{Update: bson.M{"$inc": bson.M{"downloadcount": 1}}, ReturnNew: true}
+  _, err := collection.Find(query).Apply(change, file)
+  if err == mgo.ErrNotFound {
+    return false
+  }
+  ErrorHandler(err)
+
+  // The first download of a file expiring after access starts its grace window.
+  if file.ExpireAfterAccess > 0 && file.FirstAccessedAt == nil {
+    StartAccessWindow(collection, file)
+  }
+
+  // The last download consumes the file.
+  if maxDownloads > 0 && file.DownloadCount >= maxDownloads {
+    consumedAt := CLOCK.Now()
+    err = collection.UpdateId(file.ID, bson.M{"$set": bson.M{"accessed": true, "consumedat": consumedAt}})
+    ErrorHandler(err)
+    file.Accessed = true
+    file.ConsumedAt = &consumedAt
+  }
+
+  return true
+}
+
+// Atomically counts a look at the file's information that didn't download it, updating the file's Views.
+func RecordView(collection *mgo.Collection, file *File) {
+  counted := &File{}
+  change := mgo.Change{Update: bson.M{"$inc": bson.M{"views": 1}}, ReturnNew: true}
+  _, err := collection.FindId(file.ID).Select(bson.M{"views": 1}).Apply(change, counted)
+  if err == mgo.ErrNotFound {
+    return
+  }
+  ErrorHandler(err)
+  file.Views = counted.Views
+}
+
+// Finds the file matching the submitted id, or slug. Returns the response to write instead when there's none.
+func FindFile(collection *mgo.Collection, submittedFileId string) (*File, *Response) {
+  file := &File{}
+  var err error
+
+  // Confirm whether or not the submitted id is valid.
+  if bson.IsObjectIdHex(submittedFileId) {
+    err = collection.FindId(bson.ObjectIdHex(submittedFileId)).One(file)
+  } else if IsValidSlug(submittedFileId) {
+    err = collection.Find(bson.M{"slug": submittedFileId}).One(file)
+  } else {
+    return nil, GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid ID format.")
+  }
+
+  // Soft deleted files are kept for admins to restore, and are gone for anyone else.
+  if err == nil && file.DeletedAt != nil && file.Accessed == false {
+    return nil, GoneResponse(GetGoneReason(file))
+  }
+
+  // Confirm whether a file with the given id exists, or did until it was consumed or deleted.
+  if err != nil {
+    if tombstone := FindTombstone(collection, submittedFileId); tombstone != nil {
+      return nil, GoneResponse(tombstone.GetReason())
+    }
+    return nil, GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), true, 0, "No Error.")
+  }
+
+  return file, nil
+}
+
+// Returns nil when the request may access the file, otherwise the response explaining why it may not.
+func CheckFilePassword(collection *mgo.Collection, file *File, req *http.Request) *Response {
+  if response := CheckDuplicateAccessFields(req); response != nil {
+    return response
+  }
+
+  if file.PasswordProtected == false {
+    if STRICT_PASSWORD && len(req.FormValue("password")) > 0 {
+      return GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "This file is not password protected.")
+    }
+    return nil
+  }
+
+  // Only the password derives the key decrypting an encrypted file, nothing can stand in for it.
+  if file.Encrypted && len(req.FormValue("token")) > 0 {
+    return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This file is encrypted, it can only be accessed with its password.")
+  }
+
+  // The master password opens any file, and every use of it is logged.
+  if file.Encrypted == false && IsMasterPasswordRequest(req) {
+    log.Printf("Master password used to access file %s from %s.", file.ID.Hex(), ClientIP(req))
+    return nil
+  }
+
+  passwordIsCorrect := false
+
+  // A valid download token stands in for the password, once.
+  if submittedToken := req.FormValue("token"); len(submittedToken) > 0 {
+    passwordIsCorrect = RedeemDownloadToken(collection, submittedToken, file.ID)
+  } else if file.Encrypted {
+    passwordIsCorrect = UnlockEncryptedFile(file, req.FormValue("password"))
+  } else {
+    submittedPassword := []byte(req.FormValue("password"))
+    passwordIsCorrect = IsPasswordCorrect(file.Password, submittedPassword)
+  }
+
+  if passwordIsCorrect {
+    return nil
+  }
+
+  // Files with an attempt limit are consumed once too many incorrect passwords were submitted.
+  if file.MaxPasswordAttempts > 0 && len(req.FormValue("password")) > 0 && RecordFailedPasswordAttempt(collection, file) {
+    return SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "Too many incorrect password attempts. This file has been deleted."), GoneReasonDeleted)
+  }
+
+  return GetPasswordRequiredResponse(req)
+}
+
+// The response rejecting the password or token of the request, or its lack of one.
+func GetPasswordRequiredResponse(req *http.Request) *Response {
+  response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "")
+
+  // Check whether there was no password provided or the password was incorrect. 
+  if len(req.FormValue("token")) > 0 {
+    response.ErrorText = "Invalid, expired or already redeemed download token."
+  } else if len(req.FormValue("password")) == 0 {
+    response.ErrorText = "This file requires a password in order to be accessed. Please enter the correct password in order to access this file."
+  } else {
+    response.ErrorText = "Incorrect password. Please try again."
+  }
+
+  return response
+}
+
+// Atomically counts a failed attempt, returning whether it exhausted the file's attempts. Only the
+// attempt reaching the limit deletes the file, so concurrent attempts can't delete it twice.
+func RecordFailedPasswordAttempt(collection *mgo.Collection, file *File) bool {
+  change := mgo.Change{
+    Update:    bson.M{"$inc": bson.M{"passwordattempts": 1}},
+    ReturnNew: true,
+  }
+  _, err := collection.FindId(file.ID).Apply(change, file)
+  ErrorHandler(err)
+
+  if file.PasswordAttempts != file.MaxPasswordAttempts {
+    return file.PasswordAttempts > file.MaxPasswordAttempts
+  }
+
+  if SOFT_DELETE_WINDOW > 0 {
+    SoftDeleteFile(collection, file)
+  } else if file.Accessed == false && len(file.URL) > 0 {
+    DeleteFileObjects(file)
+  }
+
+  err = collection.UpdateId(file.ID, bson.M{"$set": bson.M{"accessed": true, "consumedat": CLOCK.Now(), "gonereason": GoneReasonDeleted}})
+  ErrorHandler(err)
+  file.GoneReason = GoneReasonDeleted
+
+  return true
+}
+
+// Destructive operations require the delete password when one was set, falling back to the view password.
+func CheckDeletePassword(collection *mgo.Collection, file *File, req *http.Request) *Response {
+  if response := CheckDuplicateAccessFields(req); response != nil {
+    return response
+  }
+
+  // The management token returned with the upload stands in for either password.
+  if tokenIsCorrect, response := CheckManagementToken(file, req); tokenIsCorrect || response != nil {
+    return response
+  }
+
+  if len(file.DeletePassword) == 0 {
+    // The master password only grants access, destructive operations need the file's own password.
+    if file.PasswordProtected == true && IsMasterPasswordRequest(req) {
+      return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "The master password can't be used for this operation.")
+    }
+
+    return CheckFilePassword(collection, file, req)
+  }
+
+  submittedPassword := req.FormValue("delete_password")
+  if IsPasswordCorrect(file.DeletePassword, []byte(submittedPassword)) {
+    return nil
+  }
+
+  response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "")
+
+  if len(submittedPassword) == 0 {
+    response.ErrorText = "This operation requires the file's delete password."
+  } else {
+    response.ErrorText = "Incorrect delete password. Please try again."
+  }
+
+  return response
+}
+
+// The response rejecting the delete password or management token of the request, or the password or token
+// standing in for them.
+func GetDeletePasswordRequiredResponse(req *http.Request) *Response {
+  if len(req.Header.Get(MANAGEMENT_TOKEN_HEADER)) > 0 {
+    return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "Incorrect management token.")
+  }
+  if len(req.FormValue("delete_password")) > 0 {
+    return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "Incorrect delete password. Please try again.")
+  }
+  return GetPasswordRequiredResponse(req)
+}
+
+// Rejecting a password or token given more than once, rather than silently checking only the first.
+func CheckDuplicateAccessFields(req *http.Request) *Response {
+  if name := FindDuplicateField(req, ACCESS_FIELDS); len(name) > 0 {
+    return GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%s: Must only be given once.)", name))
+  }
+
+  return nil
+}
+
 // Mongo Utility Functions.
 func InitializeMongoSession() (session *mgo.Session) {
-  session, err := mgo.Dial("127.0.0.1")
+  session, err := CopyMongoSession()
   ErrorHandler(err)
   return
 }
 
+// Copying the Mongo session for a handler, which returns the AppError rather than bailing out.
+func OpenMongoSession() (*mgo.Session, *AppError) {
+  session, err := CopyMongoSession()
+  if err != nil {
+    return nil, HandleError(err)
+  }
+  return session, nil
+}
+
+// Dialing Mongo once and handing out copies of that session, which share its connection pool.
+func CopyMongoSession() (*mgo.Session, error) {
+  probe, err := MONGO_BREAKER.Allow()
+  if err != nil {
+    return nil, err
+  }
+
+  mongoSessionLock.Lock()
+  defer mongoSessionLock.Unlock()
+
+  if mongoSession == nil {
+    session, err := mgo.Dial(MONGO_URL)
+    MONGO_BREAKER.Record(err)
+    if err != nil {
+      return nil, err
+    }
+    mongoSession = session
+    // Creating the indexes on the primary, before reads may be sent elsewhere.
+    EnsureIndexes(mongoSession)
+    ApplyMongoSettings(mongoSession)
+    return mongoSession.Copy(), nil
+  }
+
+  // Queries don't report back to the breaker, so probing takes a ping.
+  session := mongoSession.Copy()
+  if probe {
+    err = session.Ping()
+    MONGO_BREAKER.Record(err)
+    if err != nil {
+      session.Close()
+      return nil, err
+    }
+  }
+
+  return session, nil
+}
+
+func EnsureIndexes(session *mgo.Session) {
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  // Slugs are unique among the files that have one.
+  err := collection.EnsureIndex(mgo.Index{Key: []string{"slug"}, Unique: true, Sparse: true})
+  if err != nil {
+    log.Printf("Unable to create the slug index: %v", err)
+  }
+
+  // Telling which objects are already tracked when importing.
+  err = collection.EnsureIndex(mgo.Index{Key: []string{"url"}})
+  if err != nil {
+    log.Printf("Unable to create the url index: %v", err)
+  }
+
+  // Listing the files expiring soonest.
+  err = collection.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, Sparse: true})
+  if err != nil {
+    log.Printf("Unable to create the expiry index: %v", err)
+  }
+
+  // Listing a tenant's files in upload order.
+  err = collection.EnsureIndex(mgo.Index{Key: []string{"owner", "_id"}, Sparse: true})
+  if err != nil {
+    log.Printf("Unable to create the owner index: %v", err)
+  }
+
+  EnsureTombstoneIndexes(session)
+  EnsureAccessLogIndexes(session)
+  EnsureDownloadTokenIndexes(session)
+}
+
 // Miscellaneous Utility Functions.
-func CreateFile(req *http.Request) *File {
+func ReadUploadFromForm(req *http.Request) (*Upload, error) {
+  file, header, err := req.FormFile("file")
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  content, err := ioutil.ReadAll(file)
+  if err != nil {
+    return nil, err
+  }
+
+  // Using the content type of the file part, the request's own content type is the multipart form's.
+  contentType := header.Header.Get("Content-Type")
+  if len(contentType) == 0 {
+    contentType = "application/octet-stream"
+  }
+
+  return &Upload{Filename: header.Filename, ContentType: contentType, Content: content}, nil
+}
+
+func CreateFile(req *http.Request, upload *Upload, expiresIn time.Duration) *File {
+  file := NewFile(req, expiresIn)
+  StoreUpload(file, upload)
+  return file
+}
+
+// Creating the file's record from the form, without any content yet.
+func NewFile(req *http.Request, expiresIn time.Duration) *File {
   file := &File{}
   file.ID = bson.NewObjectId()
-  submittedPassword := req.FormValue("password")
+  file.Owner, _ = AuthenticateAPIKey(req)
+  file.Region, _ = ResolveRegion(req)
+
+  if metadata := ReadFormMetadata(req); len(metadata) > 0 {
+    file.Metadata = metadata
+  }
+
+  if expiresIn > 0 {
+    expiresAt := CLOCK.Now().Add(expiresIn)
+    file.ExpiresAt = &expiresAt
+  }
+  submittedPassword := req.PostForm.Get("password")
 
-  if len(submittedPassword) > 0 {
+  // Encrypted files keep no hash of their password, only what tells whether it's right.
+  if encrypt, _ := strconv.ParseBool(req.PostForm.Get("encrypt")); encrypt {
+    EnableFileEncryption(file, submittedPassword)
+  } else if len(submittedPassword) > 0 {
     password := CreatePasswordHash(submittedPassword)
 
     file.Password = password
     file.PasswordProtected = true
   }
 
-  fileAbsoluteUrl := UploadFileToS3(req)
-  file.URL = fileAbsoluteUrl
+  // Clients hashing the password themselves send the bcrypt hash, already validated, which is stored as is.
+  if submittedPasswordHash := req.PostForm.Get("password_hash"); len(submittedPasswordHash) > 0 {
+    file.Password = []byte(submittedPasswordHash)
+    file.PasswordProtected = true
+  }
+
+  // The checksum the client expects, which the stored content is checked against.
+  file.Checksum = strings.ToLower(req.PostForm.Get("checksum"))
+
+  file.Slug = req.PostForm.Get("slug")
+  file.MaxDownloads, _ = ParsePositiveInteger(req.PostForm.Get("max_downloads"))
+  file.MaxPasswordAttempts, _ = ParsePositiveInteger(req.PostForm.Get("max_password_attempts"))
+  file.ExpireAfterAccess, _ = ParseDurationValue(req.PostForm.Get("expire_after_access"))
+
+  if immutableUntil, err := ParseTimestampValue(req.PostForm.Get("immutable_until")); err == nil {
+    file.ImmutableUntil = &immutableUntil
+  }
+
+  if submittedDeletePassword := req.PostForm.Get("delete_password"); len(submittedDeletePassword) > 0 {
+    file.DeletePassword = CreatePasswordHash(submittedDeletePassword)
+  }
+
+  IssueManagementToken(file)
 
   return file
 }
 
+// Uploading the content to S3 and filling in what the file's record knows about it.
+func StoreUpload(file *File, upload *Upload) {
+  upload.Filename = SanitizeUploadFilename(upload.Filename, upload.ContentType)
+  file.Filename = upload.Filename
+  file.ContentType = upload.ContentType
+  file.Size = int64(len(upload.Content))
+
+  // Checksumming the original content, before it's compressed or encrypted.
+  hash := sha256.New()
+  if upload.Reader != nil {
+    upload.Reader = io.TeeReader(upload.Reader, hash)
+  } else {
+    hash.Write(upload.Content)
+  }
+
+  // Compressing the content at rest when it's worth it, the size above remains the original one. Streamed
+  // content isn't compressed, that takes having all of it up front, and neither is encrypted content.
+  if COMPRESS_UPLOADS && upload.Reader == nil && file.Encrypted == false && IsCompressibleContentType(upload.ContentType) {
+    if compressedContent, ok := GzipContent(upload.Content); ok {
+      upload.Content = compressedContent
+      upload.ContentEncoding = "gzip"
+      file.Compressed = true
+    }
+  }
+
+  upload.Tags = CreateObjectTags(file)
+  upload.Prefix = GetUploadPrefix(file.Owner)
+  upload.Region = file.Region
+  upload.Metadata = file.Metadata
+
+  // Encrypting on the way to S3, the size stored remains the original one.
+  var encryptingReader *EncryptingReader
+  if file.Encrypted {
+    if upload.Reader != nil {
+      encryptingReader = NewEncryptingReader(upload.Reader, file.encryptionKey)
+      upload.Reader = encryptingReader
+    } else {
+      content, err := ioutil.ReadAll(NewEncryptingReader(bytes.NewReader(upload.Content), file.encryptionKey))
+      ErrorHandler(err)
+      upload.Content = content
+    }
+  }
+
+  fileAbsoluteUrl, size := UploadFileToS3(upload)
+  file.URL = fileAbsoluteUrl
+
+  if encryptingReader != nil {
+    file.Size = encryptingReader.PlaintextSize
+  } else if upload.Reader != nil {
+    file.Size = size
+  }
+
+  // Content that isn't what the client sent isn't kept.
+  checksum := hex.EncodeToString(hash.Sum(nil))
+  if len(file.Checksum) > 0 && file.Checksum != checksum {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    ErrorHandler(fmt.Errorf("%w, expected %s but got %s", ErrChecksumMismatch, file.Checksum, checksum))
+  }
+  file.Checksum = checksum
+}
+
+// Turning an unexpected error into the AppError a handler returns, nil if there was no error.
+func HandleError(err error) *AppError {
+  if err == nil {
+    return nil
+  }
+
+  // Storage errors were recorded by the storage's own breaker already.
+  if IsDatabaseOutageError(err) {
+    MONGO_BREAKER.Record(err)
+  }
+  return AsAppError(err)
+}
+
+// Bailing out of a helper that can't return the error, which RecoverErrors renders as an AppError.
 func ErrorHandler(err error) {
-  if err != nil {
-    panic(err)
+  if appError := HandleError(err); appError != nil {
+    panic(appError)
   }
 }
 
@@ -240,13 +1222,62 @@ func GenerateResponse(statusCode int, statusText string, success bool, errorCode
   response.Success = success
   response.ErrorCode = errorCode
   response.ErrorText = errorText
+  response.Notice = GetServiceNotice()
   return response
 }
 
-func WriteResponse(response *Response, w http.ResponseWriter) {
-  res, err := json.MarshalIndent(response, "", "  ")
-  ErrorHandler(err)
+func WriteResponse(response *Response, w http.ResponseWriter, req *http.Request) {
+  // Telling clients throttled or turned away how long to back off, in whole seconds rounded up.
+  if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+    retryAfter := response.RetryAfter
+    if retryAfter <= 0 {
+      retryAfter = RETRY_AFTER
+    }
+    w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+  }
+
+  // Browsers get a page rather than the JSON envelope for the errors a recipient may run into.
+  if AcceptsHTML(req) && WriteErrorPage(response, w) {
+    return
+  }
+
+  // Indenting the response unless turned off, per request through ?pretty or globally through JSON_PRETTY.
+  pretty := JSON_PRETTY
+  if submittedPretty, err := strconv.ParseBool(req.URL.Query().Get("pretty")); err == nil {
+    pretty = submittedPretty
+  }
+
+  var body interface{} = response
+  if IsV2Request(req) {
+    body = NewV2Response(response)
+  }
+
+  var res []byte
+  var err error
+  if pretty {
+    res, err = json.MarshalIndent(body, "", "  ")
+  } else {
+    res, err = json.Marshal(body)
+  }
+
+  // Content that can't be marshaled gets a fixed envelope, rather than a panic in the middle of the response.
+  if err != nil {
+    log.Printf("%s %s failed to marshal its response: %v", req.Method, req.URL.Path, err)
+    res = MARSHAL_FAILURE_RESPONSE
+    if IsV2Request(req) {
+      res = V2_MARSHAL_FAILURE_RESPONSE
+      response = GenerateResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), false, 1000, "Something went wrong.")
+    }
+  }
+
+  if len(RESPONSE_SIGNING_KEY) > 0 {
+    w.Header().Set("X-Signature", SignResponseBody(res))
+  }
 
   w.Header().Set("Content-Type", "application/json")
+  // /v1 always answers 200, its status code being in the envelope.
+  if IsV2Request(req) {
+    w.WriteHeader(response.StatusCode)
+  }
   w.Write(res)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "log"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// The fake Mongo the tests run against, unless TEST_MONGO_URL names a test instance to use instead, whose
+// DATABASE is dropped between tests.
+var testMongo *FakeMongo
+
+var testRouter http.Handler
+
+func TestMain(m *testing.M) {
+  mongoUrl := os.Getenv("TEST_MONGO_URL")
+  if len(mongoUrl) == 0 {
+    var err error
+    testMongo, err = StartFakeMongo()
+    if err != nil {
+      log.Fatalf("Unable to start the fake Mongo: %v", err)
+    }
+    mongoUrl = testMongo.Address()
+  }
+
+  os.Setenv("STORAGE_BACKEND", "memory")
+  os.Setenv("MONGO_URL", mongoUrl)
+  os.Setenv("TOKEN_SECRET", "test-token-secret")
+  DATABASE = "goupload-test"
+  CONFIG = LoadConfig()
+  testRouter = NewRouter()
+
+  code := m.Run()
+  if testMongo != nil {
+    testMongo.Close()
+  }
+  os.Exit(code)
+}
+
+// Test Utility Functions.
+
+// Starts the test from empty storage and an empty database.
+func ResetTestState(t *testing.T) {
+  t.Helper()
+
+  STORAGE = NewMemoryStorage()
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  if err := session.DB(DATABASE).DropDatabase(); err != nil {
+    t.Fatalf("Unable to drop the test database: %v", err)
+  }
+  EnsureIndexes(session)
+}
+
+// Sets a setting for the length of the test.
+func SetTestSetting[T any](t *testing.T, setting *T, value T) {
+  t.Helper()
+
+  previous := *setting
+  *setting = value
+  t.Cleanup(func() { *setting = previous })
+}
+
+// Serves the request through every route and middleware. /v1 answers 200 with the status in the envelope.
+func ServeTestRequest(req *http.Request) *httptest.ResponseRecorder {
+  recorder := httptest.NewRecorder()
+  testRouter.ServeHTTP(recorder, req)
+  return recorder
+}
+
+// A multipart upload of the fields, and of a "file" part unless the filename is empty.
+func NewTestUploadRequest(t *testing.T, fields [][2]string, filename string, content []byte) *http.Request {
+  t.Helper()
+
+  body := &bytes.Buffer{}
+  writer := multipart.NewWriter(body)
+  for _, field := range fields {
+    if err := writer.WriteField(field[0], field[1]); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if len(filename) > 0 {
+    part, err := writer.CreateFormFile("file", filename)
+    if err != nil {
+      t.Fatal(err)
+    }
+    part.Write(content)
+  }
+  writer.Close()
+
+  req := httptest.NewRequest("PUT", "/v1/files", body)
+  req.Header.Set("Content-Type", writer.FormDataContentType())
+  return req
+}
+
+type TestResponse struct {
+  Response
+  Content json.RawMessage `json:"content"`
+}
+
+type TestFile struct {
+  ID       bson.ObjectId `json:"ID"`
+  URL      string        `json:"file_url"`
+  Filename string        `json:"filename"`
+
+  ManagementToken string `json:"management_token"`
+}
+
+func DecodeTestResponse(t *testing.T, recorder *httptest.ResponseRecorder) *TestResponse {
+  t.Helper()
+
+  response := &TestResponse{}
+  if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+    t.Fatalf("Unable to decode the response %q: %v", recorder.Body.String(), err)
+  }
+  return response
+}
+
+// Uploads the content, failing the test unless the file is created.
+func UploadTestFile(t *testing.T, fields [][2]string, filename string, content []byte) *TestFile {
+  t.Helper()
+
+  recorder := ServeTestRequest(NewTestUploadRequest(t, fields, filename, content))
+  response := DecodeTestResponse(t, recorder)
+  if response.StatusCode != http.StatusCreated {
+    t.Fatalf("Upload returned %d: %s", response.StatusCode, recorder.Body.String())
+  }
+
+  file := &TestFile{}
+  if err := json.Unmarshal(response.Content, file); err != nil {
+    t.Fatal(err)
+  }
+  return file
+}
+
+// Tests
+func TestUploadFile(t *testing.T) {
+  cases := []struct {
+    name      string
+    fields    [][2]string
+    filename  string
+    status    int
+    errorText string
+  }{
+    {"HappyPath", [][2]string{{"password", "secret"}}, "notes.txt", http.StatusCreated, "No Error"},
+    {"WithoutPassword", nil, "notes.txt", http.StatusCreated, "No Error"},
+    {"MissingFile", [][2]string{{"password", "secret"}}, "", http.StatusBadRequest, "Invalid Form. (Missing file)"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+
+      recorder := ServeTestRequest(NewTestUploadRequest(t, c.fields, c.filename, []byte("Hello, world.")))
+      response := DecodeTestResponse(t, recorder)
+      if response.StatusCode != c.status || response.ErrorText != c.errorText {
+        t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+      }
+      if c.status != http.StatusCreated {
+        return
+      }
+
+      file := &TestFile{}
+      if err := json.Unmarshal(response.Content, file); err != nil {
+        t.Fatal(err)
+      }
+      if file.ID.Valid() == false || file.Filename != c.filename {
+        t.Fatalf("Unexpected file %+v.", file)
+      }
+
+      object, err := GetStorage("").Get(GetStorage("").Path(file.URL))
+      if err != nil {
+        t.Fatalf("The object wasn't stored: %v", err)
+      }
+      defer object.Body.Close()
+    })
+  }
+}
+
+func TestGetFile(t *testing.T) {
+  cases := []struct {
+    name      string
+    path      func(file *TestFile) string
+    prepare   func(t *testing.T, file *TestFile)
+    status    int
+    errorText string
+  }{
+    {
+      name:      "HappyPath",
+      path:      func(file *TestFile) string { return "/v1/files/" + file.ID.Hex() + "?password=secret" },
+      status:    http.StatusOK,
+      errorText: "No Error.",
+    },
+    {
+      name:      "InvalidID",
+      path:      func(file *TestFile) string { return "/v1/files/not*an*id?password=secret" },
+      status:    http.StatusBadRequest,
+      errorText: "Invalid ID format.",
+    },
+    {
+      name:      "UnknownID",
+      path:      func(file *TestFile) string { return "/v1/files/" + bson.NewObjectId().Hex() + "?password=secret" },
+      status:    http.StatusNotFound,
+      errorText: "No Error.",
+    },
+    {
+      name:      "MissingPassword",
+      path:      func(file *TestFile) string { return "/v1/files/" + file.ID.Hex() },
+      status:    http.StatusUnauthorized,
+      errorText: "This file requires a password in order to be accessed. Please enter the correct password in order to access this file.",
+    },
+    {
+      name:      "WrongPassword",
+      path:      func(file *TestFile) string { return "/v1/files/" + file.ID.Hex() + "?password=guess" },
+      status:    http.StatusUnauthorized,
+      errorText: "Incorrect password. Please try again.",
+    },
+    {
+      name: "AlreadyAccessed",
+      path: func(file *TestFile) string { return "/v1/files/" + file.ID.Hex() + "?password=secret" },
+      prepare: func(t *testing.T, file *TestFile) {
+        recorder := ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex()+"?password=secret", nil))
+        if response := DecodeTestResponse(t, recorder); response.StatusCode != http.StatusOK {
+          t.Fatalf("First access returned %d: %s", response.StatusCode, recorder.Body.String())
+        }
+      },
+      status:    http.StatusGone,
+      errorText: "No Error",
+    },
+    {
+      name: "Expired",
+      path: func(file *TestFile) string { return "/v1/files/" + file.ID.Hex() + "?password=secret" },
+      prepare: func(t *testing.T, file *TestFile) {
+        session := InitializeMongoSession()
+        defer session.Close()
+        err := session.DB(DATABASE).C(COLLECTION).UpdateId(file.ID, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+        if err != nil {
+          t.Fatal(err)
+        }
+      },
+      status:    http.StatusGone,
+      errorText: "This file has expired.",
+    },
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+
+      file := UploadTestFile(t, [][2]string{{"password", "secret"}, {"expires_in", "1h"}}, "notes.txt", []byte("Hello, world."))
+      if c.prepare != nil {
+        c.prepare(t, file)
+      }
+
+      recorder := ServeTestRequest(httptest.NewRequest("GET", c.path(file), nil))
+      response := DecodeTestResponse(t, recorder)
+      if response.StatusCode != c.status || response.ErrorText != c.errorText {
+        t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+      }
+      if c.status != http.StatusOK {
+        return
+      }
+
+      accessed := &TestFile{}
+      if err := json.Unmarshal(response.Content, accessed); err != nil {
+        t.Fatal(err)
+      }
+      if accessed.ID != file.ID || accessed.URL != file.URL {
+        t.Fatalf("Got file %+v, expected %+v.", accessed, file)
+      }
+    })
+  }
+}
+
+func TestCreateS3PathDatesKeysInUTC(t *testing.T) {
+  // Just past midnight east of UTC, still the previous day in UTC.
+  zone := time.FixedZone("UTC+5", 5*60*60)
+  SetTestSetting(t, &time.Local, zone)
+  SetTestSetting[Clock](t, &CLOCK, &FixedClock{Time: time.Date(2026, 1, 1, 1, 30, 0, 0, zone)})
+  SetTestSetting[IDGenerator](t, &ID_GENERATOR, &SequenceIDGenerator{Prefix: "id-"})
+
+  cases := []struct {
+    name          string
+    keyDateFormat string
+    expected      string
+  }{
+    {"DefaultFormat", "2006-01-02", "2025-12-31/id-1-notes.txt"},
+    {"CustomFormat", "2006/01", "2025/12/id-2-notes.txt"},
+    {"NoDate", "", "id-3-notes.txt"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      SetTestSetting(t, &KEY_DATE_FORMAT, c.keyDateFormat)
+
+      if path := CreateS3Path("notes.txt"); path != c.expected {
+        t.Fatalf("CreateS3Path returned %q, expected %q.", path, c.expected)
+      }
+    })
+  }
+}
+
+func TestUploadStoresPinnedKey(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting[Clock](t, &CLOCK, &FixedClock{Time: time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)})
+  SetTestSetting[IDGenerator](t, &ID_GENERATOR, &SequenceIDGenerator{Prefix: "id-"})
+
+  file := UploadTestFile(t, nil, "notes.txt", []byte("Hello, world."))
+  if expected := GetStorage("").URL("2026-03-14/id-1-notes.txt"); file.URL != expected {
+    t.Fatalf("Stored the object at %q, expected %q.", file.URL, expected)
+  }
+  if keys, _ := STORAGE.List("", "", 10); len(keys) != 1 || keys[0] != "2026-03-14/id-1-notes.txt" {
+    t.Fatalf("Stored the keys %v.", keys)
+  }
+}
+
+func TestFileExpiresWithClock(t *testing.T) {
+  ResetTestState(t)
+  clock := &FixedClock{Time: time.Now()}
+  SetTestSetting[Clock](t, &CLOCK, clock)
+  SetTestSetting(t, &ONE_TIME_ACCESS, false)
+
+  file := UploadTestFile(t, [][2]string{{"expires_in", "1h"}}, "notes.txt", []byte("Hello, world."))
+
+  clock.Advance(59 * time.Minute)
+  if response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex(), nil))); response.StatusCode != http.StatusOK {
+    t.Fatalf("Got %d %q before the file expired.", response.StatusCode, response.ErrorText)
+  }
+
+  clock.Advance(2 * time.Minute)
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex(), nil)))
+  if response.StatusCode != http.StatusGone || response.ErrorText != "This file has expired." {
+    t.Fatalf("Got %d %q, expected the file to have expired.", response.StatusCode, response.ErrorText)
+  }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync/atomic"
+)
+
+// Whether uploads and other changes to files are refused, configured through READ_ONLY and toggled
+// through /admin/read-only. Downloads keep being served.
+var readOnly int32
+
+// Notice included in every response, configured through SERVICE_NOTICE and set through /admin/notice.
+var serviceNotice atomic.Value
+
+type ServiceNotice struct {
+  Notice string `json:"notice"`
+}
+
+type ReadOnlyStatus struct {
+  ReadOnly bool `json:"read_only"`
+}
+
+// Loading the maintenance configuration, called once the environment has been loaded.
+func LoadMaintenanceSettings(config *Config) {
+  if readOnlySetting := config.Getenv("READ_ONLY", IsReadOnly); len(readOnlySetting) > 0 {
+    enabled, err := strconv.ParseBool(readOnlySetting)
+    if err != nil {
+      log.Fatalf("Invalid READ_ONLY %q.", readOnlySetting)
+    }
+    SetReadOnly(enabled)
+  }
+
+  serviceNotice.Store(config.Getenv("SERVICE_NOTICE", GetServiceNotice))
+}
+
+// Handlers
+func SetReadOnlyHandler(w http.ResponseWriter, req *http.Request) *AppError {
+  enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+  if err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid Form. (enabled: Must be true or false.)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  SetReadOnly(enabled)
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &ReadOnlyStatus{IsReadOnly()}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Setting the notice shown to clients, or clearing it with an empty one.
+func SetServiceNoticeHandler(w http.ResponseWriter, req *http.Request) *AppError {
+  notice := strings.TrimSpace(req.FormValue("notice"))
+  serviceNotice.Store(notice)
+
+  if len(notice) > 0 {
+    log.Printf("Service notice set: %s", notice)
+  } else {
+    log.Println("Service notice cleared.")
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &ServiceNotice{notice}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Middleware
+func RequireWritable(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if IsReadOnly() {
+      response := GenerateResponse(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), false, 0, "Uploads and changes to files are temporarily disabled for maintenance. Downloads are still available.")
+      WriteResponse(response, w, req)
+      return
+    }
+
+    next(w, req)
+  }
+}
+
+// Maintenance Utility Functions.
+func IsReadOnly() bool {
+  return atomic.LoadInt32(&readOnly) == 1
+}
+
+func GetServiceNotice() string {
+  notice, _ := serviceNotice.Load().(string)
+  return notice
+}
+
+// Switches the read-only mode, logging when it's entered or exited.
+func SetReadOnly(enabled bool) {
+  value := int32(0)
+  if enabled {
+    value = 1
+  }
+
+  if atomic.SwapInt32(&readOnly, value) == value {
+    return
+  }
+
+  if enabled {
+    log.Println("Entered read-only mode, uploads and changes to files are disabled.")
+  } else {
+    log.Println("Exited read-only mode, uploads and changes to files are enabled.")
+  }
+}
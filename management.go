@@ -0,0 +1,51 @@
+package main
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "net/http"
+)
+
+// Header carrying the management token returned with an upload, which stands in for the delete password of the
+// file to delete, extend or rotate it, so uploaders without an API key keep control over their uploads. Transfers
+// need the owner's API key and the password itself.
+const MANAGEMENT_TOKEN_HEADER = "X-Management-Token"
+
+// Random bytes in a management token, hex encoded.
+const MANAGEMENT_TOKEN_SIZE = 32
+
+// Management Token Utility Functions.
+
+// Issues the file's management token, only returned in the response creating the file. The token is random
+// enough for a plain SHA-256 of it, rather than a bcrypt hash, to be all that's stored.
+func IssueManagementToken(file *File) {
+  token := make([]byte, MANAGEMENT_TOKEN_SIZE)
+  _, err := rand.Read(token)
+  ErrorHandler(err)
+
+  file.NewManagementToken = hex.EncodeToString(token)
+  file.ManagementTokenHash = HashManagementToken(file.NewManagementToken)
+}
+
+func HashManagementToken(token string) []byte {
+  hash := sha256.Sum256([]byte(token))
+  return hash[:]
+}
+
+// Returns nil when the request carries no management token, the response rejecting it when it's not the file's,
+// and true along with nil when it is.
+func CheckManagementToken(file *File, req *http.Request) (bool, *Response) {
+  submittedToken := req.Header.Get(MANAGEMENT_TOKEN_HEADER)
+  if len(submittedToken) == 0 {
+    return false, nil
+  }
+
+  // Files uploaded before tokens were issued have none to match.
+  if len(file.ManagementTokenHash) > 0 && subtle.ConstantTimeCompare(HashManagementToken(submittedToken), file.ManagementTokenHash) == 1 {
+    return true, nil
+  }
+
+  return false, GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "Incorrect management token.")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "strconv"
+)
+
+// Content-Security-Policy sent with every response, configured through CONTENT_SECURITY_POLICY. The default
+// only allows what the error pages and inline downloads need.
+var CONTENT_SECURITY_POLICY = "default-src 'none'; img-src 'self'; media-src 'self'; object-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'none'"
+
+// Seconds clients may cache the responses of the metadata endpoints, configured through METADATA_CACHE_MAX_AGE.
+// Every other response, and all of them when 0, is sent with "Cache-Control: no-store".
+var METADATA_CACHE_MAX_AGE = 0
+
+// Whether plain HTTP requests are redirected to HTTPS, configured through FORCE_HTTPS.
+var FORCE_HTTPS = false
+
+// Paths still served over plain HTTP with FORCE_HTTPS, for load balancer health checks.
+var FORCE_HTTPS_EXEMPT_PATHS = []string{"/internal/health"}
+
+// Loading the middleware configuration, called once the environment has been loaded.
+func LoadMiddlewareSettings(config *Config) {
+  if contentSecurityPolicy, ok := config.LookupEnv("CONTENT_SECURITY_POLICY", &CONTENT_SECURITY_POLICY); ok {
+    CONTENT_SECURITY_POLICY = contentSecurityPolicy
+  }
+
+  if metadataCacheMaxAge := config.Getenv("METADATA_CACHE_MAX_AGE", &METADATA_CACHE_MAX_AGE); len(metadataCacheMaxAge) > 0 {
+    maxAge, err := strconv.Atoi(metadataCacheMaxAge)
+    if err != nil || maxAge < 0 {
+      log.Fatalf("Invalid METADATA_CACHE_MAX_AGE %q.", metadataCacheMaxAge)
+    }
+    METADATA_CACHE_MAX_AGE = maxAge
+  }
+
+  if forceHttps := config.Getenv("FORCE_HTTPS", &FORCE_HTTPS); len(forceHttps) > 0 {
+    enabled, err := strconv.ParseBool(forceHttps)
+    if err != nil {
+      log.Fatalf("Invalid FORCE_HTTPS %q.", forceHttps)
+    }
+    FORCE_HTTPS = enabled
+  }
+}
+
+// Middleware
+func SecurityHeaders(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("X-Frame-Options", "DENY")
+
+    // Nothing is cached unless said otherwise, a cached access to a one-time file would outlive the file.
+    w.Header().Set("Cache-Control", "no-store")
+
+    if len(CONTENT_SECURITY_POLICY) > 0 {
+      w.Header().Set("Content-Security-Policy", CONTENT_SECURITY_POLICY)
+    }
+
+    if IsSecureRequest(req) {
+      w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+    }
+
+    next.ServeHTTP(w, req)
+  })
+}
+
+// Redirecting plain HTTP requests to their HTTPS equivalent. Requests other than GET and HEAD get a 308, so
+// clients resend them as they were rather than as a GET.
+func RedirectToHTTPS(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if FORCE_HTTPS == false || IsSecureRequest(req) || IsForceHTTPSExemptPath(req.URL.Path) {
+      next.ServeHTTP(w, req)
+      return
+    }
+
+    secureUrl := *req.URL
+    secureUrl.Scheme = "https"
+    secureUrl.Host = req.Host
+
+    statusCode := http.StatusMovedPermanently
+    if req.Method != http.MethodGet && req.Method != http.MethodHead {
+      statusCode = http.StatusPermanentRedirect
+    }
+    http.Redirect(w, req, secureUrl.String(), statusCode)
+  })
+}
+
+// Letting clients polling the metadata endpoints cache their responses for a little while.
+func CacheMetadata(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if METADATA_CACHE_MAX_AGE > 0 {
+      w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", METADATA_CACHE_MAX_AGE))
+    }
+
+    next(w, req)
+  }
+}
+
+// Middleware Utility Functions.
+
+// Whether the path is served over plain HTTP even when FORCE_HTTPS is on.
+func IsForceHTTPSExemptPath(path string) bool {
+  for _, exemptPath := range FORCE_HTTPS_EXEMPT_PATHS {
+    if path == exemptPath {
+      return true
+    }
+  }
+  return false
+}
+
+// Whether the request was made over TLS, either to us directly or to a trusted proxy in front of us.
+func IsSecureRequest(req *http.Request) bool {
+  if req.TLS != nil {
+    return true
+  }
+
+  remoteIP := req.RemoteAddr
+  if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+    remoteIP = host
+  }
+
+  return IsTrustedProxy(net.ParseIP(remoteIP)) && req.Header.Get("X-Forwarded-Proto") == "https"
+}
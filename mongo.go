@@ -0,0 +1,67 @@
+package main
+
+import (
+  "log"
+  "strconv"
+
+  "gopkg.in/mgo.v2"
+)
+
+// Servers dialed, configured through MONGO_URL as a host or a mongodb:// URL.
+var MONGO_URL = "127.0.0.1"
+
+// Acknowledgement Mongo gives writes before they succeed, configured through MONGO_WRITE_CONCERN as "majority"
+// or a number of members. Writes are acknowledged by the primary alone when unset.
+var MONGO_WRITE_CONCERN = ""
+
+// Members of the replica set reads go to, configured through MONGO_READ_PREFERENCE. Reads go to the primary when
+// unset. Reading from secondaries may return records a moment out of date, consuming a file always goes through
+// the primary so it still happens only once.
+var MONGO_READ_PREFERENCE = ""
+
+var MONGO_READ_PREFERENCES = map[string]mgo.Mode{
+  "primary":            mgo.Primary,
+  "primaryPreferred":   mgo.PrimaryPreferred,
+  "secondary":          mgo.Secondary,
+  "secondaryPreferred": mgo.SecondaryPreferred,
+  "nearest":            mgo.Nearest,
+}
+
+// Loading the Mongo configuration, called once the environment has been loaded.
+func LoadMongoSettings(config *Config) {
+  if mongoUrl := config.GetenvSecret("MONGO_URL", &MONGO_URL); len(mongoUrl) > 0 {
+    if _, err := mgo.ParseURL(mongoUrl); err != nil {
+      log.Fatalf("Invalid MONGO_URL %q.", mongoUrl)
+    }
+    MONGO_URL = mongoUrl
+  }
+
+  if writeConcern := config.Getenv("MONGO_WRITE_CONCERN", &MONGO_WRITE_CONCERN); len(writeConcern) > 0 {
+    if members, err := strconv.Atoi(writeConcern); writeConcern != "majority" && (err != nil || members < 1) {
+      log.Fatalf("Invalid MONGO_WRITE_CONCERN %q, expected majority or a number of members.", writeConcern)
+    }
+    MONGO_WRITE_CONCERN = writeConcern
+  }
+
+  if readPreference := config.Getenv("MONGO_READ_PREFERENCE", &MONGO_READ_PREFERENCE); len(readPreference) > 0 {
+    if _, ok := MONGO_READ_PREFERENCES[readPreference]; ok == false {
+      log.Fatalf("Invalid MONGO_READ_PREFERENCE %q, expected primary, primaryPreferred, secondary, secondaryPreferred or nearest.", readPreference)
+    }
+    MONGO_READ_PREFERENCE = readPreference
+  }
+}
+
+// Mongo Utility Functions.
+
+// Applies the write concern and read preference to the dialed session, which its copies inherit.
+func ApplyMongoSettings(session *mgo.Session) {
+  if MONGO_WRITE_CONCERN == "majority" {
+    session.SetSafe(&mgo.Safe{WMode: "majority"})
+  } else if members, err := strconv.Atoi(MONGO_WRITE_CONCERN); err == nil {
+    session.SetSafe(&mgo.Safe{W: members})
+  }
+
+  if mode, ok := MONGO_READ_PREFERENCES[MONGO_READ_PREFERENCE]; ok {
+    session.SetMode(mode, true)
+  }
+}
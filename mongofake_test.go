@@ -0,0 +1,922 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "net"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// An in-memory stand-in for Mongo, speaking enough of the wire protocol for mgo to run the queries, writes
+// and commands of the handlers against it. It tells mgo it's a 3.0 server, so every operation arrives as an
+// OP_QUERY, writes as commands.
+type FakeMongo struct {
+  mutex     sync.Mutex
+  listener  net.Listener
+  databases map[string]map[string]*fakeCollection
+}
+
+type fakeCollection struct {
+  documents []bson.M
+  indexes   []fakeIndex
+}
+
+type fakeIndex struct {
+  keys   []string
+  unique bool
+  sparse bool
+}
+
+const (
+  fakeOpReply   = 1
+  fakeOpQuery   = 2004
+  fakeOpGetMore = 2005
+
+  fakeQueryFailure = 2
+)
+
+func StartFakeMongo() (*FakeMongo, error) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    return nil, err
+  }
+
+  mongo := &FakeMongo{listener: listener, databases: map[string]map[string]*fakeCollection{}}
+  go mongo.serve()
+  return mongo, nil
+}
+
+func (mongo *FakeMongo) Address() string {
+  return mongo.listener.Addr().String()
+}
+
+func (mongo *FakeMongo) Close() {
+  mongo.listener.Close()
+}
+
+// Forgets every database, between tests.
+func (mongo *FakeMongo) Reset() {
+  mongo.mutex.Lock()
+  defer mongo.mutex.Unlock()
+  mongo.databases = map[string]map[string]*fakeCollection{}
+}
+
+func (mongo *FakeMongo) serve() {
+  for {
+    connection, err := mongo.listener.Accept()
+    if err != nil {
+      return
+    }
+    go mongo.handle(connection)
+  }
+}
+
+func (mongo *FakeMongo) handle(connection net.Conn) {
+  defer connection.Close()
+
+  for {
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(connection, header); err != nil {
+      return
+    }
+    length := int(binary.LittleEndian.Uint32(header[0:]))
+    requestId := binary.LittleEndian.Uint32(header[4:])
+    opCode := binary.LittleEndian.Uint32(header[12:])
+
+    body := make([]byte, length-16)
+    if _, err := io.ReadFull(connection, body); err != nil {
+      return
+    }
+
+    var flags uint32
+    var documents []bson.M
+    switch opCode {
+    case fakeOpQuery:
+      flags, documents = mongo.query(body)
+    case fakeOpGetMore:
+      documents = []bson.M{}
+    default:
+      // Kill cursors and the legacy writes expect no reply.
+      continue
+    }
+
+    if _, err := connection.Write(encodeFakeReply(requestId, flags, documents)); err != nil {
+      return
+    }
+  }
+}
+
+func encodeFakeReply(requestId uint32, flags uint32, documents []bson.M) []byte {
+  content := &bytes.Buffer{}
+  binary.Write(content, binary.LittleEndian, flags)
+  binary.Write(content, binary.LittleEndian, int64(0))
+  binary.Write(content, binary.LittleEndian, int32(0))
+  binary.Write(content, binary.LittleEndian, int32(len(documents)))
+  for _, document := range documents {
+    data, err := bson.Marshal(document)
+    if err != nil {
+      panic(err)
+    }
+    content.Write(data)
+  }
+
+  reply := &bytes.Buffer{}
+  binary.Write(reply, binary.LittleEndian, int32(16+content.Len()))
+  binary.Write(reply, binary.LittleEndian, int32(0))
+  binary.Write(reply, binary.LittleEndian, requestId)
+  binary.Write(reply, binary.LittleEndian, int32(fakeOpReply))
+  reply.Write(content.Bytes())
+  return reply.Bytes()
+}
+
+// Decodes an OP_QUERY, answering commands sent to "<db>.$cmd" and finds on any other collection.
+func (mongo *FakeMongo) query(body []byte) (uint32, []bson.M) {
+  end := bytes.IndexByte(body[4:], 0) + 4
+  namespace := string(body[4:end])
+  skip := int(int32(binary.LittleEndian.Uint32(body[end+1:])))
+  limit := int(int32(binary.LittleEndian.Uint32(body[end+5:])))
+
+  rest := body[end+9:]
+  query, rest := readFakeDocument(rest)
+  var selector bson.M
+  if len(rest) > 0 {
+    selectorDocument, _ := readFakeDocument(rest)
+    selector = fakeDocumentToMap(selectorDocument)
+  }
+
+  separator := strings.Index(namespace, ".")
+  database, collection := namespace[:separator], namespace[separator+1:]
+
+  mongo.mutex.Lock()
+  defer mongo.mutex.Unlock()
+
+  if collection == "$cmd" {
+    return 0, []bson.M{mongo.command(database, query)}
+  }
+
+  filter := query
+  var orderBy bson.D
+  if len(query) > 0 && query[0].Name == "$query" {
+    filter = bson.D{}
+    for _, element := range query {
+      switch element.Name {
+      case "$query":
+        filter = toFakeD(element.Value)
+      case "$orderby":
+        orderBy = toFakeD(element.Value)
+      }
+    }
+  }
+
+  if limit < 0 {
+    limit = -limit
+  }
+  documents, err := mongo.find(database, collection, fakeDocumentToMap(filter), orderBy, skip, limit)
+  if err != nil {
+    return fakeQueryFailure, []bson.M{{"$err": err.Error(), "code": 2}}
+  }
+
+  results := []bson.M{}
+  for _, document := range documents {
+    results = append(results, projectFakeDocument(document, selector))
+  }
+  return 0, results
+}
+
+func readFakeDocument(data []byte) (bson.D, []byte) {
+  length := int(binary.LittleEndian.Uint32(data))
+  document := bson.D{}
+  if err := bson.Unmarshal(data[:length], &document); err != nil {
+    panic(err)
+  }
+  return document, data[length:]
+}
+
+func (mongo *FakeMongo) collection(database string, name string) *fakeCollection {
+  collections, ok := mongo.databases[database]
+  if ok == false {
+    collections = map[string]*fakeCollection{}
+    mongo.databases[database] = collections
+  }
+
+  collection, ok := collections[name]
+  if ok == false {
+    collection = &fakeCollection{}
+    collections[name] = collection
+  }
+  return collection
+}
+
+func (mongo *FakeMongo) command(database string, command bson.D) bson.M {
+  if len(command) == 0 {
+    return bson.M{"ok": 0, "errmsg": "no command"}
+  }
+  arguments := fakeDocumentToMap(command)
+  name := command[0].Name
+  collectionName, _ := command[0].Value.(string)
+
+  switch strings.ToLower(name) {
+  case "ismaster":
+    return bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 3, "minWireVersion": 0, "maxBsonObjectSize": 16 << 20, "maxMessageSizeBytes": 48 << 20, "maxWriteBatchSize": 1000}
+  case "buildinfo":
+    return bson.M{"ok": 1, "version": "3.0.0", "versionArray": []int{3, 0, 0, 0}}
+  case "ping", "getlasterror", "createindexes":
+    if strings.ToLower(name) == "createindexes" {
+      mongo.createIndexes(mongo.collection(database, collectionName), arguments["indexes"])
+    }
+    return bson.M{"ok": 1}
+  case "getnonce":
+    return bson.M{"ok": 1, "nonce": "0"}
+  case "dropdatabase":
+    delete(mongo.databases, database)
+    return bson.M{"ok": 1}
+  case "drop":
+    delete(mongo.databases[database], collectionName)
+    return bson.M{"ok": 1}
+  case "insert":
+    return mongo.insert(mongo.collection(database, collectionName), arguments["documents"])
+  case "update":
+    return mongo.update(mongo.collection(database, collectionName), arguments["updates"])
+  case "delete":
+    return mongo.delete(mongo.collection(database, collectionName), arguments["deletes"])
+  case "count":
+    filter, _ := arguments["query"].(bson.M)
+    skip, _ := fakeNumber(arguments["skip"])
+    limit, _ := fakeNumber(arguments["limit"])
+    documents, err := mongo.find(database, collectionName, filter, nil, int(skip), int(limit))
+    if err != nil {
+      return bson.M{"ok": 0, "errmsg": err.Error()}
+    }
+    return bson.M{"ok": 1, "n": len(documents)}
+  case "findandmodify":
+    return mongo.findAndModify(mongo.collection(database, collectionName), command)
+  }
+
+  return bson.M{"ok": 0, "errmsg": "no such command: " + name, "code": 59}
+}
+
+func (mongo *FakeMongo) createIndexes(collection *fakeCollection, specs interface{}) {
+  for _, spec := range fakeArray(specs) {
+    spec := spec.(bson.M)
+    index := fakeIndex{}
+    index.unique, _ = spec["unique"].(bool)
+    index.sparse, _ = spec["sparse"].(bool)
+    for _, element := range toFakeD(spec["key"]) {
+      index.keys = append(index.keys, element.Name)
+    }
+    if index.unique {
+      collection.indexes = append(collection.indexes, index)
+    }
+  }
+}
+
+func (mongo *FakeMongo) find(database string, name string, filter bson.M, orderBy bson.D, skip int, limit int) ([]bson.M, error) {
+  collection := mongo.collection(database, name)
+
+  documents := []bson.M{}
+  for _, document := range collection.documents {
+    matched, err := matchFakeDocument(document, filter)
+    if err != nil {
+      return nil, err
+    }
+    if matched {
+      documents = append(documents, document)
+    }
+  }
+
+  sortFakeDocuments(documents, orderBy)
+
+  if skip > len(documents) {
+    skip = len(documents)
+  }
+  documents = documents[skip:]
+  if limit > 0 && limit < len(documents) {
+    documents = documents[:limit]
+  }
+  return documents, nil
+}
+
+func (mongo *FakeMongo) insert(collection *fakeCollection, documents interface{}) bson.M {
+  inserted := 0
+  for i, document := range fakeArray(documents) {
+    document := copyFakeValue(document).(bson.M)
+    if _, ok := document["_id"]; ok == false {
+      document["_id"] = bson.NewObjectId()
+    }
+    if err := collection.checkUnique(document, nil); err != nil {
+      return fakeWriteError(inserted, i, err)
+    }
+    collection.documents = append(collection.documents, document)
+    inserted++
+  }
+  return bson.M{"ok": 1, "n": inserted}
+}
+
+func (mongo *FakeMongo) update(collection *fakeCollection, updates interface{}) bson.M {
+  matched := 0
+  upserted := []bson.M{}
+  for i, update := range fakeArray(updates) {
+    update := update.(bson.M)
+    filter, _ := update["q"].(bson.M)
+    multi, _ := update["multi"].(bool)
+    upsert, _ := update["upsert"].(bool)
+
+    found := false
+    for position, document := range collection.documents {
+      ok, err := matchFakeDocument(document, filter)
+      if err != nil {
+        return bson.M{"ok": 0, "errmsg": err.Error()}
+      }
+      if ok == false {
+        continue
+      }
+      found = true
+
+      updated, err := applyFakeUpdate(document, update["u"].(bson.M))
+      if err == nil {
+        err = collection.checkUnique(updated, document)
+      }
+      if err != nil {
+        return fakeWriteError(matched, i, err)
+      }
+      collection.documents[position] = updated
+      matched++
+      if multi == false {
+        break
+      }
+    }
+
+    if found == false && upsert {
+      document := bson.M{}
+      for key, value := range filter {
+        if strings.HasPrefix(key, "$") == false && isFakeOperatorDocument(value) == false {
+          document[key] = value
+        }
+      }
+      document, err := applyFakeUpdate(document, update["u"].(bson.M))
+      if err == nil {
+        if _, ok := document["_id"]; ok == false {
+          document["_id"] = bson.NewObjectId()
+        }
+        err = collection.checkUnique(document, nil)
+      }
+      if err != nil {
+        return fakeWriteError(matched, i, err)
+      }
+      collection.documents = append(collection.documents, document)
+      upserted = append(upserted, bson.M{"index": i, "_id": document["_id"]})
+      matched++
+    }
+  }
+
+  result := bson.M{"ok": 1, "n": matched, "nModified": matched - len(upserted)}
+  if len(upserted) > 0 {
+    result["upserted"] = upserted
+  }
+  return result
+}
+
+func (mongo *FakeMongo) delete(collection *fakeCollection, deletes interface{}) bson.M {
+  removed := 0
+  for _, deletion := range fakeArray(deletes) {
+    deletion := deletion.(bson.M)
+    filter, _ := deletion["q"].(bson.M)
+    limit, _ := fakeNumber(deletion["limit"])
+
+    kept := []bson.M{}
+    for _, document := range collection.documents {
+      matched, err := matchFakeDocument(document, filter)
+      if err != nil {
+        return bson.M{"ok": 0, "errmsg": err.Error()}
+      }
+      if matched && (limit == 0 || removed < int(limit)) {
+        removed++
+        continue
+      }
+      kept = append(kept, document)
+    }
+    collection.documents = kept
+  }
+  return bson.M{"ok": 1, "n": removed}
+}
+
+func (mongo *FakeMongo) findAndModify(collection *fakeCollection, command bson.D) bson.M {
+  arguments := fakeDocumentToMap(command)
+  filter, _ := arguments["query"].(bson.M)
+  remove, _ := arguments["remove"].(bool)
+  returnNew, _ := arguments["new"].(bool)
+  upsert, _ := arguments["upsert"].(bool)
+  fields, _ := arguments["fields"].(bson.M)
+
+  var orderBy bson.D
+  for _, element := range command {
+    if element.Name == "sort" {
+      orderBy = toFakeD(element.Value)
+    }
+  }
+
+  documents := []bson.M{}
+  for _, document := range collection.documents {
+    matched, err := matchFakeDocument(document, filter)
+    if err != nil {
+      return bson.M{"ok": 0, "errmsg": err.Error()}
+    }
+    if matched {
+      documents = append(documents, document)
+    }
+  }
+  sortFakeDocuments(documents, orderBy)
+
+  if len(documents) == 0 {
+    if upsert == false {
+      return bson.M{"ok": 1, "value": nil, "lastErrorObject": bson.M{"n": 0, "updatedExisting": false}}
+    }
+    result := mongo.update(collection, []interface{}{bson.M{"q": filter, "u": arguments["update"], "upsert": true}})
+    if result["ok"] != 1 || result["writeErrors"] != nil {
+      return bson.M{"ok": 0, "errmsg": "E11000 duplicate key error", "code": 11000}
+    }
+    upsertedId := result["upserted"].([]bson.M)[0]["_id"]
+    var value interface{}
+    if returnNew {
+      value = projectFakeDocument(collection.documents[len(collection.documents)-1], fields)
+    }
+    return bson.M{"ok": 1, "value": value, "lastErrorObject": bson.M{"n": 1, "updatedExisting": false, "upserted": upsertedId}}
+  }
+
+  original := documents[0]
+  for position, document := range collection.documents {
+    if fakeValuesEqual(document["_id"], original["_id"]) == false {
+      continue
+    }
+
+    if remove {
+      collection.documents = append(collection.documents[:position], collection.documents[position+1:]...)
+      return bson.M{"ok": 1, "value": projectFakeDocument(original, fields), "lastErrorObject": bson.M{"n": 1}}
+    }
+
+    updated, err := applyFakeUpdate(document, arguments["update"].(bson.M))
+    if err == nil {
+      err = collection.checkUnique(updated, document)
+    }
+    if err != nil {
+      return bson.M{"ok": 0, "errmsg": err.Error(), "code": 11000}
+    }
+    collection.documents[position] = updated
+
+    value := original
+    if returnNew {
+      value = updated
+    }
+    return bson.M{"ok": 1, "value": projectFakeDocument(value, fields), "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}
+  }
+
+  return bson.M{"ok": 1, "value": nil, "lastErrorObject": bson.M{"n": 0}}
+}
+
+func fakeWriteError(n int, index int, err error) bson.M {
+  return bson.M{"ok": 1, "n": n, "writeErrors": []bson.M{{"index": index, "code": 11000, "errmsg": err.Error()}}}
+}
+
+// Returns a duplicate key error when the document collides with another one on its _id or a unique index.
+// The document being replaced, if any, doesn't count.
+func (collection *fakeCollection) checkUnique(document bson.M, replaced bson.M) error {
+  indexes := append([]fakeIndex{{keys: []string{"_id"}, unique: true}}, collection.indexes...)
+  for _, index := range indexes {
+    values := []interface{}{}
+    present := false
+    for _, key := range index.keys {
+      value, ok := lookupFakeField(document, key)
+      present = present || ok
+      values = append(values, value)
+    }
+    if index.sparse && present == false {
+      continue
+    }
+
+    for _, other := range collection.documents {
+      if replaced != nil && fakeValuesEqual(other["_id"], replaced["_id"]) {
+        continue
+      }
+
+      duplicate := true
+      for i, key := range index.keys {
+        value, _ := lookupFakeField(other, key)
+        duplicate = duplicate && fakeValuesEqual(value, values[i])
+      }
+      if duplicate {
+        return fmt.Errorf("E11000 duplicate key error index: %s", strings.Join(index.keys, "_"))
+      }
+    }
+  }
+  return nil
+}
+
+// Matching
+
+func matchFakeDocument(document bson.M, filter bson.M) (bool, error) {
+  for key, condition := range filter {
+    switch key {
+    case "$and", "$or":
+      matches := 0
+      clauses := fakeArray(condition)
+      for _, clause := range clauses {
+        matched, err := matchFakeDocument(document, clause.(bson.M))
+        if err != nil {
+          return false, err
+        }
+        if matched {
+          matches++
+        }
+      }
+      if (key == "$and" && matches != len(clauses)) || (key == "$or" && matches == 0) {
+        return false, nil
+      }
+      continue
+    }
+
+    value, present := lookupFakeField(document, key)
+    matched, err := matchFakeCondition(value, present, condition)
+    if err != nil || matched == false {
+      return false, err
+    }
+  }
+  return true, nil
+}
+
+func matchFakeCondition(value interface{}, present bool, condition interface{}) (bool, error) {
+  if isFakeOperatorDocument(condition) == false {
+    return matchFakeEquality(value, condition), nil
+  }
+
+  for operator, operand := range condition.(bson.M) {
+    matched := false
+    switch operator {
+    case "$eq":
+      matched = matchFakeEquality(value, operand)
+    case "$ne":
+      matched = matchFakeEquality(value, operand) == false
+    case "$exists":
+      exists, _ := operand.(bool)
+      matched = present == exists
+    case "$in":
+      for _, candidate := range fakeArray(operand) {
+        matched = matched || matchFakeEquality(value, candidate)
+      }
+    case "$lt", "$lte", "$gt", "$gte":
+      matched = matchFakeComparison(value, operator, operand)
+    case "$not":
+      inner, err := matchFakeCondition(value, present, operand)
+      if err != nil {
+        return false, err
+      }
+      matched = inner == false
+    default:
+      return false, fmt.Errorf("unsupported operator %s", operator)
+    }
+
+    if matched == false {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+// Values match when they are equal, or when the value is an array holding an equal element.
+func matchFakeEquality(value interface{}, expected interface{}) bool {
+  if fakeValuesEqual(value, expected) {
+    return true
+  }
+  for _, element := range fakeArray(value) {
+    if fakeValuesEqual(element, expected) {
+      return true
+    }
+  }
+  return false
+}
+
+func matchFakeComparison(value interface{}, operator string, operand interface{}) bool {
+  if value == nil || operand == nil || fakeTypeOrder(value) != fakeTypeOrder(operand) {
+    return false
+  }
+
+  comparison := compareFakeValues(value, operand)
+  switch operator {
+  case "$lt":
+    return comparison < 0
+  case "$lte":
+    return comparison <= 0
+  case "$gt":
+    return comparison > 0
+  }
+  return comparison >= 0
+}
+
+func isFakeOperatorDocument(value interface{}) bool {
+  document, ok := value.(bson.M)
+  if ok == false || len(document) == 0 {
+    return false
+  }
+  for key := range document {
+    if strings.HasPrefix(key, "$") == false {
+      return false
+    }
+  }
+  return true
+}
+
+// Updates
+
+// Returns the document with the update applied, either as operators or as a replacement keeping the _id.
+func applyFakeUpdate(document bson.M, update bson.M) (bson.M, error) {
+  if isFakeOperatorDocument(update) == false {
+    replacement := copyFakeValue(update).(bson.M)
+    if id, ok := document["_id"]; ok {
+      replacement["_id"] = id
+    }
+    return replacement, nil
+  }
+
+  updated := copyFakeValue(document).(bson.M)
+  for operator, fields := range update {
+    for key, operand := range fields.(bson.M) {
+      switch operator {
+      case "$set":
+        setFakeField(updated, key, copyFakeValue(operand))
+      case "$unset":
+        unsetFakeField(updated, key)
+      case "$inc":
+        current, _ := lookupFakeField(updated, key)
+        setFakeField(updated, key, addFakeNumbers(current, operand))
+      case "$push":
+        current, _ := lookupFakeField(updated, key)
+        setFakeField(updated, key, append(fakeArray(current), copyFakeValue(operand)))
+      default:
+        return nil, fmt.Errorf("unsupported update operator %s", operator)
+      }
+    }
+  }
+  return updated, nil
+}
+
+func addFakeNumbers(current interface{}, increment interface{}) interface{} {
+  a, aInteger := fakeNumber(current)
+  b, bInteger := fakeNumber(increment)
+  if aInteger && bInteger {
+    if _, ok := current.(int64); ok {
+      return int64(a + b)
+    }
+    if _, ok := increment.(int64); ok {
+      return int64(a + b)
+    }
+    return int(a + b)
+  }
+  return fakeFloat(current) + fakeFloat(increment)
+}
+
+// Fields
+
+func lookupFakeField(document bson.M, key string) (interface{}, bool) {
+  var value interface{} = document
+  for _, part := range strings.Split(key, ".") {
+    nested, ok := value.(bson.M)
+    if ok == false {
+      return nil, false
+    }
+    value, ok = nested[part]
+    if ok == false {
+      return nil, false
+    }
+  }
+  return value, true
+}
+
+func setFakeField(document bson.M, key string, value interface{}) {
+  parts := strings.Split(key, ".")
+  for _, part := range parts[:len(parts)-1] {
+    nested, ok := document[part].(bson.M)
+    if ok == false {
+      nested = bson.M{}
+      document[part] = nested
+    }
+    document = nested
+  }
+  document[parts[len(parts)-1]] = value
+}
+
+func unsetFakeField(document bson.M, key string) {
+  parts := strings.Split(key, ".")
+  for _, part := range parts[:len(parts)-1] {
+    nested, ok := document[part].(bson.M)
+    if ok == false {
+      return
+    }
+    document = nested
+  }
+  delete(document, parts[len(parts)-1])
+}
+
+func projectFakeDocument(document bson.M, selector bson.M) bson.M {
+  if len(selector) == 0 {
+    return document
+  }
+
+  including := false
+  for key, value := range selector {
+    if number, _ := fakeNumber(value); key != "_id" && (number != 0 || value == true) {
+      including = true
+    }
+  }
+
+  projected := bson.M{}
+  if including {
+    for key, value := range selector {
+      if number, _ := fakeNumber(value); number != 0 || value == true {
+        if field, ok := document[key]; ok {
+          projected[key] = field
+        }
+      }
+    }
+    if number, ok := fakeNumber(selector["_id"]); ok == false || number != 0 {
+      projected["_id"] = document["_id"]
+    }
+    return projected
+  }
+
+  for key, value := range document {
+    if _, excluded := selector[key]; excluded == false {
+      projected[key] = value
+    }
+  }
+  return projected
+}
+
+// Values
+
+func sortFakeDocuments(documents []bson.M, orderBy bson.D) {
+  if len(orderBy) == 0 {
+    return
+  }
+
+  sort.SliceStable(documents, func(i, j int) bool {
+    for _, element := range orderBy {
+      a, _ := lookupFakeField(documents[i], element.Name)
+      b, _ := lookupFakeField(documents[j], element.Name)
+      comparison := compareFakeValues(a, b)
+      if direction, _ := fakeNumber(element.Value); direction < 0 {
+        comparison = -comparison
+      }
+      if comparison != 0 {
+        return comparison < 0
+      }
+    }
+    return false
+  })
+}
+
+// Orders values of different types as Mongo does, roughly.
+func fakeTypeOrder(value interface{}) int {
+  switch value.(type) {
+  case nil:
+    return 0
+  case int, int32, int64, float64:
+    return 1
+  case string:
+    return 2
+  case bson.M, bson.D:
+    return 3
+  case []interface{}:
+    return 4
+  case []byte:
+    return 5
+  case bson.ObjectId:
+    return 6
+  case bool:
+    return 7
+  case time.Time:
+    return 8
+  }
+  return 9
+}
+
+func compareFakeValues(a interface{}, b interface{}) int {
+  if orderA, orderB := fakeTypeOrder(a), fakeTypeOrder(b); orderA != orderB {
+    return orderA - orderB
+  }
+
+  switch a := a.(type) {
+  case int, int32, int64, float64:
+    x, y := fakeFloat(a), fakeFloat(b)
+    if x < y {
+      return -1
+    } else if x > y {
+      return 1
+    }
+    return 0
+  case string:
+    return strings.Compare(a, b.(string))
+  case bson.ObjectId:
+    return strings.Compare(string(a), string(b.(bson.ObjectId)))
+  case []byte:
+    return bytes.Compare(a, b.([]byte))
+  case bool:
+    if a == b.(bool) {
+      return 0
+    } else if a == false {
+      return -1
+    }
+    return 1
+  case time.Time:
+    return a.Compare(b.(time.Time))
+  case nil:
+    return 0
+  }
+
+  if fmt.Sprint(a) == fmt.Sprint(b) {
+    return 0
+  }
+  return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func fakeValuesEqual(a interface{}, b interface{}) bool {
+  if fakeTypeOrder(a) != fakeTypeOrder(b) {
+    return false
+  }
+  return compareFakeValues(a, b) == 0
+}
+
+func fakeNumber(value interface{}) (int64, bool) {
+  switch number := value.(type) {
+  case int:
+    return int64(number), true
+  case int32:
+    return int64(number), true
+  case int64:
+    return number, true
+  case float64:
+    return int64(number), false
+  }
+  return 0, false
+}
+
+func fakeFloat(value interface{}) float64 {
+  if number, ok := value.(float64); ok {
+    return number
+  }
+  number, _ := fakeNumber(value)
+  return float64(number)
+}
+
+func fakeArray(value interface{}) []interface{} {
+  array, _ := value.([]interface{})
+  return array
+}
+
+// Converts the ordered documents decoded from the wire into maps, nested ones included.
+func fakeDocumentToMap(document bson.D) bson.M {
+  return copyFakeValue(document).(bson.M)
+}
+
+func toFakeD(value interface{}) bson.D {
+  switch document := value.(type) {
+  case bson.D:
+    return document
+  case bson.M:
+    ordered := bson.D{}
+    for key, element := range document {
+      ordered = append(ordered, bson.DocElem{Name: key, Value: element})
+    }
+    return ordered
+  }
+  return nil
+}
+
+func copyFakeValue(value interface{}) interface{} {
+  switch value := value.(type) {
+  case bson.D:
+    document := bson.M{}
+    for _, element := range value {
+      document[element.Name] = copyFakeValue(element.Value)
+    }
+    return document
+  case bson.M:
+    document := bson.M{}
+    for key, element := range value {
+      document[key] = copyFakeValue(element)
+    }
+    return document
+  case []interface{}:
+    array := []interface{}{}
+    for _, element := range value {
+      array = append(array, copyFakeValue(element))
+    }
+    return array
+  }
+  return value
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+  "bytes"
+  "html/template"
+  "log"
+  "mime"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// Directory of the error page templates, configured through ERROR_TEMPLATE_DIR.
+var ERROR_TEMPLATE_DIR string
+
+// Error pages rendered for browsers, keyed by status code. Templates named "<status code>.html"
+// in ERROR_TEMPLATE_DIR replace the default page for that status.
+var ERROR_PAGE_TEMPLATES = map[int]*template.Template{}
+
+// Messages shown on error pages whose response carries no meaningful error text.
+var ERROR_PAGE_MESSAGES = map[int]string{
+  http.StatusNotFound:     "This file doesn't exist. Please check that the link is correct.",
+  http.StatusGone:         "This file has already been accessed and is no longer available.",
+  http.StatusUnauthorized: "This file requires a password in order to be accessed.",
+}
+
+type ErrorPage struct {
+  StatusCode int
+  StatusText string
+  Message    string
+  Reason     string
+}
+
+const DEFAULT_ERROR_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.StatusText}} - GoUpload</title>
+  <style>
+    body { font-family: sans-serif; color: #333; max-width: 32em; margin: 6em auto; text-align: center; }
+    h1 { font-size: 1.5em; }
+  </style>
+</head>
+<body>
+  <h1>{{.StatusText}}</h1>
+  <p>{{.Message}}</p>
+</body>
+</html>
+`
+
+// Loading the error page templates, called once the environment has been loaded.
+func LoadErrorPageTemplates(config *Config) {
+  ERROR_TEMPLATE_DIR = config.Getenv("ERROR_TEMPLATE_DIR", &ERROR_TEMPLATE_DIR)
+
+  for statusCode := range ERROR_PAGE_MESSAGES {
+    name := strconv.Itoa(statusCode) + ".html"
+    page := template.Must(template.New(name).Parse(DEFAULT_ERROR_PAGE))
+
+    if len(ERROR_TEMPLATE_DIR) > 0 {
+      if _, err := os.Stat(filepath.Join(ERROR_TEMPLATE_DIR, name)); err == nil {
+        page, err = template.ParseFiles(filepath.Join(ERROR_TEMPLATE_DIR, name))
+        if err != nil {
+          log.Fatalf("Invalid error page template %s: %v", name, err)
+        }
+      }
+    }
+
+    ERROR_PAGE_TEMPLATES[statusCode] = page
+  }
+}
+
+// Page Utility Functions.
+
+// Whether the client prefers HTML over JSON. Wildcards count for neither, so clients like curl
+// sending "*/*" keep getting JSON.
+func AcceptsHTML(req *http.Request) bool {
+  htmlQuality, jsonQuality := 0.0, 0.0
+
+  for _, mediaRange := range strings.Split(req.Header.Get("Accept"), ",") {
+    mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+    if err != nil {
+      continue
+    }
+
+    quality := 1.0
+    if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+      quality = q
+    }
+
+    switch mediaType {
+    case "text/html":
+      htmlQuality = quality
+    case "application/json":
+      jsonQuality = quality
+    }
+  }
+
+  return htmlQuality > 0 && htmlQuality > jsonQuality
+}
+
+// Writes the error page for the response's status, returning false when it has none.
+func WriteErrorPage(response *Response, w http.ResponseWriter) bool {
+  page, ok := ERROR_PAGE_TEMPLATES[response.StatusCode]
+  if ok == false {
+    return false
+  }
+
+  message := ERROR_PAGE_MESSAGES[response.StatusCode]
+  if response.Success == false && len(response.ErrorText) > 0 {
+    message = response.ErrorText
+  }
+
+  body := &bytes.Buffer{}
+  err := page.Execute(body, &ErrorPage{response.StatusCode, response.StatusText, message, response.Reason})
+  ErrorHandler(err)
+
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.WriteHeader(response.StatusCode)
+  w.Write(body.Bytes())
+  return true
+}
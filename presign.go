@@ -0,0 +1,295 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// How long a presigned upload URL remains valid, configured through PRESIGN_TTL.
+var PRESIGN_TTL = 15 * time.Minute
+
+// Fields accepted by the presign endpoint, describing the file that's going to be uploaded.
+var PRESIGN_FORM = []FormField{
+  {"filename", FieldText},
+  {"content_type", FieldText},
+  {"password", FieldText},
+  {"password_hash", FieldPasswordHash},
+  {"delete_password", FieldText},
+  {"max_downloads", FieldPositiveInteger},
+  {"max_password_attempts", FieldPositiveInteger},
+  {"expires_in", FieldDuration},
+  {"expire_after_access", FieldDuration},
+  {"slug", FieldSlug},
+  {METADATA_FIELD_PREFIX + "*", FieldMetadata},
+}
+
+type PresignedUpload struct {
+  File      *File               `json:"file"`
+  UploadURL string              `json:"upload_url"`
+  Method    string              `json:"method"`
+  Headers   map[string][]string `json:"headers"`
+  ExpiresAt time.Time           `json:"expires_at"`
+}
+
+// Loading the presigned upload configuration, called once the environment has been loaded.
+func LoadPresignSettings(config *Config) {
+  if presignTTL := config.Getenv("PRESIGN_TTL", &PRESIGN_TTL); len(presignTTL) > 0 {
+    ttl, err := time.ParseDuration(presignTTL)
+    if err != nil || ttl <= 0 {
+      log.Fatalf("Invalid PRESIGN_TTL %q.", presignTTL)
+    }
+    PRESIGN_TTL = ttl
+  }
+}
+
+// Handlers
+func PresignUpload(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  // Only clients with an API key upload directly, so every direct upload has an owner to finalize it.
+  owner, ok := AuthenticateAPIKey(req)
+  if ok == false || len(owner) == 0 {
+    response := GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This endpoint requires an API key.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if _, err := ResolveRegion(req); err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid X-Region. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if err := ParseUploadForm(req, 1<<20); err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  fieldErrors := ValidateForm(req, PRESIGN_FORM)
+  fieldErrors = append(fieldErrors, ValidatePasswordFields(req)...)
+  fieldErrors = append(fieldErrors, ValidateRetentionFields(req)...)
+  if len(fieldErrors) > 0 {
+    WriteResponse(InvalidFormResponse(fieldErrors), w, req)
+    return nil
+  }
+
+  expiresIn, expiresInNote, err := ResolveExpiresIn(req.PostForm.Get("expires_in"))
+  if err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Invalid Form. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsBlockedFilename(req.PostForm.Get("filename")) {
+    response := GenerateResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType), false, 0, "Files with this extension aren't allowed.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  file := NewFile(req, expiresIn)
+  file.UploadState = UploadStatePending
+  file.ContentType = req.PostForm.Get("content_type")
+  if len(file.ContentType) == 0 {
+    file.ContentType = "application/octet-stream"
+  }
+  file.Filename = SanitizeUploadFilename(req.PostForm.Get("filename"), file.ContentType)
+
+  storage := GetStorage(file.Region)
+  path := GetUploadPrefix(file.Owner) + CreateS3Path(file.Filename)
+  file.URL = storage.URL(path)
+
+  headers := map[string][]string{
+    "Content-Type":        {file.ContentType},
+    "x-amz-acl":           {GetObjectACL(path)},
+    "x-amz-storage-class": {STORAGE_CLASS},
+    "x-amz-tagging":       {EncodeObjectTags(CreateObjectTags(file))},
+  }
+  for key, value := range file.Metadata {
+    headers["x-amz-meta-"+key] = []string{value}
+  }
+  expiresAt := CLOCK.Now().Add(PRESIGN_TTL)
+
+  uploadUrl, err := storage.SignedPutURL(path, headers, expiresAt)
+  if err != nil {
+    response := GenerateResponse(http.StatusNotImplemented, http.StatusText(http.StatusNotImplemented), false, 0, fmt.Sprintf("Direct uploads are unavailable. (%v)", err))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  err = collection.Insert(file)
+  if mgo.IsDup(err) {
+    WriteResponse(SlugTakenResponse(req), w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+
+  response := GenerateResponse(http.StatusCreated, http.StatusText(http.StatusCreated), true, 0, "No Error")
+  response.Note = expiresInNote
+  response.Content = &PresignedUpload{file, uploadUrl, "PUT", headers, expiresAt}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+func FinalizeUpload(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetFinalizeOwnerResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Only the API key that presigned the upload can finalize it.
+  owner, ok := AuthenticateAPIKey(req)
+  if ok == false || len(owner) == 0 || owner != file.Owner {
+    WriteResponse(GetFinalizeOwnerResponse(req), w, req)
+    return nil
+  }
+
+  if file.UploadState != UploadStatePending {
+    response = GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file isn't awaiting a direct upload.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  storage := GetStorage(file.Region)
+  object, err := storage.Stat(storage.Path(file.URL))
+  if IsNoSuchKeyError(err) {
+    response = GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "The file hasn't been uploaded yet.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+
+  // The object has to meet the rules of any other upload, it's deleted when it doesn't and can be uploaded again.
+  if MAX_UPLOAD_BYTES > 0 && object.ContentLength > MAX_UPLOAD_BYTES {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    response = GenerateResponse(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge), false, 0, fmt.Sprintf("The upload is too large. (At most %d bytes)", MAX_UPLOAD_BYTES))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsBlockedFilename(file.Filename) {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    response = GenerateResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType), false, 0, "Files with this extension aren't allowed.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  claimedContentType := file.ContentType
+  if len(object.ContentType) > 0 {
+    claimedContentType = object.ContentType
+  }
+  contentType, mismatched, checksum, err := InspectDirectUpload(storage, storage.Path(file.URL), claimedContentType)
+  if err != nil {
+    return HandleError(err)
+  }
+  if mismatched && STRICT_CONTENT_TYPE {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    response = GenerateResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType), false, 0, fmt.Sprintf("The content doesn't match its content type. (Claimed %s, detected %s)", claimedContentType, contentType))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Content that isn't what the client said it would upload isn't kept.
+  if len(file.Checksum) > 0 && file.Checksum != checksum {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    return HandleError(fmt.Errorf("%w, expected %s but got %s", ErrChecksumMismatch, file.Checksum, checksum))
+  }
+
+  file.UploadState = UploadStateComplete
+  file.Size = object.ContentLength
+  file.BytesTransferred = object.ContentLength
+  file.ContentType = contentType
+  file.Checksum = checksum
+
+  finalized := bson.M{"uploadstate": file.UploadState, "size": file.Size, "bytestransferred": file.BytesTransferred, "contenttype": file.ContentType, "checksum": file.Checksum}
+  if AV_SCAN {
+    file.ScanState = ScanStateQuarantined
+    finalized["scanstate"] = file.ScanState
+  }
+
+  // Finalizing only once, even when called concurrently.
+  query := bson.M{"_id": file.ID, "uploadstate": UploadStatePending}
+  err = collection.Update(query, bson.M{"$set": finalized})
+  if err == mgo.ErrNotFound {
+    response = GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file isn't awaiting a direct upload.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+
+  if file.ScanState == ScanStateQuarantined {
+    go ScanFileInBackground(file)
+
+    response = GenerateResponse(http.StatusAccepted, http.StatusText(http.StatusAccepted), true, 0, "No Error.")
+    response.Content = file
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  RunPostUploadHooks(file)
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = file
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Presign Utility Functions.
+
+// The response rejecting a finalization on behalf of an API key that didn't presign the upload.
+func GetFinalizeOwnerResponse(req *http.Request) *Response {
+  return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This file can only be finalized with the API key that presigned it.")
+}
+
+// Reads the object uploaded directly, returning the content type detected from its content as for any other
+// upload, whether it mismatches the claimed one, and the checksum of its content.
+func InspectDirectUpload(storage Storage, path string, claimedContentType string) (contentType string, mismatched bool, checksum string, err error) {
+  object, err := storage.Get(path)
+  if err != nil {
+    return "", false, "", err
+  }
+  defer object.Body.Close()
+
+  hash := sha256.New()
+  reader := bufio.NewReaderSize(io.TeeReader(object.Body, hash), 512)
+  head, _ := reader.Peek(512)
+  contentType, mismatched = ResolveContentType(claimedContentType, http.DetectContentType(head))
+
+  if _, err = io.Copy(io.Discard, reader); err != nil {
+    return "", false, "", err
+  }
+  return contentType, mismatched, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Stores a pending file as presigning does, along with the content uploaded to its presigned URL.
+func CreateTestDirectUpload(t *testing.T, file *File, content []byte) *File {
+  t.Helper()
+
+  path := GetTenantPrefix(file.Owner) + CreateS3Path(file.Filename)
+  file.ID = bson.NewObjectId()
+  file.UploadState = UploadStatePending
+  file.URL = STORAGE.URL(path)
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  if err := session.DB(DATABASE).C(COLLECTION).Insert(file); err != nil {
+    t.Fatal(err)
+  }
+  if err := STORAGE.Put(path, content, map[string][]string{"Content-Type": {file.ContentType}}); err != nil {
+    t.Fatal(err)
+  }
+  return file
+}
+
+func TestFinalizeUpload(t *testing.T) {
+  content := []byte("Hello, world.")
+  contentSum := sha256.Sum256(content)
+  checksum := hex.EncodeToString(contentSum[:])
+
+  cases := []struct {
+    name      string
+    file      File
+    prepare   func(t *testing.T)
+    status    int
+    errorText string
+  }{
+    {"Complete", File{Filename: "notes.txt", ContentType: "text/plain"}, nil, http.StatusOK, "No Error."},
+    {"MatchingChecksum", File{Filename: "notes.txt", ContentType: "text/plain", Checksum: checksum}, nil, http.StatusOK, "No Error."},
+    {"TooLarge", File{Filename: "notes.txt", ContentType: "text/plain"}, func(t *testing.T) {
+      SetTestSetting[int64](t, &MAX_UPLOAD_BYTES, 5)
+    }, http.StatusRequestEntityTooLarge, "The upload is too large. (At most 5 bytes)"},
+    {"BlockedExtension", File{Filename: "notes.exe", ContentType: "text/plain"}, func(t *testing.T) {
+      SetTestSetting(t, &BLOCKED_EXTENSIONS, []string{"exe"})
+    }, http.StatusUnsupportedMediaType, "Files with this extension aren't allowed."},
+    {"MismatchedContentType", File{Filename: "notes.png", ContentType: "image/png"}, func(t *testing.T) {
+      SetTestSetting(t, &STRICT_CONTENT_TYPE, true)
+    }, http.StatusUnsupportedMediaType, "The content doesn't match its content type. (Claimed image/png, detected text/plain; charset=utf-8)"},
+    {"MismatchedChecksum", File{Filename: "notes.txt", ContentType: "text/plain", Checksum: hex.EncodeToString(make([]byte, 32))}, nil, http.StatusUnprocessableEntity, "The stored content doesn't match its checksum, please upload it again."},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+      SetTestSetting(t, &API_KEYS, map[string]string{"test-key": "test-api-key"})
+      if c.prepare != nil {
+        c.prepare(t)
+      }
+
+      file := c.file
+      file.Owner = "test-key"
+      CreateTestDirectUpload(t, &file, content)
+
+      req := httptest.NewRequest("POST", "/v1/files/"+file.ID.Hex()+"/finalize", nil)
+      req.Header.Set("X-API-Key", "test-api-key")
+      response := DecodeTestResponse(t, ServeTestRequest(req))
+      if response.StatusCode != c.status || response.ErrorText != c.errorText {
+        t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+      }
+
+      session := InitializeMongoSession()
+      defer session.Close()
+      stored := &File{}
+      if err := session.DB(DATABASE).C(COLLECTION).FindId(file.ID).One(stored); err != nil {
+        t.Fatal(err)
+      }
+      _, statErr := STORAGE.Stat(STORAGE.Path(file.URL))
+
+      if c.status != http.StatusOK {
+        if IsNoSuchKeyError(statErr) == false || stored.UploadState != UploadStatePending {
+          t.Fatalf("Kept the rejected object (%v), or the file is %q rather than pending.", statErr, stored.UploadState)
+        }
+        return
+      }
+      if stored.UploadState != UploadStateComplete || stored.Checksum != checksum || stored.Size != int64(len(content)) {
+        t.Fatalf("Stored the file as %q with the checksum %q and size %d.", stored.UploadState, stored.Checksum, stored.Size)
+      }
+    })
+  }
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// Requests each client IP may make to the download endpoints per minute, configured through
+// DOWNLOAD_RATE_PER_MIN. Unlimited when unset or 0.
+var DOWNLOAD_RATE_PER_MIN = 0
+
+// Whether admin and API key requests are exempt from DOWNLOAD_RATE_PER_MIN, configured through
+// DOWNLOAD_RATE_EXEMPT_AUTHENTICATED.
+var DOWNLOAD_RATE_EXEMPT_AUTHENTICATED = false
+
+// Requests counted per client IP in the current minute.
+var downloadRateWindows = map[string]*rateWindow{}
+var downloadRateLock sync.Mutex
+
+// Uploads each client IP may have in progress at once, configured through MAX_CONCURRENT_UPLOADS_PER_IP.
+// Unlimited when unset or 0.
+var MAX_CONCURRENT_UPLOADS_PER_IP = 0
+
+// Uploads in progress per client IP, IPs being dropped once they have none left.
+var concurrentUploads = map[string]int{}
+var concurrentUploadsLock sync.Mutex
+
+type rateWindow struct {
+  Start time.Time
+  Count int
+}
+
+// Loading the download rate limit configuration, called once the environment has been loaded.
+func LoadRateLimitSettings(config *Config) {
+  if ratePerMin := config.Getenv("DOWNLOAD_RATE_PER_MIN", &DOWNLOAD_RATE_PER_MIN); len(ratePerMin) > 0 {
+    rate, err := strconv.Atoi(ratePerMin)
+    if err != nil || rate < 0 {
+      log.Fatalf("Invalid DOWNLOAD_RATE_PER_MIN %q.", ratePerMin)
+    }
+    DOWNLOAD_RATE_PER_MIN = rate
+  }
+
+  if exemptAuthenticated := config.Getenv("DOWNLOAD_RATE_EXEMPT_AUTHENTICATED", &DOWNLOAD_RATE_EXEMPT_AUTHENTICATED); len(exemptAuthenticated) > 0 {
+    exempt, err := strconv.ParseBool(exemptAuthenticated)
+    if err != nil {
+      log.Fatalf("Invalid DOWNLOAD_RATE_EXEMPT_AUTHENTICATED %q.", exemptAuthenticated)
+    }
+    DOWNLOAD_RATE_EXEMPT_AUTHENTICATED = exempt
+  }
+
+  if maxConcurrentUploads := config.Getenv("MAX_CONCURRENT_UPLOADS_PER_IP", &MAX_CONCURRENT_UPLOADS_PER_IP); len(maxConcurrentUploads) > 0 {
+    uploads, err := strconv.Atoi(maxConcurrentUploads)
+    if err != nil || uploads < 0 {
+      log.Fatalf("Invalid MAX_CONCURRENT_UPLOADS_PER_IP %q.", maxConcurrentUploads)
+    }
+    MAX_CONCURRENT_UPLOADS_PER_IP = uploads
+  }
+}
+
+// Middleware
+func LimitDownloadRate(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if DOWNLOAD_RATE_PER_MIN == 0 || (DOWNLOAD_RATE_EXEMPT_AUTHENTICATED && IsAuthenticatedRequest(req)) {
+      next(w, req)
+      return
+    }
+
+    if retryAfter, ok := CountDownloadRequest(ClientIP(req), time.Now()); ok == false {
+      response := GenerateResponse(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), false, 0, "Too many download requests. Please try again later.")
+      response.RetryAfter = retryAfter
+      WriteResponse(response, w, req)
+      return
+    }
+
+    next(w, req)
+  }
+}
+
+// Bounding how many uploads a client has in progress at once, however slowly it sends them, as each holds on to
+// memory and bandwidth until it completes.
+func LimitConcurrentUploads(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if MAX_CONCURRENT_UPLOADS_PER_IP == 0 {
+      next(w, req)
+      return
+    }
+
+    ip := ClientIP(req)
+    if AcquireUploadSlot(ip) == false {
+      response := GenerateResponse(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), false, 0, fmt.Sprintf("Too many uploads in progress, at most %d are accepted at once. Please try again once one has completed.", MAX_CONCURRENT_UPLOADS_PER_IP))
+      WriteResponse(response, w, req)
+      return
+    }
+    // Released however the upload ends, ErrorHandler's panics included.
+    defer ReleaseUploadSlot(ip)
+
+    next(w, req)
+  }
+}
+
+// Rate Limit Utility Functions.
+
+// Takes one of the IP's MAX_CONCURRENT_UPLOADS_PER_IP slots, returning false when it has none left.
+func AcquireUploadSlot(ip string) bool {
+  concurrentUploadsLock.Lock()
+  defer concurrentUploadsLock.Unlock()
+
+  if concurrentUploads[ip] >= MAX_CONCURRENT_UPLOADS_PER_IP {
+    return false
+  }
+  concurrentUploads[ip]++
+  return true
+}
+
+func ReleaseUploadSlot(ip string) {
+  concurrentUploadsLock.Lock()
+  defer concurrentUploadsLock.Unlock()
+
+  concurrentUploads[ip]--
+  if concurrentUploads[ip] <= 0 {
+    delete(concurrentUploads, ip)
+  }
+}
+
+// Counts a request from the IP in its current one minute window. Returns false, with how long until the
+// window ends, when the IP has used up its requests.
+func CountDownloadRequest(ip string, now time.Time) (time.Duration, bool) {
+  downloadRateLock.Lock()
+  defer downloadRateLock.Unlock()
+
+  window, ok := downloadRateWindows[ip]
+  if ok == false || now.Sub(window.Start) >= time.Minute {
+    // Dropping the windows that ended, so the map doesn't grow with every IP ever seen.
+    if ok == false && len(downloadRateWindows) >= 10000 {
+      for windowIp, staleWindow := range downloadRateWindows {
+        if now.Sub(staleWindow.Start) >= time.Minute {
+          delete(downloadRateWindows, windowIp)
+        }
+      }
+    }
+
+    window = &rateWindow{Start: now}
+    downloadRateWindows[ip] = window
+  }
+
+  if window.Count >= DOWNLOAD_RATE_PER_MIN {
+    return window.Start.Add(time.Minute).Sub(now), false
+  }
+
+  window.Count++
+  return 0, true
+}
+
+// Whether the request carries the admin token or a valid API key.
+func IsAuthenticatedRequest(req *http.Request) bool {
+  if IsAdminRequest(req) {
+    return true
+  }
+
+  owner, ok := AuthenticateAPIKey(req)
+  return ok && len(owner) > 0
+}
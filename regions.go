@@ -0,0 +1,121 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+
+  "github.com/mitchellh/goamz/aws"
+  "github.com/mitchellh/goamz/s3"
+)
+
+// A bucket files can be stored in for data residency, picked by name.
+type S3Region struct {
+  Name      string
+  Bucket    string
+  AWSRegion aws.Region
+}
+
+// Regional buckets by name, configured through S3_REGIONS as "name=bucket@aws-region,...". Files without a
+// region are stored in AWS_STORAGE_BUCKET_NAME.
+var S3_REGIONS = map[string]*S3Region{}
+
+// Regions of the uploads made with an API key, configured through API_KEY_REGIONS as "id=region,...".
+var API_KEY_REGIONS = map[string]string{}
+
+// The storage of each region, set up by LoadRegionSettings.
+var REGION_STORAGES = map[string]Storage{}
+
+var regionBuckets = map[string]*s3.Bucket{}
+var regionBucketsLock sync.Mutex
+
+// Loading the regional buckets, called once the storage backend and API keys have been loaded.
+func LoadRegionSettings(config *Config) {
+  if s3Regions := config.Getenv("S3_REGIONS", GetRegionNames); len(s3Regions) > 0 {
+    for _, entry := range strings.Split(s3Regions, ",") {
+      name, location, _ := strings.Cut(strings.TrimSpace(entry), "=")
+      bucket, awsRegionName, _ := strings.Cut(location, "@")
+      // Regions goamz doesn't know of only need their name, the AWS SDK finds their endpoints itself.
+      awsRegion, ok := aws.Regions[awsRegionName]
+      if ok == false && IsValidAWSRegion(awsRegionName) {
+        awsRegion, ok = aws.Region{Name: awsRegionName}, true
+      }
+      if apiKeyIdPattern.MatchString(name) == false || len(bucket) == 0 || ok == false {
+        log.Fatalf("Invalid S3_REGIONS entry %q, expected name=bucket@aws-region.", entry)
+      }
+      S3_REGIONS[name] = &S3Region{name, bucket, awsRegion}
+    }
+  }
+
+  if apiKeyRegions := config.Getenv("API_KEY_REGIONS", &API_KEY_REGIONS); len(apiKeyRegions) > 0 {
+    for _, entry := range strings.Split(apiKeyRegions, ",") {
+      keyId, region, _ := strings.Cut(strings.TrimSpace(entry), "=")
+      if _, ok := API_KEYS[keyId]; ok == false || S3_REGIONS[region] == nil {
+        log.Fatalf("Invalid API_KEY_REGIONS entry %q, expected the id of an API key and the name of a region.", entry)
+      }
+      API_KEY_REGIONS[keyId] = region
+    }
+  }
+
+  // Regions share the in-memory backend, which has no buckets.
+  for name := range S3_REGIONS {
+    if IsS3Storage(STORAGE) {
+      REGION_STORAGES[name] = &BreakerStorage{NewS3Storage(name)}
+    } else {
+      REGION_STORAGES[name] = STORAGE
+    }
+  }
+}
+
+// Region Utility Functions.
+
+// Returns the region the request's upload is stored in: the one named by its X-Region header, or else the
+// one of its API key. Empty for the default bucket.
+func ResolveRegion(req *http.Request) (string, error) {
+  if region := req.Header.Get("X-Region"); len(region) > 0 {
+    if S3_REGIONS[region] == nil {
+      return "", fmt.Errorf("unknown region %q", region)
+    }
+    return region, nil
+  }
+
+  owner, _ := AuthenticateAPIKey(req)
+  return API_KEY_REGIONS[owner], nil
+}
+
+// The storage of the region, the default one for files without a region.
+func GetStorage(region string) Storage {
+  if storage, ok := REGION_STORAGES[region]; ok {
+    return storage
+  }
+  return STORAGE
+}
+
+func GetRegionBucket(region string) *s3.Bucket {
+  bucket, err := LoadRegionBucket(region)
+  ErrorHandler(err)
+  return bucket
+}
+
+func LoadRegionBucket(region string) (*s3.Bucket, error) {
+  s3Region := S3_REGIONS[region]
+  if s3Region == nil {
+    return nil, fmt.Errorf("unknown region %q", region)
+  }
+
+  regionBucketsLock.Lock()
+  defer regionBucketsLock.Unlock()
+
+  auth, err := GetAWSAuth()
+  if err != nil {
+    return nil, err
+  }
+
+  if regionBuckets[region] == nil || regionBuckets[region].Auth != auth {
+    regionBuckets[region] = s3.New(auth, s3Region.AWSRegion).Bucket(s3Region.Bucket)
+  }
+
+  return regionBuckets[region], nil
+}
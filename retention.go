@@ -0,0 +1,126 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Longest a file may be kept, configured through MAX_RETENTION. Files are kept until accessed when zero.
+var MAX_RETENTION time.Duration
+
+// What happens to an expires_in beyond MAX_RETENTION, configured through RETENTION_MODE: "clamp" shortens
+// it to MAX_RETENTION, "reject" refuses the upload.
+var RETENTION_MODE = "clamp"
+
+// Loading the retention configuration, called once the environment has been loaded.
+func LoadRetentionSettings(config *Config) {
+  if maxRetention := config.Getenv("MAX_RETENTION", &MAX_RETENTION); len(maxRetention) > 0 {
+    duration, err := time.ParseDuration(maxRetention)
+    if err != nil || duration <= 0 {
+      log.Fatalf("Invalid MAX_RETENTION %q.", maxRetention)
+    }
+    MAX_RETENTION = duration
+  }
+
+  if retentionMode := config.Getenv("RETENTION_MODE", &RETENTION_MODE); len(retentionMode) > 0 {
+    if retentionMode != "clamp" && retentionMode != "reject" {
+      log.Fatalf("Invalid RETENTION_MODE %q, expected clamp or reject.", retentionMode)
+    }
+    RETENTION_MODE = retentionMode
+  }
+}
+
+// Retention Utility Functions.
+
+// Resolves the submitted expires_in (seconds, or a duration such as "24h") against the retention policy,
+// returning the duration to keep the file for (zero for no expiration) and a note when it was clamped.
+func ResolveExpiresIn(submittedExpiresIn string) (expiresIn time.Duration, note string, err error) {
+  if len(submittedExpiresIn) == 0 {
+    return MAX_RETENTION, "", nil
+  }
+
+  expiresIn, err = ParseDurationValue(submittedExpiresIn)
+  if err != nil {
+    return 0, "", errors.New("expires_in must be a positive number of seconds or a duration such as 24h")
+  }
+
+  if MAX_RETENTION > 0 && expiresIn > MAX_RETENTION {
+    if RETENTION_MODE == "reject" {
+      return 0, "", fmt.Errorf("expires_in exceeds the maximum retention of %v", MAX_RETENTION)
+    }
+
+    return MAX_RETENTION, fmt.Sprintf("expires_in exceeded the maximum retention and was clamped to %v.", MAX_RETENTION), nil
+  }
+
+  return expiresIn, "", nil
+}
+
+// Returns the problem of an expires_in over the maximum retention when such values are rejected. Values that
+// don't parse are left to ValidateForm.
+func ValidateRetentionFields(req *http.Request) []*FieldError {
+  expiresIn, err := ParseDurationValue(req.PostForm.Get("expires_in"))
+  if err != nil || MAX_RETENTION <= 0 || expiresIn <= MAX_RETENTION || RETENTION_MODE != "reject" {
+    return nil
+  }
+
+  return []*FieldError{{"expires_in", FieldErrorOutOfRange, fmt.Sprintf("Exceeds the maximum retention of %v.", MAX_RETENTION)}}
+}
+
+func IsFileExpired(file *File) bool {
+  return file.ExpiresAt != nil && CLOCK.Now().After(*file.ExpiresAt)
+}
+
+// Deletes the objects and records of the files that expired, leaving tombstones telling they expired. Files
+// consumed first are left to PurgeConsumedFiles, soft deleted ones to PurgeSoftDeletedFiles, and those under a
+// hold until it has passed.
+func PurgeExpiredFiles(session *mgo.Session) {
+  files := []File{}
+  query := bson.M{"expiresat": bson.M{"$lt": CLOCK.Now()}, "accessed": false, "deletedat": bson.M{"$exists": false}, "$and": []bson.M{NotImmutableQuery()}}
+  err := session.DB(DATABASE).C(COLLECTION).Find(query).Limit(SWEEP_BATCH_SIZE).All(&files)
+  ErrorHandler(err)
+
+  SweepConcurrently(session, len(files), func(session *mgo.Session, i int) {
+    file := &files[i]
+    if len(file.URL) > 0 {
+      DeleteFileObjects(file)
+    }
+
+    err := RemoveFileRecord(session.DB(DATABASE).C(COLLECTION), file)
+    if err != mgo.ErrNotFound {
+      ErrorHandler(err)
+    }
+  })
+}
+
+// Starts the grace window of a file expiring after access, moving its expiration to ExpireAfterAccess from now
+// unless it already expires sooner, and scheduling the deletion of its objects for when the window ends.
+func StartAccessWindow(collection *mgo.Collection, file *File) {
+  accessedAt := CLOCK.Now()
+  expiresAt := accessedAt.Add(file.ExpireAfterAccess)
+  if file.ExpiresAt != nil && file.ExpiresAt.Before(expiresAt) {
+    expiresAt = *file.ExpiresAt
+  }
+
+  // Only the request starting the window schedules the deletion, concurrent first downloads leave it be.
+  err := collection.Update(bson.M{"_id": file.ID, "firstaccessedat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"firstaccessedat": accessedAt, "expiresat": expiresAt}})
+  if err == mgo.ErrNotFound {
+    return
+  }
+  ErrorHandler(err)
+
+  file.FirstAccessedAt = &accessedAt
+  file.ExpiresAt = &expiresAt
+
+  storage := GetStorage(file.Region)
+  deleteAt := GetObjectDeletionTime(file, expiresAt)
+  QueueDeletion(file.Region, storage.Path(file.URL), deleteAt)
+  for _, format := range file.Formats {
+    QueueDeletion(file.Region, storage.Path(format.URL), deleteAt)
+  }
+}
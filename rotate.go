@@ -0,0 +1,119 @@
+package main
+
+import (
+  "net/http"
+  "path"
+  "strings"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Handlers
+func RotateFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetDeletePasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the delete password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckDeletePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckImmutable(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true || IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Copying the object and its formats to a new random key before deleting the old ones, so neither the old
+  // link nor the formats derived from it keep working.
+  oldFile := *file
+  filename := file.Filename
+  if len(filename) == 0 {
+    filename = path.Base(GetStorage(file.Region).Path(oldFile.URL))
+  }
+
+  storage := GetStorage(file.Region)
+  oldPath := storage.Path(oldFile.URL)
+  newPath := GetTenantPrefix(file.Owner) + CreateS3Path(filename)
+  err := storage.Copy(oldPath, newPath)
+  if err != nil {
+    return HandleError(err)
+  }
+  copiedPaths := []string{newPath}
+
+  formats := []StoredFormat{}
+  for _, format := range oldFile.Formats {
+    formatPath := newPath + GetFormatSuffix(oldPath, storage.Path(format.URL), format.Name)
+    if err = storage.Copy(storage.Path(format.URL), formatPath); err != nil {
+      for _, copiedPath := range copiedPaths {
+        TryDeleteFileFromS3(file.Region, storage.URL(copiedPath))
+      }
+      return HandleError(err)
+    }
+    copiedPaths = append(copiedPaths, formatPath)
+
+    format.URL = storage.URL(formatPath)
+    formats = append(formats, format)
+  }
+
+  file.URL = storage.URL(newPath)
+  rotated := bson.M{"url": file.URL}
+  if len(formats) > 0 {
+    file.Formats = formats
+    rotated["formats"] = formats
+  }
+  err = collection.UpdateId(file.ID, bson.M{"$set": rotated})
+  if err != nil {
+    for _, copiedPath := range copiedPaths {
+      TryDeleteFileFromS3(file.Region, storage.URL(copiedPath))
+    }
+    return HandleError(err)
+  }
+
+  // The rotation is done, objects that fail to be deleted are left to the sweeper.
+  TryDeleteFileFromS3(file.Region, oldFile.URL)
+  TryDeleteFileFormats(&oldFile)
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = file
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Rotate Utility Functions.
+
+// The suffix the format's path adds to the path of the file's object, such as ".thumbnail.png", or one made of
+// the format's name for formats stored elsewhere.
+func GetFormatSuffix(filePath string, formatPath string, name string) string {
+  if strings.HasPrefix(formatPath, filePath) && len(formatPath) > len(filePath) {
+    return strings.TrimPrefix(formatPath, filePath)
+  }
+  return "." + name
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+func TestRotateMovesFormats(t *testing.T) {
+  ResetTestState(t)
+  file := UploadTestFile(t, [][2]string{{"delete_password", "delete-secret"}}, "notes.txt", []byte("Hello, world."))
+
+  // A thumbnail as the thumbnail hook stores it, beside the file's object.
+  thumbnailPath := STORAGE.Path(file.URL) + ".thumbnail.png"
+  if err := STORAGE.Put(thumbnailPath, []byte("thumbnail"), map[string][]string{"Content-Type": {"image/png"}}); err != nil {
+    t.Fatal(err)
+  }
+  session := InitializeMongoSession()
+  defer session.Close()
+  format := StoredFormat{FormatThumbnail, "image/png", 9, STORAGE.URL(thumbnailPath)}
+  if err := session.DB(DATABASE).C(COLLECTION).UpdateId(file.ID, bson.M{"$push": bson.M{"formats": format}}); err != nil {
+    t.Fatal(err)
+  }
+
+  recorder := ServeTestRequest(httptest.NewRequest("POST", "/v1/files/"+file.ID.Hex()+"/rotate?delete_password=delete-secret", nil))
+  response := DecodeTestResponse(t, recorder)
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("Rotate returned %d: %s", response.StatusCode, recorder.Body.String())
+  }
+  rotated := &TestFile{}
+  if err := json.Unmarshal(response.Content, rotated); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, oldPath := range []string{STORAGE.Path(file.URL), thumbnailPath} {
+    if _, err := STORAGE.Stat(oldPath); IsNoSuchKeyError(err) == false {
+      t.Fatalf("The old object %s is still there. (%v)", oldPath, err)
+    }
+  }
+
+  stored := &File{}
+  if err := session.DB(DATABASE).C(COLLECTION).FindId(file.ID).One(stored); err != nil {
+    t.Fatal(err)
+  }
+  expected := STORAGE.URL(STORAGE.Path(rotated.URL) + ".thumbnail.png")
+  if stored.URL != rotated.URL || len(stored.Formats) != 1 || stored.Formats[0].URL != expected {
+    t.Fatalf("Stored the URL %q and the formats %v, expected %q and a thumbnail at %q.", stored.URL, stored.Formats, rotated.URL, expected)
+  }
+  if _, err := STORAGE.Stat(STORAGE.Path(expected)); err != nil {
+    t.Fatalf("The rotated thumbnail is missing: %v", err)
+  }
+}
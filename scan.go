@@ -0,0 +1,311 @@
+package main
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// States of a file's virus scan. Files uploaded while AV_SCAN was off have no state, and are downloadable.
+const (
+  ScanStateQuarantined = "quarantined"
+  ScanStateClean       = "clean"
+  ScanStateInfected    = "infected"
+)
+
+// Whether uploads are quarantined until a virus scan finds them clean, configured through AV_SCAN.
+var AV_SCAN = false
+
+// Address of the clamd daemon scanning uploads, configured through AV_SCANNER_ADDRESS.
+var AV_SCANNER_ADDRESS = "localhost:3310"
+
+// Longest a scan may take, configured through AV_SCAN_TIMEOUT. Files still quarantined after twice as long,
+// because the scanner was unreachable or the server restarted, are scanned again by the sweeper.
+var AV_SCAN_TIMEOUT = time.Minute
+
+// Prefix scanned uploads are stored under until found clean, configured through AV_QUARANTINE_PREFIX. Clean
+// objects are then moved to the same key without it, so a bucket policy denying reads under the prefix keeps
+// unscanned content from ever being served. Uploads stay where they land when empty.
+var AV_QUARANTINE_PREFIX = ""
+
+// Size of the chunks streamed to clamd, well under its default StreamMaxLength.
+const AV_SCAN_CHUNK_SIZE = 64 << 10
+
+// Loading the virus scanning configuration, called once the environment has been loaded.
+func LoadScanSettings(config *Config) {
+  if avScan := config.Getenv("AV_SCAN", &AV_SCAN); len(avScan) > 0 {
+    enabled, err := strconv.ParseBool(avScan)
+    if err != nil {
+      log.Fatalf("Invalid AV_SCAN %q.", avScan)
+    }
+    AV_SCAN = enabled
+  }
+
+  if scannerAddress := config.Getenv("AV_SCANNER_ADDRESS", &AV_SCANNER_ADDRESS); len(scannerAddress) > 0 {
+    if _, _, err := net.SplitHostPort(scannerAddress); err != nil {
+      log.Fatalf("Invalid AV_SCANNER_ADDRESS %q.", scannerAddress)
+    }
+    AV_SCANNER_ADDRESS = scannerAddress
+  }
+
+  if scanTimeout := config.Getenv("AV_SCAN_TIMEOUT", &AV_SCAN_TIMEOUT); len(scanTimeout) > 0 {
+    timeout, err := time.ParseDuration(scanTimeout)
+    if err != nil || timeout <= 0 {
+      log.Fatalf("Invalid AV_SCAN_TIMEOUT %q.", scanTimeout)
+    }
+    AV_SCAN_TIMEOUT = timeout
+  }
+
+  if quarantinePrefix, ok := config.LookupEnv("AV_QUARANTINE_PREFIX", &AV_QUARANTINE_PREFIX); ok {
+    if strings.HasPrefix(quarantinePrefix, "/") || (len(quarantinePrefix) > 0 && strings.HasSuffix(quarantinePrefix, "/") == false) {
+      log.Fatalf("Invalid AV_QUARANTINE_PREFIX %q, expected a prefix such as quarantine/.", quarantinePrefix)
+    }
+    AV_QUARANTINE_PREFIX = quarantinePrefix
+  }
+}
+
+// Scan Utility Functions.
+
+// Returns nil unless the file is quarantined or was found infected, otherwise the response explaining why
+// it can't be accessed.
+func CheckScanState(file *File) *Response {
+  switch file.ScanState {
+  case ScanStateQuarantined:
+    return GenerateResponse(http.StatusLocked, http.StatusText(http.StatusLocked), false, 0, "This file is still being scanned.")
+  case ScanStateInfected:
+    return SetGoneReason(GenerateResponse(http.StatusUnavailableForLegalReasons, http.StatusText(http.StatusUnavailableForLegalReasons), false, 0, GONE_REASON_TEXTS[GoneReasonQuarantine]), GoneReasonQuarantine)
+  }
+
+  return nil
+}
+
+// Scans the stored file, releasing it when clean and deleting its objects when infected. Scanner errors leave
+// the file quarantined for the sweeper to scan again.
+func ScanFile(collection *mgo.Collection, file *File) {
+  signature, err := ScanObject(GetStorage(file.Region), file.URL, file.Compressed)
+  if err != nil {
+    RecordFailedScan(collection, file, err)
+    return
+  }
+
+  scanState := ScanStateClean
+  if len(signature) > 0 {
+    scanState = ScanStateInfected
+    log.Printf("File %s is infected: %s", file.ID.Hex(), signature)
+  }
+
+  // Moving clean objects out of quarantine before releasing them, a failed move being retried with the scan.
+  scanned := bson.M{"scanstate": scanState, "scannedat": CLOCK.Now()}
+  if scanState == ScanStateInfected {
+    scanned["gonereason"] = GoneReasonQuarantine
+  }
+  quarantinedUrl, releasedUrl := file.URL, ""
+  if scanState == ScanStateClean {
+    releasedUrl, err = ReleaseQuarantinedObject(file)
+    if err != nil {
+      RecordFailedScan(collection, file, err)
+      return
+    }
+    if len(releasedUrl) > 0 {
+      scanned["url"] = releasedUrl
+    }
+  }
+
+  // The file was deleted while it was being scanned when it's no longer there to update.
+  err = collection.Update(bson.M{"_id": file.ID, "scanstate": ScanStateQuarantined}, bson.M{"$set": scanned})
+  if err == mgo.ErrNotFound {
+    if len(releasedUrl) > 0 {
+      TryDeleteFileFromS3(file.Region, releasedUrl)
+    }
+    return
+  }
+  ErrorHandler(err)
+  file.ScanState = scanState
+  if scanState == ScanStateInfected {
+    file.GoneReason = GoneReasonQuarantine
+  }
+
+  if len(releasedUrl) > 0 {
+    file.URL = releasedUrl
+    TryDeleteFileFromS3(file.Region, quarantinedUrl)
+  }
+
+  // Post-upload processing waits for the file to be found clean.
+  if scanState == ScanStateInfected {
+    TryDeleteFileFromS3(file.Region, file.URL)
+    TryDeleteFileFormats(file)
+  } else {
+    RunPostUploadHooks(file)
+  }
+}
+
+// Leaves the file quarantined for the sweeper to scan again, recording when it was tried.
+func RecordFailedScan(collection *mgo.Collection, file *File, scanErr error) {
+  log.Printf("Unable to scan file %s: %v", file.ID.Hex(), scanErr)
+  err := collection.Update(bson.M{"_id": file.ID, "scanstate": ScanStateQuarantined}, bson.M{"$set": bson.M{"scannedat": CLOCK.Now()}})
+  if err != nil && err != mgo.ErrNotFound {
+    log.Printf("Unable to record the scan of file %s: %v", file.ID.Hex(), err)
+  }
+}
+
+// Copies the clean object of the file out of AV_QUARANTINE_PREFIX, returning the URL it was released to. Empty
+// when the object isn't under the prefix, such as when it landed before the prefix was configured.
+func ReleaseQuarantinedObject(file *File) (string, error) {
+  storage := GetStorage(file.Region)
+  quarantinedPath := storage.Path(file.URL)
+  if len(AV_QUARANTINE_PREFIX) == 0 || strings.HasPrefix(quarantinedPath, AV_QUARANTINE_PREFIX) == false {
+    return "", nil
+  }
+
+  releasedPath := strings.TrimPrefix(quarantinedPath, AV_QUARANTINE_PREFIX)
+  if err := storage.Copy(quarantinedPath, releasedPath); err != nil {
+    return "", err
+  }
+  return storage.URL(releasedPath), nil
+}
+
+// The prefix a new upload of the owner is stored under, within quarantine when it's to be scanned.
+func GetUploadPrefix(owner string) string {
+  if AV_SCAN {
+    return AV_QUARANTINE_PREFIX + GetTenantPrefix(owner)
+  }
+  return GetTenantPrefix(owner)
+}
+
+// The canned ACL of an object stored at the path, private while it's quarantined, so neither its URL nor a
+// misconfigured bucket policy can serve it before the scan. Releasing it copies it to a public-read object.
+func GetObjectACL(path string) string {
+  if AV_SCAN && len(AV_QUARANTINE_PREFIX) > 0 && strings.HasPrefix(path, AV_QUARANTINE_PREFIX) {
+    return "private"
+  }
+  return "public-read"
+}
+
+// Whether clients can be given the URL of the file, which only leads to scanned content once it's released.
+func IsFileReleased(file *File) bool {
+  return file.ScanState != ScanStateQuarantined && file.ScanState != ScanStateInfected
+}
+
+// Scans the file in the background of the request that stored it.
+func ScanFileInBackground(file *File) {
+  defer func() {
+    if err := recover(); err != nil {
+      log.Printf("Scan of file %s failed: %v", file.ID.Hex(), err)
+    }
+  }()
+
+  session := InitializeMongoSession()
+  defer session.Close()
+
+  ScanFile(session.DB(DATABASE).C(COLLECTION), file)
+}
+
+// Scans again the files left quarantined by a scan that failed or never finished.
+func RescanQuarantinedFiles(session *mgo.Session) {
+  if AV_SCAN == false {
+    return
+  }
+
+  collection := session.DB(DATABASE).C(COLLECTION)
+  stale := CLOCK.Now().Add(-2 * AV_SCAN_TIMEOUT)
+
+  files := []File{}
+  query := bson.M{
+    "scanstate": ScanStateQuarantined,
+    "_id":       bson.M{"$lt": bson.NewObjectIdWithTime(stale)},
+    "$or":       []bson.M{{"scannedat": bson.M{"$exists": false}}, {"scannedat": bson.M{"$lt": stale}}},
+  }
+  err := collection.Find(query).Limit(100).All(&files)
+  ErrorHandler(err)
+
+  for i := range files {
+    ScanFile(collection, &files[i])
+  }
+}
+
+// Streams the object to clamd, returning the name of the signature found, or an empty string when it's clean.
+func ScanObject(storage Storage, fileAbsoluteUrl string, compressed bool) (signature string, err error) {
+  object, err := storage.Get(storage.Path(fileAbsoluteUrl))
+  if err != nil {
+    return "", err
+  }
+  defer object.Body.Close()
+
+  // Scanning the original content, not its compressed form.
+  body := io.Reader(object.Body)
+  if compressed && object.Decompressed == false {
+    gzipReader, err := gzip.NewReader(object.Body)
+    if err != nil {
+      return "", err
+    }
+    defer gzipReader.Close()
+    body = gzipReader
+  }
+
+  connection, err := net.DialTimeout("tcp", AV_SCANNER_ADDRESS, AV_SCAN_TIMEOUT)
+  if err != nil {
+    return "", err
+  }
+  defer connection.Close()
+  connection.SetDeadline(time.Now().Add(AV_SCAN_TIMEOUT))
+
+  // INSTREAM takes chunks prefixed with their length, and a zero length chunk to end the stream.
+  if _, err = io.WriteString(connection, "zINSTREAM\x00"); err != nil {
+    return "", err
+  }
+
+  chunk := make([]byte, AV_SCAN_CHUNK_SIZE+4)
+  for {
+    n, readErr := io.ReadFull(body, chunk[4:])
+    if n > 0 {
+      binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+      if _, err = connection.Write(chunk[:n+4]); err != nil {
+        return "", err
+      }
+    }
+
+    if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+      break
+    }
+    if readErr != nil {
+      return "", readErr
+    }
+  }
+
+  if _, err = connection.Write([]byte{0, 0, 0, 0}); err != nil {
+    return "", err
+  }
+
+  reply, err := bufio.NewReader(connection).ReadString(0)
+  if err != nil && err != io.EOF {
+    return "", err
+  }
+
+  return ParseScanReply(reply)
+}
+
+// Parses clamd's reply, "stream: OK" for clean content and "stream: <signature> FOUND" otherwise.
+func ParseScanReply(reply string) (signature string, err error) {
+  reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+  result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+
+  switch {
+  case result == "OK":
+    return "", nil
+  case strings.HasSuffix(result, " FOUND"):
+    return strings.TrimSuffix(result, " FOUND"), nil
+  }
+
+  return "", fmt.Errorf("unexpected scanner reply %q", reply)
+}
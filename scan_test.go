@@ -0,0 +1,126 @@
+package main
+
+import (
+  "encoding/binary"
+  "encoding/json"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Listens as clamd would for the length of the test, finding everything clean once released is closed.
+func StartTestScanner(t *testing.T, released chan struct{}) {
+  t.Helper()
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { listener.Close() })
+  SetTestSetting(t, &AV_SCANNER_ADDRESS, listener.Addr().String())
+
+  go func() {
+    for {
+      connection, err := listener.Accept()
+      if err != nil {
+        return
+      }
+
+      go func() {
+        defer connection.Close()
+        command := make([]byte, len("zINSTREAM\x00"))
+        if _, err := io.ReadFull(connection, command); err != nil {
+          return
+        }
+        for {
+          length := make([]byte, 4)
+          if _, err := io.ReadFull(connection, length); err != nil {
+            return
+          }
+          if binary.BigEndian.Uint32(length) == 0 {
+            break
+          }
+          if _, err := io.CopyN(io.Discard, connection, int64(binary.BigEndian.Uint32(length))); err != nil {
+            return
+          }
+        }
+        <-released
+        io.WriteString(connection, "stream: OK\x00")
+      }()
+    }
+  }()
+}
+
+// The ACL the object at the path was stored with.
+func GetTestObjectACL(t *testing.T, path string) string {
+  t.Helper()
+
+  storage := STORAGE.(*MemoryStorage)
+  storage.Lock()
+  defer storage.Unlock()
+  object, ok := storage.objects[path]
+  if ok == false || len(object.headers["x-amz-acl"]) == 0 {
+    t.Fatalf("No ACL was stored for %s.", path)
+  }
+  return object.headers["x-amz-acl"][0]
+}
+
+func TestQuarantinedUploadsStayPrivate(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &AV_SCAN, true)
+  SetTestSetting(t, &AV_QUARANTINE_PREFIX, "quarantine/")
+  released := make(chan struct{})
+  release := sync.OnceFunc(func() { close(released) })
+  t.Cleanup(release)
+  StartTestScanner(t, released)
+
+  recorder := ServeTestRequest(NewTestUploadRequest(t, nil, "notes.txt", []byte("Hello, world.")))
+  response := DecodeTestResponse(t, recorder)
+  if response.StatusCode != http.StatusAccepted {
+    t.Fatalf("Upload returned %d: %s", response.StatusCode, recorder.Body.String())
+  }
+  file := &TestFile{}
+  if err := json.Unmarshal(response.Content, file); err != nil {
+    t.Fatal(err)
+  }
+  if len(file.URL) > 0 {
+    t.Errorf("Returned the URL %q of a quarantined file.", file.URL)
+  }
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  stored := &File{}
+  if err := session.DB(DATABASE).C(COLLECTION).FindId(file.ID).One(stored); err != nil {
+    t.Fatal(err)
+  }
+  if acl := GetTestObjectACL(t, STORAGE.Path(stored.URL)); acl != "private" {
+    t.Errorf("Quarantined %s with the ACL %q.", stored.URL, acl)
+  }
+  release()
+
+  // Waiting for the scan in the background to release the file.
+  for deadline := time.Now().Add(5 * time.Second); stored.ScanState != ScanStateClean; time.Sleep(10 * time.Millisecond) {
+    if time.Now().After(deadline) {
+      t.Fatalf("The file is still %q.", stored.ScanState)
+    }
+    if err := session.DB(DATABASE).C(COLLECTION).FindId(file.ID).One(stored); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if acl := GetTestObjectACL(t, STORAGE.Path(stored.URL)); acl != "public-read" {
+    t.Fatalf("Released %s with the ACL %q.", stored.URL, acl)
+  }
+
+  response = DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex(), nil)))
+  accessed := &TestFile{}
+  if err := json.Unmarshal(response.Content, accessed); err != nil {
+    t.Fatal(err)
+  }
+  if response.StatusCode != http.StatusOK || accessed.URL != stored.URL {
+    t.Fatalf("Got %d with the URL %q, expected %q.", response.StatusCode, accessed.URL, stored.URL)
+  }
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/url"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+
+  awssdk "github.com/aws/aws-sdk-go-v2/aws"
+  awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+  "github.com/aws/aws-sdk-go-v2/config"
+  "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+  s3sdk "github.com/aws/aws-sdk-go-v2/service/s3"
+  s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+  "github.com/aws/smithy-go"
+  "github.com/mitchellh/goamz/aws"
+  "github.com/mitchellh/goamz/s3"
+)
+
+// The library S3 is reached through, configured through S3_SDK as "goamz" or "aws-sdk". Both get their
+// credentials from the AWS SDK's default chain, the SDK knowing of regions goamz doesn't.
+var S3_SDK = "goamz"
+
+// Region names the AWS SDK may be given, goamz only accepting those it knows of.
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// The clients of the default bucket and of each region's, by the name of the region.
+var sdkClients = map[string]*SDKClient{}
+var sdkClientsLock sync.Mutex
+
+type SDKClient struct {
+  Client *s3sdk.Client
+  Bucket string
+  // Objects keep the URLs goamz gives them, so files stored through either library can be read through the other.
+  urlBucket *s3.Bucket
+  urlRoot   string
+}
+
+// S3 Storage through the AWS SDK, of the default bucket or of a region's.
+type SDKStorage struct {
+  Region string
+}
+
+func (storage *SDKStorage) Client() *SDKClient {
+  client, err := LoadSDKClient(storage.Region)
+  ErrorHandler(err)
+  return client
+}
+
+func (storage *SDKStorage) Put(path string, content []byte, headers map[string][]string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  input := NewSDKPutInput(client.Bucket, path, headers)
+  input.Body = bytes.NewReader(content)
+  input.ContentLength = awssdk.Int64(int64(len(content)))
+  _, err := client.Client.PutObject(context.Background(), input)
+  return err
+}
+
+// The uploader goes through a multipart upload for content larger than a part, taking every header along. The
+// SDK sends a checksum of each request's content, which S3 checks before storing it.
+func (storage *SDKStorage) PutReader(path string, reader io.Reader, headers map[string][]string) (int64, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return 0, err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  uploader := manager.NewUploader(client.Client, func(uploader *manager.Uploader) {
+    uploader.PartSize = S3_PART_SIZE
+    uploader.Concurrency = 1
+  })
+
+  counter := &countingReader{Reader: reader}
+  input := NewSDKPutInput(client.Bucket, path, headers)
+  input.Body = counter
+  _, err := uploader.Upload(context.Background(), input)
+  if err != nil {
+    return 0, err
+  }
+  return counter.Count, nil
+}
+
+// The slot is held until the object's body is closed, since the connection stays busy while it's streamed.
+func (storage *SDKStorage) Get(path string) (*StoredObject, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+
+  client := storage.Client()
+  res, err := client.Client.GetObject(context.Background(), &s3sdk.GetObjectInput{Bucket: &client.Bucket, Key: &path})
+  if err != nil {
+    ReleaseS3Slot()
+    return nil, err
+  }
+
+  // The SDK asks for content as stored, it's never decompressed in transit.
+  body := &s3SlotBody{ReadCloser: res.Body}
+  return &StoredObject{body, awssdk.ToString(res.ContentType), GetSDKContentLength(res.ContentLength), false}, nil
+}
+
+func (storage *SDKStorage) Del(path string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  _, err := client.Client.DeleteObject(context.Background(), &s3sdk.DeleteObjectInput{Bucket: &client.Bucket, Key: &path})
+  return err
+}
+
+// Copying server side, S3 keeps the source's metadata but not its storage class.
+func (storage *SDKStorage) Copy(sourcePath string, path string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  input := &s3sdk.CopyObjectInput{
+    Bucket:       &client.Bucket,
+    Key:          &path,
+    CopySource:   awssdk.String((&url.URL{Path: client.Bucket + "/" + sourcePath}).EscapedPath()),
+    ACL:          s3types.ObjectCannedACLPublicRead,
+    StorageClass: s3types.StorageClass(STORAGE_CLASS),
+  }
+  _, err := client.Client.CopyObject(context.Background(), input)
+  return err
+}
+
+func (storage *SDKStorage) List(prefix string, marker string, max int) ([]string, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  input := &s3sdk.ListObjectsV2Input{Bucket: &client.Bucket, Prefix: &prefix, MaxKeys: awssdk.Int32(int32(max))}
+  if len(marker) > 0 {
+    input.StartAfter = &marker
+  }
+  list, err := client.Client.ListObjectsV2(context.Background(), input)
+  if err != nil {
+    return nil, err
+  }
+
+  paths := []string{}
+  for _, object := range list.Contents {
+    paths = append(paths, awssdk.ToString(object.Key))
+  }
+  return paths, nil
+}
+
+func (storage *SDKStorage) Stat(path string) (*ObjectInfo, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+  defer ReleaseS3Slot()
+
+  client := storage.Client()
+  res, err := client.Client.HeadObject(context.Background(), &s3sdk.HeadObjectInput{Bucket: &client.Bucket, Key: &path})
+  if err != nil {
+    return nil, err
+  }
+
+  return &ObjectInfo{awssdk.ToString(res.ContentType), GetSDKContentLength(res.ContentLength)}, nil
+}
+
+// Signing with signature version 4, the headers it signs being added to those the client has to send. Checksums
+// are left out, the content being unknown when signing.
+func (storage *SDKStorage) SignedPutURL(path string, headers map[string][]string, expiresAt time.Time) (string, error) {
+  client := storage.Client()
+  presigner := s3sdk.NewPresignClient(client.Client, s3sdk.WithPresignClientFromClientOptions(func(options *s3sdk.Options) {
+    options.RequestChecksumCalculation = awssdk.RequestChecksumCalculationWhenRequired
+  }))
+
+  signed, err := presigner.PresignPutObject(context.Background(), NewSDKPutInput(client.Bucket, path, headers), s3sdk.WithPresignExpires(time.Until(expiresAt)))
+  if err != nil {
+    return "", err
+  }
+
+  // The signed headers come canonicalized, replacing the ones they were given as.
+  for name, values := range signed.SignedHeader {
+    if strings.EqualFold(name, "Host") {
+      continue
+    }
+    for headerName := range headers {
+      if strings.EqualFold(headerName, name) {
+        delete(headers, headerName)
+      }
+    }
+    headers[name] = values
+  }
+  return signed.URL, nil
+}
+
+func (storage *SDKStorage) SignedGetURL(path string, expiresAt time.Time) (string, error) {
+  client := storage.Client()
+  signed, err := s3sdk.NewPresignClient(client.Client).PresignGetObject(context.Background(), &s3sdk.GetObjectInput{Bucket: &client.Bucket, Key: &path}, s3sdk.WithPresignExpires(time.Until(expiresAt)))
+  if err != nil {
+    return "", err
+  }
+  return signed.URL, nil
+}
+
+func (storage *SDKStorage) URL(path string) string {
+  client := storage.Client()
+  if client.urlBucket != nil {
+    return client.urlBucket.URL(path)
+  }
+  return client.urlRoot + (&url.URL{Path: path}).EscapedPath()
+}
+
+func (storage *SDKStorage) Path(fileAbsoluteUrl string) string {
+  if len(storage.Region) == 0 {
+    return GetS3RelativeUrl(fileAbsoluteUrl)
+  }
+  return strings.TrimPrefix(fileAbsoluteUrl, storage.URL(""))
+}
+
+// SDK Storage Utility Functions.
+
+// The storage of the default bucket, or of a region's, through the library S3_SDK picks.
+func NewS3Storage(region string) Storage {
+  if S3_SDK == "aws-sdk" {
+    return &SDKStorage{Region: region}
+  }
+  return &S3Storage{Region: region}
+}
+
+// Whether the region can be used: known to goamz, or named as AWS names regions when going through the SDK.
+func IsValidAWSRegion(name string) bool {
+  if _, ok := aws.Regions[name]; ok {
+    return true
+  }
+  return S3_SDK == "aws-sdk" && awsRegionPattern.MatchString(name)
+}
+
+// Creating the client of the region once and reusing it, it's safe for concurrent use. The default bucket's
+// region is AWS_REGION, or else asked of S3 as goamz does.
+func LoadSDKClient(region string) (*SDKClient, error) {
+  sdkClientsLock.Lock()
+  defer sdkClientsLock.Unlock()
+
+  if client := sdkClients[region]; client != nil {
+    return client, nil
+  }
+
+  bucketName, regionName := AWS_STORAGE_BUCKET_NAME, AWS_REGION
+  if len(region) > 0 {
+    s3Region := S3_REGIONS[region]
+    if s3Region == nil {
+      return nil, fmt.Errorf("unknown region %q", region)
+    }
+    bucketName, regionName = s3Region.Bucket, s3Region.AWSRegion.Name
+  }
+
+  ctx := context.Background()
+  sdkConfig, err := config.LoadDefaultConfig(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(regionName) == 0 {
+    regionName, err = LookUpBucketRegion(ctx, sdkConfig, bucketName)
+    if err != nil {
+      return nil, err
+    }
+  }
+  sdkConfig.Region = regionName
+
+  client := &SDKClient{Client: s3sdk.NewFromConfig(sdkConfig), Bucket: bucketName}
+  if awsRegion, ok := aws.Regions[regionName]; ok {
+    client.urlBucket = s3.New(aws.Auth{}, awsRegion).Bucket(bucketName)
+  } else {
+    client.urlRoot = "https://s3." + regionName + ".amazonaws.com/" + bucketName + "/"
+  }
+
+  if len(region) == 0 {
+    log.Printf("Using bucket %s in %s through the AWS SDK.", bucketName, regionName)
+  }
+  sdkClients[region] = client
+  return client, nil
+}
+
+// Asks S3 which region the bucket is in, which any region answers a HEAD of the bucket with in the
+// x-amz-bucket-region header, even when it redirects or denies the request.
+func LookUpBucketRegion(ctx context.Context, sdkConfig awssdk.Config, bucketName string) (string, error) {
+  client := s3sdk.NewFromConfig(sdkConfig, func(options *s3sdk.Options) { options.Region = "us-east-1" })
+  regionName, err := manager.GetBucketRegion(ctx, client, bucketName)
+  if err != nil {
+    return "", fmt.Errorf("unable to detect the region of bucket %s, set AWS_REGION: %w", bucketName, err)
+  }
+  return regionName, nil
+}
+
+// The object the storage headers describe, the same headers goamz sends as is.
+func NewSDKPutInput(bucket string, path string, headers map[string][]string) *s3sdk.PutObjectInput {
+  input := &s3sdk.PutObjectInput{Bucket: &bucket, Key: &path, ACL: s3types.ObjectCannedACLPublicRead}
+
+  for name, values := range headers {
+    if len(values) == 0 {
+      continue
+    }
+    value := values[0]
+
+    switch lowerName := strings.ToLower(name); {
+    case lowerName == "content-type":
+      input.ContentType = &value
+    case lowerName == "content-encoding":
+      input.ContentEncoding = &value
+    case lowerName == "x-amz-acl":
+      input.ACL = s3types.ObjectCannedACL(value)
+    case lowerName == "x-amz-storage-class":
+      input.StorageClass = s3types.StorageClass(value)
+    case lowerName == "x-amz-tagging":
+      input.Tagging = &value
+    case strings.HasPrefix(lowerName, "x-amz-meta-"):
+      if input.Metadata == nil {
+        input.Metadata = map[string]string{}
+      }
+      input.Metadata[strings.TrimPrefix(lowerName, "x-amz-meta-")] = value
+    }
+  }
+
+  return input
+}
+
+func GetSDKContentLength(contentLength *int64) int64 {
+  if contentLength == nil {
+    return -1
+  }
+  return *contentLength
+}
+
+// The HTTP status S3 answered an SDK call with, 0 when the error didn't come from a response.
+func GetSDKErrorStatus(err error) int {
+  var responseError *awshttp.ResponseError
+  if errors.As(err, &responseError) {
+    return responseError.HTTPStatusCode()
+  }
+  return 0
+}
+
+// The code of the error S3 answered an SDK call with, such as "NoSuchKey".
+func GetSDKErrorCode(err error) string {
+  var apiError smithy.APIError
+  if errors.As(err, &apiError) {
+    return apiError.ErrorCode()
+  }
+  return ""
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+  Reader io.Reader
+  Count  int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+  n, err := reader.Reader.Read(p)
+  reader.Count += int64(n)
+  return n, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Collection the self-test writes its document to, kept apart from the files.
+var SELFTEST_COLLECTION = "selftest"
+
+type SelfTestStep struct {
+  Name     string `json:"name"`
+  Success  bool   `json:"success"`
+  Duration int64  `json:"duration_ms"`
+  Error    string `json:"error,omitempty"`
+}
+
+// Handlers
+func SelfTest(w http.ResponseWriter, req *http.Request) *AppError {
+  steps := []*SelfTestStep{}
+  success := true
+
+  // Running each step in order, stopping at the first failure since later steps depend on it.
+  run := func(name string, step func() error) {
+    if success == false {
+      return
+    }
+
+    start := time.Now()
+    err := step()
+    result := &SelfTestStep{Name: name, Success: err == nil, Duration: time.Since(start).Milliseconds()}
+    if err != nil {
+      result.Error = err.Error()
+      success = false
+    }
+    steps = append(steps, result)
+  }
+
+  path := fmt.Sprintf("selftest/%s", bson.NewObjectId().Hex())
+  content := []byte("GoUpload self-test")
+
+  run("storage_put", func() error {
+    return STORAGE.Put(path, content, map[string][]string{"Content-Type": {"text/plain"}})
+  })
+  run("storage_get", func() error {
+    object, err := STORAGE.Get(path)
+    if err != nil {
+      return err
+    }
+    defer object.Body.Close()
+
+    readContent, err := ioutil.ReadAll(object.Body)
+    if err != nil {
+      return err
+    }
+    if bytes.Equal(readContent, content) == false {
+      return fmt.Errorf("read back %d bytes that don't match what was written", len(readContent))
+    }
+    return nil
+  })
+  run("storage_delete", func() error {
+    return STORAGE.Del(path)
+  })
+
+  session, err := CopyMongoSession()
+  run("mongo_connect", func() error {
+    return err
+  })
+  if err == nil {
+    defer session.Close()
+  }
+
+  documentId := bson.NewObjectId()
+  run("mongo_insert", func() error {
+    return session.DB(DATABASE).C(SELFTEST_COLLECTION).Insert(bson.M{"_id": documentId, "createdat": time.Now()})
+  })
+  run("mongo_read", func() error {
+    return session.DB(DATABASE).C(SELFTEST_COLLECTION).FindId(documentId).One(&bson.M{})
+  })
+  run("mongo_delete", func() error {
+    return session.DB(DATABASE).C(SELFTEST_COLLECTION).RemoveId(documentId)
+  })
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  if success == false {
+    response = GenerateResponse(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), false, 0, "Self-test failed.")
+  }
+  response.Content = steps
+  WriteResponse(response, w, req)
+  return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+)
+
+// Key the JSON responses are signed with, in their X-Signature header, configured through RESPONSE_SIGNING_KEY.
+// Responses aren't signed when unset.
+var RESPONSE_SIGNING_KEY []byte
+
+// Loading the response signing configuration, called once the environment has been loaded.
+func LoadResponseSigningSettings(config *Config) {
+  RESPONSE_SIGNING_KEY = []byte(config.GetenvSecret("RESPONSE_SIGNING_KEY", &RESPONSE_SIGNING_KEY))
+}
+
+// Signing Utility Functions.
+
+// Returns the hex encoded HMAC-SHA256 of the body, exactly as written, keyed by RESPONSE_SIGNING_KEY.
+func SignResponseBody(body []byte) string {
+  mac := hmac.New(sha256.New, RESPONSE_SIGNING_KEY)
+  mac.Write(body)
+  return hex.EncodeToString(mac.Sum(nil))
+}
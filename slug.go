@@ -0,0 +1,37 @@
+package main
+
+import (
+  "net/http"
+  "regexp"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Custom slugs are lowercase letters, numbers, dashes and underscores, 3 to 64 characters long.
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,63}$`)
+
+// Slugs taken by the routes under /files.
+var RESERVED_SLUGS = []string{"mine"}
+
+// Slug Utility Functions.
+
+// Whether the slug is well formed. Slugs that could be mistaken for an id, or a route, are not.
+func IsValidSlug(slug string) bool {
+  for _, reservedSlug := range RESERVED_SLUGS {
+    if slug == reservedSlug {
+      return false
+    }
+  }
+
+  return slugPattern.MatchString(slug) && bson.IsObjectIdHex(slug) == false
+}
+
+// The response for a slug that's already taken: 412 when the client asked to only create the file
+// through "If-None-Match: *", 409 otherwise.
+func SlugTakenResponse(req *http.Request) *Response {
+  if req.Header.Get("If-None-Match") == "*" {
+    return GenerateResponse(http.StatusPreconditionFailed, http.StatusText(http.StatusPreconditionFailed), false, 0, "A file with this slug already exists.")
+  }
+
+  return GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This slug is already taken.")
+}
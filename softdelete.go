@@ -0,0 +1,125 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// How long the objects of deleted and consumed files are kept, during which admins can restore them, configured
+// through SOFT_DELETE_WINDOW. Objects are deleted right away when 0.
+var SOFT_DELETE_WINDOW time.Duration
+
+// Loading the soft delete configuration, called once the environment has been loaded.
+func LoadSoftDeleteSettings(config *Config) {
+  if softDeleteWindow := config.Getenv("SOFT_DELETE_WINDOW", &SOFT_DELETE_WINDOW); len(softDeleteWindow) > 0 {
+    window, err := time.ParseDuration(softDeleteWindow)
+    if err != nil || window < 0 {
+      log.Fatalf("Invalid SOFT_DELETE_WINDOW %q.", softDeleteWindow)
+    }
+    SOFT_DELETE_WINDOW = window
+  }
+}
+
+// Handlers
+// Restores a file deleted or consumed within SOFT_DELETE_WINDOW, making it available again with its
+// downloads and password attempts reset.
+func RestoreFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  submittedFileId := mux.Vars(req)["id"]
+  if bson.IsObjectIdHex(submittedFileId) == false {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid ID format.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  file := &File{}
+  query := bson.M{"_id": bson.ObjectIdHex(submittedFileId), "deletedat": bson.M{"$gt": CLOCK.Now().Add(-SOFT_DELETE_WINDOW)}}
+  change := mgo.Change{
+    Update: bson.M{
+      "$set":   bson.M{"accessed": false, "downloadcount": 0, "passwordattempts": 0},
+      "$unset": bson.M{"deletedat": "", "consumedat": "", "gonereason": ""},
+    },
+    ReturnNew: true,
+  }
+  _, err := collection.Find(query).Apply(change, file)
+  if err == mgo.ErrNotFound {
+    response := GenerateResponse(http.StatusNotFound, http.StatusText(http.StatusNotFound), false, 0, "No deleted file to restore. (It wasn't deleted, or its restore window has passed)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+  if err != nil {
+    return HandleError(err)
+  }
+
+  log.Printf("Restored file %s.", file.ID.Hex())
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = file
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Soft Delete Utility Functions.
+
+// Flags the file as deleted, leaving its objects for the sweeper to delete once SOFT_DELETE_WINDOW has passed.
+func SoftDeleteFile(collection *mgo.Collection, file *File) {
+  deletedAt := CLOCK.Now()
+  err := collection.Update(bson.M{"_id": file.ID, "deletedat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"deletedat": deletedAt}})
+  if err == mgo.ErrNotFound {
+    return
+  }
+  ErrorHandler(err)
+  file.DeletedAt = &deletedAt
+  PublishFileEvent(FileEventDeleted, file)
+}
+
+// Disposes of the objects of a file that was just consumed: deleting them, or soft deleting the file when
+// SOFT_DELETE_WINDOW is set. The access stands even if the cleanup fails, the sweeper retries it later.
+func DiscardConsumedFile(collection *mgo.Collection, file *File) {
+  if SOFT_DELETE_WINDOW > 0 {
+    SoftDeleteFile(collection, file)
+    return
+  }
+
+  DeleteFileObjects(file)
+}
+
+// Whether the file's objects are still stored: uploaded, and not yet deleted on consumption. Soft deleted
+// files keep theirs until purged.
+func HasStoredObjects(file *File) bool {
+  return len(file.URL) > 0 && (file.Accessed == false || file.DeletedAt != nil)
+}
+
+// Deletes the objects and records of the files soft deleted longer than SOFT_DELETE_WINDOW ago, once their hold
+// has passed.
+func PurgeSoftDeletedFiles(session *mgo.Session) {
+  if SOFT_DELETE_WINDOW == 0 {
+    return
+  }
+
+  files := []File{}
+  err := session.DB(DATABASE).C(COLLECTION).Find(bson.M{"deletedat": bson.M{"$lt": CLOCK.Now().Add(-SOFT_DELETE_WINDOW)}, "$and": []bson.M{NotImmutableQuery()}}).Limit(SWEEP_BATCH_SIZE).All(&files)
+  ErrorHandler(err)
+
+  SweepConcurrently(session, len(files), func(session *mgo.Session, i int) {
+    file := &files[i]
+    if len(file.URL) > 0 {
+      TryDeleteFileFromS3(file.Region, file.URL)
+      TryDeleteFileFormats(file)
+    }
+
+    err := RemoveFileRecord(session.DB(DATABASE).C(COLLECTION), file)
+    ErrorHandler(err)
+  })
+}
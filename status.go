@@ -0,0 +1,153 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Largest number of ids accepted by a single status request.
+var STATUS_BATCH_MAX = 100
+
+// Statuses reported by the batch status endpoint.
+const (
+  StatusAvailable         = "available"
+  StatusPasswordProtected = "password_protected"
+  StatusConsumed          = "consumed"
+  StatusExpired           = "expired"
+  StatusDeleted           = "deleted"
+  StatusQuarantined       = "quarantined"
+  StatusInfected          = "infected"
+  StatusNotFound          = "not_found"
+  StatusInvalidId         = "invalid_id"
+)
+
+// Handlers
+func GetFileStatuses(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  submittedFileIds := []string{}
+  err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&submittedFileIds)
+  if err != nil {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "Invalid body. (Expected a JSON array of ids)")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if len(submittedFileIds) > STATUS_BATCH_MAX {
+    response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, fmt.Sprintf("Too many ids. (At most %d per request)", STATUS_BATCH_MAX))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  statuses := map[string]string{}
+  fileIds := []bson.ObjectId{}
+
+  // Files hiding their existence are all reported as protected, missing ones included.
+  missingStatus := StatusNotFound
+  if HIDE_EXISTENCE {
+    missingStatus = StatusPasswordProtected
+  }
+
+  for _, submittedFileId := range submittedFileIds {
+    if bson.IsObjectIdHex(submittedFileId) == false {
+      statuses[submittedFileId] = StatusInvalidId
+      continue
+    }
+
+    statuses[submittedFileId] = missingStatus
+    fileIds = append(fileIds, bson.ObjectIdHex(submittedFileId))
+  }
+
+  // Looking up every file in a single query, without touching (or consuming) any of them.
+  files := []File{}
+  if len(fileIds) > 0 {
+    err = collection.Find(bson.M{"_id": bson.M{"$in": fileIds}}).Select(bson.M{"accessed": 1, "passwordprotected": 1, "expiresat": 1, "uploadstate": 1, "scanstate": 1, "deletedat": 1, "gonereason": 1}).All(&files)
+    if err != nil {
+      return HandleError(err)
+    }
+
+    // Files whose record was deleted are still known to be gone, for the reason their tombstone gives.
+    tombstones := []Tombstone{}
+    err = collection.Database.C(TOMBSTONES_COLLECTION).Find(bson.M{"_id": bson.M{"$in": fileIds}}).Select(bson.M{"_id": 1, "reason": 1}).All(&tombstones)
+    if err != nil {
+      return HandleError(err)
+    }
+
+    for _, tombstone := range tombstones {
+      if HIDE_EXISTENCE {
+        break
+      }
+      statuses[tombstone.ID.Hex()] = GetGoneStatus(tombstone.GetReason())
+    }
+  }
+
+  for _, file := range files {
+    // Hidden files keep the status of a missing one.
+    if HIDE_EXISTENCE && (file.PasswordProtected || file.Accessed || IsFileExpired(&file) || file.DeletedAt != nil) {
+      continue
+    }
+    statuses[file.ID.Hex()] = GetFileStatus(&file)
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = statuses
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Status Utility Functions.
+func GetFileStatus(file *File) string {
+  // Soft deleted files are gone for anyone but admins, as FindFile answers them.
+  if file.DeletedAt != nil && file.Accessed == false {
+    return GetGoneStatus(GetGoneReason(file))
+  }
+
+  if len(file.UploadState) > 0 && file.UploadState != UploadStateComplete {
+    return file.UploadState
+  }
+
+  if file.ScanState == ScanStateQuarantined {
+    return StatusQuarantined
+  }
+
+  if file.ScanState == ScanStateInfected {
+    return StatusInfected
+  }
+
+  if file.Accessed == true {
+    return StatusConsumed
+  }
+
+  if IsFileExpired(file) {
+    return StatusExpired
+  }
+
+  if file.PasswordProtected == true {
+    return StatusPasswordProtected
+  }
+
+  return StatusAvailable
+}
+
+// The status of a file gone for the reason.
+func GetGoneStatus(reason string) string {
+  switch reason {
+  case GoneReasonConsumed:
+    return StatusConsumed
+  case GoneReasonExpired:
+    return StatusExpired
+  case GoneReasonQuarantine:
+    return StatusInfected
+  case GoneReasonUploadFailed:
+    return UploadStateFailed
+  }
+  return StatusDeleted
+}
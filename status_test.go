@@ -0,0 +1,51 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "gopkg.in/mgo.v2/bson"
+)
+
+func TestStatusOfGoneFiles(t *testing.T) {
+  ResetTestState(t)
+
+  softDeleted := UploadTestFile(t, nil, "deleted.txt", []byte("Hello, world."))
+  available := UploadTestFile(t, nil, "available.txt", []byte("Hello, world."))
+  removedId := bson.NewObjectId()
+  missingId := bson.NewObjectId()
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+  if err := collection.UpdateId(softDeleted.ID, bson.M{"$set": bson.M{"deletedat": CLOCK.Now()}}); err != nil {
+    t.Fatal(err)
+  }
+  tombstone := &Tombstone{ID: removedId, ExpiresAt: CLOCK.Now().Add(time.Hour), Reason: GoneReasonExpired}
+  if err := collection.Database.C(TOMBSTONES_COLLECTION).Insert(tombstone); err != nil {
+    t.Fatal(err)
+  }
+
+  // The status agrees with the reason the file itself is answered with.
+  if response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+softDeleted.ID.Hex(), nil))); response.StatusCode != http.StatusGone || response.Reason != GoneReasonDeleted {
+    t.Fatalf("Got %d %q, expected the soft deleted file to be gone.", response.StatusCode, response.Reason)
+  }
+
+  body := `["` + strings.Join([]string{softDeleted.ID.Hex(), available.ID.Hex(), removedId.Hex(), missingId.Hex()}, `","`) + `"]`
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("POST", "/v1/files/status", strings.NewReader(body))))
+  statuses := map[string]string{}
+  if err := json.Unmarshal(response.Content, &statuses); err != nil {
+    t.Fatal(err)
+  }
+
+  expected := map[string]string{softDeleted.ID.Hex(): StatusDeleted, available.ID.Hex(): StatusAvailable, removedId.Hex(): StatusExpired, missingId.Hex(): StatusNotFound}
+  for id, status := range expected {
+    if statuses[id] != status {
+      t.Fatalf("Got the statuses %v, expected %v.", statuses, expected)
+    }
+  }
+}
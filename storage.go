@@ -0,0 +1,663 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/md5"
+  "crypto/sha1"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  awssdk "github.com/aws/aws-sdk-go-v2/aws"
+  "github.com/aws/aws-sdk-go-v2/config"
+  "github.com/mitchellh/goamz/aws"
+  "github.com/mitchellh/goamz/s3"
+)
+
+// Backend objects are stored in, selected through STORAGE_BACKEND.
+var STORAGE Storage = &S3Storage{}
+
+// Storage is where the content of files lives. Paths are relative to the root of the storage.
+type Storage interface {
+  Put(path string, content []byte, headers map[string][]string) error
+  // PutReader stores content of unknown length as it's read, returning how many bytes were stored.
+  PutReader(path string, reader io.Reader, headers map[string][]string) (int64, error)
+  Get(path string) (*StoredObject, error)
+  Del(path string) error
+  Copy(sourcePath string, path string) error
+  // List returns up to max paths starting with the prefix that sort after the marker, in order.
+  List(prefix string, marker string, max int) ([]string, error)
+  // Stat returns what's known about an object without reading it.
+  Stat(path string) (*ObjectInfo, error)
+  // SignedPutURL returns a URL clients can PUT the content of a path to directly, sending the given headers,
+  // to which it adds any other header the client has to send.
+  SignedPutURL(path string, headers map[string][]string, expiresAt time.Time) (string, error)
+  // SignedGetURL returns a URL the content of a path can be downloaded from until it expires.
+  SignedGetURL(path string, expiresAt time.Time) (string, error)
+  // URL returns the absolute URL of a path, and Path the path of an absolute URL.
+  URL(path string) string
+  Path(fileAbsoluteUrl string) string
+}
+
+type StoredObject struct {
+  Body          io.ReadCloser
+  ContentType   string
+  ContentLength int64 // -1 when unknown.
+  Decompressed  bool  // Whether a gzip Content-Encoding was already undone in transit.
+}
+
+// Most S3 operations in flight at once, configured through S3_MAX_CONCURRENCY. Unlimited when unset or 0.
+var S3_MAX_CONCURRENCY = 0
+
+// Longest an S3 operation waits for a free slot before failing, configured through S3_CONCURRENCY_TIMEOUT.
+var S3_CONCURRENCY_TIMEOUT = 30 * time.Second
+
+// The storage backend files are stored in, configured through STORAGE_BACKEND as "s3" or "memory".
+var STORAGE_BACKEND = "s3"
+
+// Bucket of the files without a region, and the root of its URLs, configured through AWS_STORAGE_BUCKET_NAME
+// and AWS_BUCKET_ROOT_PATH.
+var AWS_STORAGE_BUCKET_NAME string
+var AWS_BUCKET_ROOT_PATH string
+
+// Region of AWS_STORAGE_BUCKET_NAME, configured through AWS_REGION. Detected from the bucket itself when unset.
+var AWS_REGION string
+
+// Where goamz gets its credentials from, set up on first use.
+var awsCredentials awssdk.CredentialsProvider
+var awsCredentialsLock sync.Mutex
+
+// Slots of the S3 operations in flight, nil when unlimited.
+var s3Slots chan struct{}
+
+// Size of the parts content of unknown length is uploaded in, the smallest S3 accepts.
+const S3_PART_SIZE = 5 << 20
+
+// Times a part whose ETag doesn't match its MD5 is uploaded before the upload is given up.
+const S3_PART_ATTEMPTS = 3
+
+var ErrS3Busy = errors.New("timed out waiting for a free S3 connection")
+
+// The error of content that doesn't match its checksum once stored, the object is deleted.
+var ErrChecksumMismatch = errors.New("the stored content doesn't match its checksum")
+
+type ObjectInfo struct {
+  ContentType   string
+  ContentLength int64
+}
+
+// Loading the storage backend, called once the environment has been loaded.
+func LoadStorageBackend(config *Config) {
+  if maxConcurrency := config.Getenv("S3_MAX_CONCURRENCY", &S3_MAX_CONCURRENCY); len(maxConcurrency) > 0 {
+    concurrency, err := strconv.Atoi(maxConcurrency)
+    if err != nil || concurrency < 0 {
+      log.Fatalf("Invalid S3_MAX_CONCURRENCY %q.", maxConcurrency)
+    }
+    S3_MAX_CONCURRENCY = concurrency
+  }
+
+  if concurrencyTimeout := config.Getenv("S3_CONCURRENCY_TIMEOUT", &S3_CONCURRENCY_TIMEOUT); len(concurrencyTimeout) > 0 {
+    timeout, err := time.ParseDuration(concurrencyTimeout)
+    if err != nil || timeout <= 0 {
+      log.Fatalf("Invalid S3_CONCURRENCY_TIMEOUT %q.", concurrencyTimeout)
+    }
+    S3_CONCURRENCY_TIMEOUT = timeout
+  }
+
+  if S3_MAX_CONCURRENCY > 0 {
+    s3Slots = make(chan struct{}, S3_MAX_CONCURRENCY)
+  }
+
+  AWS_STORAGE_BUCKET_NAME = config.Getenv("AWS_STORAGE_BUCKET_NAME", &AWS_STORAGE_BUCKET_NAME)
+  AWS_BUCKET_ROOT_PATH = config.Getenv("AWS_BUCKET_ROOT_PATH", &AWS_BUCKET_ROOT_PATH)
+
+  if s3SDK := config.Getenv("S3_SDK", &S3_SDK); len(s3SDK) > 0 {
+    if s3SDK != "goamz" && s3SDK != "aws-sdk" {
+      log.Fatalf("Invalid S3_SDK %q, expected goamz or aws-sdk.", s3SDK)
+    }
+    S3_SDK = s3SDK
+  }
+
+  if awsRegion := config.Getenv("AWS_REGION", &AWS_REGION); len(awsRegion) > 0 {
+    if IsValidAWSRegion(awsRegion) == false {
+      log.Fatalf("Invalid AWS_REGION %q.", awsRegion)
+    }
+    AWS_REGION = awsRegion
+  }
+
+  switch backend := config.Getenv("STORAGE_BACKEND", &STORAGE_BACKEND); backend {
+  case "", "s3":
+    if len(AWS_STORAGE_BUCKET_NAME) == 0 {
+      log.Fatal("AWS_STORAGE_BUCKET_NAME is required by the s3 storage backend.")
+    }
+    STORAGE = &BreakerStorage{NewS3Storage("")}
+  case "memory":
+    STORAGE_BACKEND = backend
+    log.Println("Using the in-memory storage backend, files will not survive a restart.")
+    STORAGE = NewMemoryStorage()
+  default:
+    log.Fatalf("Invalid STORAGE_BACKEND %q, expected s3 or memory.", backend)
+  }
+}
+
+// S3 Storage, of the default bucket or of a region's.
+type S3Storage struct {
+  Region string
+}
+
+func (storage *S3Storage) Bucket() *s3.Bucket {
+  if len(storage.Region) == 0 {
+    return GetS3Bucket()
+  }
+  return GetRegionBucket(storage.Region)
+}
+
+// The canned ACL the headers ask for through x-amz-acl, public-read when they don't.
+func GetHeadersACL(headers map[string][]string) s3.ACL {
+  if values := headers["x-amz-acl"]; len(values) > 0 {
+    return s3.ACL(values[0])
+  }
+  return s3.PublicRead
+}
+
+func (storage *S3Storage) Put(path string, content []byte, headers map[string][]string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  return storage.Bucket().PutHeader(path, content, headers, GetHeadersACL(headers))
+}
+
+// Content fitting in a single part is put as is. Anything larger goes through a multipart upload, which only
+// takes a content type, so the remaining headers are applied by copying the object onto itself once complete.
+// Each part's ETag is checked against its MD5, and the assembled object's against the ETag its parts make up.
+func (storage *S3Storage) PutReader(path string, reader io.Reader, headers map[string][]string) (int64, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return 0, err
+  }
+  defer ReleaseS3Slot()
+
+  bucket := storage.Bucket()
+  part := make([]byte, S3_PART_SIZE)
+
+  n, err := io.ReadFull(reader, part)
+  if err == io.EOF || err == io.ErrUnexpectedEOF {
+    return int64(n), bucket.PutHeader(path, part[:n], headers, GetHeadersACL(headers))
+  }
+  if err != nil {
+    return 0, err
+  }
+
+  contentType := ""
+  if values := headers["Content-Type"]; len(values) > 0 {
+    contentType = values[0]
+  }
+
+  multi, err := bucket.InitMulti(path, contentType, GetHeadersACL(headers))
+  if err != nil {
+    return 0, err
+  }
+
+  size := int64(0)
+  parts := []s3.Part{}
+  partSums := [][]byte{}
+  for n > 0 {
+    partSum := md5.Sum(part[:n])
+    uploadedPart, err := PutVerifiedPart(multi, len(parts)+1, part[:n], partSum[:])
+    if err != nil {
+      multi.Abort()
+      return 0, err
+    }
+    parts = append(parts, uploadedPart)
+    partSums = append(partSums, partSum[:])
+    size += int64(n)
+
+    n, err = io.ReadFull(reader, part)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      multi.Abort()
+      return 0, err
+    }
+  }
+
+  if err := multi.Complete(parts); err != nil {
+    multi.Abort()
+    return 0, err
+  }
+
+  res, err := bucket.Head(path)
+  if err != nil {
+    return 0, err
+  }
+  res.Body.Close()
+
+  if IsETagMatching(res.Header.Get("ETag"), GetMultipartETag(partSums)) == false {
+    bucket.Del(path)
+    return 0, ErrChecksumMismatch
+  }
+
+  copyHeaders := map[string][]string{
+    "x-amz-copy-source":        {(&url.URL{Path: bucket.Name + "/" + path}).EscapedPath()},
+    "x-amz-metadata-directive": {"REPLACE"},
+    "x-amz-tagging-directive":  {"REPLACE"},
+  }
+  for name, values := range headers {
+    copyHeaders[name] = values
+  }
+  return size, bucket.PutHeader(path, []byte{}, copyHeaders, GetHeadersACL(headers))
+}
+
+// Uploads the part, again when S3 reports an ETag other than its MD5, which means it was corrupted on the way.
+func PutVerifiedPart(multi *s3.Multi, number int, content []byte, sum []byte) (s3.Part, error) {
+  expectedETag := hex.EncodeToString(sum)
+
+  for attempt := 1; ; attempt++ {
+    uploadedPart, err := multi.PutPart(number, bytes.NewReader(content))
+    if err != nil {
+      return s3.Part{}, err
+    }
+    if IsETagMatching(uploadedPart.ETag, expectedETag) {
+      return uploadedPart, nil
+    }
+
+    log.Printf("Part %d of %s has ETag %s rather than %s, attempt %d of %d.", number, multi.Key, uploadedPart.ETag, expectedETag, attempt, S3_PART_ATTEMPTS)
+    if attempt == S3_PART_ATTEMPTS {
+      return s3.Part{}, ErrChecksumMismatch
+    }
+  }
+}
+
+// The ETag S3 gives a multipart object: the MD5 of its parts' MD5s, followed by how many parts there are.
+func GetMultipartETag(partSums [][]byte) string {
+  hash := md5.New()
+  for _, sum := range partSums {
+    hash.Write(sum)
+  }
+  return hex.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(partSums))
+}
+
+func IsETagMatching(etag string, expectedETag string) bool {
+  return strings.EqualFold(strings.Trim(etag, `"`), expectedETag)
+}
+
+// The slot is held until the object's body is closed, since the connection stays busy while it's streamed.
+func (storage *S3Storage) Get(path string) (*StoredObject, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+
+  res, err := storage.Bucket().GetResponse(path)
+  if err != nil {
+    ReleaseS3Slot()
+    return nil, err
+  }
+
+  body := &s3SlotBody{ReadCloser: res.Body}
+  return &StoredObject{body, res.Header.Get("Content-Type"), res.ContentLength, res.Uncompressed}, nil
+}
+
+func (storage *S3Storage) Del(path string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  return storage.Bucket().Del(path)
+}
+
+// Copying server side, S3 keeps the source's metadata but not its storage class.
+func (storage *S3Storage) Copy(sourcePath string, path string) error {
+  if err := AcquireS3Slot(); err != nil {
+    return err
+  }
+  defer ReleaseS3Slot()
+
+  bucket := storage.Bucket()
+  headers := map[string][]string{
+    "x-amz-copy-source":   {(&url.URL{Path: bucket.Name + "/" + sourcePath}).EscapedPath()},
+    "x-amz-storage-class": {STORAGE_CLASS},
+  }
+  return bucket.PutHeader(path, []byte{}, headers, s3.PublicRead)
+}
+
+func (storage *S3Storage) List(prefix string, marker string, max int) ([]string, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+  defer ReleaseS3Slot()
+
+  list, err := storage.Bucket().List(prefix, "", marker, max)
+  if err != nil {
+    return nil, err
+  }
+
+  paths := []string{}
+  for _, key := range list.Contents {
+    paths = append(paths, key.Key)
+  }
+  return paths, nil
+}
+
+func (storage *S3Storage) Stat(path string) (*ObjectInfo, error) {
+  if err := AcquireS3Slot(); err != nil {
+    return nil, err
+  }
+  defer ReleaseS3Slot()
+
+  res, err := storage.Bucket().Head(path)
+  if err != nil {
+    return nil, err
+  }
+  res.Body.Close()
+
+  return &ObjectInfo{res.Header.Get("Content-Type"), res.ContentLength}, nil
+}
+
+// Signing with query string authentication (signature version 2), which goamz only implements for GET. Every
+// header signed has to be sent as is by the client.
+func (storage *S3Storage) SignedPutURL(path string, headers map[string][]string, expiresAt time.Time) (string, error) {
+  bucket := storage.Bucket()
+  if len(bucket.Auth.Token) > 0 {
+    headers["x-amz-security-token"] = []string{bucket.Auth.Token}
+  }
+
+  contentType := ""
+  amzHeaders := []string{}
+  for name, values := range headers {
+    if strings.EqualFold(name, "Content-Type") {
+      contentType = values[0]
+    } else if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+      amzHeaders = append(amzHeaders, strings.ToLower(name)+":"+strings.Join(values, ",")+"\n")
+    }
+  }
+  sort.Strings(amzHeaders)
+
+  expires := strconv.FormatInt(expiresAt.Unix(), 10)
+  resource := (&url.URL{Path: "/" + bucket.Name + "/" + path}).EscapedPath()
+  stringToSign := "PUT\n\n" + contentType + "\n" + expires + "\n" + strings.Join(amzHeaders, "") + resource
+
+  mac := hmac.New(sha1.New, []byte(bucket.Auth.SecretKey))
+  mac.Write([]byte(stringToSign))
+
+  query := url.Values{
+    "AWSAccessKeyId": {bucket.Auth.AccessKey},
+    "Expires":        {expires},
+    "Signature":      {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+  }
+  return bucket.URL(path) + "?" + query.Encode(), nil
+}
+
+func (storage *S3Storage) SignedGetURL(path string, expiresAt time.Time) (string, error) {
+  return storage.Bucket().SignedURL(path, expiresAt), nil
+}
+
+func (storage *S3Storage) URL(path string) string {
+  return storage.Bucket().URL(path)
+}
+
+func (storage *S3Storage) Path(fileAbsoluteUrl string) string {
+  if len(storage.Region) == 0 {
+    return GetS3RelativeUrl(fileAbsoluteUrl)
+  }
+  return strings.TrimPrefix(fileAbsoluteUrl, storage.Bucket().URL(""))
+}
+
+// Returns the current credentials for goamz, resolved through the AWS SDK's default chain: the environment's
+// access keys, shared config files, then the ECS container or EC2 instance role. Temporary credentials are
+// cached by the SDK until shortly before they expire, and renewed then.
+func GetAWSAuth() (aws.Auth, error) {
+  awsCredentialsLock.Lock()
+  if awsCredentials == nil {
+    sdkConfig, err := config.LoadDefaultConfig(context.Background())
+    if err != nil {
+      awsCredentialsLock.Unlock()
+      return aws.Auth{}, err
+    }
+    awsCredentials = sdkConfig.Credentials
+  }
+  credentials := awsCredentials
+  awsCredentialsLock.Unlock()
+
+  if credentials == nil {
+    return aws.Auth{}, errors.New("no AWS credentials found in the environment, shared config files or instance role")
+  }
+
+  value, err := credentials.Retrieve(context.Background())
+  if err != nil {
+    return aws.Auth{}, fmt.Errorf("unable to resolve the AWS credentials: %w", err)
+  }
+  return aws.Auth{AccessKey: value.AccessKeyID, SecretKey: value.SecretAccessKey, Token: value.SessionToken}, nil
+}
+
+// Returns the region of the bucket, AWS_REGION when set. Otherwise S3 is asked for it through the AWS SDK, goamz
+// having no way to.
+func DetectBucketRegion(bucketName string) (aws.Region, error) {
+  regionName := AWS_REGION
+  if len(regionName) == 0 {
+    ctx := context.Background()
+    sdkConfig, err := config.LoadDefaultConfig(ctx)
+    if err != nil {
+      return aws.Region{}, err
+    }
+
+    regionName, err = LookUpBucketRegion(ctx, sdkConfig, bucketName)
+    if err != nil {
+      return aws.Region{}, err
+    }
+  }
+
+  region, ok := aws.Regions[regionName]
+  if ok == false {
+    return aws.Region{}, fmt.Errorf("bucket %s is in the unknown region %q", bucketName, regionName)
+  }
+  return region, nil
+}
+
+// Whether the storage is S3, behind its breaker or not.
+func IsS3Storage(storage Storage) bool {
+  if breakerStorage, ok := storage.(*BreakerStorage); ok {
+    storage = breakerStorage.Storage
+  }
+
+  switch storage.(type) {
+  case *S3Storage, *SDKStorage:
+    return true
+  }
+  return false
+}
+
+// Whether the error is S3, or a stand-in, reporting that the object doesn't exist.
+func IsNoSuchKeyError(err error) bool {
+  var s3Error *s3.Error
+  if errors.As(err, &s3Error) {
+    return s3Error.Code == "NoSuchKey" || s3Error.StatusCode == http.StatusNotFound
+  }
+
+  code := GetSDKErrorCode(err)
+  return code == "NoSuchKey" || code == "NotFound" || GetSDKErrorStatus(err) == http.StatusNotFound
+}
+
+// Waits for one of the S3_MAX_CONCURRENCY slots, for at most S3_CONCURRENCY_TIMEOUT.
+func AcquireS3Slot() error {
+  if s3Slots == nil {
+    return nil
+  }
+
+  select {
+  case s3Slots <- struct{}{}:
+    return nil
+  default:
+  }
+
+  timer := time.NewTimer(S3_CONCURRENCY_TIMEOUT)
+  defer timer.Stop()
+
+  select {
+  case s3Slots <- struct{}{}:
+    return nil
+  case <-timer.C:
+    return ErrS3Busy
+  }
+}
+
+func ReleaseS3Slot() {
+  if s3Slots != nil {
+    <-s3Slots
+  }
+}
+
+// An object body releasing its S3 slot once closed.
+type s3SlotBody struct {
+  io.ReadCloser
+  once sync.Once
+}
+
+func (body *s3SlotBody) Close() error {
+  err := body.ReadCloser.Close()
+  body.once.Do(ReleaseS3Slot)
+  return err
+}
+
+// Memory Storage, a stand-in for S3 when running locally or under test.
+type MemoryStorage struct {
+  sync.Mutex
+  objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+  content []byte
+  headers map[string][]string
+}
+
+const MEMORY_STORAGE_ROOT = "memory:///"
+
+func NewMemoryStorage() *MemoryStorage {
+  return &MemoryStorage{objects: map[string]*memoryObject{}}
+}
+
+func (storage *MemoryStorage) Put(path string, content []byte, headers map[string][]string) error {
+  storage.Lock()
+  defer storage.Unlock()
+
+  storage.objects[path] = &memoryObject{append([]byte{}, content...), headers}
+  return nil
+}
+
+func (storage *MemoryStorage) PutReader(path string, reader io.Reader, headers map[string][]string) (int64, error) {
+  content, err := ioutil.ReadAll(reader)
+  if err != nil {
+    return 0, err
+  }
+
+  return int64(len(content)), storage.Put(path, content, headers)
+}
+
+func (storage *MemoryStorage) Get(path string) (*StoredObject, error) {
+  storage.Lock()
+  defer storage.Unlock()
+
+  object, ok := storage.objects[path]
+  if ok == false {
+    return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: "The specified key does not exist."}
+  }
+
+  contentType := ""
+  if values := object.headers["Content-Type"]; len(values) > 0 {
+    contentType = values[0]
+  }
+
+  return &StoredObject{ioutil.NopCloser(bytes.NewReader(object.content)), contentType, int64(len(object.content)), false}, nil
+}
+
+func (storage *MemoryStorage) Del(path string) error {
+  storage.Lock()
+  defer storage.Unlock()
+
+  delete(storage.objects, path)
+  return nil
+}
+
+func (storage *MemoryStorage) Copy(sourcePath string, path string) error {
+  storage.Lock()
+  defer storage.Unlock()
+
+  object, ok := storage.objects[sourcePath]
+  if ok == false {
+    return &s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: "The specified key does not exist."}
+  }
+
+  // Copies are public-read, as the S3 backends make them.
+  headers := map[string][]string{}
+  for name, values := range object.headers {
+    headers[name] = values
+  }
+  headers["x-amz-acl"] = []string{"public-read"}
+
+  storage.objects[path] = &memoryObject{object.content, headers}
+  return nil
+}
+
+func (storage *MemoryStorage) List(prefix string, marker string, max int) ([]string, error) {
+  storage.Lock()
+  defer storage.Unlock()
+
+  paths := []string{}
+  for path := range storage.objects {
+    if strings.HasPrefix(path, prefix) && path > marker {
+      paths = append(paths, path)
+    }
+  }
+  sort.Strings(paths)
+
+  if len(paths) > max {
+    paths = paths[:max]
+  }
+  return paths, nil
+}
+
+func (storage *MemoryStorage) Stat(path string) (*ObjectInfo, error) {
+  storage.Lock()
+  defer storage.Unlock()
+
+  object, ok := storage.objects[path]
+  if ok == false {
+    return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: "The specified key does not exist."}
+  }
+
+  contentType := ""
+  if values := object.headers["Content-Type"]; len(values) > 0 {
+    contentType = values[0]
+  }
+
+  return &ObjectInfo{contentType, int64(len(object.content))}, nil
+}
+
+// Nothing outside the process can reach the memory backend.
+func (storage *MemoryStorage) SignedPutURL(path string, headers map[string][]string, expiresAt time.Time) (string, error) {
+  return "", errors.New("the memory storage backend doesn't support direct uploads")
+}
+
+func (storage *MemoryStorage) SignedGetURL(path string, expiresAt time.Time) (string, error) {
+  return "", errors.New("the memory storage backend doesn't support direct downloads")
+}
+
+func (storage *MemoryStorage) URL(path string) string {
+  return MEMORY_STORAGE_ROOT + path
+}
+
+func (storage *MemoryStorage) Path(fileAbsoluteUrl string) string {
+  return strings.TrimPrefix(fileAbsoluteUrl, MEMORY_STORAGE_ROOT)
+}
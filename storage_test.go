@@ -0,0 +1,71 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync/atomic"
+  "testing"
+)
+
+// Answers a HEAD of any bucket as S3 does, with the region it's in, through an S3 endpoint for the test.
+func StartTestBucketRegionServer(t *testing.T, regionName string) *atomic.Int32 {
+  t.Helper()
+
+  requests := &atomic.Int32{}
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    requests.Add(1)
+    if len(regionName) == 0 {
+      w.WriteHeader(http.StatusForbidden)
+      return
+    }
+    // Buckets of other regions are redirected, with the region they're in all the same.
+    w.Header().Set("x-amz-bucket-region", regionName)
+    w.WriteHeader(http.StatusMovedPermanently)
+  }))
+  t.Cleanup(server.Close)
+
+  t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+  t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+  t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+  return requests
+}
+
+func TestDetectBucketRegion(t *testing.T) {
+  cases := []struct {
+    name       string
+    configured string
+    detected   string
+    expected   string
+    errorText  string
+  }{
+    {"Detected", "", "eu-west-1", "eu-west-1", ""},
+    {"Configured", "ap-southeast-1", "eu-west-1", "ap-southeast-1", ""},
+    {"UnknownRegion", "", "xx-nowhere-1", "", `bucket uploads is in the unknown region "xx-nowhere-1"`},
+    {"Undetectable", "", "", "", "unable to detect the region of bucket uploads, set AWS_REGION"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      SetTestSetting(t, &AWS_REGION, c.configured)
+      requests := StartTestBucketRegionServer(t, c.detected)
+
+      region, err := DetectBucketRegion("uploads")
+      if len(c.errorText) > 0 {
+        if err == nil || strings.Contains(err.Error(), c.errorText) == false {
+          t.Fatalf("Got %v, expected %q.", err, c.errorText)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if region.Name != c.expected {
+        t.Fatalf("Got the region %q, expected %q.", region.Name, c.expected)
+      }
+      if len(c.configured) > 0 && requests.Load() > 0 {
+        t.Fatalf("Asked S3 for the region of a bucket configured through AWS_REGION.")
+      }
+    })
+  }
+}
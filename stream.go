@@ -0,0 +1,475 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "mime"
+  "mime/multipart"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "time"
+)
+
+// Whether uploads are streamed to S3 as they arrive rather than parsed first, configured through
+// STREAM_UPLOADS. Streamed uploads need the file to be the last field of the form.
+var STREAM_UPLOADS = false
+
+// Most bytes read from the non-file fields of an upload form, or those sent ahead of the file part of a
+// streamed upload.
+const STREAM_FIELDS_MAX_BYTES = 1 << 20
+
+// Most non-file fields accepted in an upload form, configured through MAX_FORM_FIELDS.
+var MAX_FORM_FIELDS = 100
+
+// The error of a multipart body that's truncated or otherwise can't be parsed.
+var ErrMalformedMultipart = errors.New("malformed multipart body")
+
+var ErrTooManyFormFields = errors.New("too many fields")
+
+// Most bytes of headers a multipart part may have, configured through MAX_PART_HEADER_BYTES, and most bytes of
+// headers all the parts of a body may have together, configured through MAX_MULTIPART_HEADER_BYTES. Bodies
+// going over either are cut off before their headers are buffered, and refused with a 400.
+var MAX_PART_HEADER_BYTES int64 = 16 << 10
+var MAX_MULTIPART_HEADER_BYTES int64 = 1 << 20
+
+// Longest a request body may go without sending anything while it's being read, configured through
+// BODY_READ_IDLE_TIMEOUT. Bodies taking long to arrive are fine as long as they keep arriving. Unlimited when 0.
+var BODY_READ_IDLE_TIMEOUT = time.Minute
+
+// The error of a body that stopped arriving for longer than BODY_READ_IDLE_TIMEOUT.
+var ErrBodyReadStalled = errors.New("the request body stopped arriving")
+
+// The error of a multipart body whose part headers went over one of the limits.
+type MultipartHeaderError struct {
+  Limit int64
+  Total bool
+}
+
+func (err *MultipartHeaderError) Error() string {
+  if err.Total {
+    return fmt.Sprintf("the part headers are too large, at most %d bytes are accepted in total", err.Limit)
+  }
+  return fmt.Sprintf("a part's headers are too large, at most %d bytes are accepted per part", err.Limit)
+}
+
+// Loading the streaming configuration, called once the environment has been loaded.
+func LoadStreamingSettings(config *Config) {
+  if streamUploads := config.Getenv("STREAM_UPLOADS", &STREAM_UPLOADS); len(streamUploads) > 0 {
+    enabled, err := strconv.ParseBool(streamUploads)
+    if err != nil {
+      log.Fatalf("Invalid STREAM_UPLOADS %q.", streamUploads)
+    }
+    STREAM_UPLOADS = enabled
+  }
+
+  if maxFormFields := config.Getenv("MAX_FORM_FIELDS", &MAX_FORM_FIELDS); len(maxFormFields) > 0 {
+    fields, err := strconv.Atoi(maxFormFields)
+    if err != nil || fields <= 0 {
+      log.Fatalf("Invalid MAX_FORM_FIELDS %q.", maxFormFields)
+    }
+    MAX_FORM_FIELDS = fields
+  }
+
+  if maxPartHeaderBytes := config.Getenv("MAX_PART_HEADER_BYTES", &MAX_PART_HEADER_BYTES); len(maxPartHeaderBytes) > 0 {
+    limit, err := strconv.ParseInt(maxPartHeaderBytes, 10, 64)
+    if err != nil || limit <= 0 {
+      log.Fatalf("Invalid MAX_PART_HEADER_BYTES %q.", maxPartHeaderBytes)
+    }
+    MAX_PART_HEADER_BYTES = limit
+  }
+
+  if maxMultipartHeaderBytes := config.Getenv("MAX_MULTIPART_HEADER_BYTES", &MAX_MULTIPART_HEADER_BYTES); len(maxMultipartHeaderBytes) > 0 {
+    limit, err := strconv.ParseInt(maxMultipartHeaderBytes, 10, 64)
+    if err != nil || limit < MAX_PART_HEADER_BYTES {
+      log.Fatalf("Invalid MAX_MULTIPART_HEADER_BYTES %q, it must be at least MAX_PART_HEADER_BYTES.", maxMultipartHeaderBytes)
+    }
+    MAX_MULTIPART_HEADER_BYTES = limit
+  }
+
+  if bodyReadIdleTimeout := config.Getenv("BODY_READ_IDLE_TIMEOUT", &BODY_READ_IDLE_TIMEOUT); len(bodyReadIdleTimeout) > 0 {
+    timeout, err := time.ParseDuration(bodyReadIdleTimeout)
+    if err != nil || timeout < 0 {
+      log.Fatalf("Invalid BODY_READ_IDLE_TIMEOUT %q.", bodyReadIdleTimeout)
+    }
+    BODY_READ_IDLE_TIMEOUT = timeout
+  }
+}
+
+// Middleware
+// Every endpoint reading a form may parse a multipart body, so they all have its part headers bounded.
+func LimitMultipartHeaders(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+    if err == nil && mediaType == "multipart/form-data" && len(params["boundary"]) > 0 {
+      req.Body = NewMultipartHeaderLimiter(req.Body, params["boundary"])
+    }
+    next.ServeHTTP(w, req)
+  })
+}
+
+// Cutting off bodies that stall rather than those that are slow, the deadline of the connection being pushed back
+// on every read of the body.
+func WatchBodyReads(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if BODY_READ_IDLE_TIMEOUT > 0 && req.Body != nil && req.Body != http.NoBody {
+      req.Body = &IdleTimeoutBody{body: req.Body, controller: http.NewResponseController(w), timeout: BODY_READ_IDLE_TIMEOUT}
+    }
+    next.ServeHTTP(w, req)
+  })
+}
+
+// Streaming Utility Functions.
+
+// Parses the form of the request, returning ErrMalformedMultipart when its multipart body can't be parsed.
+// Requests that aren't multipart forms are parsed as url encoded ones. Multipart bodies are read a part at a
+// time, as streamed ones are, so a form with more than MAX_FORM_FIELDS fields is refused at the first field
+// too many rather than once all of them were buffered. File parts are kept in memory up to maxMemory bytes in
+// total, and in temporary files past that.
+func ParseUploadForm(req *http.Request, maxMemory int64) error {
+  if IsMultipartRequest(req) == false {
+    if err := req.ParseForm(); err != nil {
+      return err
+    }
+    return CheckFormFieldCount(req.PostForm)
+  }
+
+  reader, err := req.MultipartReader()
+  if err != nil {
+    return ErrMalformedMultipart
+  }
+
+  values := url.Values{}
+  form := &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+  remaining := int64(STREAM_FIELDS_MAX_BYTES)
+
+  // Reporting the limits the body went over as such, anything else failing to read it being a malformed body.
+  fail := func(err error) error {
+    form.RemoveAll()
+    if IsBodyTooLargeError(err) || IsBodyReadStalledError(err) || errors.Is(err, ErrTooManyFormFields) {
+      return err
+    }
+    if headerError := AsMultipartHeaderError(err); headerError != nil {
+      return headerError
+    }
+    return ErrMalformedMultipart
+  }
+
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      SetMultipartForm(req, form)
+      return nil
+    }
+    if err != nil {
+      return fail(err)
+    }
+
+    if len(part.FileName()) > 0 {
+      header, err := ReadFormFilePart(part, maxMemory)
+      if err != nil {
+        return fail(err)
+      }
+      form.File[part.FormName()] = append(form.File[part.FormName()], header)
+      if maxMemory -= header.Size; maxMemory < 0 {
+        maxMemory = 0
+      }
+      continue
+    }
+
+    value, err := ioutil.ReadAll(io.LimitReader(part, remaining+1))
+    if err != nil {
+      return fail(err)
+    }
+
+    remaining -= int64(len(value))
+    if remaining < 0 {
+      form.RemoveAll()
+      return errors.New("the fields are too large")
+    }
+
+    values.Add(part.FormName(), string(value))
+    if err = CheckFormFieldCount(values); err != nil {
+      return fail(err)
+    }
+  }
+}
+
+func IsMultipartRequest(req *http.Request) bool {
+  mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+  return err == nil && mediaType == "multipart/form-data"
+}
+
+// Reads the fields of the form up to its first file part, which is returned unread. The fields read are set
+// on the request as if the form had been parsed, so they're validated and read the same as any other upload.
+func ReadStreamingForm(req *http.Request) (*multipart.Reader, *multipart.Part, error) {
+  reader, err := req.MultipartReader()
+  if err != nil {
+    return nil, nil, err
+  }
+
+  values := url.Values{}
+  form := &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+  remaining := int64(STREAM_FIELDS_MAX_BYTES)
+
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      SetMultipartForm(req, form)
+      return reader, nil, nil
+    }
+    if IsBodyTooLargeError(err) || IsBodyReadStalledError(err) {
+      return nil, nil, err
+    }
+    if headerError := AsMultipartHeaderError(err); headerError != nil {
+      return nil, nil, headerError
+    }
+    if err != nil {
+      return nil, nil, ErrMalformedMultipart
+    }
+
+    if len(part.FileName()) > 0 {
+      form.File[part.FormName()] = []*multipart.FileHeader{{Filename: part.FileName(), Header: part.Header}}
+      SetMultipartForm(req, form)
+      return reader, part, nil
+    }
+
+    value, err := ioutil.ReadAll(io.LimitReader(part, remaining+1))
+    if IsBodyTooLargeError(err) || IsBodyReadStalledError(err) {
+      return nil, nil, err
+    }
+    if err != nil {
+      return nil, nil, ErrMalformedMultipart
+    }
+
+    remaining -= int64(len(value))
+    if remaining < 0 {
+      return nil, nil, errors.New("the fields before the file are too large")
+    }
+
+    values.Add(part.FormName(), string(value))
+    if err = CheckFormFieldCount(values); err != nil {
+      return nil, nil, err
+    }
+  }
+}
+
+// Sets the fields read from a multipart body on the request, as if ParseMultipartForm had parsed them.
+func SetMultipartForm(req *http.Request, form *multipart.Form) {
+  req.PostForm = form.Value
+  req.MultipartForm = form
+  req.Form = url.Values{}
+  for name, fieldValues := range form.Value {
+    req.Form[name] = append(req.Form[name], fieldValues...)
+  }
+  for name, queryValues := range req.URL.Query() {
+    req.Form[name] = append(req.Form[name], queryValues...)
+  }
+}
+
+// Reads a file part into a FileHeader, kept in memory up to maxMemory bytes and in a temporary file past that.
+// FileHeaders can only be made by the standard library's form parsing, so the part is handed to it on its own.
+func ReadFormFilePart(part *multipart.Part, maxMemory int64) (*multipart.FileHeader, error) {
+  pipeReader, pipeWriter := io.Pipe()
+  writer := multipart.NewWriter(pipeWriter)
+  go func() {
+    partWriter, err := writer.CreatePart(part.Header)
+    if err == nil {
+      _, err = io.Copy(partWriter, part)
+    }
+    if err == nil {
+      err = writer.Close()
+    }
+    pipeWriter.CloseWithError(err)
+  }()
+
+  form, err := multipart.NewReader(pipeReader, writer.Boundary()).ReadForm(maxMemory)
+  // Unblocking the copy when parsing stopped short of the end of the part.
+  pipeReader.Close()
+  if err != nil {
+    return nil, err
+  }
+
+  headers := form.File[part.FormName()]
+  if len(headers) != 1 {
+    form.RemoveAll()
+    return nil, ErrMalformedMultipart
+  }
+  return headers[0], nil
+}
+
+func ReadUploadFromPart(part *multipart.Part) *Upload {
+  // Using the content type of the file part, the request's own content type is the multipart form's.
+  contentType := part.Header.Get("Content-Type")
+  if len(contentType) == 0 {
+    contentType = "application/octet-stream"
+  }
+
+  return &Upload{Filename: part.FileName(), ContentType: contentType, Reader: &multipartPartReader{part}}
+}
+
+// A file part reporting a body cut short as a malformed one, rather than as a failure of where it was copied to.
+type multipartPartReader struct {
+  part *multipart.Part
+}
+
+func (reader *multipartPartReader) Read(p []byte) (int, error) {
+  n, err := reader.part.Read(p)
+  if err != nil && err != io.EOF && IsBodyTooLargeError(err) == false && IsBodyReadStalledError(err) == false {
+    err = fmt.Errorf("%w: %v", ErrMalformedMultipart, err)
+  }
+  return n, err
+}
+
+// Counting every value of the fields, a field repeated being as costly as several.
+func CheckFormFieldCount(values url.Values) error {
+  count := 0
+  for _, fieldValues := range values {
+    count += len(fieldValues)
+  }
+
+  if count > MAX_FORM_FIELDS {
+    return fmt.Errorf("%w, at most %d are accepted", ErrTooManyFormFields, MAX_FORM_FIELDS)
+  }
+  return nil
+}
+
+// Whether reading the body failed because it went over MAX_UPLOAD_BYTES.
+func IsBodyTooLargeError(err error) bool {
+  var maxBytesError *http.MaxBytesError
+  return errors.As(err, &maxBytesError)
+}
+
+// Whether reading the body failed because it went over BODY_READ_IDLE_TIMEOUT without any progress.
+func IsBodyReadStalledError(err error) bool {
+  return errors.Is(err, ErrBodyReadStalled)
+}
+
+// Returns the MultipartHeaderError the error wraps, nil when it wraps none.
+func AsMultipartHeaderError(err error) *MultipartHeaderError {
+  var headerError *MultipartHeaderError
+  if errors.As(err, &headerError) {
+    return headerError
+  }
+  return nil
+}
+
+// Counts the bytes of the part headers of a multipart body as it's read, failing the read once they go over
+// MAX_PART_HEADER_BYTES or MAX_MULTIPART_HEADER_BYTES. Boundaries can't contain CR or LF, so the delimiter
+// ahead of each part is found without backtracking.
+type MultipartHeaderLimiter struct {
+  body       io.ReadCloser
+  delimiter  []byte
+  matched    int
+  inHeaders  bool
+  partBytes  int64
+  totalBytes int64
+  lastBytes  uint32
+  closed     bool
+  err        error
+}
+
+func NewMultipartHeaderLimiter(body io.ReadCloser, boundary string) *MultipartHeaderLimiter {
+  // The first delimiter may open the body without a line break before it, which matching from position 2 allows.
+  return &MultipartHeaderLimiter{body: body, delimiter: []byte("\r\n--" + boundary), matched: 2}
+}
+
+func (limiter *MultipartHeaderLimiter) Read(p []byte) (int, error) {
+  if limiter.err != nil {
+    return 0, limiter.err
+  }
+
+  n, err := limiter.body.Read(p)
+  for _, b := range p[:n] {
+    if limiter.closed {
+      break
+    }
+
+    if limiter.inHeaders {
+      limiter.partBytes++
+      limiter.totalBytes++
+      limiter.lastBytes = limiter.lastBytes<<8 | uint32(b)
+
+      switch {
+      case limiter.partBytes == 2 && limiter.lastBytes&0xffff == '-'<<8|'-':
+        // The closing delimiter, only the epilogue follows.
+        limiter.closed = true
+      case limiter.lastBytes == '\r'<<24|'\n'<<16|'\r'<<8|'\n':
+        limiter.inHeaders = false
+      case limiter.partBytes > MAX_PART_HEADER_BYTES:
+        limiter.err = &MultipartHeaderError{MAX_PART_HEADER_BYTES, false}
+      case limiter.totalBytes > MAX_MULTIPART_HEADER_BYTES:
+        limiter.err = &MultipartHeaderError{MAX_MULTIPART_HEADER_BYTES, true}
+      }
+
+      if limiter.err != nil {
+        return 0, limiter.err
+      }
+      continue
+    }
+
+    if b == limiter.delimiter[limiter.matched] {
+      limiter.matched++
+    } else if b == '\r' {
+      limiter.matched = 1
+    } else {
+      limiter.matched = 0
+    }
+
+    if limiter.matched == len(limiter.delimiter) {
+      limiter.matched = 0
+      limiter.inHeaders = true
+      limiter.partBytes = 0
+      limiter.lastBytes = 0
+    }
+  }
+
+  return n, err
+}
+
+func (limiter *MultipartHeaderLimiter) Close() error {
+  return limiter.body.Close()
+}
+
+// Whether any part follows the one that was streamed.
+func HasRemainingParts(reader *multipart.Reader) bool {
+  _, err := reader.NextPart()
+  return err != io.EOF
+}
+
+// A request body failing with ErrBodyReadStalled once nothing arrives for its timeout. The deadline is cleared
+// once the body is read entirely, so it doesn't outlive the body.
+type IdleTimeoutBody struct {
+  body       io.ReadCloser
+  controller *http.ResponseController
+  timeout    time.Duration
+  unwatched  bool
+}
+
+func (body *IdleTimeoutBody) Read(p []byte) (int, error) {
+  // Connections whose deadline can't be set are read without a watchdog.
+  if body.unwatched == false && body.controller.SetReadDeadline(time.Now().Add(body.timeout)) != nil {
+    body.unwatched = true
+  }
+
+  n, err := body.body.Read(p)
+  if body.unwatched {
+    return n, err
+  }
+
+  if errors.Is(err, os.ErrDeadlineExceeded) {
+    return n, fmt.Errorf("%w for longer than %v", ErrBodyReadStalled, body.timeout)
+  }
+  if err == io.EOF {
+    body.controller.SetReadDeadline(time.Time{})
+  }
+  return n, err
+}
+
+func (body *IdleTimeoutBody) Close() error {
+  return body.body.Close()
+}
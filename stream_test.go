@@ -0,0 +1,199 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "net/textproto"
+  "strings"
+  "testing"
+)
+
+// A multipart upload of a text file, whose body is handed to corrupt before it's sent.
+func NewCorruptUploadRequest(t *testing.T, corrupt func(body []byte, boundary string) []byte) *http.Request {
+  t.Helper()
+
+  body := &bytes.Buffer{}
+  writer := multipart.NewWriter(body)
+  writer.WriteField("expires_in", "1h")
+  part, err := writer.CreateFormFile("file", "notes.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  part.Write(bytes.Repeat([]byte("Hello, world. "), 100))
+  writer.Close()
+
+  req := httptest.NewRequest("PUT", "/v1/files", bytes.NewReader(corrupt(body.Bytes(), writer.Boundary())))
+  req.Header.Set("Content-Type", writer.FormDataContentType())
+  return req
+}
+
+func TestUploadRejectsMalformedMultipart(t *testing.T) {
+  cases := []struct {
+    name    string
+    corrupt func(body []byte, boundary string) []byte
+  }{
+    {"Truncated", func(body []byte, boundary string) []byte { return body[:len(body)/2] }},
+    {"MissingClosingBoundary", func(body []byte, boundary string) []byte {
+      return body[:bytes.LastIndex(body, []byte("--"+boundary))]
+    }},
+    {"NoBoundary", func(body []byte, boundary string) []byte { return []byte("Hello, world.") }},
+    {"Empty", func(body []byte, boundary string) []byte { return nil }},
+    {"CorruptPartHeaders", func(body []byte, boundary string) []byte {
+      return bytes.Replace(body, []byte("Content-Disposition: form-data;"), []byte("Content-Disposition form-data"), 1)
+    }},
+  }
+
+  for _, streamUploads := range []bool{false, true} {
+    for _, c := range cases {
+      name := c.name
+      if streamUploads {
+        name = "Streamed" + name
+      }
+
+      t.Run(name, func(t *testing.T) {
+        ResetTestState(t)
+        SetTestSetting(t, &STREAM_UPLOADS, streamUploads)
+
+        response := DecodeTestResponse(t, ServeTestRequest(NewCorruptUploadRequest(t, c.corrupt)))
+        if response.StatusCode != http.StatusBadRequest || response.ErrorText != "Invalid Form. (malformed multipart body)" {
+          t.Fatalf("Got %d %q, expected a malformed body.", response.StatusCode, response.ErrorText)
+        }
+        if keys, _ := STORAGE.List("", "", 10); len(keys) > 0 {
+          t.Fatalf("Stored %v for a malformed upload.", keys)
+        }
+      })
+    }
+  }
+}
+
+// A body failing the test as soon as it's read past the bytes it was given.
+type testBodyLimit struct {
+  t      *testing.T
+  reader *bytes.Reader
+}
+
+func (body *testBodyLimit) Read(p []byte) (int, error) {
+  if body.reader.Len() == 0 {
+    body.t.Errorf("The body was read past the field limit.")
+    return 0, io.ErrUnexpectedEOF
+  }
+  return body.reader.Read(p)
+}
+
+func TestUploadStopsReadingAtTooManyFields(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting(t, &MAX_FORM_FIELDS, 10)
+
+  // The field over the limit, followed by more than the parser reads ahead, then nothing.
+  body := &bytes.Buffer{}
+  writer := multipart.NewWriter(body)
+  for i := 0; i <= MAX_FORM_FIELDS; i++ {
+    writer.WriteField(fmt.Sprintf("meta_field-%d", i), "value")
+  }
+  writer.WriteField("meta_padding", strings.Repeat("x", 64<<10))
+
+  req := httptest.NewRequest("PUT", "/v1/files", &testBodyLimit{t, bytes.NewReader(body.Bytes())})
+  req.Header.Set("Content-Type", writer.FormDataContentType())
+  req.ContentLength = -1
+
+  response := DecodeTestResponse(t, ServeTestRequest(req))
+  if response.StatusCode != http.StatusBadRequest || response.ErrorText != "Invalid Form. (too many fields, at most 10 are accepted)" {
+    t.Fatalf("Got %d %q, expected too many fields.", response.StatusCode, response.ErrorText)
+  }
+}
+
+func TestUploadLimitsBufferedFileParts(t *testing.T) {
+  ResetTestState(t)
+  SetTestSetting[int64](t, &MAX_UPLOAD_BYTES, 1024)
+
+  req := NewTestUploadRequest(t, nil, "notes.txt", bytes.Repeat([]byte("x"), 4096))
+  // Announcing no length, so the body is only found to be too large while the file part is read.
+  req.ContentLength = -1
+
+  response := DecodeTestResponse(t, ServeTestRequest(req))
+  if response.StatusCode != http.StatusRequestEntityTooLarge {
+    t.Fatalf("Got %d %q, expected a 413.", response.StatusCode, response.ErrorText)
+  }
+}
+
+func TestLimitMultipartHeaders(t *testing.T) {
+  cases := []struct {
+    name      string
+    header    string
+    content   []byte
+    status    int
+    errorText string
+  }{
+    {"Normal", "", []byte("Hello, world."), http.StatusCreated, "No Error"},
+    // Content looking like headers is only content, however long.
+    {"HeaderLikeContent", "", bytes.Repeat([]byte("X-Padding: value\r\n"), 4096), http.StatusCreated, "No Error"},
+    {"OversizedPartHeader", strings.Repeat("x", 1024), []byte("Hello, world."), http.StatusBadRequest, "Invalid Form. (a part's headers are too large, at most 512 bytes are accepted per part)"},
+  }
+
+  for _, streamUploads := range []bool{false, true} {
+    for _, c := range cases {
+      name := c.name
+      if streamUploads {
+        name = "Streamed" + name
+      }
+
+      t.Run(name, func(t *testing.T) {
+        ResetTestState(t)
+        SetTestSetting(t, &STREAM_UPLOADS, streamUploads)
+        SetTestSetting[int64](t, &MAX_PART_HEADER_BYTES, 512)
+
+        body := &bytes.Buffer{}
+        writer := multipart.NewWriter(body)
+        header := textproto.MIMEHeader{}
+        header.Set("Content-Disposition", `form-data; name="file"; filename="notes.txt"`)
+        header.Set("Content-Type", "text/plain")
+        if len(c.header) > 0 {
+          header.Set("X-Padding", c.header)
+        }
+        part, err := writer.CreatePart(header)
+        if err != nil {
+          t.Fatal(err)
+        }
+        part.Write(c.content)
+        writer.Close()
+
+        req := httptest.NewRequest("PUT", "/v1/files", body)
+        req.Header.Set("Content-Type", writer.FormDataContentType())
+
+        response := DecodeTestResponse(t, ServeTestRequest(req))
+        if response.StatusCode != c.status || response.ErrorText != c.errorText {
+          t.Fatalf("Got %d %q, expected %d %q.", response.StatusCode, response.ErrorText, c.status, c.errorText)
+        }
+        if keys, _ := STORAGE.List("", "", 10); c.status != http.StatusCreated && len(keys) > 0 {
+          t.Fatalf("Stored %v for a rejected upload.", keys)
+        }
+      })
+    }
+  }
+}
+
+func TestMultipartHeaderLimiterTotal(t *testing.T) {
+  SetTestSetting[int64](t, &MAX_PART_HEADER_BYTES, 1024)
+  SetTestSetting[int64](t, &MAX_MULTIPART_HEADER_BYTES, 2048)
+
+  body := &bytes.Buffer{}
+  writer := multipart.NewWriter(body)
+  for i := 0; i < 10; i++ {
+    header := textproto.MIMEHeader{}
+    header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="meta_field-%d"`, i))
+    header.Set("X-Padding", strings.Repeat("x", 500))
+    part, _ := writer.CreatePart(header)
+    part.Write([]byte("value"))
+  }
+  writer.Close()
+
+  _, err := io.ReadAll(NewMultipartHeaderLimiter(io.NopCloser(body), writer.Boundary()))
+  headerError := AsMultipartHeaderError(err)
+  if headerError == nil || headerError.Total == false || headerError.Limit != 2048 {
+    t.Fatalf("Got %v, expected the total header limit to be exceeded.", err)
+  }
+}
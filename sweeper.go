@@ -0,0 +1,253 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Collection of S3 deletions that failed and are retried by the sweeper, along with the deletions
+// scheduled for later.
+var FAILED_DELETIONS_COLLECTION = "failed_deletions"
+
+// How often the sweeper runs, configured through SWEEP_INTERVAL.
+var SWEEP_INTERVAL = 5 * time.Minute
+
+// Attempts at a deletion before the sweeper gives up on it and dead-letters it, configured through
+// SWEEP_MAX_ATTEMPTS.
+var SWEEP_MAX_ATTEMPTS = 10
+
+// Goroutines a run of the sweeper deletes objects and records on, configured through SWEEP_WORKERS. Their S3
+// calls take slots of S3_MAX_CONCURRENCY like any other, of which more than one worker leaves at least one to requests.
+var SWEEP_WORKERS = 4
+
+// Most deletions, and most files of each kind purged, per run of the sweeper, configured through SWEEP_BATCH_SIZE.
+// Whatever is left over is taken up by the next runs.
+var SWEEP_BATCH_SIZE = 1000
+
+// Longest wait between two attempts at a deletion, which otherwise doubles after each failure.
+const SWEEP_MAX_BACKOFF = 24 * time.Hour
+
+// Most dead-lettered deletions listed by /admin/dead-letters.
+const DEAD_LETTER_LIST_MAX = 1000
+
+type FailedDeletion struct {
+  ID          bson.ObjectId `bson:"_id,omitempty" json:"id"`
+  Path        string        `json:"path"`
+  Region      string        `json:"region,omitempty" bson:",omitempty"`
+  Error       string        `json:"error"`
+  Attempts    int           `json:"attempts"`
+  CreatedAt   time.Time     `json:"created_at"`
+  LastTriedAt time.Time     `json:"last_tried_at"`
+  NotBefore   *time.Time    `json:"not_before,omitempty" bson:",omitempty"`
+  DeadLetter  bool          `json:"dead_letter" bson:",omitempty"`
+}
+
+type DeadLetterList struct {
+  Deletions []FailedDeletion `json:"deletions"`
+}
+
+// Loading the sweeper configuration, called once the environment has been loaded.
+func LoadSweeperSettings(config *Config) {
+  if sweepInterval := config.Getenv("SWEEP_INTERVAL", &SWEEP_INTERVAL); len(sweepInterval) > 0 {
+    interval, err := time.ParseDuration(sweepInterval)
+    if err != nil || interval <= 0 {
+      log.Fatalf("Invalid SWEEP_INTERVAL %q.", sweepInterval)
+    }
+    SWEEP_INTERVAL = interval
+  }
+
+  if maxAttempts := config.Getenv("SWEEP_MAX_ATTEMPTS", &SWEEP_MAX_ATTEMPTS); len(maxAttempts) > 0 {
+    attempts, err := strconv.Atoi(maxAttempts)
+    if err != nil || attempts <= 0 {
+      log.Fatalf("Invalid SWEEP_MAX_ATTEMPTS %q.", maxAttempts)
+    }
+    SWEEP_MAX_ATTEMPTS = attempts
+  }
+
+  if sweepWorkers := config.Getenv("SWEEP_WORKERS", &SWEEP_WORKERS); len(sweepWorkers) > 0 {
+    workers, err := strconv.Atoi(sweepWorkers)
+    if err != nil || workers <= 0 {
+      log.Fatalf("Invalid SWEEP_WORKERS %q.", sweepWorkers)
+    }
+    SWEEP_WORKERS = workers
+  }
+
+  // Called once the storage backend has been loaded.
+  if S3_MAX_CONCURRENCY > 0 && SWEEP_WORKERS > 1 && SWEEP_WORKERS >= S3_MAX_CONCURRENCY {
+    if len(config.Getenv("SWEEP_WORKERS", &SWEEP_WORKERS)) > 0 {
+      log.Fatalf("Invalid SWEEP_WORKERS %d, it must be less than S3_MAX_CONCURRENCY (%d).", SWEEP_WORKERS, S3_MAX_CONCURRENCY)
+    }
+    SWEEP_WORKERS = max(S3_MAX_CONCURRENCY-1, 1)
+  }
+
+  if sweepBatchSize := config.Getenv("SWEEP_BATCH_SIZE", &SWEEP_BATCH_SIZE); len(sweepBatchSize) > 0 {
+    batchSize, err := strconv.Atoi(sweepBatchSize)
+    if err != nil || batchSize <= 0 {
+      log.Fatalf("Invalid SWEEP_BATCH_SIZE %q.", sweepBatchSize)
+    }
+    SWEEP_BATCH_SIZE = batchSize
+  }
+}
+
+// Handlers
+// Lists the deletions the sweeper gave up on, oldest first. Their objects are left in S3 until removed by hand.
+func ListDeadLetters(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+
+  deletions := []FailedDeletion{}
+  err := session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION).Find(bson.M{"deadletter": true}).Sort("_id").Limit(DEAD_LETTER_LIST_MAX).All(&deletions)
+  if err != nil {
+    return HandleError(err)
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &DeadLetterList{deletions}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Runs the sweeper every SWEEP_INTERVAL, never returns.
+func RunSweeper() {
+  for range time.Tick(SWEEP_INTERVAL) {
+    Sweep()
+  }
+}
+
+// Sweeper Utility Functions.
+func Sweep() {
+  // A failed run is logged and retried on the next tick rather than bringing the server down.
+  defer func() {
+    if err := recover(); err != nil {
+      log.Printf("Sweep failed: %v", err)
+    }
+  }()
+
+  session := InitializeMongoSession()
+  defer session.Close()
+
+  PurgeExpiredFiles(session)
+  PurgeConsumedFiles(session)
+  PurgeSoftDeletedFiles(session)
+  RescanQuarantinedFiles(session)
+  PublishExpiringFiles(session)
+
+  deletions := []FailedDeletion{}
+  due := bson.M{
+    "deadletter": bson.M{"$ne": true},
+    "$or":        []bson.M{{"notbefore": bson.M{"$exists": false}}, {"notbefore": bson.M{"$lte": CLOCK.Now()}}},
+  }
+  err := session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION).Find(due).Limit(SWEEP_BATCH_SIZE).All(&deletions)
+  ErrorHandler(err)
+
+  SweepConcurrently(session, len(deletions), func(session *mgo.Session, i int) {
+    RetryDeletion(session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION), &deletions[i])
+  })
+}
+
+func RetryDeletion(failedDeletions *mgo.Collection, deletion *FailedDeletion) {
+  err := GetStorage(deletion.Region).Del(deletion.Path)
+  if err == nil {
+    err = failedDeletions.RemoveId(deletion.ID)
+    ErrorHandler(err)
+    return
+  }
+
+  // Waiting on a slot isn't the deletion failing, it's left as is for the next run.
+  if errors.Is(err, ErrS3Busy) {
+    return
+  }
+
+  // Backing off after each failure, and giving up once the attempts run out.
+  attempts := deletion.Attempts + 1
+  update := bson.M{"attempts": attempts, "error": err.Error(), "lasttriedat": CLOCK.Now(), "notbefore": GetNextDeletionAttempt(attempts)}
+  if attempts >= SWEEP_MAX_ATTEMPTS {
+    log.Printf("ALERT: Giving up on deleting %s after %d attempts, it has been dead-lettered: %v", deletion.Path, attempts, err)
+    update["deadletter"] = true
+  }
+
+  err = failedDeletions.UpdateId(deletion.ID, bson.M{"$set": update})
+  ErrorHandler(err)
+}
+
+// Runs the task for each of the count items on SWEEP_WORKERS goroutines, each with its own copy of the session,
+// returning once all of them are done. A failed task is logged and left for the next run, the others carry on.
+func SweepConcurrently(session *mgo.Session, count int, task func(session *mgo.Session, i int)) {
+  items := make(chan int)
+  var wait sync.WaitGroup
+
+  for worker := 0; worker < min(SWEEP_WORKERS, count); worker++ {
+    wait.Add(1)
+    go func() {
+      defer wait.Done()
+      workerSession := session.Copy()
+      defer workerSession.Close()
+
+      for i := range items {
+        RunSweepTask(func() { task(workerSession, i) })
+      }
+    }()
+  }
+
+  for i := 0; i < count; i++ {
+    items <- i
+  }
+  close(items)
+  wait.Wait()
+}
+
+func RunSweepTask(task func()) {
+  defer func() {
+    if err := recover(); err != nil {
+      log.Printf("Sweep task failed: %v", err)
+    }
+  }()
+
+  task()
+}
+
+// When a deletion that failed its attempts so far is next tried: a SWEEP_INTERVAL later after the first
+// failure, doubling after each one up to SWEEP_MAX_BACKOFF.
+func GetNextDeletionAttempt(attempts int) time.Time {
+  backoff := SWEEP_INTERVAL
+  for i := 1; i < attempts && backoff < SWEEP_MAX_BACKOFF; i++ {
+    backoff *= 2
+  }
+  if backoff > SWEEP_MAX_BACKOFF {
+    backoff = SWEEP_MAX_BACKOFF
+  }
+
+  return CLOCK.Now().Add(backoff)
+}
+
+// Records a failed S3 deletion for the sweeper to retry.
+func QueueFailedDeletion(region string, path string, deletionError error) {
+  session := InitializeMongoSession()
+  defer session.Close()
+
+  now := CLOCK.Now()
+  notBefore := GetNextDeletionAttempt(1)
+  deletion := &FailedDeletion{ID: bson.NewObjectId(), Path: path, Region: region, Error: deletionError.Error(), Attempts: 1, CreatedAt: now, LastTriedAt: now, NotBefore: &notBefore}
+  err := session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION).Insert(deletion)
+  ErrorHandler(err)
+}
+
+// Schedules an S3 deletion for the sweeper to make once the time has come.
+func QueueDeletion(region string, path string, notBefore time.Time) {
+  session := InitializeMongoSession()
+  defer session.Close()
+
+  deletion := &FailedDeletion{ID: bson.NewObjectId(), Path: path, Region: region, CreatedAt: CLOCK.Now(), NotBefore: &notBefore}
+  err := session.DB(DATABASE).C(FAILED_DELETIONS_COLLECTION).Insert(deletion)
+  ErrorHandler(err)
+}
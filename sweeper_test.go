@@ -0,0 +1,40 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestSweepPurgesExpiredFiles(t *testing.T) {
+  ResetTestState(t)
+  clock := &FixedClock{Time: time.Now()}
+  SetTestSetting[Clock](t, &CLOCK, clock)
+
+  expiring := UploadTestFile(t, [][2]string{{"expires_in", "1h"}}, "expiring.txt", []byte("Hello, world."))
+  kept := UploadTestFile(t, [][2]string{{"expires_in", "3h"}}, "kept.txt", []byte("Hello, world."))
+
+  clock.Advance(2 * time.Hour)
+  Sweep()
+
+  session := InitializeMongoSession()
+  defer session.Close()
+  if count, _ := session.DB(DATABASE).C(COLLECTION).FindId(expiring.ID).Count(); count != 0 {
+    t.Fatalf("The expired file's record is still there.")
+  }
+  if count, _ := session.DB(DATABASE).C(COLLECTION).FindId(kept.ID).Count(); count != 1 {
+    t.Fatalf("The unexpired file's record was deleted.")
+  }
+
+  keys, _ := STORAGE.List("", "", 10)
+  if len(keys) != 1 || GetStorage("").URL(keys[0]) != kept.URL {
+    t.Fatalf("Stored %v, expected only %q.", keys, kept.URL)
+  }
+
+  // The tombstone still tells the file expired.
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+expiring.ID.Hex(), nil)))
+  if response.StatusCode != http.StatusGone || response.Reason != GoneReasonExpired {
+    t.Fatalf("Got %d %q, expected the file to have expired.", response.StatusCode, response.Reason)
+  }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/url"
+  "regexp"
+  "strings"
+  "unicode/utf8"
+)
+
+// Tags set on every uploaded object, configured through S3_OBJECT_TAGS as "key=value,key=value".
+var OBJECT_TAGS = map[string]string{"app": "goupload"}
+
+// S3 allows at most 10 tags per object.
+const MAX_OBJECT_TAGS = 10
+
+// Characters S3 allows in tag keys and values.
+var objectTagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// Loading the object tag configuration, called once the environment has been loaded.
+func LoadObjectTags(config *Config) {
+  objectTags, ok := config.LookupEnv("S3_OBJECT_TAGS", &OBJECT_TAGS)
+  if ok == false {
+    return
+  }
+
+  OBJECT_TAGS = map[string]string{}
+  for _, tag := range strings.Split(objectTags, ",") {
+    if len(strings.TrimSpace(tag)) == 0 {
+      continue
+    }
+
+    key, value, _ := strings.Cut(tag, "=")
+    key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+    if err := ValidateObjectTag(key, value); err != nil {
+      log.Fatalf("Invalid S3_OBJECT_TAGS entry %q: %v.", tag, err)
+    }
+    OBJECT_TAGS[key] = value
+  }
+
+  // Leaving room for the expires and tenant tags added per file.
+  if len(OBJECT_TAGS) > MAX_OBJECT_TAGS-2 {
+    log.Fatalf("Invalid S3_OBJECT_TAGS, at most %d tags can be configured.", MAX_OBJECT_TAGS-2)
+  }
+}
+
+// Tag Utility Functions.
+
+// Returns the tags for the file's object: the configured ones, plus its expiration date so lifecycle
+// rules can clean up objects the app didn't, and its owner so they can be scoped per tenant.
+func CreateObjectTags(file *File) map[string]string {
+  tags := map[string]string{}
+  for key, value := range OBJECT_TAGS {
+    tags[key] = value
+  }
+
+  if file.ExpiresAt != nil {
+    tags["expires"] = file.ExpiresAt.UTC().Format("2006-01-02")
+  }
+
+  if len(file.Owner) > 0 {
+    tags["tenant"] = file.Owner
+  }
+
+  return tags
+}
+
+// Encoding tags as the x-amz-tagging header expects, a URL query string.
+func EncodeObjectTags(tags map[string]string) string {
+  values := url.Values{}
+  for key, value := range tags {
+    values.Set(key, value)
+  }
+  return values.Encode()
+}
+
+func ValidateObjectTag(key string, value string) error {
+  if len(key) == 0 || utf8.RuneCountInString(key) > 128 {
+    return fmt.Errorf("keys must be 1 to 128 characters")
+  }
+
+  if utf8.RuneCountInString(value) > 256 {
+    return fmt.Errorf("values must be at most 256 characters")
+  }
+
+  if strings.HasPrefix(strings.ToLower(key), "aws:") {
+    return fmt.Errorf("the aws: prefix is reserved")
+  }
+
+  if objectTagPattern.MatchString(key) == false || objectTagPattern.MatchString(value) == false {
+    return fmt.Errorf("only letters, numbers, spaces and _ . : / = + - @ are allowed")
+  }
+
+  return nil
+}
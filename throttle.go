@@ -0,0 +1,60 @@
+package main
+
+import (
+  "io"
+  "log"
+  "strconv"
+  "time"
+)
+
+// Bytes per second served to each download, configured through DOWNLOAD_RATE_LIMIT_BPS. Unlimited when zero.
+var DOWNLOAD_RATE_LIMIT_BPS int64
+
+// Loading the download throttling configuration, called once the environment has been loaded.
+func LoadThrottleSettings(config *Config) {
+  if rateLimit := config.Getenv("DOWNLOAD_RATE_LIMIT_BPS", &DOWNLOAD_RATE_LIMIT_BPS); len(rateLimit) > 0 {
+    bytesPerSecond, err := strconv.ParseInt(rateLimit, 10, 64)
+    if err != nil || bytesPerSecond < 0 {
+      log.Fatalf("Invalid DOWNLOAD_RATE_LIMIT_BPS %q.", rateLimit)
+    }
+    DOWNLOAD_RATE_LIMIT_BPS = bytesPerSecond
+  }
+}
+
+// A reader that sleeps as needed to average at most BytesPerSecond since its first read.
+type RateLimitedReader struct {
+  Reader         io.Reader
+  BytesPerSecond int64
+  start          time.Time
+  read           int64
+}
+
+func (reader *RateLimitedReader) Read(p []byte) (int, error) {
+  if reader.start.IsZero() {
+    reader.start = time.Now()
+  }
+
+  // Reading at most a tenth of a second's worth at once, so the output doesn't go out in bursts.
+  if chunk := reader.BytesPerSecond / 10; chunk > 0 && int64(len(p)) > chunk {
+    p = p[:chunk]
+  }
+
+  n, err := reader.Reader.Read(p)
+  reader.read += int64(n)
+
+  expected := time.Duration(float64(reader.read) / float64(reader.BytesPerSecond) * float64(time.Second))
+  if wait := expected - time.Since(reader.start); wait > 0 {
+    time.Sleep(wait)
+  }
+
+  return n, err
+}
+
+// Throttle Utility Functions.
+func ThrottleDownload(reader io.Reader) io.Reader {
+  if DOWNLOAD_RATE_LIMIT_BPS <= 0 {
+    return reader
+  }
+
+  return &RateLimitedReader{Reader: reader, BytesPerSecond: DOWNLOAD_RATE_LIMIT_BPS}
+}
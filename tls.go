@@ -0,0 +1,100 @@
+package main
+
+import (
+  "crypto/tls"
+  "log"
+  "net/http"
+  "strings"
+)
+
+// Certificate and key the server listens with over TLS, configured through TLS_CERT_FILE and TLS_KEY_FILE.
+// The server listens over plain HTTP when unset, e.g. behind a load balancer terminating TLS.
+var TLS_CERT_FILE string
+var TLS_KEY_FILE string
+
+// Oldest TLS version accepted, configured through TLS_MIN_VERSION as "1.2" or "1.3".
+var TLS_MIN_VERSION uint16 = tls.VersionTLS12
+
+// Cipher suites accepted for TLS 1.2, configured through TLS_CIPHER_SUITES as a comma separated list of
+// their names. Go's defaults are used when empty, TLS 1.3 suites aren't configurable.
+var TLS_CIPHER_SUITES = []uint16{}
+
+var TLS_VERSIONS = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// Loading the TLS configuration, called once the environment has been loaded.
+func LoadTLSSettings(config *Config) {
+  TLS_CERT_FILE = config.Getenv("TLS_CERT_FILE", &TLS_CERT_FILE)
+  TLS_KEY_FILE = config.Getenv("TLS_KEY_FILE", &TLS_KEY_FILE)
+  if (len(TLS_CERT_FILE) == 0) != (len(TLS_KEY_FILE) == 0) {
+    log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together.")
+  }
+
+  if minVersion := config.Getenv("TLS_MIN_VERSION", GetTLSMinVersionName); len(minVersion) > 0 {
+    version, ok := TLS_VERSIONS[minVersion]
+    if ok == false {
+      log.Fatalf("Invalid TLS_MIN_VERSION %q, expected 1.2 or 1.3.", minVersion)
+    }
+    TLS_MIN_VERSION = version
+  }
+
+  if cipherSuites := config.Getenv("TLS_CIPHER_SUITES", GetCipherSuiteNames); len(cipherSuites) > 0 {
+    for _, name := range strings.Split(cipherSuites, ",") {
+      id, ok := GetCipherSuiteID(strings.TrimSpace(name))
+      if ok == false {
+        log.Fatalf("Invalid TLS_CIPHER_SUITES entry %q, expected the name of a secure cipher suite such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.", name)
+      }
+      TLS_CIPHER_SUITES = append(TLS_CIPHER_SUITES, id)
+    }
+  }
+
+  if len(TLS_CERT_FILE) > 0 {
+    log.Printf("Serving TLS %s and up, with %s.", tls.VersionName(TLS_MIN_VERSION), strings.Join(GetCipherSuiteNames(), ", "))
+  }
+}
+
+// TLS Utility Functions.
+
+func GetTLSMinVersionName() string {
+  return tls.VersionName(TLS_MIN_VERSION)
+}
+
+// Listens over TLS when a certificate is configured, over plain HTTP otherwise. Never returns.
+func ListenAndServe(address string, handler http.Handler) error {
+  if len(TLS_CERT_FILE) == 0 {
+    return http.ListenAndServe(address, handler)
+  }
+
+  server := &http.Server{Addr: address, Handler: handler, TLSConfig: CreateTLSConfig()}
+  return server.ListenAndServeTLS(TLS_CERT_FILE, TLS_KEY_FILE)
+}
+
+func CreateTLSConfig() *tls.Config {
+  config := &tls.Config{MinVersion: TLS_MIN_VERSION}
+  if len(TLS_CIPHER_SUITES) > 0 {
+    config.CipherSuites = TLS_CIPHER_SUITES
+  }
+  return config
+}
+
+// Only the suites Go considers secure can be configured.
+func GetCipherSuiteID(name string) (uint16, bool) {
+  for _, suite := range tls.CipherSuites() {
+    if suite.Name == name {
+      return suite.ID, true
+    }
+  }
+  return 0, false
+}
+
+// The names of the cipher suites accepted for TLS 1.2.
+func GetCipherSuiteNames() []string {
+  if len(TLS_CIPHER_SUITES) == 0 {
+    return []string{"the default cipher suites"}
+  }
+
+  names := []string{}
+  for _, id := range TLS_CIPHER_SUITES {
+    names = append(names, tls.CipherSuiteName(id))
+  }
+  return names
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Secret used to sign download tokens, configured through TOKEN_SECRET.
+var TOKEN_SECRET []byte
+
+// How long a download token remains valid, configured through TOKEN_TTL.
+var TOKEN_TTL = 5 * time.Minute
+
+// Collection holding the nonces of redeemed tokens until the tokens expire.
+var REDEEMED_TOKENS_COLLECTION = "redeemedtokens"
+
+type DownloadToken struct {
+  Token     string    `json:"token"`
+  ExpiresAt time.Time `json:"expires_at"`
+}
+
+type RedeemedToken struct {
+  Nonce     string        `bson:"_id"`
+  FileID    bson.ObjectId `bson:"fileid"`
+  ExpiresAt time.Time     `bson:"expiresat"`
+}
+
+// Loading the token signing configuration, called once the environment has been loaded.
+func LoadDownloadTokenSettings(config *Config) {
+  TOKEN_SECRET = []byte(config.GetenvSecret("TOKEN_SECRET", &TOKEN_SECRET))
+
+  // Without a configured secret, tokens are signed with a random one and only redeemable on this instance until it restarts.
+  if len(TOKEN_SECRET) == 0 {
+    log.Println("TOKEN_SECRET is not set, download tokens will not survive a restart.")
+    TOKEN_SECRET = make([]byte, 32)
+    _, err := rand.Read(TOKEN_SECRET)
+    ErrorHandler(err)
+  }
+
+  if tokenTTL := config.Getenv("TOKEN_TTL", &TOKEN_TTL); len(tokenTTL) > 0 {
+    ttl, err := time.ParseDuration(tokenTTL)
+    if err != nil || ttl <= 0 {
+      log.Fatalf("Invalid TOKEN_TTL %q.", tokenTTL)
+    }
+    TOKEN_TTL = ttl
+  }
+}
+
+// Handlers
+func CreateDownloadToken(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetPasswordRequiredResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Checking the password first, so only the requests allowed to know tell what state the file is in.
+  if response = CheckFilePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Files still being fetched in the background have no content yet.
+  if response = CheckUploadState(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckEncryptedAccess(file); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // A token can't be redeemed for a file that has already been accessed.
+  if file.Accessed == true {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, "This file has expired."), GoneReasonExpired)
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  expiresAt := CLOCK.Now().Add(TOKEN_TTL)
+  response = GenerateResponse(http.StatusCreated, http.StatusText(http.StatusCreated), true, 0, "No Error")
+  response.Content = &DownloadToken{CreateDownloadTokenString(file.ID, expiresAt), expiresAt}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Token Utility Functions.
+
+// Tokens take the form "<file id>.<nonce>.<expiry unix time>.<signature>", where the signature is an HMAC-SHA256
+// of the first three parts. The random nonce tells tokens apart, so each one can only be redeemed once.
+func CreateDownloadTokenString(fileId bson.ObjectId, expiresAt time.Time) string {
+  nonce := make([]byte, 16)
+  _, err := rand.Read(nonce)
+  ErrorHandler(err)
+
+  payload := fmt.Sprintf("%s.%s.%d", fileId.Hex(), hex.EncodeToString(nonce), expiresAt.Unix())
+  return payload + "." + SignDownloadTokenPayload(payload)
+}
+
+// Returns the nonce and expiry of a token signed for the file and not yet expired.
+func ParseDownloadToken(token string, fileId bson.ObjectId) (string, time.Time, bool) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 4 || parts[0] != fileId.Hex() || len(parts[1]) == 0 {
+    return "", time.Time{}, false
+  }
+
+  expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+  if err != nil || CLOCK.Now().Unix() > expiresAt {
+    return "", time.Time{}, false
+  }
+
+  signature := SignDownloadTokenPayload(parts[0] + "." + parts[1] + "." + parts[2])
+  if hmac.Equal([]byte(signature), []byte(parts[3])) == false {
+    return "", time.Time{}, false
+  }
+
+  return parts[1], time.Unix(expiresAt, 0), true
+}
+
+// Redeems a valid token, recording its nonce so that it's refused from then on. Only the request inserting
+// the nonce redeems the token, so concurrent requests can't both use it.
+func RedeemDownloadToken(collection *mgo.Collection, token string, fileId bson.ObjectId) bool {
+  nonce, expiresAt, ok := ParseDownloadToken(token, fileId)
+  if ok == false {
+    return false
+  }
+
+  err := collection.Database.C(REDEEMED_TOKENS_COLLECTION).Insert(&RedeemedToken{nonce, fileId, expiresAt})
+  if mgo.IsDup(err) {
+    return false
+  }
+  ErrorHandler(err)
+
+  return true
+}
+
+func EnsureDownloadTokenIndexes(session *mgo.Session) {
+  redeemedTokens := session.DB(DATABASE).C(REDEEMED_TOKENS_COLLECTION)
+
+  // Mongo forgets redeemed tokens once they expire, as they're refused from then on anyway.
+  err := redeemedTokens.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+  if err != nil {
+    log.Printf("Unable to create the redeemed token expiry index: %v", err)
+  }
+}
+
+func SignDownloadTokenPayload(payload string) string {
+  mac := hmac.New(sha256.New, TOKEN_SECRET)
+  mac.Write([]byte(payload))
+  return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "time"
+
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Collection of the tombstones left behind by the records of consumed files once they're deleted.
+var TOMBSTONES_COLLECTION = "tombstones"
+
+// How long tombstones are kept, configured through TOMBSTONE_TTL.
+var TOMBSTONE_TTL = 30 * 24 * time.Hour
+
+// How long the records of consumed files are kept before the sweeper replaces them with tombstones,
+// configured through CONSUMED_RECORD_RETENTION. Records are kept forever when 0.
+var CONSUMED_RECORD_RETENTION time.Duration
+
+// Why a file is no longer available, given as the reason of its 410 and kept on its tombstone.
+const (
+  GoneReasonConsumed     = "consumed"
+  GoneReasonExpired      = "expired"
+  GoneReasonDeleted      = "deleted"
+  GoneReasonQuarantine   = "quarantine"
+  GoneReasonUploadFailed = "upload_failed"
+)
+
+// The error text of the 410 of a file gone for each reason.
+var GONE_REASON_TEXTS = map[string]string{
+  GoneReasonConsumed:     "This file has already been accessed.",
+  GoneReasonExpired:      "This file has expired.",
+  GoneReasonDeleted:      "This file has been deleted.",
+  GoneReasonQuarantine:   "This file was found to be infected and has been deleted.",
+  GoneReasonUploadFailed: "The upload of this file failed.",
+}
+
+// What's left of a consumed or deleted file once its record is deleted, so it can still be told apart from one
+// that never existed.
+type Tombstone struct {
+  ID         bson.ObjectId `bson:"_id"`
+  Slug       string        `bson:",omitempty"`
+  ConsumedAt *time.Time    `bson:",omitempty"`
+  ExpiresAt  time.Time
+  Reason     string        `bson:",omitempty"`
+}
+
+// Loading the tombstone configuration, called once the environment has been loaded.
+func LoadTombstoneSettings(config *Config) {
+  if tombstoneTTL := config.Getenv("TOMBSTONE_TTL", &TOMBSTONE_TTL); len(tombstoneTTL) > 0 {
+    ttl, err := time.ParseDuration(tombstoneTTL)
+    if err != nil || ttl <= 0 {
+      log.Fatalf("Invalid TOMBSTONE_TTL %q.", tombstoneTTL)
+    }
+    TOMBSTONE_TTL = ttl
+  }
+
+  if recordRetention := config.Getenv("CONSUMED_RECORD_RETENTION", &CONSUMED_RECORD_RETENTION); len(recordRetention) > 0 {
+    retention, err := time.ParseDuration(recordRetention)
+    if err != nil || retention < 0 {
+      log.Fatalf("Invalid CONSUMED_RECORD_RETENTION %q.", recordRetention)
+    }
+    CONSUMED_RECORD_RETENTION = retention
+  }
+}
+
+// Tombstone Utility Functions.
+
+// Removes the file's record, leaving a tombstone behind telling why the file is gone, along with its access
+// log entries when CASCADE_ACCESS_LOGS is set.
+func RemoveFileRecord(collection *mgo.Collection, file *File) error {
+  if err := RemoveAccessLogs(collection, file); err != nil {
+    return err
+  }
+
+  tombstone := &Tombstone{file.ID, file.Slug, file.ConsumedAt, CLOCK.Now().Add(TOMBSTONE_TTL), GetGoneReason(file)}
+  if _, err := collection.Database.C(TOMBSTONES_COLLECTION).UpsertId(file.ID, tombstone); err != nil {
+    return err
+  }
+
+  err := collection.RemoveId(file.ID)
+  if err == nil {
+    PublishFileEvent(FileEventDeleted, file)
+  }
+  return err
+}
+
+// Tombstones left before reasons were kept were all of consumed files.
+func (tombstone *Tombstone) GetReason() string {
+  if len(tombstone.Reason) == 0 {
+    return GoneReasonConsumed
+  }
+  return tombstone.Reason
+}
+
+// Why the file is gone, or would be once removed: the reason recorded when it was finalized, otherwise its
+// consumption or expiration. Files removed for none of these were deleted.
+func GetGoneReason(file *File) string {
+  switch {
+  case len(file.GoneReason) > 0:
+    return file.GoneReason
+  case file.Accessed == true:
+    return GoneReasonConsumed
+  case IsFileExpired(file):
+    return GoneReasonExpired
+  }
+  return GoneReasonDeleted
+}
+
+// The 410 of a file gone for the reason.
+func GoneResponse(reason string) *Response {
+  return SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), false, 0, GONE_REASON_TEXTS[reason]), reason)
+}
+
+// Tells clients why the file of the response is gone, under "reason".
+func SetGoneReason(response *Response, reason string) *Response {
+  response.Reason = reason
+  return response
+}
+
+// Finds the tombstone of the submitted id, or slug, returning nil when there's none.
+func FindTombstone(collection *mgo.Collection, submittedFileId string) *Tombstone {
+  query := bson.M{"slug": submittedFileId}
+  if bson.IsObjectIdHex(submittedFileId) {
+    query = bson.M{"_id": bson.ObjectIdHex(submittedFileId)}
+  }
+
+  tombstone := &Tombstone{}
+  err := collection.Database.C(TOMBSTONES_COLLECTION).Find(query).One(tombstone)
+  if err != nil {
+    return nil
+  }
+
+  return tombstone
+}
+
+// Replaces the records of files consumed longer than CONSUMED_RECORD_RETENTION ago with tombstones. Soft
+// deleted files are left to PurgeSoftDeletedFiles, which deletes their objects along with their records.
+func PurgeConsumedFiles(session *mgo.Session) {
+  if CONSUMED_RECORD_RETENTION == 0 {
+    return
+  }
+
+  files := []File{}
+  err := session.DB(DATABASE).C(COLLECTION).Find(bson.M{"accessed": true, "consumedat": bson.M{"$lt": CLOCK.Now().Add(-CONSUMED_RECORD_RETENTION)}, "deletedat": bson.M{"$exists": false}}).Limit(SWEEP_BATCH_SIZE).All(&files)
+  ErrorHandler(err)
+
+  SweepConcurrently(session, len(files), func(session *mgo.Session, i int) {
+    err := RemoveFileRecord(session.DB(DATABASE).C(COLLECTION), &files[i])
+    ErrorHandler(err)
+  })
+}
+
+func EnsureTombstoneIndexes(session *mgo.Session) {
+  tombstones := session.DB(DATABASE).C(TOMBSTONES_COLLECTION)
+
+  // Mongo removes tombstones once they expire.
+  err := tombstones.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+  if err != nil {
+    log.Printf("Unable to create the tombstone expiry index: %v", err)
+  }
+
+  err = tombstones.EnsureIndex(mgo.Index{Key: []string{"slug"}, Sparse: true})
+  if err != nil {
+    log.Printf("Unable to create the tombstone slug index: %v", err)
+  }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+  "log"
+  "net/http"
+
+  "github.com/gorilla/mux"
+  "gopkg.in/mgo.v2"
+  "gopkg.in/mgo.v2/bson"
+)
+
+// Handlers
+// Hands the file over to the API key named by "owner", on behalf of the API key owning it. Only the ownership
+// changes, the file's objects stay where they were stored and its links keep working.
+func TransferFile(w http.ResponseWriter, req *http.Request) *AppError {
+  session, appError := OpenMongoSession()
+  if appError != nil {
+    return appError
+  }
+  defer session.Close()
+  collection := session.DB(DATABASE).C(COLLECTION)
+
+  vars := mux.Vars(req)
+  submittedFileId := string(vars["id"])
+
+  // Find the file matching the submitted id, or slug.
+  file, response := FindVisibleFile(collection, submittedFileId, req, GetTransferOwnerResponse)
+  if response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  // Only the API key owning the file can give it away, anonymous uploads have no owner to transfer from.
+  owner, ok := AuthenticateAPIKey(req)
+  if ok == false || len(owner) == 0 || owner != file.Owner {
+    WriteResponse(GetTransferOwnerResponse(req), w, req)
+    return nil
+  }
+
+  // The management token is for uploaders without an API key, handing a file over takes its delete password.
+  if len(req.Header.Get(MANAGEMENT_TOKEN_HEADER)) > 0 {
+    response = GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, "The management token can't be used to transfer a file, send its delete password instead.")
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if response = CheckDeletePassword(collection, file, req); response != nil {
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if file.Accessed == true || IsFileExpired(file) {
+    response = SetGoneReason(GenerateResponse(http.StatusGone, http.StatusText(http.StatusGone), true, 0, "No Error"), GetGoneReason(file))
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  if fieldErrors := ValidateTransferFields(req); len(fieldErrors) > 0 {
+    WriteResponse(InvalidFormResponse(fieldErrors), w, req)
+    return nil
+  }
+
+  // Transferring only from the owner checked above, so concurrent transfers can't both succeed.
+  newOwner := req.FormValue("owner")
+  if newOwner != file.Owner {
+    err := collection.Update(bson.M{"_id": file.ID, "owner": file.Owner}, bson.M{"$set": bson.M{"owner": newOwner}})
+    if err == mgo.ErrNotFound {
+      response = GenerateResponse(http.StatusConflict, http.StatusText(http.StatusConflict), false, 0, "This file was transferred in the meantime.")
+      WriteResponse(response, w, req)
+      return nil
+    }
+    if err != nil {
+      return HandleError(err)
+    }
+
+    log.Printf("File %s transferred from %s to %s.", file.ID.Hex(), file.Owner, newOwner)
+    file.Owner = newOwner
+  }
+
+  response = GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = file
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Transfer Utility Functions.
+
+// The response rejecting a transfer on behalf of an API key that doesn't own the file.
+func GetTransferOwnerResponse(req *http.Request) *Response {
+  return GenerateResponse(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), false, 0, "This file can only be transferred with the API key that owns it.")
+}
+
+// Returns the problems of the owner to transfer to, which must be the id of a configured API key.
+func ValidateTransferFields(req *http.Request) []*FieldError {
+  if name := FindDuplicateField(req, []string{"owner"}); len(name) > 0 {
+    return []*FieldError{{name, FieldErrorDuplicate, "Must only be given once."}}
+  }
+
+  newOwner := req.FormValue("owner")
+  if len(newOwner) == 0 {
+    return []*FieldError{{"owner", FieldErrorRequires, "Is required."}}
+  }
+  if _, ok := API_KEYS[newOwner]; ok == false {
+    return []*FieldError{{"owner", FieldErrorInvalid, "Must be the id of an API key."}}
+  }
+
+  return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+  "bytes"
+  "html/template"
+  "log"
+  "net/http"
+  "strconv"
+)
+
+// Whether a minimal upload page is served at "/", configured through SERVE_UI. UI_TEMPLATE is the path of a
+// template replacing the default page.
+var SERVE_UI = false
+
+var UI_TEMPLATE string
+
+var UPLOAD_PAGE_TEMPLATE *template.Template
+
+type UploadPage struct {
+  MaxUploadBytes int64
+}
+
+// The file field comes last, streamed uploads need every other field ahead of it.
+const DEFAULT_UPLOAD_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Upload - GoUpload</title>
+  <style>
+    body { font-family: sans-serif; color: #333; max-width: 32em; margin: 6em auto; }
+    h1 { font-size: 1.5em; text-align: center; }
+    label { display: block; margin: 1em 0 0.25em; }
+    input { width: 100%; box-sizing: border-box; }
+    button { margin-top: 1.5em; width: 100%; }
+  </style>
+</head>
+<body>
+  <h1>Upload a file</h1>
+  <form action="/v1/files" method="post" enctype="multipart/form-data">
+    <label for="password">Password (optional)</label>
+    <input type="password" id="password" name="password" autocomplete="new-password">
+    <label for="expires_in">Expires in (optional, e.g. 24h)</label>
+    <input type="text" id="expires_in" name="expires_in">
+    <label for="file">File{{if .MaxUploadBytes}} (at most {{.MaxUploadBytes}} bytes){{end}}</label>
+    <input type="file" id="file" name="file" required>
+    <button type="submit">Upload</button>
+  </form>
+</body>
+</html>
+`
+
+// Loading the upload page configuration, called once the environment has been loaded.
+func LoadUISettings(config *Config) {
+  if serveUI := config.Getenv("SERVE_UI", &SERVE_UI); len(serveUI) > 0 {
+    enabled, err := strconv.ParseBool(serveUI)
+    if err != nil {
+      log.Fatalf("Invalid SERVE_UI %q.", serveUI)
+    }
+    SERVE_UI = enabled
+  }
+
+  UPLOAD_PAGE_TEMPLATE = template.Must(template.New("upload.html").Parse(DEFAULT_UPLOAD_PAGE))
+  UI_TEMPLATE = config.Getenv("UI_TEMPLATE", &UI_TEMPLATE)
+  if len(UI_TEMPLATE) > 0 {
+    page, err := template.ParseFiles(UI_TEMPLATE)
+    if err != nil {
+      log.Fatalf("Invalid UI_TEMPLATE %q: %v", UI_TEMPLATE, err)
+    }
+    UPLOAD_PAGE_TEMPLATE = page
+  }
+}
+
+// Handlers
+func ServeUploadPage(w http.ResponseWriter, req *http.Request) *AppError {
+  body := &bytes.Buffer{}
+  err := UPLOAD_PAGE_TEMPLATE.Execute(body, &UploadPage{MAX_UPLOAD_BYTES})
+  if err != nil {
+    return HandleError(err)
+  }
+
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.Write(body.Bytes())
+  return nil
+}
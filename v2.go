@@ -0,0 +1,212 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "reflect"
+  "strings"
+  "unicode"
+)
+
+// The /v2 routes share the handlers of /v1, only their responses are written differently: with the HTTP status
+// code of the response rather than always 200, and an envelope nesting the status under "meta" and the error
+// under "error", the content under "data" having its fields in camelCase. Keys of maps, such as the ids of
+// /files/status or the metadata of a file, are data and kept as they are.
+const V2_PREFIX = "/v2/"
+
+type V2Response struct {
+  Data  interface{} `json:"data"`
+  Error *V2Error    `json:"error,omitempty"`
+  Meta  V2Meta      `json:"meta"`
+}
+
+type V2Error struct {
+  Code    int    `json:"code,omitempty"`
+  Message string `json:"message"`
+}
+
+type V2Meta struct {
+  Status     int    `json:"status"`
+  StatusText string `json:"statusText"`
+  Note       string `json:"note,omitempty"`
+  Notice     string `json:"notice,omitempty"`
+  Reason     string `json:"reason,omitempty"`
+}
+
+// Written in place of a /v2 response that couldn't be marshaled.
+var V2_MARSHAL_FAILURE_RESPONSE = []byte(`{"data":null,"error":{"code":1000,"message":"Something went wrong."},"meta":{"status":500,"statusText":"Internal Server Error"}}`)
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// V2 Utility Functions.
+
+func IsV2Request(req *http.Request) bool {
+  return strings.HasPrefix(req.URL.Path, V2_PREFIX)
+}
+
+func NewV2Response(response *Response) *V2Response {
+  v2Response := &V2Response{
+    Data: ToV2Value(reflect.ValueOf(response.Content)),
+    Meta: V2Meta{response.StatusCode, response.StatusText, response.Note, response.Notice, response.Reason},
+  }
+
+  if response.Success == false {
+    message := response.ErrorText
+    if len(message) == 0 || strings.HasPrefix(message, "No Error") {
+      message = response.StatusText
+    }
+    v2Response.Error = &V2Error{response.ErrorCode, message}
+  }
+
+  return v2Response
+}
+
+// Converts the content of a response to what it marshals as in /v2: structs become objects of their marshaled
+// fields named in camelCase, following the same json tags and omitempty rules as /v1. Values marshaling
+// themselves, such as times and ids, are left to do so.
+func ToV2Value(value reflect.Value) interface{} {
+  for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+    if value.IsNil() {
+      return nil
+    }
+    value = value.Elem()
+  }
+
+  switch {
+  case value.IsValid() == false:
+    return nil
+  case value.Type() == reflect.TypeOf(File{}):
+    return FileToV2Object(value)
+  case value.Type().Implements(jsonMarshalerType):
+    return value.Interface()
+  }
+
+  switch value.Kind() {
+  case reflect.Struct:
+    object := map[string]interface{}{}
+    AddV2Fields(object, value)
+    return object
+  case reflect.Map:
+    if value.IsNil() {
+      return nil
+    }
+    object := map[string]interface{}{}
+    iter := value.MapRange()
+    for iter.Next() {
+      object[fmt.Sprint(iter.Key().Interface())] = ToV2Value(iter.Value())
+    }
+    return object
+  case reflect.Slice, reflect.Array:
+    if value.Kind() == reflect.Slice && value.IsNil() {
+      return nil
+    }
+    // Bytes marshal as base64 strings as they are.
+    if value.Type().Elem().Kind() == reflect.Uint8 {
+      return value.Interface()
+    }
+    items := make([]interface{}, value.Len())
+    for i := range items {
+      items[i] = ToV2Value(value.Index(i))
+    }
+    return items
+  }
+
+  return value.Interface()
+}
+
+// Files marshal with the computed downloads remaining added to their stored fields, in /v2 as in /v1.
+func FileToV2Object(value reflect.Value) map[string]interface{} {
+  object := map[string]interface{}{}
+  AddV2Fields(object, value)
+
+  file := value.Interface().(File)
+  if remaining := file.GetDownloadsRemaining(); remaining != nil {
+    object["downloadsRemaining"] = *remaining
+  }
+  return object
+}
+
+// Adds the fields of the struct as encoding/json would marshal them, the fields of embedded structs included.
+func AddV2Fields(object map[string]interface{}, value reflect.Value) {
+  for i := 0; i < value.NumField(); i++ {
+    field := value.Type().Field(i)
+    fieldValue := value.Field(i)
+
+    tag := field.Tag.Get("json")
+    if tag == "-" {
+      continue
+    }
+    name, options, _ := strings.Cut(tag, ",")
+
+    if field.Anonymous && len(name) == 0 {
+      embedded := fieldValue
+      if embedded.Kind() == reflect.Ptr {
+        if embedded.IsNil() {
+          continue
+        }
+        embedded = embedded.Elem()
+      }
+      if embedded.Kind() == reflect.Struct {
+        AddV2Fields(object, embedded)
+        continue
+      }
+    }
+    if field.IsExported() == false {
+      continue
+    }
+
+    if len(name) == 0 {
+      name = field.Name
+    }
+    if strings.Contains(","+options+",", ",omitempty,") && IsEmptyJSONValue(fieldValue) {
+      continue
+    }
+
+    object[ToCamelCase(name)] = ToV2Value(fieldValue)
+  }
+}
+
+// Whether omitempty leaves the value out, as defined by encoding/json.
+func IsEmptyJSONValue(value reflect.Value) bool {
+  switch value.Kind() {
+  case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+    return value.Len() == 0
+  case reflect.Bool:
+    return value.Bool() == false
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return value.Int() == 0
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    return value.Uint() == 0
+  case reflect.Float32, reflect.Float64:
+    return value.Float() == 0
+  case reflect.Interface, reflect.Ptr:
+    return value.IsNil()
+  }
+  return false
+}
+
+// Converts snake_case json names, and Go names of untagged fields, to camelCase: "status_code" to "statusCode",
+// "URL" to "url" and "ContentType" to "contentType".
+func ToCamelCase(name string) string {
+  words := strings.Split(name, "_")
+  for i, word := range words {
+    if i > 0 && len(word) > 0 {
+      words[i] = strings.ToUpper(word[:1]) + word[1:]
+    }
+  }
+  name = strings.Join(words, "")
+
+  // Lowering the leading capitals, but the one starting the next word, e.g. "URLPath" to "urlPath".
+  runes := []rune(name)
+  for i := range runes {
+    if unicode.IsUpper(runes[i]) == false {
+      break
+    }
+    if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+      break
+    }
+    runes[i] = unicode.ToLower(runes[i])
+  }
+  return string(runes)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/url"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+type FieldType int
+
+const (
+  FieldText FieldType = iota
+  FieldPositiveInteger
+  FieldDuration
+  FieldURL
+  FieldFile
+  FieldSlug
+  FieldBoolean
+  FieldPasswordHash
+  FieldMetadata
+  FieldChecksum
+  FieldTimestamp
+)
+
+type FormField struct {
+  Name string
+  Type FieldType
+}
+
+type FieldError struct {
+  Field   string `json:"field"`
+  Code    string `json:"code"`
+  Message string `json:"message"`
+}
+
+// Codes of the field errors, for clients to tell problems apart without parsing their messages.
+const (
+  FieldErrorUnknown    = "unknown_field"
+  FieldErrorDuplicate  = "duplicate_field"
+  FieldErrorInvalid    = "invalid_value"
+  FieldErrorTooLarge   = "too_large"
+  FieldErrorConflict   = "conflicting_fields"
+  FieldErrorRequires   = "requires_field"
+  FieldErrorNotAllowed = "not_allowed"
+  FieldErrorOutOfRange = "out_of_range"
+)
+
+// The content of a form rejected as invalid. Every problem found is listed under "errors", the first one also
+// being given as "field" and "message" as it was before the others were reported.
+type ValidationErrors struct {
+  Field   string        `json:"field"`
+  Message string        `json:"message"`
+  Errors  []*FieldError `json:"errors"`
+}
+
+// Fields accepted by the upload endpoint. Anything else in the form is rejected.
+var UPLOAD_FORM = []FormField{
+  {"file", FieldFile},
+  {"source_url", FieldURL},
+  {"password", FieldText},
+  {"password_hash", FieldPasswordHash},
+  {"delete_password", FieldText},
+  {"max_downloads", FieldPositiveInteger},
+  {"max_password_attempts", FieldPositiveInteger},
+  {"expires_in", FieldDuration},
+  {"expire_after_access", FieldDuration},
+  {"slug", FieldSlug},
+  {"async", FieldBoolean},
+  {"encrypt", FieldBoolean},
+  {"checksum", FieldChecksum},
+  {"immutable_until", FieldTimestamp},
+  {METADATA_FIELD_PREFIX + "*", FieldMetadata},
+}
+
+// Largest integer accepted in a form, for counts such as max_downloads.
+const MAX_FORM_INTEGER = 1000000
+
+// Longest duration accepted in a form, about a hundred years.
+const MAX_FORM_DURATION = 100 * 365 * 24 * time.Hour
+
+var digitsPattern = regexp.MustCompile(`^[0-9]+$`)
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// Prefix of the form fields carrying metadata, stored on the object as x-amz-meta-* headers.
+const METADATA_FIELD_PREFIX = "meta_"
+
+// Most bytes of metadata, keys and values together, S3 accepts on an object.
+const MAX_METADATA_BYTES = 2048
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+var metadataValuePattern = regexp.MustCompile(`^[\x20-\x7e]*$`)
+
+// Query parameters accepted alongside a validated form, which only change how the response is written. The
+// fields themselves are only read from the form body.
+var FORM_QUERY_PARAMETERS = []string{"pretty"}
+
+// Fields read by the endpoints accessing an existing file.
+var ACCESS_FIELDS = []string{"password", "token", "delete_password"}
+
+// Validation Utility Functions.
+
+// Validates the parsed form of the request against the fields, returning every problem found.
+func ValidateForm(req *http.Request, fields []FormField) []*FieldError {
+  // Fields named with a trailing "*" stand for every submitted field sharing their prefix.
+  fields = ExpandFormFields(req, fields)
+
+  fieldTypes := map[string]FieldType{}
+  for _, field := range fields {
+    fieldTypes[field.Name] = field.Type
+  }
+
+  submittedNames := []string{}
+  for name := range req.PostForm {
+    submittedNames = append(submittedNames, name)
+  }
+  if req.MultipartForm != nil {
+    for name := range req.MultipartForm.File {
+      submittedNames = append(submittedNames, name)
+    }
+  }
+  sort.Strings(submittedNames)
+
+  fieldErrors := []*FieldError{}
+  for _, name := range submittedNames {
+    if _, ok := fieldTypes[name]; ok == false {
+      fieldErrors = append(fieldErrors, &FieldError{name, FieldErrorUnknown, "Unknown field."})
+    }
+  }
+
+  // Fields in the query string would otherwise go unvalidated, so only the response options are accepted there.
+  queryNames := []string{}
+  for name := range req.URL.Query() {
+    if IsFormQueryParameter(name) == false {
+      queryNames = append(queryNames, name)
+    }
+  }
+  sort.Strings(queryNames)
+
+  for _, name := range queryNames {
+    fieldErrors = append(fieldErrors, &FieldError{name, FieldErrorNotAllowed, "Must be sent in the form body, not the query string."})
+  }
+
+  // Every field is read as a single value, so repeating one would leave which value counts ambiguous.
+  for _, field := range fields {
+    if name := FindDuplicateField(req, []string{field.Name}); len(name) > 0 {
+      fieldErrors = append(fieldErrors, &FieldError{name, FieldErrorDuplicate, "Must only be given once."})
+    }
+  }
+
+  for _, field := range fields {
+    if field.Type == FieldFile {
+      if req.MultipartForm != nil && len(req.PostForm[field.Name]) > 0 {
+        fieldErrors = append(fieldErrors, &FieldError{field.Name, FieldErrorInvalid, "Must be a file."})
+      }
+      continue
+    }
+
+    value := req.PostForm.Get(field.Name)
+    if len(value) == 0 {
+      continue
+    }
+
+    if message := ValidateFieldValue(field.Type, value); len(message) > 0 {
+      fieldErrors = append(fieldErrors, &FieldError{field.Name, FieldErrorInvalid, message})
+    }
+  }
+
+  metadata := ReadFormMetadata(req)
+  keys := []string{}
+  for key := range metadata {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  metadataBytes := 0
+  for _, key := range keys {
+    if metadataKeyPattern.MatchString(key) == false {
+      fieldErrors = append(fieldErrors, &FieldError{METADATA_FIELD_PREFIX + key, FieldErrorInvalid, "Must be named with 1 to 64 lowercase letters, numbers or dashes after the prefix."})
+    }
+    metadataBytes += len(key) + len(metadata[key])
+  }
+  if metadataBytes > MAX_METADATA_BYTES {
+    fieldErrors = append(fieldErrors, &FieldError{METADATA_FIELD_PREFIX, FieldErrorTooLarge, fmt.Sprintf("Metadata must be at most %d bytes in total.", MAX_METADATA_BYTES)})
+  }
+
+  return fieldErrors
+}
+
+// Returns the problems of the password fields given together, a password and a hash of one being exclusive.
+func ValidatePasswordFields(req *http.Request) []*FieldError {
+  if len(req.PostForm.Get("password")) > 0 && len(req.PostForm.Get("password_hash")) > 0 {
+    return []*FieldError{{"password_hash", FieldErrorConflict, "Can't be given along with a password."}}
+  }
+
+  return nil
+}
+
+// The response rejecting a form with the problems found, the first one being named in the error text.
+func InvalidFormResponse(fieldErrors []*FieldError) *Response {
+  first := fieldErrors[0]
+  errorText := fmt.Sprintf("Invalid Form. (%s: %s)", first.Field, first.Message)
+  if len(fieldErrors) > 1 {
+    errorText = fmt.Sprintf("Invalid Form. (%s: %s, and %d more)", first.Field, first.Message, len(fieldErrors)-1)
+  }
+
+  response := GenerateResponse(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), false, 0, errorText)
+  response.Content = &ValidationErrors{first.Field, first.Message, fieldErrors}
+  return response
+}
+
+func IsFormQueryParameter(name string) bool {
+  for _, parameter := range FORM_QUERY_PARAMETERS {
+    if name == parameter {
+      return true
+    }
+  }
+
+  return false
+}
+
+// Replaces the fields named with a trailing "*" by the submitted fields sharing their prefix.
+func ExpandFormFields(req *http.Request, fields []FormField) []FormField {
+  expanded := []FormField{}
+  for _, field := range fields {
+    prefix, ok := strings.CutSuffix(field.Name, "*")
+    if ok == false {
+      expanded = append(expanded, field)
+      continue
+    }
+
+    names := []string{}
+    for name := range req.PostForm {
+      if strings.HasPrefix(name, prefix) {
+        names = append(names, name)
+      }
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+      expanded = append(expanded, FormField{name, field.Type})
+    }
+  }
+
+  return expanded
+}
+
+// Returns the metadata submitted as meta_* fields, keyed without the prefix.
+func ReadFormMetadata(req *http.Request) map[string]string {
+  metadata := map[string]string{}
+  for name, values := range req.PostForm {
+    if key, ok := strings.CutPrefix(name, METADATA_FIELD_PREFIX); ok && len(values) > 0 {
+      metadata[key] = values[0]
+    }
+  }
+
+  return metadata
+}
+
+// Returns the first of the fields given more than once, across the query string, form values and file parts.
+func FindDuplicateField(req *http.Request, names []string) string {
+  if req.Form == nil {
+    req.ParseMultipartForm(32 << 20)
+  }
+
+  for _, name := range names {
+    count := len(req.Form[name])
+    if req.MultipartForm != nil {
+      count += len(req.MultipartForm.File[name])
+    }
+
+    if count > 1 {
+      return name
+    }
+  }
+
+  return ""
+}
+
+// Returns why the value isn't valid for the type, or an empty string when it is.
+func ValidateFieldValue(fieldType FieldType, value string) string {
+  switch fieldType {
+  case FieldPositiveInteger:
+    if _, err := ParsePositiveInteger(value); err != nil {
+      return fmt.Sprintf("Must be a positive integer, at most %d.", MAX_FORM_INTEGER)
+    }
+  case FieldDuration:
+    if _, err := ParseDurationValue(value); err != nil {
+      return fmt.Sprintf("Must be a positive number of seconds or a duration such as 24h, at most %s.", MAX_FORM_DURATION)
+    }
+  case FieldSlug:
+    if IsValidSlug(value) == false {
+      return "Must be 3 to 64 lowercase letters, numbers, dashes or underscores."
+    }
+  case FieldBoolean:
+    if _, err := strconv.ParseBool(value); err != nil {
+      return "Must be true or false."
+    }
+  case FieldPasswordHash:
+    if cost, err := bcrypt.Cost([]byte(value)); err != nil || cost < bcrypt.DefaultCost {
+      return fmt.Sprintf("Must be a bcrypt hash with a cost of at least %d.", bcrypt.DefaultCost)
+    }
+  case FieldMetadata:
+    if metadataValuePattern.MatchString(value) == false {
+      return "Must only contain printable ASCII characters."
+    }
+  case FieldChecksum:
+    if checksumPattern.MatchString(value) == false {
+      return "Must be the hex encoded SHA-256 of the file."
+    }
+  case FieldTimestamp:
+    if _, err := ParseTimestampValue(value); err != nil {
+      return fmt.Sprintf("Must be an RFC 3339 time in the future, at most %s from now.", MAX_FORM_DURATION)
+    }
+  case FieldURL:
+    if parsedUrl, err := url.Parse(value); err != nil || parsedUrl.IsAbs() == false {
+      return "Must be an absolute URL."
+    }
+  }
+
+  return ""
+}
+
+// Parses a positive integer no larger than MAX_FORM_INTEGER. Only plain digits are accepted, no sign,
+// spaces or exponent.
+func ParsePositiveInteger(value string) (int, error) {
+  if digitsPattern.MatchString(value) == false {
+    return 0, fmt.Errorf("invalid integer %q", value)
+  }
+
+  number, err := strconv.ParseInt(value, 10, 64)
+  if err != nil || number <= 0 || number > MAX_FORM_INTEGER {
+    return 0, fmt.Errorf("integer %q is out of range", value)
+  }
+
+  return int(number), nil
+}
+
+// Parses a positive number of seconds, or a duration such as "24h", no longer than MAX_FORM_DURATION.
+func ParseDurationValue(value string) (time.Duration, error) {
+  if digitsPattern.MatchString(value) {
+    seconds, err := strconv.ParseInt(value, 10, 64)
+    if err == nil && seconds > 0 && seconds <= int64(MAX_FORM_DURATION/time.Second) {
+      return time.Duration(seconds) * time.Second, nil
+    }
+    return 0, fmt.Errorf("invalid duration %q", value)
+  }
+
+  if duration, err := time.ParseDuration(value); err == nil && duration > 0 && duration <= MAX_FORM_DURATION {
+    return duration, nil
+  }
+
+  return 0, fmt.Errorf("invalid duration %q", value)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestUploadRejectsQueryFields(t *testing.T) {
+  ResetTestState(t)
+
+  req := NewTestUploadRequest(t, nil, "notes.txt", []byte("Hello, world."))
+  req.URL.RawQuery = "max_downloads=-5&bogus=1&pretty=false"
+
+  response := DecodeTestResponse(t, ServeTestRequest(req))
+  if response.StatusCode != http.StatusBadRequest {
+    t.Fatalf("Got %d %q, expected a 400.", response.StatusCode, response.ErrorText)
+  }
+
+  validationErrors := &ValidationErrors{}
+  if err := json.Unmarshal(response.Content, validationErrors); err != nil {
+    t.Fatal(err)
+  }
+
+  expected := []FieldError{{"bogus", FieldErrorNotAllowed, "Must be sent in the form body, not the query string."}, {"max_downloads", FieldErrorNotAllowed, "Must be sent in the form body, not the query string."}}
+  if len(validationErrors.Errors) != len(expected) {
+    t.Fatalf("Got the errors %+v, expected %+v.", validationErrors.Errors, expected)
+  }
+  for i, fieldError := range validationErrors.Errors {
+    if *fieldError != expected[i] {
+      t.Fatalf("Got the error %+v, expected %+v.", fieldError, expected[i])
+    }
+  }
+}
+
+func TestUploadRejectsDuplicateFields(t *testing.T) {
+  cases := []struct {
+    name      string
+    fields    [][2]string
+    files     []string
+    errorText string
+  }{
+    {"Password", [][2]string{{"password", "first"}, {"password", "second"}}, []string{"notes.txt"}, "Invalid Form. (password: Must only be given once.)"},
+    {"DeletePassword", [][2]string{{"delete_password", "first"}, {"delete_password", "second"}}, []string{"notes.txt"}, "Invalid Form. (delete_password: Must only be given once.)"},
+    {"MaxDownloads", [][2]string{{"max_downloads", "1"}, {"max_downloads", "5"}}, []string{"notes.txt"}, "Invalid Form. (max_downloads: Must only be given once.)"},
+    {"File", nil, []string{"first.txt", "second.txt"}, "Invalid Form. (file: Must only be given once.)"},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+
+      body := &bytes.Buffer{}
+      writer := multipart.NewWriter(body)
+      for _, field := range c.fields {
+        writer.WriteField(field[0], field[1])
+      }
+      for _, filename := range c.files {
+        part, _ := writer.CreateFormFile("file", filename)
+        part.Write([]byte("Hello, world."))
+      }
+      writer.Close()
+
+      req := httptest.NewRequest("PUT", "/v1/files", body)
+      req.Header.Set("Content-Type", writer.FormDataContentType())
+
+      response := DecodeTestResponse(t, ServeTestRequest(req))
+      if response.StatusCode != http.StatusBadRequest || response.ErrorText != c.errorText {
+        t.Fatalf("Got %d %q, expected 400 %q.", response.StatusCode, response.ErrorText, c.errorText)
+      }
+
+      if keys, _ := STORAGE.List("", "", 10); len(keys) > 0 {
+        t.Fatalf("Stored %v for a rejected upload.", keys)
+      }
+    })
+  }
+}
+
+func TestGetFileRejectsDuplicatePasswords(t *testing.T) {
+  ResetTestState(t)
+
+  file := UploadTestFile(t, [][2]string{{"password", "secret"}}, "notes.txt", []byte("Hello, world."))
+
+  for _, query := range []string{"password=secret&password=guess", "password=guess&password=secret", "token=a&token=b"} {
+    t.Run(query, func(t *testing.T) {
+      response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex()+"?"+query, nil)))
+      if response.StatusCode != http.StatusBadRequest {
+        t.Fatalf("Got %d %q, expected a 400.", response.StatusCode, response.ErrorText)
+      }
+    })
+  }
+
+  // Neither request consumed the file.
+  response := DecodeTestResponse(t, ServeTestRequest(httptest.NewRequest("GET", "/v1/files/"+file.ID.Hex()+"?password=secret", nil)))
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("Got %d %q, expected the file.", response.StatusCode, response.ErrorText)
+  }
+}
+
+func TestUploadRejectsOutOfRangeNumbers(t *testing.T) {
+  integerError := "Must be a positive integer, at most 1000000."
+  durationError := "Must be a positive number of seconds or a duration such as 24h, at most 876000h0m0s."
+
+  cases := []struct {
+    name      string
+    field     string
+    value     string
+    errorText string
+  }{
+    {"MaxDownloadsNegative", "max_downloads", "-1", integerError},
+    {"MaxDownloadsZero", "max_downloads", "0", integerError},
+    {"MaxDownloadsLargest", "max_downloads", "1000000", ""},
+    {"MaxDownloadsTooLarge", "max_downloads", "1000001", integerError},
+    {"MaxDownloadsOverflow", "max_downloads", "99999999999999999999", integerError},
+    {"MaxDownloadsFraction", "max_downloads", "1.5", integerError},
+    {"MaxDownloadsSigned", "max_downloads", "+1", integerError},
+    {"MaxPasswordAttemptsNegative", "max_password_attempts", "-1", integerError},
+    {"ExpiresInOverflow", "expires_in", "99999999999999999999", durationError},
+    {"ExpiresInZero", "expires_in", "0", durationError},
+    {"ExpiresInNegative", "expires_in", "-1", durationError},
+    {"ExpiresInNegativeDuration", "expires_in", "-24h", durationError},
+    {"ExpiresInSmallest", "expires_in", "1", ""},
+    {"ExpireAfterAccessOverflow", "expire_after_access", "99999999999999999999", durationError},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ResetTestState(t)
+
+      response := DecodeTestResponse(t, ServeTestRequest(NewTestUploadRequest(t, [][2]string{{c.field, c.value}}, "notes.txt", []byte("Hello, world."))))
+      if len(c.errorText) == 0 {
+        if response.StatusCode != http.StatusCreated {
+          t.Fatalf("Got %d %q, expected the file to be created.", response.StatusCode, response.ErrorText)
+        }
+        return
+      }
+
+      errorText := "Invalid Form. (" + c.field + ": " + c.errorText + ")"
+      if response.StatusCode != http.StatusBadRequest || response.ErrorText != errorText {
+        t.Fatalf("Got %d %q, expected 400 %q.", response.StatusCode, response.ErrorText, errorText)
+      }
+      if keys, _ := STORAGE.List("", "", 10); len(keys) > 0 {
+        t.Fatalf("Stored %v for a rejected upload.", keys)
+      }
+    })
+  }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "strconv"
+)
+
+// The version and commit of the build, set at build time with
+// -ldflags "-X main.VERSION=1.4.0 -X main.COMMIT=$(git rev-parse --short HEAD)".
+var VERSION = "dev"
+var COMMIT = ""
+
+// Whether every response carries the version of the build in an X-GoUpload-Version header, configured
+// through VERSION_HEADER. Off by default, the version tells anyone which fixes a deployment lacks.
+var VERSION_HEADER = false
+
+type VersionInfo struct {
+  Version        string          `json:"version"`
+  Commit         string          `json:"commit,omitempty"`
+  StorageBackend string          `json:"storage_backend"`
+  Features       map[string]bool `json:"features"`
+}
+
+// Loading the version configuration, called once the environment has been loaded.
+func LoadVersionSettings(config *Config) {
+  if versionHeader := config.Getenv("VERSION_HEADER", &VERSION_HEADER); len(versionHeader) > 0 {
+    enabled, err := strconv.ParseBool(versionHeader)
+    if err != nil {
+      log.Fatalf("Invalid VERSION_HEADER %q.", versionHeader)
+    }
+    VERSION_HEADER = enabled
+  }
+}
+
+// Handlers
+// Returns the version of the build, the storage backend and which features are switched on.
+func GetVersion(w http.ResponseWriter, req *http.Request) *AppError {
+  features := GetFeatureFlags(CONFIG)
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = &VersionInfo{VERSION, COMMIT, STORAGE_BACKEND, features}
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Middleware
+func SendVersionHeader(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if VERSION_HEADER {
+      w.Header().Set("X-GoUpload-Version", GetVersionString())
+    }
+    next.ServeHTTP(w, req)
+  })
+}
+
+// Version Utility Functions.
+
+func GetVersionString() string {
+  if len(COMMIT) == 0 {
+    return VERSION
+  }
+  return VERSION + " (" + COMMIT + ")"
+}
+
+// The settings switching a feature on or off, by name, as they are now. Only whether each is on is given, never
+// a value.
+func GetFeatureFlags(config *Config) map[string]bool {
+  features := map[string]bool{}
+  for _, setting := range config.Settings {
+    if enabled, ok := setting.Current().(bool); ok && setting.Secret == false {
+      features[setting.Name] = enabled
+    }
+  }
+  return features
+}
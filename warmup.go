@@ -0,0 +1,78 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "time"
+
+  awssdk "github.com/aws/aws-sdk-go-v2/aws"
+  s3sdk "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Handlers
+func WarmUpHandler(w http.ResponseWriter, req *http.Request) *AppError {
+  timings, err := WarmUp()
+  if err != nil {
+    response := GenerateResponse(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), false, 0, fmt.Sprintf("Warm-up failed. (%v)", err))
+    response.Content = timings
+    WriteResponse(response, w, req)
+    return nil
+  }
+
+  response := GenerateResponse(http.StatusOK, http.StatusText(http.StatusOK), true, 0, "No Error.")
+  response.Content = timings
+  WriteResponse(response, w, req)
+  return nil
+}
+
+// Warm-up Utility Functions.
+
+// Establishes the Mongo session and verifies the S3 credentials, caching both for later requests.
+// Returns how long each step took, in milliseconds.
+func WarmUp() (map[string]int64, error) {
+  timings := map[string]int64{}
+
+  start := time.Now()
+  session, err := CopyMongoSession()
+  if err != nil {
+    return timings, fmt.Errorf("mongo: %v", err)
+  }
+  defer session.Close()
+
+  err = session.Ping()
+  if err != nil {
+    return timings, fmt.Errorf("mongo: %v", err)
+  }
+  timings["mongo"] = time.Since(start).Milliseconds()
+
+  if IsS3Storage(STORAGE) && S3_SDK == "aws-sdk" {
+    start = time.Now()
+    client, err := LoadSDKClient("")
+    if err != nil {
+      return timings, fmt.Errorf("s3: %v", err)
+    }
+
+    // Listing a single key is the cheapest request that exercises the credentials.
+    _, err = client.Client.ListObjectsV2(context.Background(), &s3sdk.ListObjectsV2Input{Bucket: &client.Bucket, MaxKeys: awssdk.Int32(1)})
+    if err != nil {
+      return timings, fmt.Errorf("s3: %v", err)
+    }
+    timings["s3"] = time.Since(start).Milliseconds()
+  } else if IsS3Storage(STORAGE) {
+    start = time.Now()
+    bucket, err := LoadS3Bucket()
+    if err != nil {
+      return timings, fmt.Errorf("s3: %v", err)
+    }
+
+    // Listing a single key is the cheapest request that exercises the credentials.
+    _, err = bucket.List("", "", "", 1)
+    if err != nil {
+      return timings, fmt.Errorf("s3: %v", err)
+    }
+    timings["s3"] = time.Since(start).Milliseconds()
+  }
+
+  return timings, nil
+}